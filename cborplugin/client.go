@@ -16,7 +16,9 @@
 
 // Package cborplugin is a plugin system allowing mix network services
 // to be added in any language. It communicates queries and responses to and from
-// the mix server using CBOR over HTTP over UNIX domain socket. Beyond that,
+// the mix server using CBOR over HTTP over UNIX domain socket, or with
+// protocol v2 using length prefixed CBOR frames multiplexed over a single
+// UNIX domain socket connection. Beyond that,
 // a client supplied SURB is used to route the response back to the client
 // as described in our Kaetzchen specification document:
 //
@@ -28,9 +30,13 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
 	"os/exec"
 	"syscall"
 	"time"
@@ -41,6 +47,19 @@ import (
 	"gopkg.in/op/go-logging.v1"
 )
 
+const (
+	// killTimeout is how long a plugin has to exit after being sent SIGTERM,
+	// before it is killed.
+	killTimeout = 10 * time.Second
+
+	// requestTimeout is how long a plugin has to respond to a request.
+	requestTimeout = 5 * time.Second
+)
+
+// ErrNoSocketPath is the error returned when a plugin exits without
+// printing its socket path.
+var ErrNoSocketPath = errors.New("cborplugin: plugin did not print a socket path")
+
 // Request is the struct type used in service query requests to plugins.
 type Request struct {
 	ID      uint64
@@ -95,10 +114,16 @@ type Client struct {
 	log        *logging.Logger
 	httpClient *http.Client
 	cmd        *exec.Cmd
+	command    string
 	socketPath string
 	endpoint   string
 	capability string
 	params     *Parameters
+	version    int
+	stream     *streamConn
+
+	exitCh  chan struct{}
+	exitErr error
 }
 
 // New creates a new plugin client instance which represents the single execution
@@ -113,11 +138,67 @@ func New(command, capability, endpoint string, logBackend *log.Backend) *Client
 	}
 }
 
+// Dial returns a Client for a plugin that is already listening on
+// socketPath with the given protocol version, rather than launching it.
+// Halting the Client closes the connection, but leaves the plugin running.
+func Dial(socketPath string, version int, capability, endpoint string, logBackend *log.Backend) (*Client, error) {
+	c := New(socketPath, capability, endpoint, logBackend)
+	c.socketPath = socketPath
+	c.version = version
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	c.Go(func() {
+		<-c.HaltCh()
+		if c.stream != nil {
+			c.stream.close()
+		}
+	})
+	return c, nil
+}
+
 // Start execs the plugin and starts a worker thread to listen
 // on the halt chan sends a TERM signal to the plugin if the shutdown
 // even is dispatched.
 func (c *Client) Start(command string, args []string) error {
-	err := c.launch(command, args)
+	return c.StartWithOptions(command, args, nil)
+}
+
+// LaunchOptions are the optional parameters used to launch a plugin.
+type LaunchOptions struct {
+	// Config, if not nil, is CBOR encoded and written to the plugin's
+	// stdin, which is then closed.
+	Config map[string]interface{}
+
+	// Env is the extra environment variables set for the plugin.
+	Env map[string]string
+
+	// Dir is the plugin's working directory, if not empty.
+	Dir string
+
+	// ClearEnv starts the plugin with only the Env variables, instead of
+	// also inheriting the server's environment.
+	ClearEnv bool
+
+	// Credential, if not nil, is the user and group that the plugin runs
+	// as, which requires running as root.
+	Credential *Credential
+
+	// RLimits are the resource limits applied to the plugin.
+	RLimits RLimits
+
+	// NoNewPrivileges sets no_new_privs for the plugin, so that it can not
+	// gain privileges (eg: via setuid executables).  Linux only.
+	NoNewPrivileges bool
+}
+
+// StartWithOptions is like Start, but launches the plugin with the given
+// LaunchOptions.
+func (c *Client) StartWithOptions(command string, args []string, opts *LaunchOptions) error {
+	if opts == nil {
+		opts = &LaunchOptions{}
+	}
+	err := c.launch(command, args, opts)
 	if err != nil {
 		return err
 	}
@@ -126,17 +207,49 @@ func (c *Client) Start(command string, args []string) error {
 }
 
 func (c *Client) worker() {
-	<-c.HaltCh()
+	select {
+	case <-c.HaltCh():
+	case <-c.exitCh:
+		// The plugin exited on its own, which is reported by Exited.
+		return
+	}
+
+	if c.stream != nil {
+		c.stream.close()
+	}
 	c.cmd.Process.Signal(syscall.SIGTERM)
-	err := c.cmd.Wait()
-	if err != nil {
-		c.log.Errorf("CBOR plugin worker, command exec error: %s\n", err)
+	select {
+	case <-c.exitCh:
+	case <-time.After(killTimeout):
+		c.log.Warningf("Plugin did not exit after SIGTERM, killing.")
+		c.cmd.Process.Kill()
+		<-c.exitCh
+	}
+	if c.exitErr != nil {
+		c.log.Errorf("CBOR plugin worker, command exec error: %s\n", c.exitErr)
 	}
 }
 
+// Exited returns a channel that is closed when the plugin process exits, or
+// nil for Clients returned by Dial.
+func (c *Client) Exited() <-chan struct{} {
+	return c.exitCh
+}
+
+// ProtocolVersion returns the protocol version negotiated with the plugin.
+func (c *Client) ProtocolVersion() int {
+	return c.version
+}
+
+// ExitErr returns the plugin process's exit error, and must only be called
+// after it has exited.
+func (c *Client) ExitErr() error {
+	return c.exitErr
+}
+
 func (c *Client) setupHTTPClient(socketPath string) {
 	c.httpClient = &http.Client{
-		Timeout: 5 * time.Second,
+		Timeout: requestTimeout,
 		Transport: &http.Transport{
 			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
 				return new(net.Dialer).DialContext(ctx, "unix", socketPath)
@@ -146,17 +259,40 @@ func (c *Client) setupHTTPClient(socketPath string) {
 }
 
 func (c *Client) logPluginStderr(stderr io.ReadCloser) {
-	logWriter := c.logBackend.GetLogWriter(c.cmd.Path, "DEBUG")
+	logWriter := c.logBackend.GetLogWriter(c.command, "DEBUG")
 	_, err := io.Copy(logWriter, stderr)
 	if err != nil {
 		c.log.Errorf("Failed to proxy cborplugin stderr to DEBUG log: %s", err)
 	}
-	c.Halt()
+
+	// The pipe is closed once the plugin exits, and Wait must only be
+	// called after all reads from the pipe have completed.
+	c.exitErr = c.cmd.Wait()
+	close(c.exitCh)
 }
 
-func (c *Client) launch(command string, args []string) error {
+func (c *Client) launch(command string, args []string, opts *LaunchOptions) error {
 	// exec plugin
-	c.cmd = exec.Command(command, args...)
+	var sandboxErrs *os.File
+	var err error
+	c.command = command
+	if c.cmd, sandboxErrs, err = newCommand(command, args, opts); err != nil {
+		c.log.Debugf("failed to prepare exec: %s", err)
+		return err
+	}
+	if sandboxErrs != nil {
+		defer sandboxErrs.Close()
+		defer c.cmd.ExtraFiles[0].Close()
+	}
+	if opts.Config != nil {
+		// The config is written to stdin rather than being passed as
+		// arguments, as those are visible to all users.
+		b, err := cbor.Marshal(opts.Config)
+		if err != nil {
+			return fmt.Errorf("cborplugin: failed to encode config: %v", err)
+		}
+		c.cmd.Stdin = bytes.NewReader(b)
+	}
 	stdout, err := c.cmd.StdoutPipe()
 	if err != nil {
 		c.log.Debugf("pipe failure: %s", err)
@@ -173,24 +309,77 @@ func (c *Client) launch(command string, args []string) error {
 		return err
 	}
 
-	// proxy stderr to our debug log
+	// proxy stderr to our debug log, and reap the plugin on exit
+	c.exitCh = make(chan struct{})
 	c.Go(func() {
 		c.logPluginStderr(stderr)
 	})
 
+	if sandboxErrs != nil {
+		// The sandbox's copy of the write end is closed once it executes
+		// the plugin, or exits after reporting an error.
+		c.cmd.ExtraFiles[0].Close()
+		b, _ := ioutil.ReadAll(sandboxErrs)
+		if len(b) > 0 {
+			<-c.exitCh
+			return fmt.Errorf("cborplugin: failed to sandbox plugin: %s", b)
+		}
+	}
+
 	// read and decode plugin stdout
 	stdoutScanner := bufio.NewScanner(stdout)
-	stdoutScanner.Scan()
-	c.socketPath = stdoutScanner.Text()
-	c.log.Debugf("plugin socket path:'%s'\n", c.socketPath)
-	c.setupHTTPClient(c.socketPath)
+	if !stdoutScanner.Scan() {
+		c.cmd.Process.Kill()
+		<-c.exitCh
+		return ErrNoSocketPath
+	}
+	c.version, c.socketPath, err = parseStartupLine(stdoutScanner.Text())
+	if err != nil {
+		c.cmd.Process.Kill()
+		<-c.exitCh
+		return err
+	}
+	c.log.Debugf("plugin socket path:'%s' (protocol v%d)\n", c.socketPath, c.version)
+	if err = c.connect(); err != nil {
+		c.cmd.Process.Kill()
+		<-c.exitCh
+		return err
+	}
 
 	c.log.Debug("finished launching plugin.")
 	return nil
 }
 
+func (c *Client) connect() error {
+	switch c.version {
+	case ProtocolV1:
+		c.setupHTTPClient(c.socketPath)
+	case ProtocolV2:
+		stream, err := dialStream(c.socketPath)
+		if err != nil {
+			return err
+		}
+		c.stream = stream
+		c.Go(c.stream.readLoop)
+	default:
+		return fmt.Errorf("cborplugin: unsupported protocol version: %v", c.version)
+	}
+	return nil
+}
+
 // OnRequest send a query request to plugin using CBOR + HTTP over Unix domain socket.
 func (c *Client) OnRequest(request *Request) ([]byte, error) {
+	if c.stream != nil {
+		f, err := c.stream.roundTrip(&Frame{Type: FrameRequest, Request: request})
+		if err != nil {
+			return nil, err
+		}
+		if f.Type != FrameResponse || f.Response == nil {
+			return nil, fmt.Errorf("cborplugin: unexpected frame type: %v", f.Type)
+		}
+		return f.Response.Payload, nil
+	}
+
 	serialized, err := cbor.Marshal(request)
 	if err != nil {
 		return nil, err
@@ -200,6 +389,10 @@ func (c *Client) OnRequest(request *Request) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer rawResponse.Body.Close()
+	if rawResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cborplugin: unexpected status: %v", rawResponse.Status)
+	}
 	response := new(Response)
 	decoder := cbor.NewDecoder(rawResponse.Body)
 	err = decoder.Decode(&response)
@@ -209,6 +402,25 @@ func (c *Client) OnRequest(request *Request) ([]byte, error) {
 	return response.Payload, nil
 }
 
+// Ping checks that the plugin is responsive, by requesting its parameters.
+func (c *Client) Ping() error {
+	if c.stream != nil {
+		_, err := c.stream.roundTrip(&Frame{Type: FrameGetParameters})
+		return err
+	}
+
+	rawResponse, err := c.httpClient.Post("http://unix/parameters", "application/octet-stream", http.NoBody)
+	if err != nil {
+		return err
+	}
+	defer rawResponse.Body.Close()
+	io.Copy(ioutil.Discard, rawResponse.Body)
+	if rawResponse.StatusCode != http.StatusOK {
+		return fmt.Errorf("cborplugin: unexpected status: %v", rawResponse.Status)
+	}
+	return nil
+}
+
 // Capability are used in Mix Descriptor publication to give
 // service clients more information about the service. Not
 // plugins will need to use this feature.
@@ -222,12 +434,16 @@ func (c *Client) Capability() string {
 func (c *Client) GetParameters() *Parameters {
 	// get plugin parameters if any
 	c.log.Debug("requesting plugin Parameters for Mix Descriptor publication...")
+	if c.stream != nil {
+		return c.getParametersV2()
+	}
 	rawResponse, err := c.httpClient.Post("http://unix/parameters", "application/octet-stream", http.NoBody)
 	if err != nil {
 		c.log.Debugf("post failure: %s", err)
 		c.Halt()
 		return nil
 	}
+	defer rawResponse.Body.Close()
 	responseParams := make(Parameters)
 	decoder := cbor.NewDecoder(rawResponse.Body)
 	err = decoder.Decode(&responseParams)
@@ -243,3 +459,22 @@ func (c *Client) GetParameters() *Parameters {
 	responseParams["endpoint"] = c.endpoint
 	return &responseParams
 }
+
+func (c *Client) getParametersV2() *Parameters {
+	f, err := c.stream.roundTrip(&Frame{Type: FrameGetParameters})
+	if err != nil {
+		c.log.Debugf("request failure: %s", err)
+		c.Halt()
+		return nil
+	}
+	if f.Type != FrameParameters {
+		c.log.Debugf("unexpected frame type: %v", f.Type)
+		return nil
+	}
+	responseParams := f.Parameters
+	if responseParams == nil {
+		responseParams = make(Parameters)
+	}
+	responseParams["endpoint"] = c.endpoint
+	return &responseParams
+}
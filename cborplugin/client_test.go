@@ -0,0 +1,212 @@
+// client_test.go - cbor plugin client tests
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/katzenpost/core/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPlugin is an in-process echo plugin listening on a unix domain socket.
+type testPlugin struct {
+	dir string
+	ln  net.Listener
+}
+
+func (p *testPlugin) socketPath() string {
+	return filepath.Join(p.dir, "plugin.sock")
+}
+
+func (p *testPlugin) close() {
+	p.ln.Close()
+	os.RemoveAll(p.dir)
+}
+
+func newTestPlugin(tb testing.TB) *testPlugin {
+	dir, err := ioutil.TempDir("", "cborplugin_test")
+	require.NoError(tb, err, "TempDir()")
+	p := &testPlugin{dir: dir}
+	p.ln, err = net.Listen("unix", p.socketPath())
+	require.NoError(tb, err, "Listen()")
+	return p
+}
+
+func startHTTPPlugin(tb testing.TB) *testPlugin {
+	p := newTestPlugin(tb)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/request", func(w http.ResponseWriter, r *http.Request) {
+		req := new(Request)
+		if err := cbor.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cbor.NewEncoder(w).Encode(&Response{Payload: req.Payload})
+	})
+	mux.HandleFunc("/parameters", func(w http.ResponseWriter, r *http.Request) {
+		cbor.NewEncoder(w).Encode(Parameters{"name": "echo"})
+	})
+	go http.Serve(p.ln, mux)
+	return p
+}
+
+func startV2Plugin(tb testing.TB) *testPlugin {
+	p := newTestPlugin(tb)
+	go func() {
+		for {
+			conn, err := p.ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveV2(conn)
+		}
+	}()
+	return p
+}
+
+func serveV2(conn net.Conn) {
+	defer conn.Close()
+
+	var writeLock sync.Mutex
+	r := bufio.NewReader(conn)
+	for {
+		f, err := ReadFrame(r)
+		if err != nil {
+			return
+		}
+		go func() {
+			resp := &Frame{Tag: f.Tag}
+			switch f.Type {
+			case FrameRequest:
+				resp.Type = FrameResponse
+				resp.Response = &Response{Payload: f.Request.Payload}
+			case FrameGetParameters:
+				resp.Type = FrameParameters
+				resp.Parameters = Parameters{"name": "echo"}
+			default:
+				resp.Error = "unknown frame type"
+			}
+			writeLock.Lock()
+			defer writeLock.Unlock()
+			WriteFrame(conn, resp)
+		}()
+	}
+}
+
+func newTestClient(tb testing.TB, p *testPlugin, version int) *Client {
+	logBackend, err := log.New("", "ERROR", false)
+	require.NoError(tb, err, "log.New()")
+
+	c, err := Dial(p.socketPath(), version, "echo", "+echo", logBackend)
+	require.NoError(tb, err, "Dial()")
+	return c
+}
+
+func TestParseStartupLine(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, v := range []struct {
+		line    string
+		version int
+		path    string
+	}{
+		{"/tmp/plugin.sock", ProtocolV1, "/tmp/plugin.sock"},
+		{"/tmp/v2 plugin.sock", ProtocolV1, "/tmp/v2 plugin.sock"},
+		{StartupLine(ProtocolV1, "/tmp/plugin.sock"), ProtocolV1, "/tmp/plugin.sock"},
+		{StartupLine(ProtocolV2, "/tmp/plugin.sock"), ProtocolV2, "/tmp/plugin.sock"},
+	} {
+		version, path, err := parseStartupLine(v.line)
+		assert.NoError(err, "parseStartupLine(%v)", v.line)
+		assert.Equal(v.version, version, "parseStartupLine(%v): version", v.line)
+		assert.Equal(v.path, path, "parseStartupLine(%v): path", v.line)
+	}
+	_, _, err := parseStartupLine("v3 /tmp/plugin.sock")
+	assert.Error(err, "parseStartupLine(): unsupported version")
+}
+
+func TestClientV2(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	p := startV2Plugin(t)
+	defer p.close()
+	c := newTestClient(t, p, ProtocolV2)
+
+	// Concurrent requests are matched with their responses.
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payload := []byte(fmt.Sprintf("request %d", i))
+			resp, err := c.OnRequest(&Request{ID: uint64(i), Payload: payload, HasSURB: true})
+			if assert.NoError(err, "OnRequest(%d)", i) {
+				assert.Equal(payload, resp, "OnRequest(%d)", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	params := c.GetParameters()
+	require.NotNil(params, "GetParameters()")
+	assert.Equal("echo", (*params)["name"], "GetParameters()")
+	assert.Equal("+echo", (*params)["endpoint"], "GetParameters()")
+	assert.NoError(c.Ping(), "Ping()")
+	assert.Empty(c.stream.pending, "pending requests")
+
+	c.Halt()
+	_, err := c.OnRequest(&Request{Payload: []byte("closed")})
+	assert.Equal(ErrClosed, err, "OnRequest(): closed")
+}
+
+func benchmarkOnRequest(b *testing.B, p *testPlugin, version int) {
+	c := newTestClient(b, p, version)
+	defer c.Halt()
+
+	payload := make([]byte, 2000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := c.OnRequest(&Request{Payload: payload, HasSURB: true}); err != nil {
+				b.Fatalf("OnRequest(): %v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkOnRequestV1(b *testing.B) {
+	p := startHTTPPlugin(b)
+	defer p.close()
+	benchmarkOnRequest(b, p, ProtocolV1)
+}
+
+func BenchmarkOnRequestV2(b *testing.B) {
+	p := startV2Plugin(b)
+	defer p.close()
+	benchmarkOnRequest(b, p, ProtocolV2)
+}
@@ -0,0 +1,144 @@
+// frame.go - cbor plugin protocol v2 framing
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	// ProtocolV1 is the original protocol, where each request is a CBOR
+	// encoded HTTP POST over the plugin's unix domain socket.
+	ProtocolV1 = 1
+
+	// ProtocolV2 is the multiplexed protocol, where requests and responses
+	// are length prefixed CBOR encoded Frames, tagged so that many may be
+	// in flight over a single long lived unix domain socket connection.
+	ProtocolV2 = 2
+
+	// ProtocolVersionsEnv is the environment variable with the comma
+	// separated protocol versions offered to the plugin on launch.  Plugins
+	// that support a version other than ProtocolV1 select it by prefixing
+	// the socket path they print with "v<version> ".
+	ProtocolVersionsEnv = "KATZENPOST_CBORPLUGIN_VERSIONS"
+
+	// MaxFrameLength is the maximum length of an encoded Frame.
+	MaxFrameLength = 1 << 20
+
+	frameLengthSize = 4
+)
+
+// FrameType is the type of a protocol v2 Frame.
+type FrameType uint8
+
+const (
+	// FrameRequest is a Request sent to the plugin.
+	FrameRequest FrameType = iota + 1
+
+	// FrameResponse is the plugin's Response to a FrameRequest.
+	FrameResponse
+
+	// FrameGetParameters is a request for the plugin's Parameters.
+	FrameGetParameters
+
+	// FrameParameters is the plugin's response to a FrameGetParameters.
+	FrameParameters
+)
+
+// Frame is a protocol v2 message.  Each response carries the Tag of the
+// request it is a response to.
+type Frame struct {
+	Type FrameType
+	Tag  uint64
+
+	Request    *Request   `cbor:",omitempty"`
+	Response   *Response  `cbor:",omitempty"`
+	Parameters Parameters `cbor:",omitempty"`
+
+	// Error is set instead of the response body iff the plugin failed to
+	// handle the request.
+	Error string `cbor:",omitempty"`
+}
+
+// ReadFrame reads a length prefixed Frame from r.
+func ReadFrame(r io.Reader) (*Frame, error) {
+	var l [frameLengthSize]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n > MaxFrameLength {
+		return nil, fmt.Errorf("cborplugin: frame too long: %v", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	f := new(Frame)
+	if err := cbor.Unmarshal(b, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// WriteFrame writes f to w, prefixed with its length.
+func WriteFrame(w io.Writer, f *Frame) error {
+	b, err := cbor.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if len(b) > MaxFrameLength {
+		return fmt.Errorf("cborplugin: frame too long: %v", len(b))
+	}
+	buf := make([]byte, frameLengthSize, frameLengthSize+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	_, err = w.Write(append(buf, b...))
+	return err
+}
+
+// StartupLine returns the line that a plugin prints on stdout once it is
+// listening on socketPath, to select the protocol version.
+func StartupLine(version int, socketPath string) string {
+	if version == ProtocolV1 {
+		return socketPath
+	}
+	return fmt.Sprintf("v%d %s", version, socketPath)
+}
+
+// parseStartupLine returns the protocol version and socket path from the
+// line printed by a plugin.  Plugins that predate version negotiation print
+// the bare socket path.
+func parseStartupLine(line string) (int, string, error) {
+	sp := strings.SplitN(line, " ", 2)
+	if len(sp) != 2 || !strings.HasPrefix(sp[0], "v") {
+		return ProtocolV1, line, nil
+	}
+	version, err := strconv.Atoi(sp[0][1:])
+	if err != nil {
+		return ProtocolV1, line, nil
+	}
+	if version != ProtocolV1 && version != ProtocolV2 {
+		return 0, "", fmt.Errorf("cborplugin: unsupported protocol version: %v", version)
+	}
+	return version, sp[1], nil
+}
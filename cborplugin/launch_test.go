@@ -0,0 +1,209 @@
+// launch_test.go - cbor plugin launch tests
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/server/cborplugin"
+	"github.com/katzenpost/server/cborplugin/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const helperEnv = "CBORPLUGIN_TEST_HELPER"
+
+type helperConfig struct {
+	Limit int               `cbor:"limit"`
+	Debug bool              `cbor:"debug"`
+	Peers []string          `cbor:"peers"`
+	Table map[string]string `cbor:"table"`
+}
+
+type helperReport struct {
+	Config     helperConfig
+	Secret     string
+	Dir        string
+	Args       []string
+	Environ    []string
+	OpenFiles  uint64
+	NoNewPrivs bool
+}
+
+type helperHandler struct {
+	report []byte
+}
+
+func (h *helperHandler) OnRequest(*cborplugin.Request) ([]byte, error) {
+	return h.report, nil
+}
+
+func (h *helperHandler) GetParameters() *cborplugin.Parameters {
+	return nil
+}
+
+// TestHelperProcess is the plugin launched by TestLaunch, which reports the
+// configuration it was launched with in response to every request.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv(helperEnv) != "1" {
+		return
+	}
+
+	r := helperReport{
+		Secret: os.Getenv("HELPER_SECRET"),
+		Args:   flagArgs(),
+	}
+	if len(r.Args) == 0 {
+		if err := server.ReadConfig(&r.Config); err != nil {
+			fmt.Fprintf(os.Stderr, "ReadConfig(): %v\n", err)
+			os.Exit(1)
+		}
+	}
+	r.Dir, _ = os.Getwd()
+	r.Environ = os.Environ()
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err == nil {
+		r.OpenFiles = rlim.Cur
+	}
+	if b, err := ioutil.ReadFile("/proc/self/status"); err == nil {
+		r.NoNewPrivs = strings.Contains(string(b), "NoNewPrivs:\t1")
+	}
+	b, err := cbor.Marshal(&r)
+	if err != nil {
+		os.Exit(1)
+	}
+	if err = server.Run(&helperHandler{report: b}); err != nil {
+		fmt.Fprintf(os.Stderr, "Run(): %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// flagArgs returns the arguments following "--".
+func flagArgs() []string {
+	for i, v := range os.Args {
+		if v == "--" {
+			return os.Args[i+1:]
+		}
+	}
+	return nil
+}
+
+func startHelper(t *testing.T, args []string, opts *cborplugin.LaunchOptions) (*cborplugin.Client, error) {
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(t, err, "log.New()")
+
+	if opts.Env == nil {
+		opts.Env = make(map[string]string)
+	}
+	opts.Env[helperEnv] = "1"
+	c := cborplugin.New(os.Args[0], "helper", "+helper", logBackend)
+	args = append([]string{"-test.run=TestHelperProcess", "--"}, args...)
+	return c, c.StartWithOptions(os.Args[0], args, opts)
+}
+
+func launchHelper(t *testing.T, args []string, opts *cborplugin.LaunchOptions) *helperReport {
+	require := require.New(t)
+
+	c, err := startHelper(t, args, opts)
+	require.NoError(err, "StartWithOptions()")
+	assert.Equal(t, cborplugin.ProtocolV2, c.ProtocolVersion(), "ProtocolVersion()")
+
+	b, err := c.OnRequest(&cborplugin.Request{Payload: []byte("report")})
+	require.NoError(err, "OnRequest()")
+	r := new(helperReport)
+	require.NoError(cbor.Unmarshal(b, r), "Unmarshal()")
+
+	// The plugin exits cleanly on SIGTERM.
+	c.Halt()
+	<-c.Exited()
+	assert.NoError(t, c.ExitErr(), "ExitErr()")
+	return r
+}
+
+func TestLaunch(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "cborplugin_launch")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	require.NoError(err, "EvalSymlinks()")
+
+	// The Config is written to stdin with its types intact.
+	r := launchHelper(t, nil, &cborplugin.LaunchOptions{
+		Config: map[string]interface{}{
+			"limit": int64(10),
+			"debug": true,
+			"peers": []interface{}{"alice", "bob"},
+			"table": map[string]interface{}{"key": "value"},
+		},
+		Env: map[string]string{"HELPER_SECRET": "secret"},
+		Dir: dir,
+	})
+	assert.Equal(helperConfig{
+		Limit: 10,
+		Debug: true,
+		Peers: []string{"alice", "bob"},
+		Table: map[string]string{"key": "value"},
+	}, r.Config, "Config")
+	assert.Equal("secret", r.Secret, "Env")
+	assert.Equal(dir, r.Dir, "Dir")
+	assert.Empty(r.Args, "Args")
+
+	// Plugins may still be passed arguments instead.
+	r = launchHelper(t, []string{"-limit", "10"}, &cborplugin.LaunchOptions{})
+	assert.Equal([]string{"-limit", "10"}, r.Args, "Args")
+	assert.Empty(r.Secret, "Env")
+}
+
+func TestLaunchSandbox(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	r := launchHelper(t, nil, &cborplugin.LaunchOptions{
+		Config:          map[string]interface{}{},
+		Env:             map[string]string{"HELPER_SECRET": "secret"},
+		ClearEnv:        true,
+		RLimits:         cborplugin.RLimits{OpenFiles: 64},
+		NoNewPrivileges: runtime.GOOS == "linux",
+	})
+	assert.Equal(uint64(64), r.OpenFiles, "RLimits")
+	assert.Equal(runtime.GOOS == "linux", r.NoNewPrivs, "NoNewPrivileges")
+	assert.Equal("secret", r.Secret, "Env")
+	for _, v := range r.Environ {
+		name := strings.SplitN(v, "=", 2)[0]
+		assert.Contains([]string{"HELPER_SECRET", helperEnv, cborplugin.ProtocolVersionsEnv}, name, "ClearEnv")
+	}
+
+	// Sandbox failures are reported on launch.
+	_, err := startHelper(t, nil, &cborplugin.LaunchOptions{
+		RLimits: cborplugin.RLimits{OpenFiles: 1 << 40},
+	})
+	require.Error(err, "StartWithOptions(): invalid RLimits")
+	assert.Contains(err.Error(), "open files", "StartWithOptions(): invalid RLimits")
+}
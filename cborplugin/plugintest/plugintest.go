@@ -0,0 +1,100 @@
+// plugintest.go - cbor plugin test harness
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package plugintest provides an in-process harness for testing plugins
+// built with the cborplugin/server package, through the same
+// cborplugin.Client that the mix server uses.
+package plugintest
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/server/cborplugin"
+	"github.com/katzenpost/server/cborplugin/server"
+)
+
+const (
+	// Capability is the capability of the plugins served by the harness.
+	Capability = "test"
+
+	// Endpoint is the endpoint of the plugins served by the harness.
+	Endpoint = "+test"
+)
+
+// Plugin is a plugin served in-process, and a Client connected to it.
+type Plugin struct {
+	// Client is connected to the plugin.
+	Client *cborplugin.Client
+
+	// Server is the plugin's server.
+	Server *server.Server
+
+	dir     string
+	serveCh chan error
+}
+
+// Shutdown halts the Client, and shuts the plugin down gracefully as if it
+// was sent SIGTERM, returning the error returned by Serve, if any.
+func (p *Plugin) Shutdown() error {
+	defer os.RemoveAll(p.dir)
+
+	p.Client.Halt()
+	ctx, cancel := context.WithTimeout(context.Background(), server.ShutdownTimeout)
+	defer cancel()
+	if err := p.Server.Shutdown(ctx); err != nil {
+		return err
+	}
+	return <-p.serveCh
+}
+
+// New serves handler with the given protocol version, and connects a Client
+// to it.
+func New(handler server.Handler, version int) (*Plugin, error) {
+	logBackend, err := log.New("", "DEBUG", false)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "plugintest")
+	if err != nil {
+		return nil, err
+	}
+	p := &Plugin{
+		Server:  server.New(handler, version),
+		dir:     dir,
+		serveCh: make(chan error, 1),
+	}
+
+	socketPath := filepath.Join(dir, "plugin.sock")
+	if err = p.Server.Listen(socketPath); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	go func() {
+		p.serveCh <- p.Server.Serve()
+	}()
+
+	if p.Client, err = cborplugin.Dial(socketPath, version, Capability, Endpoint, logBackend); err != nil {
+		p.Server.Shutdown(context.Background())
+		<-p.serveCh
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,171 @@
+// sandbox.go - cbor plugin process hardening
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+const (
+	// sandboxArg0 is the argv[0] that the current executable is re-executed
+	// with to apply the resource limits and no_new_privs, that can not be
+	// applied between fork and exec by os/exec, before executing the
+	// plugin.
+	sandboxArg0 = "katzenpost-cborplugin-sandbox"
+
+	sandboxEnv = "KATZENPOST_CBORPLUGIN_SANDBOX"
+
+	// sandboxErrFd is the descriptor that the sandbox reports errors on,
+	// which is closed on a successful exec of the plugin.
+	sandboxErrFd = 3
+)
+
+// RLimits are the resource limits applied to a plugin, where 0 leaves the
+// inherited limit unchanged.
+type RLimits struct {
+	// CPU is the CPU time limit in seconds.
+	CPU uint64
+
+	// AddressSpace is the address space limit in bytes.
+	AddressSpace uint64
+
+	// OpenFiles is the open file descriptor limit.
+	OpenFiles uint64
+}
+
+// Credential is the user and group that a plugin runs as.
+type Credential struct {
+	UID uint32
+	GID uint32
+}
+
+type sandboxParams struct {
+	RLimits         RLimits
+	NoNewPrivileges bool
+}
+
+func init() {
+	if len(os.Args) > 0 && os.Args[0] == sandboxArg0 {
+		runSandbox()
+	}
+}
+
+// runSandbox applies the limits passed in the environment to the current
+// process, and executes the plugin in its place.
+func runSandbox() {
+	fail := func(err error) {
+		f := os.NewFile(sandboxErrFd, "sandbox errors")
+		fmt.Fprintf(f, "%v", err)
+		os.Exit(1)
+	}
+	syscall.CloseOnExec(sandboxErrFd)
+
+	var params sandboxParams
+	if err := json.Unmarshal([]byte(os.Getenv(sandboxEnv)), &params); err != nil {
+		fail(fmt.Errorf("invalid parameters: %v", err))
+	}
+	os.Unsetenv(sandboxEnv)
+	if len(os.Args) < 2 {
+		fail(fmt.Errorf("no command"))
+	}
+
+	for _, l := range []struct {
+		name     string
+		resource int
+		value    uint64
+	}{
+		{"CPU", syscall.RLIMIT_CPU, params.RLimits.CPU},
+		{"address space", syscall.RLIMIT_AS, params.RLimits.AddressSpace},
+		{"open files", syscall.RLIMIT_NOFILE, params.RLimits.OpenFiles},
+	} {
+		if l.value == 0 {
+			continue
+		}
+		if err := syscall.Setrlimit(l.resource, &syscall.Rlimit{Cur: l.value, Max: l.value}); err != nil {
+			fail(fmt.Errorf("failed to set the %v limit to %v: %v", l.name, l.value, err))
+		}
+	}
+	if params.NoNewPrivileges {
+		if err := setNoNewPrivs(); err != nil {
+			fail(fmt.Errorf("failed to set no_new_privs: %v", err))
+		}
+	}
+
+	err := syscall.Exec(os.Args[1], os.Args[1:], os.Environ())
+	fail(fmt.Errorf("failed to exec '%v': %v", os.Args[1], err))
+}
+
+func (opts *LaunchOptions) needsSandbox() bool {
+	return opts.RLimits != (RLimits{}) || opts.NoNewPrivileges
+}
+
+// newCommand returns the command that executes the plugin with opts, and
+// iff the plugin is executed via the sandbox, the pipe that the sandbox
+// reports errors on, the write end of which is cmd.ExtraFiles[0].
+func newCommand(command string, args []string, opts *LaunchOptions) (*exec.Cmd, *os.File, error) {
+	var env []string
+	if !opts.ClearEnv {
+		env = os.Environ()
+	}
+	env = append(env, fmt.Sprintf("%s=%d,%d", ProtocolVersionsEnv, ProtocolV1, ProtocolV2))
+	for k, v := range opts.Env {
+		env = append(env, k+"="+v)
+	}
+
+	cmd := exec.Command(command, args...)
+	var errR, errW *os.File
+	if opts.needsSandbox() {
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, nil, fmt.Errorf("cborplugin: failed to find the sandbox executable: %v", err)
+		}
+		if cmd.Path, err = exec.LookPath(command); err != nil {
+			return nil, nil, err
+		}
+		b, err := json.Marshal(&sandboxParams{
+			RLimits:         opts.RLimits,
+			NoNewPrivileges: opts.NoNewPrivileges,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if errR, errW, err = os.Pipe(); err != nil {
+			return nil, nil, err
+		}
+
+		cmd.Args = append([]string{sandboxArg0, cmd.Path}, args...)
+		cmd.Path = exe
+		cmd.ExtraFiles = []*os.File{errW}
+		env = append(env, sandboxEnv+"="+string(b))
+	}
+	cmd.Env = env
+	cmd.Dir = opts.Dir
+	if opts.Credential != nil {
+		// The supplementary groups are cleared.
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{
+				Uid: opts.Credential.UID,
+				Gid: opts.Credential.GID,
+			},
+		}
+	}
+	return cmd, errR, nil
+}
@@ -0,0 +1,354 @@
+// server.go - cbor plugin server
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package server implements the plugin side of the cborplugin protocol,
+// so that Kaetzchen plugins written in Go only need to implement a Handler.
+//
+// A plugin's main function is typically just:
+//
+//	if err := server.Run(handler); err != nil {
+//		fmt.Fprintf(os.Stderr, "%v\n", err)
+//		os.Exit(1)
+//	}
+//
+// Plugins must not write anything else to stdout.  Anything written to
+// stderr is logged by the mix server.
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/katzenpost/server/cborplugin"
+)
+
+// ShutdownTimeout is how long Run waits for in-flight requests to complete
+// after receiving SIGTERM.  It is shorter than the time the mix server waits
+// before killing the plugin.
+const ShutdownTimeout = 5 * time.Second
+
+// ErrServerClosed is the error returned by Listen and Serve after Shutdown.
+var ErrServerClosed = errors.New("server: closed")
+
+// Handler is the interface implemented by plugins.
+type Handler interface {
+	// OnRequest is called for each request received by the plugin, and
+	// returns the response payload.  It may be called concurrently.
+	OnRequest(request *cborplugin.Request) ([]byte, error)
+
+	// GetParameters returns the plugin's parameters for publication in the
+	// Provider's descriptor, or nil.
+	GetParameters() *cborplugin.Parameters
+}
+
+// Server serves a Handler over a unix domain socket.
+type Server struct {
+	sync.Mutex
+
+	handler Handler
+	version int
+
+	ln         net.Listener
+	httpServer *http.Server
+	conns      map[net.Conn]bool
+	connWg     sync.WaitGroup
+	closed     bool
+}
+
+// NegotiateVersion returns the highest protocol version offered by the mix
+// server in the environment, that is supported by this package.
+func NegotiateVersion() int {
+	version := cborplugin.ProtocolV1
+	for _, v := range strings.Split(os.Getenv(cborplugin.ProtocolVersionsEnv), ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && n == cborplugin.ProtocolV2 {
+			version = n
+		}
+	}
+	return version
+}
+
+// Version returns the protocol version served.
+func (s *Server) Version() int {
+	return s.version
+}
+
+// Listen creates the unix domain socket at socketPath.
+func (s *Server) Listen(socketPath string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return ErrServerClosed
+	}
+	if s.ln != nil {
+		return errors.New("server: already listening")
+	}
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	return nil
+}
+
+// StartupLine returns the line that the plugin must print on stdout once
+// it is listening, for the mix server to connect to it.
+func (s *Server) StartupLine() string {
+	return cborplugin.StartupLine(s.version, s.ln.Addr().String())
+}
+
+// Serve serves requests until Shutdown is called, after which it returns
+// nil.
+func (s *Server) Serve() error {
+	s.Lock()
+	ln, closed := s.ln, s.closed
+	s.Unlock()
+	if closed {
+		return ErrServerClosed
+	}
+	if ln == nil {
+		return errors.New("server: not listening")
+	}
+
+	if s.version == cborplugin.ProtocolV1 {
+		err := s.httpServer.Serve(ln)
+		if err == http.ErrServerClosed {
+			return nil
+		}
+		return err
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.Lock()
+			closed = s.closed
+			s.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.Lock()
+		if s.closed {
+			s.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = true
+		s.connWg.Add(1)
+		s.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Shutdown stops accepting new requests, and waits for in-flight requests
+// to complete or for ctx to be done, whichever happens first.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return nil
+	}
+	s.closed = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	if s.version == cborplugin.ProtocolV1 {
+		s.Unlock()
+		return s.httpServer.Shutdown(ctx)
+	}
+	for conn := range s.conns {
+		// Stop reading requests, while still allowing the responses to
+		// in-flight requests to be written.
+		if uc, ok := conn.(*net.UnixConn); ok {
+			uc.CloseRead()
+		} else {
+			conn.Close()
+		}
+	}
+	s.Unlock()
+
+	doneCh := make(chan struct{})
+	go func() {
+		s.connWg.Wait()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+		return nil
+	case <-ctx.Done():
+		s.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.connWg.Done()
+
+	var writeLock sync.Mutex
+	var reqWg sync.WaitGroup
+	r := bufio.NewReader(conn)
+	for {
+		f, err := cborplugin.ReadFrame(r)
+		if err != nil {
+			break
+		}
+		reqWg.Add(1)
+		go func() {
+			defer reqWg.Done()
+			resp := s.onFrame(f)
+			writeLock.Lock()
+			defer writeLock.Unlock()
+			cborplugin.WriteFrame(conn, resp)
+		}()
+	}
+	reqWg.Wait()
+
+	s.Lock()
+	delete(s.conns, conn)
+	s.Unlock()
+	conn.Close()
+}
+
+func (s *Server) onFrame(f *cborplugin.Frame) *cborplugin.Frame {
+	resp := &cborplugin.Frame{Tag: f.Tag}
+	switch f.Type {
+	case cborplugin.FrameRequest:
+		if f.Request == nil {
+			resp.Error = "missing request"
+			break
+		}
+		payload, err := s.handler.OnRequest(f.Request)
+		if err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		resp.Type = cborplugin.FrameResponse
+		resp.Response = &cborplugin.Response{Payload: payload}
+	case cborplugin.FrameGetParameters:
+		resp.Type = cborplugin.FrameParameters
+		resp.Parameters = s.parameters()
+	default:
+		resp.Error = fmt.Sprintf("unsupported frame type: %v", f.Type)
+	}
+	return resp
+}
+
+func (s *Server) parameters() cborplugin.Parameters {
+	if p := s.handler.GetParameters(); p != nil {
+		return *p
+	}
+	return make(cborplugin.Parameters)
+}
+
+func (s *Server) onHTTPRequest(w http.ResponseWriter, r *http.Request) {
+	request := new(cborplugin.Request)
+	if err := cbor.NewDecoder(r.Body).Decode(request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload, err := s.handler.OnRequest(request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cbor.NewEncoder(w).Encode(&cborplugin.Response{Payload: payload})
+}
+
+func (s *Server) onHTTPParameters(w http.ResponseWriter, r *http.Request) {
+	cbor.NewEncoder(w).Encode(s.parameters())
+}
+
+// New returns a new Server that serves handler with the given protocol
+// version.
+func New(handler Handler, version int) *Server {
+	s := &Server{
+		handler: handler,
+		version: version,
+		conns:   make(map[net.Conn]bool),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/request", s.onHTTPRequest)
+	mux.HandleFunc("/parameters", s.onHTTPParameters)
+	s.httpServer = &http.Server{Handler: mux}
+	return s
+}
+
+// ReadConfig decodes the plugin's Config, written as CBOR to stdin by the
+// mix server on launch, into v.  Plugins configured with LegacyConfigArgs
+// receive their Config as command line arguments instead.
+func ReadConfig(v interface{}) error {
+	return cbor.NewDecoder(os.Stdin).Decode(v)
+}
+
+// Run serves handler as a plugin launched by the mix server, with the
+// protocol version negotiated via the environment.  It returns nil once the
+// plugin has been shut down gracefully by SIGTERM or SIGINT.
+func Run(handler Handler) error {
+	dir, err := ioutil.TempDir("", "cborplugin")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	s := New(handler, NegotiateVersion())
+	if err = s.Listen(filepath.Join(dir, "plugin.sock")); err != nil {
+		return err
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sigCh)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Serve()
+	}()
+	fmt.Println(s.StartupLine())
+
+	select {
+	case err = <-errCh:
+		return err
+	case <-sigCh:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err = s.Shutdown(ctx); err != nil {
+		return err
+	}
+	return <-errCh
+}
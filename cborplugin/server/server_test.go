@@ -0,0 +1,136 @@
+// server_test.go - cbor plugin server tests
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/server/cborplugin"
+	"github.com/katzenpost/server/cborplugin/plugintest"
+	"github.com/katzenpost/server/cborplugin/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type echoHandler struct {
+	startedCh chan struct{}
+	releaseCh chan struct{}
+}
+
+func (h *echoHandler) OnRequest(request *cborplugin.Request) ([]byte, error) {
+	if string(request.Payload) == "fail" {
+		return nil, errors.New("request failed")
+	}
+	if h.releaseCh != nil {
+		h.startedCh <- struct{}{}
+		<-h.releaseCh
+	}
+	return append([]byte("echo: "), request.Payload...), nil
+}
+
+func (h *echoHandler) GetParameters() *cborplugin.Parameters {
+	return &cborplugin.Parameters{"name": "echo"}
+}
+
+func TestServer(t *testing.T) {
+	for _, version := range []int{cborplugin.ProtocolV1, cborplugin.ProtocolV2} {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			require := require.New(t)
+			assert := assert.New(t)
+
+			p, err := plugintest.New(&echoHandler{}, version)
+			require.NoError(err, "plugintest.New()")
+			assert.Equal(version, p.Client.ProtocolVersion(), "ProtocolVersion()")
+
+			resp, err := p.Client.OnRequest(&cborplugin.Request{ID: 1, Payload: []byte("hello"), HasSURB: true})
+			require.NoError(err, "OnRequest()")
+			assert.Equal([]byte("echo: hello"), resp, "OnRequest()")
+			_, err = p.Client.OnRequest(&cborplugin.Request{ID: 2, Payload: []byte("fail")})
+			assert.Error(err, "OnRequest(): handler error")
+
+			params := p.Client.GetParameters()
+			require.NotNil(params, "GetParameters()")
+			assert.Equal("echo", (*params)["name"], "GetParameters()")
+			assert.Equal(plugintest.Endpoint, (*params)["endpoint"], "GetParameters()")
+			assert.NoError(p.Client.Ping(), "Ping()")
+
+			assert.NoError(p.Shutdown(), "Shutdown()")
+		})
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	for _, version := range []int{cborplugin.ProtocolV1, cborplugin.ProtocolV2} {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			require := require.New(t)
+			assert := assert.New(t)
+
+			h := &echoHandler{
+				startedCh: make(chan struct{}),
+				releaseCh: make(chan struct{}),
+			}
+			p, err := plugintest.New(h, version)
+			require.NoError(err, "plugintest.New()")
+
+			type result struct {
+				resp []byte
+				err  error
+			}
+			respCh := make(chan result, 1)
+			go func() {
+				resp, err := p.Client.OnRequest(&cborplugin.Request{Payload: []byte("in-flight")})
+				respCh <- result{resp, err}
+			}()
+			<-h.startedCh
+
+			// Shutting down waits for the in-flight request.
+			shutdownCh := make(chan error, 1)
+			go func() {
+				shutdownCh <- p.Server.Shutdown(context.Background())
+			}()
+			select {
+			case <-shutdownCh:
+				t.Fatal("Shutdown() returned with a request in flight")
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			close(h.releaseCh)
+			r := <-respCh
+			require.NoError(r.err, "OnRequest(): in-flight")
+			assert.Equal([]byte("echo: in-flight"), r.resp, "OnRequest(): in-flight")
+			assert.NoError(<-shutdownCh, "Shutdown()")
+			assert.NoError(p.Shutdown(), "Shutdown(): plugintest")
+		})
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.Unsetenv(cborplugin.ProtocolVersionsEnv)
+	os.Unsetenv(cborplugin.ProtocolVersionsEnv)
+	assert.Equal(cborplugin.ProtocolV1, server.NegotiateVersion(), "NegotiateVersion(): unset")
+	os.Setenv(cborplugin.ProtocolVersionsEnv, "1")
+	assert.Equal(cborplugin.ProtocolV1, server.NegotiateVersion(), "NegotiateVersion(): v1")
+	os.Setenv(cborplugin.ProtocolVersionsEnv, "1,2")
+	assert.Equal(cborplugin.ProtocolV2, server.NegotiateVersion(), "NegotiateVersion(): v1, v2")
+}
@@ -0,0 +1,143 @@
+// stream.go - cbor plugin protocol v2 client connection
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrClosed is the error returned when the connection to the plugin is
+	// closed while requests are in flight.
+	ErrClosed = errors.New("cborplugin: connection closed")
+
+	// ErrTimeout is the error returned when the plugin does not respond to
+	// a request in time.
+	ErrTimeout = errors.New("cborplugin: request timed out")
+)
+
+// streamConn is a protocol v2 connection, multiplexing concurrent requests
+// over a single unix domain socket connection.
+type streamConn struct {
+	sync.Mutex
+
+	conn      net.Conn
+	writeLock sync.Mutex
+
+	pending map[uint64]chan *Frame
+	tag     uint64
+	err     error
+}
+
+func dialStream(socketPath string) (*streamConn, error) {
+	conn, err := net.DialTimeout("unix", socketPath, requestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &streamConn{
+		conn:    conn,
+		pending: make(map[uint64]chan *Frame),
+	}, nil
+}
+
+// readLoop dispatches the responses read from the connection, until it is
+// closed.
+func (s *streamConn) readLoop() {
+	r := bufio.NewReader(s.conn)
+	for {
+		f, err := ReadFrame(r)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+
+		s.Lock()
+		ch, ok := s.pending[f.Tag]
+		delete(s.pending, f.Tag)
+		s.Unlock()
+		if ok {
+			ch <- f
+		}
+	}
+}
+
+func (s *streamConn) fail(err error) {
+	s.conn.Close()
+
+	s.Lock()
+	defer s.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	for tag, ch := range s.pending {
+		close(ch)
+		delete(s.pending, tag)
+	}
+}
+
+func (s *streamConn) close() {
+	s.fail(ErrClosed)
+}
+
+func (s *streamConn) roundTrip(f *Frame) (*Frame, error) {
+	ch := make(chan *Frame, 1)
+
+	s.Lock()
+	if s.err != nil {
+		s.Unlock()
+		return nil, ErrClosed
+	}
+	s.tag++
+	f.Tag = s.tag
+	s.pending[f.Tag] = ch
+	s.Unlock()
+
+	deadline := time.Now().Add(requestTimeout)
+	s.writeLock.Lock()
+	s.conn.SetWriteDeadline(deadline)
+	err := WriteFrame(s.conn, f)
+	s.writeLock.Unlock()
+	if err != nil {
+		// The frame may have been partially written, so the connection is
+		// no longer usable.
+		s.fail(err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, ErrClosed
+		}
+		if resp.Error != "" {
+			return nil, fmt.Errorf("cborplugin: plugin error: %v", resp.Error)
+		}
+		return resp, nil
+	case <-timer.C:
+		s.Lock()
+		delete(s.pending, f.Tag)
+		s.Unlock()
+		return nil, ErrTimeout
+	}
+}
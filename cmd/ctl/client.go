@@ -0,0 +1,108 @@
+// client.go - Katzenpost management interface client.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+)
+
+const (
+	dialTimeout = 10 * time.Second
+
+	// statusServiceReady is the status code of the greeting sent by the
+	// server upon connection establishment.
+	statusServiceReady = 220
+
+	// statusUnknownCommand is the status code returned for commands that
+	// the server does not have registered.
+	statusUnknownCommand = 500
+)
+
+// reply is a parsed thwack reply.
+type reply struct {
+	Command string   `json:"command"`
+	Status  int      `json:"status"`
+	Ok      bool     `json:"ok"`
+	Lines   []string `json:"lines,omitempty"`
+}
+
+// client is a thwack management interface client.
+type client struct {
+	conn *textproto.Conn
+}
+
+func (c *client) close() {
+	c.conn.Close()
+}
+
+// do sends a single command line, and returns the server's reply.
+func (c *client) do(cmd string, args ...string) (*reply, error) {
+	line := strings.Join(append([]string{cmd}, args...), " ")
+	id, err := c.conn.Cmd("%s", line)
+	if err != nil {
+		return nil, err
+	}
+	c.conn.StartResponse(id)
+	defer c.conn.EndResponse(id)
+
+	// Note: Passing 0 skips the status code check, so that failures are
+	// returned as a reply rather than an error.
+	code, msg, err := c.conn.ReadResponse(0)
+	if err != nil {
+		if _, ok := err.(*textproto.Error); !ok {
+			return nil, err
+		}
+	}
+
+	r := &reply{
+		Command: cmd,
+		Status:  code,
+		Ok:      code == int(thwack.StatusOk),
+	}
+	lines := strings.Split(msg, "\n")
+	if len(lines) > 1 {
+		// Multi-line replies are terminated by a bare status line.
+		lines = lines[:len(lines)-1]
+	}
+	for _, l := range lines {
+		if l != "" {
+			r.Lines = append(r.Lines, l)
+		}
+	}
+	return r, nil
+}
+
+// dial connects to the management socket at path, and consumes the greeting.
+func dial(path string) (*client, error) {
+	conn, err := net.DialTimeout("unix", path, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &client{conn: textproto.NewConn(conn)}
+	if _, _, err = c.conn.ReadResponse(statusServiceReady); err != nil {
+		c.close()
+		return nil, fmt.Errorf("invalid greeting: %v", err)
+	}
+	return c, nil
+}
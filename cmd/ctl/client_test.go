@@ -0,0 +1,174 @@
+// client_test.go - Katzenpost management interface client tests.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/katzenpost/core/thwack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer is a stand-in management interface that answers each command
+// with the canned reply lines, and records the command lines received.
+type fakeServer struct {
+	l       net.Listener
+	replies map[string][]string
+	cmdCh   chan string
+}
+
+func (s *fakeServer) serve() {
+	defer close(s.cmdCh)
+
+	conn, err := s.l.Accept()
+	if err != nil {
+		return
+	}
+	c := textproto.NewConn(conn)
+	defer c.Close()
+
+	if err = c.PrintfLine("%v Service ready", statusServiceReady); err != nil {
+		return
+	}
+	for {
+		l, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		s.cmdCh <- l
+		reply, ok := s.replies[l]
+		if !ok {
+			reply = []string{"500 Unknown command"}
+		}
+		for _, v := range reply {
+			if err = c.PrintfLine("%s", v); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func newFakeServer(t *testing.T, path string, replies map[string][]string) *fakeServer {
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err, "Listen()")
+	s := &fakeServer{
+		l:       l,
+		replies: replies,
+		cmdCh:   make(chan string, len(replies)+1),
+	}
+	go s.serve()
+	return s
+}
+
+func TestClient(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ctl_tests")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "management_sock")
+
+	s := newFakeServer(t, path, map[string][]string{
+		"SPOOL_COUNT alice":  {"250 3 1024"},
+		"QUEUE_STATS":        {"250-crypto_workers: 0", "250-scheduler: 2", "250 Ok"},
+		"REMOVE_USER alice":  {"554 Transaction failed"},
+		"SPOOL_VACUUM FORCE": {"501 Syntax error"},
+	})
+	defer s.l.Close()
+
+	c, err := dial(path)
+	require.NoError(err, "dial()")
+	defer c.close()
+
+	for _, tc := range []struct {
+		cmd  string
+		args []string
+		want *reply
+	}{
+		{"SPOOL_COUNT", []string{"alice"}, &reply{
+			Command: "SPOOL_COUNT",
+			Status:  int(thwack.StatusOk),
+			Ok:      true,
+			Lines:   []string{"3 1024"},
+		}},
+		{"QUEUE_STATS", nil, &reply{
+			Command: "QUEUE_STATS",
+			Status:  int(thwack.StatusOk),
+			Ok:      true,
+			Lines:   []string{"crypto_workers: 0", "scheduler: 2"},
+		}},
+		{"REMOVE_USER", []string{"alice"}, &reply{
+			Command: "REMOVE_USER",
+			Status:  int(thwack.StatusTransactionFailed),
+			Lines:   []string{"Transaction failed"},
+		}},
+		{"SPOOL_VACUUM", []string{"FORCE"}, &reply{
+			Command: "SPOOL_VACUUM",
+			Status:  int(thwack.StatusSyntaxError),
+			Lines:   []string{"Syntax error"},
+		}},
+		{"NO_SUCH_COMMAND", nil, &reply{
+			Command: "NO_SUCH_COMMAND",
+			Status:  statusUnknownCommand,
+			Lines:   []string{"Unknown command"},
+		}},
+	} {
+		r, err := c.do(tc.cmd, tc.args...)
+		require.NoError(err, "do(%v)", tc.cmd)
+		assert.Equal(tc.want, r, "do(%v)", tc.cmd)
+		assert.Equal(tc.want.Ok, statusToExitCode(r.Status) == exitOk, "do(%v): exit code", tc.cmd)
+	}
+
+	// The command lines are sent with the arguments space separated.
+	c.close()
+	var cmds []string
+	for l := range s.cmdCh {
+		cmds = append(cmds, l)
+	}
+	assert.Equal([]string{
+		"SPOOL_COUNT alice",
+		"QUEUE_STATS",
+		"REMOVE_USER alice",
+		"SPOOL_VACUUM FORCE",
+		"NO_SUCH_COMMAND",
+	}, cmds, "command lines")
+
+	// Servers that do not send the greeting are rejected.
+	badPath := filepath.Join(dir, "bad_sock")
+	l, err := net.Listen("unix", badPath)
+	require.NoError(err, "Listen(bad)")
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		textproto.NewConn(conn).PrintfLine("%v Not ready", thwack.StatusTransactionFailed)
+		conn.Close()
+	}()
+	_, err = dial(badPath)
+	assert.Error(err, "dial(): invalid greeting")
+	_, err = dial(filepath.Join(dir, "missing_sock"))
+	assert.Error(err, "dial(): missing socket")
+}
@@ -0,0 +1,365 @@
+// main.go - Katzenpost management interface command line client.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Command ctl is a command line client for the server management interface.
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/userdb"
+)
+
+// Exit codes.
+const (
+	exitOk = iota
+	exitFailed
+	exitUsage
+	exitConnect
+)
+
+// argKind is the type of a subcommand argument, used for validation.
+type argKind int
+
+const (
+	argUser argKind = iota
+	argKey
+	argUint
+	argKeyName
+	argKeyword
+)
+
+type argSpec struct {
+	name     string
+	kind     argKind
+	optional bool
+}
+
+type subcommand struct {
+	cmd  string
+	args []argSpec
+	help string
+}
+
+var subcommands = map[string]*subcommand{
+	"add-user": {
+		cmd:  "ADD_USER",
+		args: []argSpec{{"user", argUser, false}, {"link-key", argKey, false}},
+		help: "Add a user with the given link key.",
+	},
+	"update-user": {
+		cmd:  "UPDATE_USER",
+		args: []argSpec{{"user", argUser, false}, {"link-key", argKey, false}},
+		help: "Update an existing user's default link key.",
+	},
+	"remove-user": {
+		cmd:  "REMOVE_USER",
+		args: []argSpec{{"user", argUser, false}},
+		help: "Remove a user and their spool.",
+	},
+	"add-link-key": {
+		cmd:  "ADD_USER_LINK_KEY",
+		args: []argSpec{{"user", argUser, false}, {"key-name", argKeyName, false}, {"link-key", argKey, false}},
+		help: "Add a named link key (eg: for an additional device) to a user.",
+	},
+	"remove-link-key": {
+		cmd:  "REMOVE_USER_LINK_KEY",
+		args: []argSpec{{"user", argUser, false}, {"key-name", argKeyName, false}},
+		help: "Revoke a user's named link key.",
+	},
+	"user-link-keys": {
+		cmd:  "USER_LINK_KEYS",
+		args: []argSpec{{"user", argUser, false}},
+		help: "Show all of a user's named link keys.",
+	},
+	"set-user-identity": {
+		cmd:  "SET_USER_IDENTITY",
+		args: []argSpec{{"user", argUser, false}, {"identity-key", argKey, true}},
+		help: "Set (or clear if omitted) a user's identity key.",
+	},
+	"remove-user-identity": {
+		cmd:  "REMOVE_USER_IDENTITY",
+		args: []argSpec{{"user", argUser, false}},
+		help: "Clear a user's identity key.",
+	},
+	"user-identity": {
+		cmd:  "USER_IDENTITY",
+		args: []argSpec{{"user", argUser, false}},
+		help: "Show a user's identity key.",
+	},
+	"user-link": {
+		cmd:  "USER_LINK",
+		args: []argSpec{{"user", argUser, false}},
+		help: "Show a user's default link key.",
+	},
+	"list-users": {
+		cmd:  "LIST_USERS",
+		help: "List the users, with their metadata.",
+	},
+	"disable-user": {
+		cmd:  "DISABLE_USER",
+		args: []argSpec{{"user", argUser, false}},
+		help: "Suspend a user, without removing their spool.",
+	},
+	"enable-user": {
+		cmd:  "ENABLE_USER",
+		args: []argSpec{{"user", argUser, false}},
+		help: "Re-enable a suspended user.",
+	},
+	"send-rate": {
+		cmd:  "SEND_RATE",
+		args: []argSpec{{"packets-per-minute", argUint, false}},
+		help: "Set the client send rate limit.",
+	},
+	"send-burst": {
+		cmd:  "SEND_BURST",
+		args: []argSpec{{"packets", argUint, false}},
+		help: "Set the client send burst limit.",
+	},
+	"set-user-rate-limit": {
+		cmd:  "SET_USER_RATE_LIMIT",
+		args: []argSpec{{"user", argUser, false}, {"packets-per-minute", argUint, false}, {"packets", argUint, false}},
+		help: "Override a user's send rate and burst limits (0 for unlimited).",
+	},
+	"remove-user-rate-limit": {
+		cmd:  "REMOVE_USER_RATE_LIMIT",
+		args: []argSpec{{"user", argUser, false}},
+		help: "Remove a user's send rate limit override.",
+	},
+	"spool-count": {
+		cmd:  "SPOOL_COUNT",
+		args: []argSpec{{"user", argUser, false}},
+		help: "Show the number and total size of messages in a user's spool.",
+	},
+	"spool-vacuum": {
+		cmd:  "SPOOL_VACUUM",
+		args: []argSpec{{"force", argKeyword, true}},
+		help: "Vacuum the spool, and compact it if needed (or always if forced).",
+	},
+	"status": {
+		cmd:  "STATUS",
+		help: "Show the server status.",
+	},
+	"list-conns": {
+		cmd:  "LIST_CONNS",
+		help: "List the established incoming and outgoing connections.",
+	},
+	"queue-stats": {
+		cmd:  "QUEUE_STATS",
+		help: "Show the internal queue backlogs.",
+	},
+	"pki-status": {
+		cmd:  "PKI_STATUS",
+		help: "Show the cached PKI documents and descriptor publication status.",
+	},
+	"plugin-status": {
+		cmd:  "PLUGIN_STATUS",
+		help: "Show the state and restart count of each CBOR plugin process.",
+	},
+	"shutdown": {
+		cmd:  "SHUTDOWN",
+		help: "Shut down the server.",
+	},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] <command> [args...]\n\nOptions:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n    \t%s\n", subcommands[name].usage(name), subcommands[name].help)
+	}
+	fmt.Fprintf(os.Stderr, "\nKeys may be specified literally, or as @path to load a key file.\n")
+}
+
+func (s *subcommand) usage(name string) string {
+	parts := []string{name}
+	for _, a := range s.args {
+		if a.optional {
+			parts = append(parts, "["+a.name+"]")
+		} else {
+			parts = append(parts, "<"+a.name+">")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// validateArgs validates and normalizes the subcommand arguments into the
+// form expected by the server.
+func (s *subcommand) validateArgs(args []string) ([]string, error) {
+	nRequired := 0
+	for _, a := range s.args {
+		if !a.optional {
+			nRequired++
+		}
+	}
+	if len(args) < nRequired || len(args) > len(s.args) {
+		return nil, fmt.Errorf("expected %d to %d arguments, got %d", nRequired, len(s.args), len(args))
+	}
+
+	ret := make([]string, 0, len(args))
+	for i, v := range args {
+		spec := s.args[i]
+		switch spec.kind {
+		case argUser:
+			if len(v) == 0 || len(v) > userdb.MaxUsernameSize || strings.ContainsAny(v, " \t\r\n") {
+				return nil, fmt.Errorf("invalid %s: '%v'", spec.name, v)
+			}
+		case argKey:
+			k, err := loadPublicKey(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", spec.name, err)
+			}
+			v = k.String()
+		case argKeyName:
+			if !userdb.IsValidLinkKeyName(v) {
+				return nil, fmt.Errorf("invalid %s: '%v'", spec.name, v)
+			}
+		case argUint:
+			if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", spec.name, err)
+			}
+		case argKeyword:
+			if !strings.EqualFold(v, spec.name) {
+				return nil, fmt.Errorf("expected '%s', got '%v'", spec.name, v)
+			}
+			v = strings.ToUpper(v)
+		}
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
+// loadPublicKey parses a public key, either from the literal string
+// representation, or from a PEM or text file if prefixed with `@`.
+func loadPublicKey(v string) (*ecdh.PublicKey, error) {
+	k := new(ecdh.PublicKey)
+	if !strings.HasPrefix(v, "@") {
+		return k, k.FromString(v)
+	}
+
+	b, err := ioutil.ReadFile(strings.TrimPrefix(v, "@"))
+	if err != nil {
+		return nil, err
+	}
+	if blk, _ := pem.Decode(b); blk != nil {
+		return k, k.FromBytes(blk.Bytes)
+	}
+	return k, k.FromString(strings.TrimSpace(string(b)))
+}
+
+func socketPath(cfgFile, sockPath string) (string, error) {
+	if sockPath != "" {
+		return sockPath, nil
+	}
+
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to load config file '%v': %v", cfgFile, err)
+	}
+	if !cfg.Management.Enable {
+		return "", errors.New("management interface is not enabled in the config file")
+	}
+	return cfg.Management.Path, nil
+}
+
+func statusToExitCode(status int) int {
+	switch status {
+	case int(thwack.StatusOk):
+		return exitOk
+	case int(thwack.StatusSyntaxError), statusUnknownCommand:
+		return exitUsage
+	default:
+		return exitFailed
+	}
+}
+
+func main() {
+	cfgFile := flag.String("f", "katzenpost.toml", "Path to the server config file.")
+	sockPath := flag.String("s", "", "Path to the management socket (overrides the config file).")
+	jsonOut := flag.Bool("json", false, "Output the reply as JSON.")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	name := flag.Arg(0)
+	sub, ok := subcommands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: '%v'\n", name)
+		usage()
+		os.Exit(exitUsage)
+	}
+	args, err := sub.validateArgs(flag.Args()[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s\n%v: %v\n", os.Args[0], sub.usage(name), name, err)
+		os.Exit(exitUsage)
+	}
+
+	path, err := socketPath(*cfgFile, *sockPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitConnect)
+	}
+	c, err := dial(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to '%v': %v\n", path, err)
+		os.Exit(exitConnect)
+	}
+	r, err := c.do(sub.cmd, args...)
+	c.close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to issue %v: %v\n", sub.cmd, err)
+		os.Exit(exitConnect)
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(r)
+	} else {
+		out := os.Stdout
+		if !r.Ok {
+			out = os.Stderr
+			fmt.Fprintf(out, "%v failed with status %v\n", sub.cmd, r.Status)
+		}
+		for _, l := range r.Lines {
+			fmt.Fprintln(out, l)
+		}
+	}
+
+	os.Exit(statusToExitCode(r.Status))
+}
@@ -0,0 +1,138 @@
+// main_test.go - Katzenpost management interface command line client tests.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/server/userdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateArgs(t *testing.T) {
+	require := require.New(t)
+
+	privKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair()")
+	key := privKey.PublicKey().String()
+
+	for _, tc := range []struct {
+		name    string
+		command string
+		args    []string
+		want    []string
+		wantErr bool
+	}{
+		{"user and key", "add-user", []string{"alice", key}, []string{"alice", key}, false},
+		{"missing argument", "add-user", []string{"alice"}, nil, true},
+		{"extra argument", "remove-user", []string{"alice", "bob"}, nil, true},
+		{"no arguments", "status", nil, []string{}, false},
+		{"unexpected argument", "status", []string{"alice"}, nil, true},
+		{"optional argument omitted", "set-user-identity", []string{"alice"}, []string{"alice"}, false},
+		{"optional argument", "set-user-identity", []string{"alice", key}, []string{"alice", key}, false},
+		{"empty user", "remove-user", []string{""}, nil, true},
+		{"user with whitespace", "remove-user", []string{"al ice"}, nil, true},
+		{"user too long", "remove-user", []string{strings.Repeat("a", userdb.MaxUsernameSize+1)}, nil, true},
+		{"invalid key", "add-user", []string{"alice", "not-a-key"}, nil, true},
+		{"key name", "remove-link-key", []string{"alice", "laptop"}, []string{"alice", "laptop"}, false},
+		{"invalid key name", "remove-link-key", []string{"alice", "lap\ttop"}, nil, true},
+		{"uints", "set-user-rate-limit", []string{"alice", "30", "0"}, []string{"alice", "30", "0"}, false},
+		{"non-numeric uint", "send-rate", []string{"fast"}, nil, true},
+		{"negative uint", "send-burst", []string{"-1"}, nil, true},
+		{"keyword omitted", "spool-vacuum", nil, []string{}, false},
+		{"keyword", "spool-vacuum", []string{"force"}, []string{"FORCE"}, false},
+		{"keyword upper-cased", "spool-vacuum", []string{"Force"}, []string{"FORCE"}, false},
+		{"wrong keyword", "spool-vacuum", []string{"now"}, nil, true},
+	} {
+		sub, ok := subcommands[tc.command]
+		require.True(ok, "subcommands[%v]", tc.command)
+		got, err := sub.validateArgs(tc.args)
+		if tc.wantErr {
+			assert.Error(t, err, "validateArgs(): %v", tc.name)
+			continue
+		}
+		if assert.NoError(t, err, "validateArgs(): %v", tc.name) {
+			assert.Equal(t, tc.want, got, "validateArgs(): %v", tc.name)
+		}
+	}
+}
+
+func TestLoadPublicKey(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "ctl_tests")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	privKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair()")
+	pubKey := privKey.PublicKey()
+
+	pemFile := filepath.Join(dir, "link.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "X25519 PUBLIC KEY", Bytes: pubKey.Bytes()})
+	require.NoError(ioutil.WriteFile(pemFile, b, 0600), "WriteFile(pem)")
+	txtFile := filepath.Join(dir, "link.txt")
+	require.NoError(ioutil.WriteFile(txtFile, []byte(pubKey.String()+"\n"), 0600), "WriteFile(txt)")
+	badFile := filepath.Join(dir, "bad.txt")
+	require.NoError(ioutil.WriteFile(badFile, []byte("not-a-key\n"), 0600), "WriteFile(bad)")
+
+	for _, tc := range []struct {
+		name    string
+		arg     string
+		wantErr bool
+	}{
+		{"literal", pubKey.String(), false},
+		{"pem file", "@" + pemFile, false},
+		{"text file", "@" + txtFile, false},
+		{"invalid literal", "not-a-key", true},
+		{"invalid file", "@" + badFile, true},
+		{"missing file", "@" + filepath.Join(dir, "missing.pem"), true},
+	} {
+		k, err := loadPublicKey(tc.arg)
+		if tc.wantErr {
+			assert.Error(t, err, "loadPublicKey(): %v", tc.name)
+			continue
+		}
+		if assert.NoError(t, err, "loadPublicKey(): %v", tc.name) {
+			assert.Equal(t, pubKey.Bytes(), k.Bytes(), "loadPublicKey(): %v", tc.name)
+		}
+	}
+}
+
+func TestStatusToExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		want   int
+	}{
+		{int(thwack.StatusOk), exitOk},
+		{int(thwack.StatusSyntaxError), exitUsage},
+		{statusUnknownCommand, exitUsage},
+		{int(thwack.StatusTransactionFailed), exitFailed},
+		{statusServiceReady, exitFailed},
+	} {
+		assert.Equal(t, tc.want, statusToExitCode(tc.status), "statusToExitCode(%v)", tc.status)
+	}
+}
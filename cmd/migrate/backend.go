@@ -0,0 +1,205 @@
+// backend.go - Katzenpost provider database migration backends.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/internal/glue"
+	"github.com/katzenpost/server/internal/sqldb"
+	"github.com/katzenpost/server/spool"
+	"github.com/katzenpost/server/spool/boltspool"
+	"github.com/katzenpost/server/spool/spoolcrypt"
+	"github.com/katzenpost/server/userdb"
+	"github.com/katzenpost/server/userdb/boltuserdb"
+	"github.com/katzenpost/server/userdb/externuserdb"
+)
+
+// sqlGlue provides the subset of glue.Glue used by sqldb.New, so that the
+// SQL database can be opened without instantiating the rest of the server.
+type sqlGlue struct {
+	glue.Glue
+
+	cfg        *config.Config
+	logBackend *log.Backend
+}
+
+func (g *sqlGlue) Config() *config.Config {
+	return g.cfg
+}
+
+func (g *sqlGlue) LogBackend() *log.Backend {
+	return g.logBackend
+}
+
+// backend is a provider's user database and spool.
+type backend struct {
+	userDB userdb.UserDB
+	spool  spool.Spool
+	sqlDB  *sqldb.SQLDB
+}
+
+func (b *backend) Close() {
+	if b.spool != nil {
+		b.spool.Close()
+	}
+	if b.userDB != nil {
+		b.userDB.Close()
+	}
+	if b.sqlDB != nil {
+		b.sqlDB.Close()
+	}
+}
+
+// openBackend opens the UserDB and SpoolDB backends of the provider
+// configuration cfg, or only the SpoolDB backend if spoolOnly is set.
+// Unlike the provider, the UserDB cache and spool quota are deliberately
+// ignored.
+func openBackend(cfg *config.Config, logBackend *log.Backend, spoolOnly bool) (*backend, error) {
+	pCfg := cfg.Provider
+	if pCfg == nil {
+		return nil, errors.New("not a Provider configuration")
+	}
+	if pCfg.UserDB.Backend == config.BackendMemory || pCfg.SpoolDB.Backend == config.BackendMemory {
+		return nil, errors.New("the memory backends can not be migrated to or from")
+	}
+	if spoolOnly && pCfg.UserDB.Backend == config.BackendSQL && pCfg.SpoolDB.Backend == config.BackendSQL {
+		return nil, errors.New("the SQL SpoolDB shares a database with the UserDB, and can not be migrated alone")
+	}
+
+	b := new(backend)
+	isOk := false
+	defer func() {
+		if !isOk {
+			b.Close()
+		}
+	}()
+
+	var err error
+	if pCfg.SpoolDB.Backend == config.BackendSQL || (!spoolOnly && pCfg.UserDB.Backend == config.BackendSQL) {
+		if pCfg.SQLDB == nil {
+			return nil, errors.New("SQL backend with no SQL database")
+		}
+		if b.sqlDB, err = sqldb.New(&sqlGlue{cfg: cfg, logBackend: logBackend}); err != nil {
+			return nil, err
+		}
+	}
+
+	// The UserDB is left alone when only migrating the spool, as it may well
+	// be shared with the source.
+	if !spoolOnly {
+		switch pCfg.UserDB.Backend {
+		case config.BackendBolt:
+			b.userDB, err = boltuserdb.New(pCfg.UserDB.Bolt.UserDB)
+		case config.BackendExtern:
+			eCfg := pCfg.UserDB.Extern
+			b.userDB, err = externuserdb.New(&externuserdb.Config{
+				ProviderURL:       eCfg.ProviderURL,
+				Timeout:           time.Duration(eCfg.RequestTimeout) * time.Millisecond,
+				BearerToken:       eCfg.BearerToken,
+				TLSClientCertFile: eCfg.TLSClientCertFile,
+				TLSClientKeyFile:  eCfg.TLSClientKeyFile,
+				TLSCACertFile:     eCfg.TLSCACertFile,
+				LegacyProtocol:    eCfg.LegacyProtocol,
+			})
+		case config.BackendSQL:
+			b.userDB, err = b.sqlDB.UserDB()
+		default:
+			err = fmt.Errorf("unknown UserDB backend: %v", pCfg.UserDB.Backend)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch pCfg.SpoolDB.Backend {
+	case config.BackendBolt:
+		if eCfg := pCfg.SpoolDB.Encryption; eCfg != nil {
+			var k *spoolcrypt.Key
+			if k, err = spoolcrypt.Load(eCfg.KeyFile, eCfg.Passphrase); err == nil {
+				b.spool, err = boltspool.NewEncrypted(pCfg.SpoolDB.Bolt.SpoolDB, k)
+			}
+		} else {
+			b.spool, err = boltspool.New(pCfg.SpoolDB.Bolt.SpoolDB)
+		}
+	case config.BackendSQL:
+		b.spool = b.sqlDB.Spool()
+	default:
+		err = fmt.Errorf("unknown SpoolDB backend: %v", pCfg.SpoolDB.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	isOk = true
+	return b, nil
+}
+
+// checkDistinct returns an error if the source and destination
+// configurations share a database, as migrating a database onto itself
+// would corrupt it.  If spoolOnly is set, only the destination SpoolDB is
+// checked, as the UserDB is expected to be shared.
+func checkDistinct(src, dst *config.Config, spoolOnly bool) error {
+	sCfg, dCfg := src.Provider, dst.Provider
+
+	var srcFiles []string
+	if sCfg.UserDB.Backend == config.BackendBolt {
+		srcFiles = append(srcFiles, sCfg.UserDB.Bolt.UserDB)
+	}
+	if sCfg.SpoolDB.Backend == config.BackendBolt {
+		srcFiles = append(srcFiles, sCfg.SpoolDB.Bolt.SpoolDB)
+	}
+	isSrcFile := func(f string) bool {
+		for _, v := range srcFiles {
+			if filepath.Clean(v) == filepath.Clean(f) {
+				return true
+			}
+		}
+		return false
+	}
+	if !spoolOnly && dCfg.UserDB.Backend == config.BackendBolt && isSrcFile(dCfg.UserDB.Bolt.UserDB) {
+		return fmt.Errorf("destination UserDB '%v' is also a source database", dCfg.UserDB.Bolt.UserDB)
+	}
+	if dCfg.SpoolDB.Backend == config.BackendBolt && isSrcFile(dCfg.SpoolDB.Bolt.SpoolDB) {
+		return fmt.Errorf("destination SpoolDB '%v' is also a source database", dCfg.SpoolDB.Bolt.SpoolDB)
+	}
+
+	if sCfg.SQLDB != nil && dCfg.SQLDB != nil && sCfg.SQLDB.DataSourceName == dCfg.SQLDB.DataSourceName {
+		usesSQL := func(pCfg *config.Provider) bool {
+			return pCfg.UserDB.Backend == config.BackendSQL || pCfg.SpoolDB.Backend == config.BackendSQL
+		}
+		dstUsesSQL := usesSQL(dCfg)
+		if spoolOnly {
+			dstUsesSQL = dCfg.SpoolDB.Backend == config.BackendSQL
+		}
+		if usesSQL(sCfg) && dstUsesSQL {
+			return errors.New("source and destination share a SQL database")
+		}
+	}
+
+	if !spoolOnly && sCfg.UserDB.Backend == config.BackendExtern && dCfg.UserDB.Backend == config.BackendExtern &&
+		sCfg.UserDB.Extern.ProviderURL == dCfg.UserDB.Extern.ProviderURL {
+		return errors.New("source and destination share an external UserDB")
+	}
+
+	return nil
+}
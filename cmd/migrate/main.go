@@ -0,0 +1,161 @@
+// main.go - Katzenpost provider database migration tool.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Command migrate copies a provider's user database and user message spool
+// from the backends of one server configuration to those of another, for
+// example from bolt to a SQL database.
+//
+// The server must not be running while the migration is in progress.  Link
+// keys, identity keys, the disabled flag, the last authentication time, the
+// rate limit override and the spooled messages (in order, with SURB IDs) are
+// preserved.  User creation times and message storage times are reset to the
+// time of the migration.
+//
+// With -spool-only, only the spool is copied, and the destination UserDB is
+// never opened, which is how an existing spool is converted to (or from) an
+// encrypted spool: point the destination configuration at a new SpoolDB with
+// the Encryption section set, migrate, and then switch the server over to
+// the destination configuration.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/server/config"
+)
+
+// Exit codes.
+const (
+	exitOk = iota
+	exitFailed
+	exitUsage
+	exitVerify
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s -from <config> -to <config> [-n] [-spool-only] [-progress <n>]\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func loadConfig(f string) (*config.Config, error) {
+	cfg, err := config.LoadFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config file '%v': %v", f, err)
+	}
+	if cfg.Provider == nil {
+		return nil, fmt.Errorf("config file '%v' is not a Provider configuration", f)
+	}
+	return cfg, nil
+}
+
+func main() {
+	srcFile := flag.String("from", "", "Path to the server config file with the source backends.")
+	dstFile := flag.String("to", "", "Path to the server config file with the destination backends.")
+	dryRun := flag.Bool("n", false, "Dry run, read the source without writing the destination.")
+	spoolOnly := flag.Bool("spool-only", false, "Only migrate the spool, leaving the UserDB as is.")
+	progressEvery := flag.Int("progress", 100, "Report progress every n users (0 disables).")
+	flag.Usage = usage
+	flag.Parse()
+
+	if *srcFile == "" || (*dstFile == "" && !*dryRun) || flag.NArg() != 0 {
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	// Set the umask to something "paranoid".
+	syscall.Umask(0077)
+
+	logBackend, err := log.New("", "WARNING", false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize logging: %v\n", err)
+		os.Exit(exitFailed)
+	}
+
+	srcCfg, err := loadConfig(*srcFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitUsage)
+	}
+	var dstCfg *config.Config
+	if !*dryRun {
+		if dstCfg, err = loadConfig(*dstFile); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(exitUsage)
+		}
+		if err = checkDistinct(srcCfg, dstCfg, *spoolOnly); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	os.Exit(run(srcCfg, dstCfg, logBackend, *spoolOnly, *progressEvery))
+}
+
+func run(srcCfg, dstCfg *config.Config, logBackend *log.Backend, spoolOnly bool, progressEvery int) int {
+	m := &migrator{
+		out:           os.Stdout,
+		progressEvery: progressEvery,
+		spoolOnly:     spoolOnly,
+	}
+
+	var err error
+	if m.src, err = openBackend(srcCfg, logBackend, false); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open the source backends: %v\n", err)
+		return exitFailed
+	}
+	defer m.src.Close()
+
+	// The destination is never opened for a dry run, as doing so would
+	// create the bolt databases.
+	if dstCfg == nil {
+		s, err := m.run()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Dry run failed: %v\n", err)
+			return exitFailed
+		}
+		fmt.Fprintf(os.Stdout, "Dry run complete, would migrate %v.\n", s)
+		return exitOk
+	}
+
+	if m.dst, err = openBackend(dstCfg, logBackend, spoolOnly); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open the destination backends: %v\n", err)
+		return exitFailed
+	}
+	defer m.dst.Close()
+
+	s, err := m.run()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Migration failed after %v: %v\n", s, err)
+		return exitFailed
+	}
+	fmt.Fprintf(os.Stdout, "Migration complete, migrated %v.\n", s)
+
+	if s, err = m.verify(); err != nil {
+		fmt.Fprintf(os.Stderr, "Verification failed: %v\n", err)
+		return exitFailed
+	}
+	if s.nrFailed > 0 {
+		fmt.Fprintf(os.Stderr, "Verification failed: %d mismatches.\n", s.nrFailed)
+		return exitVerify
+	}
+	fmt.Fprintf(os.Stdout, "Verification complete, %v match.\n", s)
+
+	return exitOk
+}
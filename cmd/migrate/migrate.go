@@ -0,0 +1,374 @@
+// migrate.go - Katzenpost provider database migration.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/server/userdb"
+)
+
+// userDigest summarizes a user's state, for the verification pass.
+type userDigest struct {
+	nrLinkKeys int
+	nrMessages int
+	nrBytes    int
+
+	// userHash covers the link keys, identity key and metadata.
+	userHash [sha256.Size]byte
+
+	// spoolHash covers the messages and SURB IDs, in order.
+	spoolHash [sha256.Size]byte
+}
+
+// stats is the running total of a migration or verification pass.
+type stats struct {
+	nrUsers    int
+	nrLinkKeys int
+	nrMessages int
+	nrBytes    int
+	nrFailed   int
+}
+
+func (s *stats) add(d *userDigest) {
+	s.nrUsers++
+	s.nrLinkKeys += d.nrLinkKeys
+	s.nrMessages += d.nrMessages
+	s.nrBytes += d.nrBytes
+}
+
+func (s *stats) String() string {
+	return fmt.Sprintf("%d users, %d link keys, %d messages (%d bytes)", s.nrUsers, s.nrLinkKeys, s.nrMessages, s.nrBytes)
+}
+
+func writeField(h hash.Hash, b []byte) {
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(b)))
+	h.Write(l[:])
+	h.Write(b)
+}
+
+func sortedKeyNames(keys map[string][]byte) []string {
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// digestUser computes the digest of the user u in the backend b, or only of
+// the user's spool if spoolOnly is set.
+func digestUser(b *backend, u []byte, spoolOnly bool) (*userDigest, error) {
+	d := new(userDigest)
+	if !spoolOnly {
+		if err := digestUserDB(b, u, d); err != nil {
+			return nil, err
+		}
+	}
+
+	h := sha256.New()
+	err := b.spool.ForEach(u, func(msg, surbID []byte) error {
+		d.nrMessages++
+		d.nrBytes += len(msg)
+		writeField(h, surbID)
+		writeField(h, msg)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("spool ForEach(): %v", err)
+	}
+	copy(d.spoolHash[:], h.Sum(nil))
+
+	return d, nil
+}
+
+func digestUserDB(b *backend, u []byte, d *userDigest) error {
+	info, err := b.userDB.Info(u)
+	if err != nil {
+		return fmt.Errorf("Info(): %v", err)
+	}
+	linkKeys, err := b.userDB.LinkKeys(u)
+	if err != nil {
+		return fmt.Errorf("LinkKeys(): %v", err)
+	}
+	rawKeys := make(map[string][]byte)
+	for name, k := range linkKeys {
+		rawKeys[name] = k.Bytes()
+	}
+	var rawIdentity []byte
+	switch idKey, err := b.userDB.Identity(u); err {
+	case nil:
+		rawIdentity = idKey.Bytes()
+	case userdb.ErrNoIdentity:
+	default:
+		return fmt.Errorf("Identity(): %v", err)
+	}
+
+	// Backends only preserve the times to second precision, and CreatedAt
+	// is set by the destination, so only the LastAuthenticated second is
+	// part of the digest.
+	h := sha256.New()
+	d.nrLinkKeys = len(rawKeys)
+	for _, name := range sortedKeyNames(rawKeys) {
+		writeField(h, []byte(name))
+		writeField(h, rawKeys[name])
+	}
+	writeField(h, rawIdentity)
+	var meta [1 + 8 + 16]byte
+	if info.Disabled {
+		meta[0] |= 1
+	}
+	if !info.LastAuthenticated.IsZero() {
+		binary.BigEndian.PutUint64(meta[1:9], uint64(info.LastAuthenticated.Unix()))
+	}
+	if rl := info.RateLimit; rl != nil {
+		meta[0] |= 2
+		binary.BigEndian.PutUint64(meta[9:17], rl.SendRatePerMinute)
+		binary.BigEndian.PutUint64(meta[17:25], rl.SendBurst)
+	}
+	h.Write(meta[:])
+	copy(d.userHash[:], h.Sum(nil))
+
+	return nil
+}
+
+// migrateUser copies the user u, and the user's spool from src to dst.
+func migrateUser(src, dst *backend, u []byte, info *userdb.UserInfo) error {
+	linkKeys, err := src.userDB.LinkKeys(u)
+	if err != nil {
+		return fmt.Errorf("LinkKeys(): %v", err)
+	}
+	if len(linkKeys) == 0 {
+		return fmt.Errorf("user has no link keys")
+	}
+
+	// Add always sets the default link key, so if the default key was
+	// removed, add the user with the first key, and remove the default
+	// once the remaining keys are in place.
+	names := make([]string, 0, len(linkKeys))
+	for name := range linkKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	_, hasDefault := linkKeys[userdb.DefaultLinkKeyName]
+	initialKey := linkKeys[userdb.DefaultLinkKeyName]
+	if !hasDefault {
+		initialKey = linkKeys[names[0]]
+	}
+	if err = dst.userDB.Add(u, initialKey, false); err != nil {
+		return fmt.Errorf("Add(): %v", err)
+	}
+	for _, name := range names {
+		if name == userdb.DefaultLinkKeyName {
+			continue
+		}
+		if err = dst.userDB.AddLinkKey(u, name, linkKeys[name]); err != nil {
+			return fmt.Errorf("AddLinkKey(%v): %v", name, err)
+		}
+	}
+	if !hasDefault {
+		if err = dst.userDB.RemoveLinkKey(u, userdb.DefaultLinkKeyName); err != nil {
+			return fmt.Errorf("RemoveLinkKey(%v): %v", userdb.DefaultLinkKeyName, err)
+		}
+	}
+
+	switch idKey, err := src.userDB.Identity(u); err {
+	case nil:
+		if err = dst.userDB.SetIdentity(u, idKey); err != nil {
+			return fmt.Errorf("SetIdentity(): %v", err)
+		}
+	case userdb.ErrNoIdentity:
+	default:
+		return fmt.Errorf("Identity(): %v", err)
+	}
+
+	if info.Disabled {
+		if err = dst.userDB.SetDisabled(u, true); err != nil {
+			return fmt.Errorf("SetDisabled(): %v", err)
+		}
+	}
+	if !info.LastAuthenticated.IsZero() {
+		if err = dst.userDB.SetLastAuthenticated(u, info.LastAuthenticated); err != nil {
+			return fmt.Errorf("SetLastAuthenticated(): %v", err)
+		}
+	}
+	if info.RateLimit != nil {
+		if err = dst.userDB.SetRateLimit(u, info.RateLimit); err != nil {
+			return fmt.Errorf("SetRateLimit(): %v", err)
+		}
+	}
+
+	return migrateSpool(src, dst, u)
+}
+
+// migrateSpool copies the user u's spool from src to dst.
+func migrateSpool(src, dst *backend, u []byte) error {
+	// Refuse to interleave the user's messages with existing ones.
+	if count, _, err := dst.spool.Usage(u); err != nil {
+		return fmt.Errorf("destination Usage(): %v", err)
+	} else if count != 0 {
+		return fmt.Errorf("destination spool is not empty")
+	}
+	return src.spool.ForEach(u, func(msg, surbID []byte) error {
+		if surbID == nil {
+			return dst.spool.StoreMessage(u, msg)
+		}
+		if len(surbID) != sConstants.SURBIDLength {
+			return fmt.Errorf("invalid SURB ID length: %d", len(surbID))
+		}
+		var id [sConstants.SURBIDLength]byte
+		copy(id[:], surbID)
+		return dst.spool.StoreSURBReply(u, &id, msg)
+	})
+}
+
+// migrator migrates (or dry-runs the migration of) a provider's databases,
+// or only the spool if spoolOnly is set.
+type migrator struct {
+	src, dst *backend
+
+	out           io.Writer
+	progressEvery int
+	spoolOnly     bool
+}
+
+func (m *migrator) progress(verb string, s *stats, total int) {
+	fmt.Fprintf(m.out, "%s %d/%d users: %v\n", verb, s.nrUsers, total, s)
+}
+
+// run copies every user in the source to the destination, or when the
+// destination is nil, reads every user to report what would be migrated.
+func (m *migrator) run() (*stats, error) {
+	total, err := m.src.userDB.Count()
+	if err != nil {
+		return nil, fmt.Errorf("source Count(): %v", err)
+	}
+	verb := "Read"
+	if m.dst != nil {
+		verb = "Migrated"
+	}
+	if m.dst != nil && !m.spoolOnly {
+		n, err := m.dst.userDB.Count()
+		if err != nil {
+			return nil, fmt.Errorf("destination Count(): %v", err)
+		}
+		if n != 0 {
+			return nil, fmt.Errorf("destination UserDB is not empty (%d users)", n)
+		}
+	}
+
+	s := new(stats)
+	err = m.src.userDB.ForEach(func(u []byte, info *userdb.UserInfo) error {
+		d, err := digestUser(m.src, u, m.spoolOnly)
+		if err != nil {
+			return fmt.Errorf("user '%s': %v", u, err)
+		}
+		switch {
+		case m.dst == nil:
+		case m.spoolOnly:
+			err = migrateSpool(m.src, m.dst, u)
+		default:
+			err = migrateUser(m.src, m.dst, u, info)
+		}
+		if err != nil {
+			return fmt.Errorf("user '%s': %v", u, err)
+		}
+		s.add(d)
+		if m.progressEvery > 0 && s.nrUsers%m.progressEvery == 0 {
+			m.progress(verb, s, total)
+		}
+		return nil
+	})
+	if err != nil {
+		return s, err
+	}
+	m.progress(verb, s, total)
+
+	return s, nil
+}
+
+// verify compares the digest of every user in the source with that of the
+// destination.
+func (m *migrator) verify() (*stats, error) {
+	srcTotal, err := m.src.userDB.Count()
+	if err != nil {
+		return nil, fmt.Errorf("source Count(): %v", err)
+	}
+
+	s := new(stats)
+	if !m.spoolOnly {
+		dstTotal, err := m.dst.userDB.Count()
+		if err != nil {
+			return nil, fmt.Errorf("destination Count(): %v", err)
+		}
+		if srcTotal != dstTotal {
+			fmt.Fprintf(m.out, "MISMATCH: user count: source %d, destination %d\n", srcTotal, dstTotal)
+			s.nrFailed++
+		}
+	}
+
+	err = m.src.userDB.ForEach(func(u []byte, info *userdb.UserInfo) error {
+		srcDigest, err := digestUser(m.src, u, m.spoolOnly)
+		if err != nil {
+			return fmt.Errorf("user '%s': source: %v", u, err)
+		}
+		s.add(srcDigest)
+
+		dstDigest, err := digestUser(m.dst, u, m.spoolOnly)
+		if err != nil {
+			fmt.Fprintf(m.out, "MISMATCH: user '%s': destination: %v\n", u, err)
+			s.nrFailed++
+			return nil
+		}
+		var mismatches []string
+		if srcDigest.nrLinkKeys != dstDigest.nrLinkKeys {
+			mismatches = append(mismatches, fmt.Sprintf("link keys %d != %d", srcDigest.nrLinkKeys, dstDigest.nrLinkKeys))
+		}
+		if srcDigest.nrMessages != dstDigest.nrMessages {
+			mismatches = append(mismatches, fmt.Sprintf("messages %d != %d", srcDigest.nrMessages, dstDigest.nrMessages))
+		}
+		if !bytes.Equal(srcDigest.userHash[:], dstDigest.userHash[:]) {
+			mismatches = append(mismatches, "user hash")
+		}
+		if !bytes.Equal(srcDigest.spoolHash[:], dstDigest.spoolHash[:]) {
+			mismatches = append(mismatches, "spool hash")
+		}
+		if len(mismatches) > 0 {
+			fmt.Fprintf(m.out, "MISMATCH: user '%s': %v\n", u, mismatches)
+			s.nrFailed++
+		}
+
+		if m.progressEvery > 0 && s.nrUsers%m.progressEvery == 0 {
+			m.progress("Verified", s, srcTotal)
+		}
+		return nil
+	})
+	if err != nil {
+		return s, err
+	}
+	m.progress("Verified", s, srcTotal)
+
+	return s, nil
+}
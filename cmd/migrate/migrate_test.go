@@ -0,0 +1,168 @@
+// migrate_test.go - Katzenpost provider database migration tests.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/sphinx"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/server/spool/boltspool"
+	"github.com/katzenpost/server/spool/memspool"
+	"github.com/katzenpost/server/spool/spoolcrypt"
+	"github.com/katzenpost/server/userdb"
+	"github.com/katzenpost/server/userdb/memuserdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMemBackend() *backend {
+	return &backend{
+		userDB: memuserdb.New(),
+		spool:  memspool.New(),
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	newPublicKey := func() *ecdh.PublicKey {
+		privKey, err := ecdh.NewKeypair(rand.Reader)
+		require.NoError(err, "NewKeypair()")
+		return privKey.PublicKey()
+	}
+
+	src, dst := newMemBackend(), newMemBackend()
+	defer src.Close()
+	defer dst.Close()
+
+	// alice has multiple link keys, an identity key, metadata and a spool
+	// containing both messages and SURBReplies.
+	alice, bob := []byte("alice"), []byte("bob")
+	laptopKey := newPublicKey()
+	require.NoError(src.userDB.Add(alice, newPublicKey(), false), "Add(alice)")
+	require.NoError(src.userDB.AddLinkKey(alice, "laptop", laptopKey), "AddLinkKey(alice)")
+	require.NoError(src.userDB.SetIdentity(alice, newPublicKey()), "SetIdentity(alice)")
+	require.NoError(src.userDB.SetLastAuthenticated(alice, time.Now()), "SetLastAuthenticated(alice)")
+	require.NoError(src.userDB.SetDisabled(alice, true), "SetDisabled(alice)")
+	require.NoError(src.userDB.SetRateLimit(alice, &userdb.RateLimit{SendRatePerMinute: 30, SendBurst: 2}), "SetRateLimit(alice)")
+
+	msg := make([]byte, constants.UserForwardPayloadLength)
+	surbMsg := make([]byte, sphinx.PayloadTagLength+constants.ForwardPayloadLength)
+	var surbID [sConstants.SURBIDLength]byte
+	for _, b := range [][]byte{msg, surbMsg, surbID[:]} {
+		_, err := rand.Reader.Read(b)
+		require.NoError(err, "rand.Read()")
+	}
+	require.NoError(src.spool.StoreMessage(alice, msg), "StoreMessage(alice)")
+	require.NoError(src.spool.StoreSURBReply(alice, &surbID, surbMsg), "StoreSURBReply(alice)")
+
+	// bob's default link key was removed.
+	require.NoError(src.userDB.Add(bob, newPublicKey(), false), "Add(bob)")
+	require.NoError(src.userDB.AddLinkKey(bob, "phone", newPublicKey()), "AddLinkKey(bob)")
+	require.NoError(src.userDB.RemoveLinkKey(bob, userdb.DefaultLinkKeyName), "RemoveLinkKey(bob)")
+
+	// A dry run leaves the destination untouched.
+	m := &migrator{src: src, out: ioutil.Discard}
+	s, err := m.run()
+	require.NoError(err, "run(): dry run")
+	assert.Equal(2, s.nrUsers, "run(): dry run users")
+	assert.Equal(2, s.nrMessages, "run(): dry run messages")
+
+	m.dst = dst
+	s, err = m.run()
+	require.NoError(err, "run()")
+	assert.Equal(4, s.nrLinkKeys, "run(): link keys")
+
+	keys, err := dst.userDB.LinkKeys(bob)
+	require.NoError(err, "LinkKeys(bob)")
+	assert.Len(keys, 1, "LinkKeys(bob): default not recreated")
+	assert.Contains(keys, "phone", "LinkKeys(bob): phone")
+	info, err := dst.userDB.Info(alice)
+	require.NoError(err, "Info(alice)")
+	assert.Equal(&userdb.RateLimit{SendRatePerMinute: 30, SendBurst: 2}, info.RateLimit, "Info(alice): RateLimit")
+
+	s, err = m.verify()
+	require.NoError(err, "verify()")
+	assert.Equal(0, s.nrFailed, "verify(): mismatches")
+
+	// Destinations must be empty.
+	_, err = m.run()
+	assert.Error(err, "run(): non-empty destination")
+
+	// Divergent spools are detected.
+	require.NoError(dst.spool.StoreMessage(bob, msg), "StoreMessage(bob)")
+	s, err = m.verify()
+	require.NoError(err, "verify(): divergent")
+	assert.Equal(1, s.nrFailed, "verify(): divergent mismatches")
+}
+
+func TestMigrateSpoolOnly(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "migrate_spool_only_tests")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	privKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair()")
+
+	src := newMemBackend()
+	defer src.Close()
+	alice := []byte("alice")
+	require.NoError(src.userDB.Add(alice, privKey.PublicKey(), false), "Add(alice)")
+	msgs := make([][]byte, 3)
+	for i := range msgs {
+		msgs[i] = make([]byte, constants.UserForwardPayloadLength)
+		msgs[i][0] = byte(i)
+		require.NoError(src.spool.StoreMessage(alice, msgs[i]), "StoreMessage(alice)")
+	}
+
+	// Convert the plaintext spool to an encrypted spool, without a
+	// destination UserDB.
+	k, err := spoolcrypt.Load(filepath.Join(dir, "spool.key"), "")
+	require.NoError(err, "spoolcrypt.Load()")
+	dst := new(backend)
+	dst.spool, err = boltspool.NewEncrypted(filepath.Join(dir, "spool.db"), k)
+	require.NoError(err, "boltspool.NewEncrypted()")
+	defer dst.Close()
+
+	m := &migrator{src: src, dst: dst, out: ioutil.Discard, spoolOnly: true}
+	s, err := m.run()
+	require.NoError(err, "run()")
+	assert.Equal(3, s.nrMessages, "run(): messages")
+
+	s, err = m.verify()
+	require.NoError(err, "verify()")
+	assert.Equal(0, s.nrFailed, "verify(): mismatches")
+
+	var got [][]byte
+	require.NoError(dst.spool.ForEach(alice, func(msg, surbID []byte) error {
+		got = append(got, msg)
+		return nil
+	}), "ForEach(alice)")
+	assert.Equal(msgs, got, "ForEach(alice): destination")
+}
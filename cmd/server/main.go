@@ -31,6 +31,7 @@ import (
 func main() {
 	cfgFile := flag.String("f", "katzenpost.toml", "Path to the server config file.")
 	genOnly := flag.Bool("g", false, "Generate the keys and exit immediately.")
+	migrateOnly := flag.Bool("migrate", false, "Apply the SQL database schema migrations and exit immediately.")
 	flag.Parse()
 
 	// Set the umask to something "paranoid".
@@ -54,6 +55,13 @@ func main() {
 	if *genOnly && !cfg.Debug.GenerateOnly {
 		cfg.Debug.GenerateOnly = true
 	}
+	if *migrateOnly {
+		if err := server.MigrateDatabase(cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to migrate the SQL database: %v\n", err)
+			os.Exit(-1)
+		}
+		os.Exit(0)
+	}
 
 	// Setup the signal handling.
 	haltCh := make(chan os.Signal)
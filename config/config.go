@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/mail"
 	"net/url"
@@ -58,9 +59,31 @@ const (
 	defaultKaetzchenDelay      = 750       // 750 ms.
 	defaultUserDB              = "users.db"
 	defaultSpoolDB             = "spool.db"
+	defaultSpoolKeyFile        = "spool.key"
 	defaultManagementSocket    = "management_sock"
-
-	backendPgx = "pgx"
+	defaultMetricsAddress      = "127.0.0.1:6543"
+	defaultVacuumInterval      = 60 * 60 // 1 hour.
+	defaultCompactionThreshold = 0.5
+	defaultSpoolMaxBatchDelay  = 2 // 2 ms.
+	defaultIPv4PrefixLength    = 32
+	defaultIPv6PrefixLength    = 64
+	defaultPluginHealthCheck   = 30 // 30 sec.
+
+	// MetricsUnixPrefix is the prefix used to specify a unix domain socket
+	// path as the metrics listener address.
+	MetricsUnixPrefix = "unix:"
+
+	// AddressUnixPrefix is the prefix used to specify a unix domain socket
+	// path as a Server Address.
+	AddressUnixPrefix = "unix:"
+
+	// AddressSystemdPrefix is the prefix used to specify a socket inherited
+	// via systemd socket activation as a Server Address, by its
+	// FileDescriptorName or its index in LISTEN_FDS.
+	AddressSystemdPrefix = "systemd:"
+
+	backendPgx    = "pgx"
+	backendSQLite = "sqlite"
 
 	// BackendSQL is a SQL based backend.
 	BackendSQL = "sql"
@@ -70,6 +93,16 @@ const (
 
 	// BackendExtern is a External (RESTful http) backend.
 	BackendExtern = "extern"
+
+	// BackendMemory is a volatile in-memory backend.
+	BackendMemory = "memory"
+
+	// QuotaPolicyReject rejects new messages when a spool quota is reached.
+	QuotaPolicyReject = "reject"
+
+	// QuotaPolicyEvict evicts the oldest messages when a spool quota is
+	// reached.
+	QuotaPolicyEvict = "evict"
 )
 
 var defaultLogging = Logging{
@@ -84,7 +117,11 @@ type Server struct {
 	Identifier string
 
 	// Addresses are the IP address/port combinations that the server will bind
-	// to for incoming connections.
+	// to for incoming connections.  Absolute unix domain socket paths
+	// prefixed with `unix:`, which are not advertised in the PKI, and
+	// sockets inherited via systemd socket activation prefixed with
+	// `systemd:`, which are advertised iff bound to a specific TCP address,
+	// may also be used.
 	Addresses []string
 
 	// AltAddresses is the map of extra transports and addresses at which
@@ -116,8 +153,19 @@ func (sCfg *Server) validate() error {
 
 	if sCfg.Addresses != nil {
 		for _, v := range sCfg.Addresses {
-			if err := utils.EnsureAddrIPPort(v); err != nil {
-				return fmt.Errorf("config: Server: Address '%v' is invalid: %v", v, err)
+			switch {
+			case strings.HasPrefix(v, AddressUnixPrefix):
+				if p := strings.TrimPrefix(v, AddressUnixPrefix); !filepath.IsAbs(p) {
+					return fmt.Errorf("config: Server: Address '%v' is not an absolute path", v)
+				}
+			case strings.HasPrefix(v, AddressSystemdPrefix):
+				if strings.TrimPrefix(v, AddressSystemdPrefix) == "" {
+					return fmt.Errorf("config: Server: Address '%v' is missing the socket name", v)
+				}
+			default:
+				if err := utils.EnsureAddrIPPort(v); err != nil {
+					return fmt.Errorf("config: Server: Address '%v' is invalid: %v", v, err)
+				}
 			}
 		}
 	} else {
@@ -175,7 +223,8 @@ type Debug struct {
 	NumSphinxWorkers int
 
 	// NumProviderWorkers specifies the number of worker instances to use for
-	// provider specific packet processing.
+	// provider specific packet processing.  If left as 0, it will use the
+	// number of CPUs iff the BoltDB spool batches stores, and 1 otherwise.
 	NumProviderWorkers int
 
 	// NumKaetzchenWorkers specifies the number of worker instances to use for
@@ -238,7 +287,7 @@ type Debug struct {
 	// WARNING: This option will go away once decoy traffic is more concrete.
 	SendDecoyTraffic bool
 
-	// DisableRateLimit disables the per-client rate limiter.  This option
+	// DisableRateLimit disables the per-user client rate limiter.  This option
 	// should only be used for testing.
 	DisableRateLimit bool
 
@@ -252,7 +301,7 @@ func (dCfg *Debug) IsUnsafe() bool {
 	return dCfg.IdentityKey != nil
 }
 
-func (dCfg *Debug) applyDefaults() {
+func (dCfg *Debug) applyDefaults(pCfg *Provider) {
 	if dCfg.NumSphinxWorkers <= 0 {
 		// Pick a sane default for the number of workers.
 		//
@@ -261,10 +310,20 @@ func (dCfg *Debug) applyDefaults() {
 		dCfg.NumSphinxWorkers = runtime.NumCPU()
 	}
 	if dCfg.NumProviderWorkers <= 0 {
-		// TODO/perf: This should do something clever as well, though 1 is
-		// the right number for something that uses the boltspool due to all
-		// write spool operations being serialized.
-		dCfg.NumProviderWorkers = defaultNumProviderWorkers
+		if pCfg != nil && pCfg.SpoolDB.batchesStores() {
+			// The provider workers mostly wait on the spool, and
+			// concurrent boltspool writes are batched into a single
+			// transaction, so throughput scales with the number of
+			// workers.
+			//
+			// TODO/perf: Tune this.
+			dCfg.NumProviderWorkers = runtime.NumCPU()
+		} else {
+			// TODO/perf: This should do something clever as well, though
+			// 1 is the right number for the boltspool without batching,
+			// due to all write spool operations being serialized.
+			dCfg.NumProviderWorkers = defaultNumProviderWorkers
+		}
 	}
 	if dCfg.NumKaetzchenWorkers <= 0 {
 		dCfg.NumKaetzchenWorkers = defaultNumKaetzchenWorkers
@@ -381,18 +440,33 @@ type SQLDB struct {
 	// Backend is the active database backend (driver).
 	//
 	//  - pgx: Postgresql.
+	//  - sqlite: SQLite (embedded, pure Go).
 	Backend string
 
 	// DataSourceName is the SQL data source name or URI.  The format
 	// of this parameter is dependent on the database driver being used.
 	//
 	//  - pgx: https://godoc.org/github.com/jackc/pgx#ParseConnectionString
+	//  - sqlite: The path to the database file, relative to the DataDir
+	//    unless absolute, or a `file:` URI.  The file is created and the
+	//    schema is migrated as required when the database is opened.
 	DataSourceName string
+
+	// SpoolOnly specifies that the database will only be used for the
+	// spool, and not as the user database.  It is only used when creating
+	// the schema of a new pgx database.
+	SpoolOnly bool
+
+	// DisableAutoMigrate disables creating the schema and applying schema
+	// migrations on startup.  The server will refuse to start if the
+	// schema version does not match, until the migrations are applied with
+	// the `-migrate` flag.
+	DisableAutoMigrate bool
 }
 
 func (sCfg *SQLDB) validate() error {
 	switch sCfg.Backend {
-	case backendPgx:
+	case backendPgx, backendSQLite:
 	default:
 		return fmt.Errorf("config: SQLDB: Backend '%v' is invalid", sCfg.Backend)
 	}
@@ -405,7 +479,8 @@ func (sCfg *SQLDB) validate() error {
 // UserDB is the userdb backend configuration.
 type UserDB struct {
 	// Backend is the active userdb backend.  If left empty, the BoltUserDB
-	// backend will be used (`bolt`).
+	// backend will be used (`bolt`).  The volatile in-memory backend
+	// (`memory`) requires no further configuration.
 	Backend string
 
 	// BoltDB backed userdb (`bolt`).
@@ -413,6 +488,38 @@ type UserDB struct {
 
 	// Externally defined (RESTful http) userdb (`extern`).
 	Extern *ExternUserDB
+
+	// Cache, if set, enables caching of the active userdb backend's user
+	// lookups.
+	Cache *UserDBCache
+}
+
+// UserDBCache is the userdb lookup cache configuration.
+type UserDBCache struct {
+	// MaxEntries is the maximum number of cached lookups.  If left zero,
+	// a default of 10000 will be used.
+	MaxEntries int
+
+	// PositiveTTL is the lifetime of a cached positive lookup in seconds.
+	// If left zero, a default of 60 seconds will be used.
+	PositiveTTL int
+
+	// NegativeTTL is the lifetime of a cached negative lookup in seconds.
+	// If left zero, a default of 5 seconds will be used.
+	NegativeTTL int
+}
+
+func (cCfg *UserDBCache) validate() error {
+	if cCfg.MaxEntries < 0 {
+		return fmt.Errorf("config: Provider: UserDB Cache MaxEntries %v is invalid", cCfg.MaxEntries)
+	}
+	if cCfg.PositiveTTL < 0 {
+		return fmt.Errorf("config: Provider: UserDB Cache PositiveTTL %v is invalid", cCfg.PositiveTTL)
+	}
+	if cCfg.NegativeTTL < 0 {
+		return fmt.Errorf("config: Provider: UserDB Cache NegativeTTL %v is invalid", cCfg.NegativeTTL)
+	}
+	return nil
 }
 
 // BoltUserDB is the BoltDB implementation of userdb.
@@ -427,16 +534,124 @@ type ExternUserDB struct {
 	// ProviderURL is the base url used for the external provider authentication API.
 	// It should be in the form `http://localhost:8080/`
 	ProviderURL string
+
+	// RequestTimeout is the per-request timeout in milliseconds.  If left
+	// zero, a default of 5 seconds will be used.
+	RequestTimeout int
+
+	// BearerToken, if set, is sent as the `Authorization` header of each
+	// request.
+	BearerToken string
+
+	// TLSClientCertFile and TLSClientKeyFile, if set, are the PEM encoded
+	// certificate and private key used for TLS client authentication.
+	TLSClientCertFile string
+	TLSClientKeyFile  string
+
+	// TLSCACertFile, if set, is the PEM encoded CA certificate used to
+	// verify the external provider, instead of the system roots.
+	TLSCACertFile string
+
+	// LegacyProtocol, if set, uses the original form encoded protocol
+	// (`/isvalid`, `/exists` and `/getidkey`) instead of the versioned one.
+	// Users can not be listed or modified via the legacy protocol.
+	LegacyProtocol bool
 }
 
 // SpoolDB is the user message spool configuration.
 type SpoolDB struct {
 	// Backend is the active spool backend.  If left empty, the BoltSpoolDB
-	// backend will be used (`bolt`).
+	// backend will be used (`bolt`).  The volatile in-memory backend
+	// (`memory`) requires no further configuration.
 	Backend string
 
 	// BoltDB backed spool (`bolt`).
 	Bolt *BoltSpoolDB
+
+	// MaxMessages is the maximum number of messages that can be held in
+	// each user's spool.  A value <= 0 is treated as unlimited.
+	MaxMessages int
+
+	// MaxBytes is the maximum total size of the messages that can be held
+	// in each user's spool in bytes.  A value <= 0 is treated as unlimited.
+	MaxBytes int
+
+	// MaxMessageAge is the maximum age of a spooled message in seconds,
+	// after which it will be discarded.  A value <= 0 is treated as
+	// unlimited.
+	MaxMessageAge int
+
+	// QuotaPolicy is the action taken when storing a message would exceed
+	// MaxMessages or MaxBytes, either `reject` the new message (default),
+	// or `evict` the oldest message(s).
+	QuotaPolicy string
+
+	// VacuumInterval is the interval between background spool maintenance
+	// runs in seconds, each of which purges the spools of removed users and
+	// expired messages, and compacts the spool if supported.  If left as
+	// 0, it will use 1 hour.  A negative value disables periodic
+	// maintenance, leaving only the run at startup.
+	VacuumInterval int
+
+	// CompactionThreshold is the fraction of the BoltDB spool file that
+	// must be unused before the maintenance run compacts it by copying the
+	// live data to a fresh file.  If left as 0, it will use 0.5.  A value
+	// of 1 disables automatic compaction.
+	CompactionThreshold float64
+
+	// Encryption is the optional at-rest encryption of the spool contents,
+	// supported by the `bolt` and `sql` backends.
+	Encryption *SpoolEncryption
+}
+
+// SpoolEncryption is the spool at-rest encryption configuration.  Existing
+// spools are not converted in place, use the migration tool to copy a
+// plaintext spool to a new encrypted spool.
+type SpoolEncryption struct {
+	// KeyFile is the path to the spool storage key, which is generated if
+	// it does not exist.  If left empty, it will use `spool.key` under the
+	// DataDir.
+	KeyFile string
+
+	// Passphrase, if set, is used to derive the storage key, in which case
+	// KeyFile holds the random salt instead of the key itself.
+	Passphrase string
+}
+
+// batchesStores returns true iff the spool is a BoltDB spool that batches
+// the concurrent stores of the provider workers, which it does whenever it
+// has a positive MaxBatchDelay.
+func (sCfg *SpoolDB) batchesStores() bool {
+	return sCfg.Backend == BackendBolt && sCfg.Bolt != nil && sCfg.Bolt.MaxBatchDelay > 0
+}
+
+func (sCfg *SpoolDB) applyDefaults() {
+	if sCfg.VacuumInterval == 0 {
+		sCfg.VacuumInterval = defaultVacuumInterval
+	}
+	if sCfg.CompactionThreshold == 0 {
+		sCfg.CompactionThreshold = defaultCompactionThreshold
+	}
+}
+
+func (sCfg *SpoolDB) validate() error {
+	switch sCfg.QuotaPolicy {
+	case QuotaPolicyReject, QuotaPolicyEvict:
+	default:
+		return fmt.Errorf("config: Provider: SpoolDB: QuotaPolicy '%v' is invalid", sCfg.QuotaPolicy)
+	}
+	if sCfg.CompactionThreshold <= 0 || sCfg.CompactionThreshold > 1 {
+		return fmt.Errorf("config: Provider: SpoolDB: CompactionThreshold '%v' is not in (0, 1]", sCfg.CompactionThreshold)
+	}
+	if eCfg := sCfg.Encryption; eCfg != nil {
+		if sCfg.Backend == BackendMemory {
+			return fmt.Errorf("config: Provider: SpoolDB: Encryption is not supported by the '%v' backend", sCfg.Backend)
+		}
+		if !filepath.IsAbs(eCfg.KeyFile) {
+			return fmt.Errorf("config: Provider: SpoolDB: Encryption: KeyFile '%v' is not an absolute path", eCfg.KeyFile)
+		}
+	}
+	return nil
 }
 
 // BoltSpoolDB is the BolTDB implementation of the spool.
@@ -444,6 +659,13 @@ type BoltSpoolDB struct {
 	// SpoolDB is the path to the user message spool.  If left empty, it will
 	// use `spool.db` under the DataDir.
 	SpoolDB string
+
+	// MaxBatchDelay is the maximum time in milliseconds that a message
+	// store will wait for the stores made by the other provider workers to
+	// join it in a single transaction.  A batch is committed early once it
+	// has a store from every worker.  If left as 0, it will use 2 ms.  A
+	// negative value disables batching.
+	MaxBatchDelay int
 }
 
 // Kaetzchen is a Provider auto-responder agent.
@@ -496,22 +718,85 @@ type CBORPluginKaetzchen struct {
 	// address.
 	Endpoint string
 
-	// Config is the extra per agent arguments to be passed to the agent's
-	// initialization routine.
+	// Config is the extra per agent configuration, which is CBOR encoded
+	// and written to the plugin's stdin on launch, preserving the types of
+	// the values (eg: integers, booleans, arrays and tables).
 	Config map[string]interface{}
 
+	// LegacyConfigArgs passes Config to the plugin as `-key value` command
+	// line arguments instead, for plugins that predate Config being
+	// written to stdin.  All of the values must be strings.
+	LegacyConfigArgs bool
+
 	// Command is the full file path to the external plugin program
 	// that implements this Kaetzchen service.
 	Command string
 
+	// Env is the extra environment variables set for the plugin.
+	Env map[string]string
+
+	// WorkingDirectory is the plugin's working directory.  If left empty
+	// the plugin inherits the server's working directory.
+	WorkingDirectory string
+
+	// Sandbox is the optional process hardening applied to the plugin.
+	Sandbox *CBORPluginSandbox
+
 	// MaxConcurrency is the number of worker goroutines to start
-	// for this service.
+	// for this service.  Each worker has its own plugin process, unless
+	// the plugin supports protocol v2, in which case the workers share a
+	// single process.
 	MaxConcurrency int
 
+	// HealthCheckInterval is the interval between health checks of each
+	// plugin process in seconds, after 3 consecutive failures of which the
+	// process is restarted.  If left unset it will use 30 seconds, and a
+	// negative value disables the health checks.  Processes that exit are
+	// always restarted.
+	HealthCheckInterval int
+
 	// Disable disabled a configured agent.
 	Disable bool
 }
 
+// CBORPluginSandbox is the process hardening applied to a CBOR plugin.
+type CBORPluginSandbox struct {
+	// User is the name or uid of the user that the plugin runs as, which
+	// requires the server to be running as root.
+	User string
+
+	// Group is the name or gid of the group that the plugin runs as.  If
+	// left empty the User's primary group will be used.
+	Group string
+
+	// ClearEnv starts the plugin with only its Env variables, instead of
+	// also inheriting the server's environment.
+	ClearEnv bool
+
+	// PrivateWorkingDirectory runs the plugin in a new private temporary
+	// directory owned by User, that is removed on shutdown.
+	PrivateWorkingDirectory bool
+
+	// NoNewPrivileges prevents the plugin from gaining privileges (eg: via
+	// setuid executables).  Linux only.
+	NoNewPrivileges bool
+
+	// MaxCPUTime is the plugin's CPU time limit in seconds.
+	MaxCPUTime uint64
+
+	// MaxAddressSpace is the plugin's address space limit in bytes.
+	MaxAddressSpace uint64
+
+	// MaxOpenFiles is the plugin's open file descriptor limit.
+	MaxOpenFiles uint64
+}
+
+func (kCfg *CBORPluginKaetzchen) applyDefaults() {
+	if kCfg.HealthCheckInterval == 0 {
+		kCfg.HealthCheckInterval = defaultPluginHealthCheck
+	}
+}
+
 func (kCfg *CBORPluginKaetzchen) validate() error {
 	if kCfg.Capability == "" {
 		return fmt.Errorf("config: Kaetzchen: Capability is invalid")
@@ -531,6 +816,29 @@ func (kCfg *CBORPluginKaetzchen) validate() error {
 	if _, err = mail.ParseAddress(kCfg.Endpoint + "@test.invalid"); err != nil {
 		return fmt.Errorf("config: Kaetzchen: '%v' has non local-part endpoint '%v': %v", kCfg.Capability, kCfg.Endpoint, err)
 	}
+	if kCfg.LegacyConfigArgs {
+		for k, v := range kCfg.Config {
+			if _, ok := v.(string); !ok {
+				return fmt.Errorf("config: Kaetzchen: '%v' Config '%v' must be a string with LegacyConfigArgs", kCfg.Capability, k)
+			}
+		}
+	}
+	for k := range kCfg.Env {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			return fmt.Errorf("config: Kaetzchen: '%v' has invalid Env variable '%v'", kCfg.Capability, k)
+		}
+	}
+	if kCfg.WorkingDirectory != "" && !filepath.IsAbs(kCfg.WorkingDirectory) {
+		return fmt.Errorf("config: Kaetzchen: '%v' WorkingDirectory '%v' is not an absolute path", kCfg.Capability, kCfg.WorkingDirectory)
+	}
+	if sb := kCfg.Sandbox; sb != nil {
+		if sb.Group != "" && sb.User == "" {
+			return fmt.Errorf("config: Kaetzchen: '%v' Sandbox Group requires a User", kCfg.Capability)
+		}
+		if sb.PrivateWorkingDirectory && kCfg.WorkingDirectory != "" {
+			return fmt.Errorf("config: Kaetzchen: '%v' Sandbox PrivateWorkingDirectory and WorkingDirectory are mutually exclusive", kCfg.Capability)
+		}
+	}
 
 	return nil
 }
@@ -559,6 +867,10 @@ func (pCfg *Provider) applyDefaults(sCfg *Server) {
 	if pCfg.SpoolDB.Backend == "" {
 		pCfg.SpoolDB.Backend = BackendBolt
 	}
+	if pCfg.SpoolDB.QuotaPolicy == "" {
+		pCfg.SpoolDB.QuotaPolicy = QuotaPolicyReject
+	}
+	pCfg.SpoolDB.applyDefaults()
 	switch pCfg.SpoolDB.Backend {
 	case BackendBolt:
 		if pCfg.SpoolDB.Bolt == nil {
@@ -567,8 +879,17 @@ func (pCfg *Provider) applyDefaults(sCfg *Server) {
 		if pCfg.SpoolDB.Bolt.SpoolDB == "" {
 			pCfg.SpoolDB.Bolt.SpoolDB = filepath.Join(sCfg.DataDir, defaultSpoolDB)
 		}
+		if pCfg.SpoolDB.Bolt.MaxBatchDelay == 0 {
+			pCfg.SpoolDB.Bolt.MaxBatchDelay = defaultSpoolMaxBatchDelay
+		}
 	default:
 	}
+	if eCfg := pCfg.SpoolDB.Encryption; eCfg != nil && eCfg.KeyFile == "" {
+		eCfg.KeyFile = filepath.Join(sCfg.DataDir, defaultSpoolKeyFile)
+	}
+	for _, v := range pCfg.CBORPluginKaetzchen {
+		v.applyDefaults()
+	}
 }
 
 func (pCfg *Provider) validate() error {
@@ -616,13 +937,28 @@ func (pCfg *Provider) validate() error {
 		default:
 			return fmt.Errorf("config: Provider: ProviderURL should be of http schema")
 		}
+		if pCfg.UserDB.Extern.RequestTimeout < 0 {
+			return fmt.Errorf("config: Provider: Extern RequestTimeout %v is invalid", pCfg.UserDB.Extern.RequestTimeout)
+		}
+		if (pCfg.UserDB.Extern.TLSClientCertFile == "") != (pCfg.UserDB.Extern.TLSClientKeyFile == "") {
+			return fmt.Errorf("config: Provider: Extern TLSClientCertFile and TLSClientKeyFile must be set together")
+		}
+		if pCfg.UserDB.Extern.TLSClientCertFile != "" && providerURL.Scheme != "https" {
+			return fmt.Errorf("config: Provider: Extern TLS client certificates require a https ProviderURL")
+		}
 	case BackendSQL:
 		if pCfg.SQLDB == nil {
 			return fmt.Errorf("config: Provider: UserDB configured for an SQL backend without a SQLDB block")
 		}
+	case BackendMemory:
 	default:
 		return fmt.Errorf("config: Provider: Invalid UserDB Backend: '%v'", pCfg.UserDB.Backend)
 	}
+	if pCfg.UserDB.Cache != nil {
+		if err := pCfg.UserDB.Cache.validate(); err != nil {
+			return err
+		}
+	}
 
 	switch pCfg.SpoolDB.Backend {
 	case BackendBolt:
@@ -633,9 +969,13 @@ func (pCfg *Provider) validate() error {
 		if pCfg.SQLDB == nil {
 			return fmt.Errorf("config: Provider: SpoolDB configured for an SQL backend without a SQLDB block")
 		}
+	case BackendMemory:
 	default:
 		return fmt.Errorf("config: Provider: Invalid SpoolDB Backend: '%v'", pCfg.SpoolDB.Backend)
 	}
+	if err := pCfg.SpoolDB.validate(); err != nil {
+		return err
+	}
 
 	capaMap := make(map[string]bool)
 	for _, v := range pCfg.Kaetzchen {
@@ -799,6 +1139,163 @@ func (mCfg *Management) validate() error {
 	return nil
 }
 
+// Metrics is the Katzenpost metrics and health check HTTP listener
+// configuration.
+type Metrics struct {
+	// Enable enables the metrics listener.  If the Metrics section is
+	// absent, the listener is enabled on the default Address.
+	Enable bool
+
+	// Address is the TCP/IP address/port combination that the listener
+	// will bind to, or an absolute unix domain socket path prefixed with
+	// `unix:`.  If left empty it will use `127.0.0.1:6543`.
+	Address string
+
+	// BasicAuthUser and BasicAuthPassword, if set, require HTTP basic
+	// authentication for all requests.
+	BasicAuthUser     string
+	BasicAuthPassword string
+
+	// BearerToken, if set, requires a matching `Authorization: Bearer`
+	// header for all requests.
+	BearerToken string
+
+	// TLSCertFile and TLSKeyFile, if set, are the paths to the PEM encoded
+	// certificate and private key used to serve HTTPS.
+	TLSCertFile string
+	TLSKeyFile  string
+}
+
+func (mCfg *Metrics) applyDefaults() {
+	if mCfg.Address == "" {
+		mCfg.Address = defaultMetricsAddress
+	}
+}
+
+func (mCfg *Metrics) validate() error {
+	if !mCfg.Enable {
+		return nil
+	}
+	if strings.HasPrefix(mCfg.Address, MetricsUnixPrefix) {
+		if p := strings.TrimPrefix(mCfg.Address, MetricsUnixPrefix); !filepath.IsAbs(p) {
+			return fmt.Errorf("config: Metrics: Address '%v' is not an absolute path", p)
+		}
+	} else if _, _, err := net.SplitHostPort(mCfg.Address); err != nil {
+		return fmt.Errorf("config: Metrics: Address '%v' is invalid: %v", mCfg.Address, err)
+	}
+	if (mCfg.BasicAuthUser == "") != (mCfg.BasicAuthPassword == "") {
+		return errors.New("config: Metrics: BasicAuthUser and BasicAuthPassword must be set together")
+	}
+	if mCfg.BasicAuthUser != "" && mCfg.BearerToken != "" {
+		return errors.New("config: Metrics: BasicAuth and BearerToken are mutually exclusive")
+	}
+	if (mCfg.TLSCertFile == "") != (mCfg.TLSKeyFile == "") {
+		return errors.New("config: Metrics: TLSCertFile and TLSKeyFile must be set together")
+	}
+	return nil
+}
+
+// Listener is the Katzenpost incoming connection listener configuration.
+// The limits are shared by all of the listeners, and do not apply to
+// connections from source addresses that have recently authenticated as
+// mixes listed in the PKI.
+type Listener struct {
+	// MaxConnections is the maximum number of concurrent incoming
+	// connections.  A value of 0 disables the limit.
+	MaxConnections int
+
+	// MaxConnectionsPerIP is the maximum number of concurrent incoming
+	// connections from a single source address prefix.  A value of 0
+	// disables the limit.
+	MaxConnectionsPerIP int
+
+	// IPv4PrefixLength and IPv6PrefixLength are the lengths of the prefixes
+	// that source addresses are grouped by for the per-IP limits.  If left
+	// unset they default to 32 and 64 respectively.
+	IPv4PrefixLength int
+	IPv6PrefixLength int
+
+	// HandshakeRate is the number of handshakes per second that may be
+	// started from a single source address prefix.  A value of 0 disables
+	// the limit.
+	HandshakeRate float64
+
+	// HandshakeBurst is the maximum number of handshakes that may be
+	// started from a single source address prefix in a burst.  If left
+	// unset it defaults to the HandshakeRate, rounded up.
+	HandshakeBurst int
+
+	// ProxyProtocolAddresses are the Server Addresses of the listeners that
+	// expect each connection to start with a HAProxy PROXY protocol (v1 or
+	// v2) header, carrying the source address used for logging and the
+	// limits.
+	ProxyProtocolAddresses []string
+
+	// TrustedProxies are the CIDR blocks of the upstream proxies that are
+	// allowed to send PROXY protocol headers.  Connections from any other
+	// address to the ProxyProtocolAddresses are rejected, except on unix
+	// domain sockets, where all peers are trusted.
+	TrustedProxies []string
+}
+
+func (lCfg *Listener) applyDefaults() {
+	if lCfg.IPv4PrefixLength == 0 {
+		lCfg.IPv4PrefixLength = defaultIPv4PrefixLength
+	}
+	if lCfg.IPv6PrefixLength == 0 {
+		lCfg.IPv6PrefixLength = defaultIPv6PrefixLength
+	}
+	if lCfg.HandshakeBurst == 0 {
+		lCfg.HandshakeBurst = int(math.Ceil(lCfg.HandshakeRate))
+	}
+}
+
+func (lCfg *Listener) validate(sCfg *Server) error {
+	if lCfg.MaxConnections < 0 {
+		return fmt.Errorf("config: Listener: MaxConnections %v is invalid", lCfg.MaxConnections)
+	}
+	if lCfg.MaxConnectionsPerIP < 0 {
+		return fmt.Errorf("config: Listener: MaxConnectionsPerIP %v is invalid", lCfg.MaxConnectionsPerIP)
+	}
+	if lCfg.IPv4PrefixLength < 1 || lCfg.IPv4PrefixLength > 32 {
+		return fmt.Errorf("config: Listener: IPv4PrefixLength %v is invalid", lCfg.IPv4PrefixLength)
+	}
+	if lCfg.IPv6PrefixLength < 1 || lCfg.IPv6PrefixLength > 128 {
+		return fmt.Errorf("config: Listener: IPv6PrefixLength %v is invalid", lCfg.IPv6PrefixLength)
+	}
+	if lCfg.HandshakeRate < 0 || math.IsNaN(lCfg.HandshakeRate) || math.IsInf(lCfg.HandshakeRate, 0) {
+		return fmt.Errorf("config: Listener: HandshakeRate %v is invalid", lCfg.HandshakeRate)
+	}
+	if lCfg.HandshakeRate > 0 && lCfg.HandshakeBurst < 1 {
+		return fmt.Errorf("config: Listener: HandshakeBurst %v is invalid", lCfg.HandshakeBurst)
+	}
+	for _, v := range lCfg.ProxyProtocolAddresses {
+		found := false
+		for _, addr := range sCfg.Addresses {
+			if v == addr {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("config: Listener: ProxyProtocolAddress '%v' is not a Server Address", v)
+		}
+	}
+	for _, v := range lCfg.ProxyProtocolAddresses {
+		// Access to unix domain sockets is controlled by the file system,
+		// so all peers are trusted.
+		if !strings.HasPrefix(v, AddressUnixPrefix) && len(lCfg.TrustedProxies) == 0 {
+			return errors.New("config: Listener: ProxyProtocolAddresses set without TrustedProxies")
+		}
+	}
+	for _, v := range lCfg.TrustedProxies {
+		if _, _, err := net.ParseCIDR(v); err != nil {
+			return fmt.Errorf("config: Listener: TrustedProxy '%v' is invalid: %v", v, err)
+		}
+	}
+	return nil
+}
+
 // Config is the top level Katzenpost server configuration.
 type Config struct {
 	Server     *Server
@@ -806,6 +1303,8 @@ type Config struct {
 	Provider   *Provider
 	PKI        *PKI
 	Management *Management
+	Metrics    *Metrics
+	Listener   *Listener
 
 	Debug *Debug
 }
@@ -830,6 +1329,14 @@ func (cfg *Config) FixupAndValidate() error {
 	if cfg.Management == nil {
 		cfg.Management = &Management{}
 	}
+	if cfg.Metrics == nil {
+		// Keep serving metrics to existing deployments, which predate the
+		// Metrics section.
+		cfg.Metrics = &Metrics{Enable: true}
+	}
+	if cfg.Listener == nil {
+		cfg.Listener = &Listener{}
+	}
 
 	// Perform basic validation.
 	cfg.Server.applyDefaults()
@@ -857,7 +1364,15 @@ func (cfg *Config) FixupAndValidate() error {
 	if err := cfg.Management.validate(); err != nil {
 		return err
 	}
-	cfg.Debug.applyDefaults()
+	cfg.Metrics.applyDefaults()
+	if err := cfg.Metrics.validate(); err != nil {
+		return err
+	}
+	cfg.Listener.applyDefaults()
+	if err := cfg.Listener.validate(cfg.Server); err != nil {
+		return err
+	}
+	cfg.Debug.applyDefaults(cfg.Provider)
 
 	var err error
 	cfg.Server.Identifier, err = idna.Lookup.ToASCII(cfg.Server.Identifier)
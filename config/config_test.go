@@ -18,6 +18,7 @@ package config
 
 import (
 	"encoding/json"
+	"runtime"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -58,6 +59,8 @@ PublicKey = "kAiVchOBwHVtKJVFJLsdCQ9UyN2SlfhLHYqT8ePBetg="
 
 	cfg, err := Load([]byte(basicConfig))
 	require.NoError(err, "Load() with basic config")
+	require.True(cfg.Metrics.Enable, "Load() with no Metrics section: Enable")
+	require.Equal(defaultMetricsAddress, cfg.Metrics.Address, "Load() with no Metrics section: Address")
 
 	jCfg, _ := json.Marshal(cfg)
 	t.Logf("cfg: %v", string(jCfg))
@@ -122,3 +125,196 @@ PublicKey = "kAiVchOBwHVtKJVFJLsdCQ9UyN2SlfhLHYqT8ePBetg="
 	require.EqualError(err, "config: Server: Identifier is not set")
 
 }
+
+func TestServerAddresses(t *testing.T) {
+	require := require.New(t)
+
+	sCfg := &Server{
+		Identifier: "katzenpost.example.com",
+		DataDir:    "/var/lib/katzenpost",
+		Addresses: []string{
+			"192.0.2.1:29483",
+			AddressUnixPrefix + "/run/katzenpost/mix.sock",
+			AddressSystemdPrefix + "mix",
+		},
+	}
+	sCfg.applyDefaults()
+	require.NoError(sCfg.validate(), "validate() with unix and systemd Addresses")
+
+	sCfg.Addresses = []string{AddressUnixPrefix + "mix.sock"}
+	require.Error(sCfg.validate(), "validate() with relative unix path")
+
+	sCfg.Addresses = []string{AddressSystemdPrefix}
+	require.Error(sCfg.validate(), "validate() with no systemd socket name")
+}
+
+func TestMetricsConfig(t *testing.T) {
+	require := require.New(t)
+
+	m := &Metrics{Enable: true}
+	m.applyDefaults()
+	require.Equal(defaultMetricsAddress, m.Address, "default Address")
+	require.NoError(m.validate(), "validate() with defaults")
+
+	m = &Metrics{Enable: true, Address: MetricsUnixPrefix + "metrics.sock"}
+	require.Error(m.validate(), "validate() with relative unix path")
+
+	m = &Metrics{Enable: true, Address: MetricsUnixPrefix + "/run/katzenpost/metrics.sock"}
+	require.NoError(m.validate(), "validate() with absolute unix path")
+
+	m = &Metrics{Enable: true, Address: defaultMetricsAddress, BasicAuthUser: "prometheus"}
+	require.Error(m.validate(), "validate() with BasicAuthUser only")
+
+	m = &Metrics{Enable: true, Address: defaultMetricsAddress, BasicAuthUser: "prometheus", BasicAuthPassword: "hunter2", BearerToken: "token"}
+	require.Error(m.validate(), "validate() with both basic and bearer auth")
+
+	m = &Metrics{Enable: true, Address: defaultMetricsAddress, TLSCertFile: "/etc/metrics.crt"}
+	require.Error(m.validate(), "validate() with TLSCertFile only")
+}
+
+func TestNumProviderWorkersDefault(t *testing.T) {
+	require := require.New(t)
+
+	sCfg := &Server{DataDir: "/var/lib/katzenpost"}
+	newProvider := func(sdb *SpoolDB) *Provider {
+		pCfg := &Provider{SpoolDB: sdb}
+		pCfg.applyDefaults(sCfg)
+		return pCfg
+	}
+
+	d := &Debug{}
+	d.applyDefaults(newProvider(&SpoolDB{}))
+	require.Equal(runtime.NumCPU(), d.NumProviderWorkers, "bolt spool with batching")
+
+	d = &Debug{}
+	d.applyDefaults(newProvider(&SpoolDB{Bolt: &BoltSpoolDB{MaxBatchDelay: -1}}))
+	require.Equal(defaultNumProviderWorkers, d.NumProviderWorkers, "bolt spool without batching")
+
+	d = &Debug{}
+	d.applyDefaults(newProvider(&SpoolDB{Backend: BackendMemory}))
+	require.Equal(defaultNumProviderWorkers, d.NumProviderWorkers, "memory spool")
+
+	d = &Debug{NumProviderWorkers: 4}
+	d.applyDefaults(newProvider(&SpoolDB{Backend: BackendMemory}))
+	require.Equal(4, d.NumProviderWorkers, "explicit NumProviderWorkers")
+
+	d = &Debug{}
+	d.applyDefaults(nil)
+	require.Equal(defaultNumProviderWorkers, d.NumProviderWorkers, "not a Provider")
+}
+
+func TestListenerConfig(t *testing.T) {
+	require := require.New(t)
+
+	sCfg := &Server{Addresses: []string{"192.0.2.1:29483", "192.0.2.1:29484"}}
+
+	l := &Listener{}
+	l.applyDefaults()
+	require.Equal(defaultIPv4PrefixLength, l.IPv4PrefixLength, "default IPv4PrefixLength")
+	require.Equal(defaultIPv6PrefixLength, l.IPv6PrefixLength, "default IPv6PrefixLength")
+	require.NoError(l.validate(sCfg), "validate() with defaults")
+
+	l = &Listener{HandshakeRate: 2.5}
+	l.applyDefaults()
+	require.Equal(3, l.HandshakeBurst, "default HandshakeBurst")
+	require.NoError(l.validate(sCfg), "validate() with HandshakeRate")
+
+	l = &Listener{IPv6PrefixLength: 129}
+	l.applyDefaults()
+	require.Error(l.validate(sCfg), "validate() with invalid IPv6PrefixLength")
+
+	l = &Listener{MaxConnectionsPerIP: -1}
+	l.applyDefaults()
+	require.Error(l.validate(sCfg), "validate() with negative MaxConnectionsPerIP")
+
+	l = &Listener{HandshakeRate: 1, HandshakeBurst: -1}
+	l.applyDefaults()
+	require.Error(l.validate(sCfg), "validate() with invalid HandshakeBurst")
+
+	l = &Listener{ProxyProtocolAddresses: []string{"192.0.2.1:29484"}}
+	l.applyDefaults()
+	require.Error(l.validate(sCfg), "validate() with no TrustedProxies")
+
+	l = &Listener{ProxyProtocolAddresses: []string{"192.0.2.1:29485"}, TrustedProxies: []string{"10.0.0.0/8"}}
+	l.applyDefaults()
+	require.Error(l.validate(sCfg), "validate() with unknown ProxyProtocolAddress")
+
+	l = &Listener{ProxyProtocolAddresses: []string{"192.0.2.1:29484"}, TrustedProxies: []string{"10.0.0.1"}}
+	l.applyDefaults()
+	require.Error(l.validate(sCfg), "validate() with invalid TrustedProxy")
+
+	l = &Listener{ProxyProtocolAddresses: []string{"192.0.2.1:29484"}, TrustedProxies: []string{"10.0.0.0/8", "2001:db8::/32"}}
+	l.applyDefaults()
+	require.NoError(l.validate(sCfg), "validate() with PROXY protocol")
+
+	sCfg.Addresses = append(sCfg.Addresses, AddressUnixPrefix+"/run/katzenpost/mix.sock")
+	l = &Listener{ProxyProtocolAddresses: []string{AddressUnixPrefix + "/run/katzenpost/mix.sock"}}
+	l.applyDefaults()
+	require.NoError(l.validate(sCfg), "validate() with PROXY protocol on a unix socket")
+}
+
+func TestCBORPluginKaetzchenConfig(t *testing.T) {
+	require := require.New(t)
+
+	newCfg := func() *CBORPluginKaetzchen {
+		return &CBORPluginKaetzchen{
+			Capability: "echo",
+			Endpoint:   "+echo",
+			Command:    "/usr/lib/katzenpost/echo",
+			Config: map[string]interface{}{
+				"name":  "echo",
+				"limit": int64(10),
+				"peers": []interface{}{"alice", "bob"},
+			},
+		}
+	}
+
+	k := newCfg()
+	require.NoError(k.validate(), "validate() with typed Config")
+
+	k = newCfg()
+	k.LegacyConfigArgs = true
+	require.Error(k.validate(), "validate() with typed Config and LegacyConfigArgs")
+	k.Config = map[string]interface{}{"name": "echo"}
+	require.NoError(k.validate(), "validate() with LegacyConfigArgs")
+
+	k = newCfg()
+	k.Env = map[string]string{"ECHO_TOKEN": "secret"}
+	k.WorkingDirectory = "/var/lib/katzenpost/echo"
+	require.NoError(k.validate(), "validate() with Env and WorkingDirectory")
+	k.Env["ECHO=TOKEN"] = "secret"
+	require.Error(k.validate(), "validate() with invalid Env")
+
+	k = newCfg()
+	k.WorkingDirectory = "echo"
+	require.Error(k.validate(), "validate() with relative WorkingDirectory")
+}
+
+func TestCBORPluginSandboxConfig(t *testing.T) {
+	require := require.New(t)
+
+	k := &CBORPluginKaetzchen{
+		Capability: "echo",
+		Endpoint:   "+echo",
+		Command:    "/usr/lib/katzenpost/echo",
+		Sandbox: &CBORPluginSandbox{
+			User:            "katzenpost-echo",
+			ClearEnv:        true,
+			NoNewPrivileges: true,
+			MaxCPUTime:      60,
+			MaxAddressSpace: 1 << 30,
+			MaxOpenFiles:    64,
+		},
+	}
+	require.NoError(k.validate(), "validate() with Sandbox")
+
+	k.Sandbox.PrivateWorkingDirectory = true
+	require.NoError(k.validate(), "validate() with PrivateWorkingDirectory")
+	k.WorkingDirectory = "/var/lib/katzenpost/echo"
+	require.Error(k.validate(), "validate() with PrivateWorkingDirectory and WorkingDirectory")
+
+	k.WorkingDirectory = ""
+	k.Sandbox.User = ""
+	k.Sandbox.Group = "katzenpost-echo"
+	require.Error(k.validate(), "validate() with Group and no User")
+}
@@ -19,6 +19,9 @@
 package glue
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/crypto/eddsa"
 	"github.com/katzenpost/core/log"
@@ -30,7 +33,9 @@ import (
 	"github.com/katzenpost/server/internal/mixkey"
 	"github.com/katzenpost/server/internal/packet"
 	"github.com/katzenpost/server/internal/pkicache"
+	"github.com/katzenpost/server/internal/ratelimit"
 	"github.com/katzenpost/server/spool"
+	"github.com/katzenpost/server/spool/notifyspool"
 	"github.com/katzenpost/server/userdb"
 )
 
@@ -67,22 +72,30 @@ type PKI interface {
 	OutgoingDestinations() map[[constants.NodeIDLength]byte]*pki.MixDescriptor
 	AuthenticateConnection(*wire.PeerCredentials, bool) (*pki.MixDescriptor, bool, bool)
 	GetRawConsensus(uint64) ([]byte, error)
+	DocumentEpochs() []uint64
+	LastPublish() (uint64, time.Time, error)
 }
 
 type Provider interface {
 	Halt()
 	UserDB() userdb.UserDB
 	Spool() spool.Spool
+	SubscribeSpool([]byte) *notifyspool.Subscription
+	RateLimiter() *ratelimit.Limiter
 	AuthenticateClient(*wire.PeerCredentials) bool
 	OnPacket(*packet.Packet)
 	KaetzchenForPKI() (map[string]map[string]interface{}, error)
 	AdvertiseRegistrationHTTPAddresses() []string
+	Ping() error
+	QueueStats() map[string]int
+	PluginStatus() []PluginInfo
 }
 
 type Scheduler interface {
 	Halt()
 	OnNewMixMaxDelay(uint64)
 	OnPacket(*packet.Packet)
+	QueueLen() int
 }
 
 type Connector interface {
@@ -90,6 +103,7 @@ type Connector interface {
 	DispatchPacket(*packet.Packet)
 	IsValidForwardDest(*[constants.NodeIDLength]byte) bool
 	ForceUpdate()
+	Connections() []ConnInfo
 }
 
 type Listener interface {
@@ -97,6 +111,8 @@ type Listener interface {
 	CloseOldConns(interface{}) error
 	OnNewSendRatePerMinute(uint64)
 	OnNewSendBurst(uint64)
+	IsListening() bool
+	Connections() []ConnInfo
 }
 
 type Decoy interface {
@@ -104,3 +120,29 @@ type Decoy interface {
 	OnNewDocument(*pkicache.Entry)
 	OnPacket(*packet.Packet)
 }
+
+// PluginInfo describes the state of a plugin process.
+type PluginInfo struct {
+	Capability string
+	Instance   int
+	IsUp       bool
+	Restarts   uint64
+	Since      time.Time
+}
+
+// String returns the PLUGIN_STATUS management command line for the plugin.
+func (i PluginInfo) String() string {
+	state := "down"
+	if i.IsUp {
+		state = "up"
+	}
+	return fmt.Sprintf("%v %v %v Restarts: %v Since: %v", i.Capability, i.Instance, state, i.Restarts, i.Since.UTC().Format(time.RFC3339))
+}
+
+// ConnInfo describes an established peer connection.
+type ConnInfo struct {
+	Peer     string
+	Addr     string
+	IsClient bool
+	Since    time.Time
+}
@@ -35,6 +35,7 @@ import (
 	internalConstants "github.com/katzenpost/server/internal/constants"
 	"github.com/katzenpost/server/internal/debug"
 	"github.com/katzenpost/server/internal/packet"
+	"github.com/katzenpost/server/spool/notifyspool"
 	"github.com/prometheus/client_golang/prometheus"
 	"gopkg.in/op/go-logging.v1"
 )
@@ -51,21 +52,34 @@ type incomingConn struct {
 
 	id      uint64
 	retrSeq uint32
+	retrID  uint64 // Spool ID of the message last retrieved, if any.
 
-	sendTokens    uint64
-	maxSendTokens uint64
+	// slot is the connection's share of the connection limits.
+	slot *connSlot
 
-	sendTokenIncr time.Duration
-	sendTokenLast time.Duration
-
-	isInitialized bool // Set by listener.
+	isInitialized bool      // Set by listener.
+	initializedAt time.Time // Set by listener.
+	wasClient     bool      // Set by listener.
 	fromClient    bool
 	fromMix       bool
 	canSend       bool
 
+	// spoolSub is the subscription to the changes to a client's spool, and
+	// spoolHead is the head of the spool, prefetched after each change.
+	spoolSub       *notifyspool.Subscription
+	spoolHead      *spoolHead
+	spoolHeadSince time.Time
+
 	closeConnectionCh chan bool
 }
 
+type spoolHead struct {
+	id        uint64
+	msg       []byte
+	surbID    []byte
+	remaining int
+}
+
 var (
 	incomingConns = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -84,6 +98,15 @@ var (
 			Help:      "Number of dropped packets",
 		},
 	)
+	packetsRateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: internalConstants.Namespace,
+			Name:      "rate_limited_packets_total",
+			Subsystem: internalConstants.IncomingConnSubsystem,
+			Help:      "Number of packets dropped by the client send rate limits",
+		},
+		[]string{"reason"},
+	)
 	ingressQueueSize = prometheus.NewSummary(
 		prometheus.SummaryOpts{
 			Namespace: internalConstants.Namespace,
@@ -92,12 +115,23 @@ var (
 			Help:      "Size of the ingress queue",
 		},
 	)
+	spoolDeliveryLatency = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: internalConstants.Namespace,
+			Name:      "spool_delivery_latency_seconds",
+			Subsystem: internalConstants.IncomingConnSubsystem,
+			Help:      "Time between a message being spooled for a connected client, and its retrieval",
+			Buckets:   []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 120, 300},
+		},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(incomingConns)
 	prometheus.MustRegister(packetsDropped)
+	prometheus.MustRegister(packetsRateLimited)
 	prometheus.MustRegister(ingressQueueSize)
+	prometheus.MustRegister(spoolDeliveryLatency)
 }
 
 func (c *incomingConn) IsPeerValid(creds *wire.PeerCredentials) bool {
@@ -112,47 +146,6 @@ func (c *incomingConn) IsPeerValid(creds *wire.PeerCredentials) bool {
 			// Ok this is a connection from a client.
 			c.fromClient = true
 			c.canSend = true // Clients can always send for now.
-
-			// Update the rate limiter parameters.
-			if c.l.glue.Config().Debug.DisableRateLimit {
-				return true
-			}
-
-			// send token duration
-			sendRatePerMinute := atomic.LoadUint64(&c.l.sendRatePerMinute)
-			ratePerMin := float64(sendRatePerMinute)
-			sendTokenDuration := uint64((1 / ratePerMin) * 60 * 1000)
-
-			switch sendTokenDuration {
-			case uint64(c.sendTokenIncr / time.Millisecond):
-			// The send shift didn't change, don't update anything.
-			case 0:
-				c.log.Debugf("Rate limit disabled, no SendRatePerMinute.")
-				c.sendTokenIncr = 0
-				c.sendTokens = 0
-				c.maxSendTokens = 0
-			default:
-				c.log.Debugf("Rate limit SendRatePerMinute updated: %v", c.sendTokenIncr)
-			}
-			// If there was no previous limit start at 1 send credit.
-			if c.sendTokenIncr == 0 {
-				c.sendTokens = 1
-				c.sendTokenLast = monotime.Now()
-			}
-			c.sendTokenIncr = time.Duration(sendTokenDuration) * time.Millisecond
-
-			// max send tokens
-			c.maxSendTokens = atomic.LoadUint64(&c.l.sendBurst)
-			switch c.maxSendTokens {
-			case 0:
-				c.log.Debugf("Rate limit disabled, no MaxSendTokens.")
-				c.sendTokenIncr = 0
-				c.sendTokens = 0
-				c.maxSendTokens = 0
-			default:
-				c.log.Debugf("Rate limit MaxSendTokens updated: %v", c.maxSendTokens)
-			}
-
 			return true
 		}
 
@@ -166,6 +159,7 @@ func (c *incomingConn) IsPeerValid(creds *wire.PeerCredentials) bool {
 	_, c.canSend, isValid = c.l.glue.PKI().AuthenticateConnection(creds, false)
 	if isValid {
 		c.fromMix = true
+		c.l.limits.onMixAuthenticated(c.c.RemoteAddr(), c.slot)
 	} else {
 		c.log.Debugf("Authentication failed: '%v' (%v)", debug.BytesToPrintString(creds.AdditionalData), creds.PublicKey)
 	}
@@ -185,6 +179,32 @@ func (c *incomingConn) worker() {
 		c.l.onClosedConn(c) // Remove from the connection list.
 	}()
 
+	// The handshake timeout also covers reading the PROXY protocol header.
+	timeoutMs := time.Duration(c.l.glue.Config().Debug.HandshakeTimeout) * time.Millisecond
+	c.c.SetDeadline(time.Now().Add(timeoutMs))
+
+	// Replace the proxy's address with the source address carried in the
+	// PROXY protocol header, and only then enforce the connection limits.
+	if c.l.proxyProtocol {
+		conn, err := c.l.acceptProxyConn(c.c)
+		if err != nil {
+			c.log.Errorf("Invalid PROXY protocol header from %v: %v", c.c.RemoteAddr(), err)
+			return
+		}
+		c.l.Lock()
+		c.c = conn
+		c.l.Unlock()
+		c.log.Debugf("PROXY protocol source address: %v", conn.RemoteAddr())
+
+		slot := c.l.acquireSlot(conn.RemoteAddr())
+		if slot == nil {
+			return
+		}
+		c.l.Lock()
+		c.slot = slot
+		c.l.Unlock()
+	}
+
 	// Allocate the session struct.
 	cfg := &wire.SessionConfig{
 		Authenticator:     c,
@@ -203,8 +223,6 @@ func (c *incomingConn) worker() {
 	defer c.w.Close()
 
 	// Bind the session to the conn, handshake, authenticate.
-	timeoutMs := time.Duration(c.l.glue.Config().Debug.HandshakeTimeout) * time.Millisecond
-	c.c.SetDeadline(time.Now().Add(timeoutMs))
 	if err = c.w.Initialize(c.c); err != nil {
 		c.log.Errorf("Handshake failed: %v", err)
 		return
@@ -225,7 +243,8 @@ func (c *incomingConn) worker() {
 	}
 
 	// Ensure that there's only one incoming conn from any given peer, though
-	// this only really matters for user sessions. Newest connection wins.
+	// this only really matters for user sessions, where each of a user's
+	// link keys is treated as a distinct peer. Newest connection wins.
 	for _, s := range c.l.glue.Listeners() {
 		err := s.CloseOldConns(c)
 		if err != nil {
@@ -234,6 +253,16 @@ func (c *incomingConn) worker() {
 		}
 	}
 
+	// Subscribe to the changes to a client's spool, so that the head of the
+	// spool is fetched as soon as a message arrives, rather than when the
+	// client next polls.
+	var spoolCh <-chan struct{}
+	if c.fromClient {
+		c.spoolSub = c.l.glue.Provider().SubscribeSpool(creds.AdditionalData)
+		defer c.spoolSub.Cancel()
+		spoolCh = c.spoolSub.C
+	}
+
 	// Start the reauthenticate ticker.
 	reauthMs := time.Duration(c.l.glue.Config().Debug.ReauthInterval) * time.Millisecond
 	reauth := time.NewTicker(reauthMs)
@@ -285,6 +314,9 @@ func (c *incomingConn) worker() {
 		case <-c.closeConnectionCh:
 			c.log.Debugf("Disconnecting to make room for a newer connection from the same peer.")
 			return
+		case <-spoolCh:
+			c.prefetchSpoolHead()
+			continue
 		case rawCmd, ok = <-commandCh:
 			if !ok {
 				return
@@ -371,27 +403,11 @@ func (c *incomingConn) onGetConsensus(cmd *commands.GetConsensus) error {
 }
 
 func (c *incomingConn) onRetrieveMessage(cmd *commands.RetrieveMessage) error {
-	advance := false
-	switch cmd.Sequence {
-	case c.retrSeq:
-		c.log.Debugf("RetrieveMessage: %d", cmd.Sequence)
-	case c.retrSeq + 1:
-		c.log.Debugf("RetrieveMessage: %d (Popping head)", cmd.Sequence)
-		c.retrSeq++ // Advance the sequence number.
-		advance = true
-	default:
-		return fmt.Errorf("provider: RetrieveMessage out of sequence: %d", cmd.Sequence)
-	}
-
-	// Get the message from the user's spool, advancing as appropriate.
-	creds, err := c.w.PeerCredentials()
-	if err != nil {
-		return err
-	}
-	msg, surbID, remaining, err := c.l.glue.Provider().Spool().Get(creds.AdditionalData, advance)
+	head, err := c.retrieveSpoolHead(cmd.Sequence)
 	if err != nil {
 		return err
 	}
+	msg, surbID, remaining := head.msg, head.surbID, head.remaining
 	if remaining > math.MaxUint8 {
 		// The count hint is an 8 bit value and is clamped.
 		remaining = math.MaxUint8
@@ -438,6 +454,95 @@ func (c *incomingConn) onRetrieveMessage(cmd *commands.RetrieveMessage) error {
 	return c.w.SendCommand(respCmd)
 }
 
+// retrieveSpoolHead returns the head of the user's spool for the
+// RetrieveMessage with the sequence number seq, after acknowledging the
+// message last retrieved iff seq advances the sequence number.
+func (c *incomingConn) retrieveSpoolHead(seq uint32) (*spoolHead, error) {
+	var ackID uint64
+	switch seq {
+	case c.retrSeq:
+		c.log.Debugf("RetrieveMessage: %d", seq)
+	case c.retrSeq + 1:
+		c.log.Debugf("RetrieveMessage: %d (Popping head)", seq)
+		c.retrSeq++ // Advance the sequence number.
+		ackID = c.retrID
+	default:
+		return nil, fmt.Errorf("provider: RetrieveMessage out of sequence: %d", seq)
+	}
+
+	// Get the message from the user's spool, acknowledging the message last
+	// retrieved as appropriate, or use the prefetched head if there is one.
+	// The acknowledgement is by ID, so a message that was evicted or expired
+	// since it was retrieved never causes its successor to be lost unseen.
+	var head *spoolHead
+	if c.spoolSub != nil {
+		// Apply any pending change first, to avoid serving a stale head.
+		select {
+		case <-c.spoolSub.C:
+			c.prefetchSpoolHead()
+		default:
+		}
+		if ackID == 0 {
+			head = c.spoolHead
+		}
+	}
+	if head == nil {
+		var err error
+		if head, err = c.getSpoolHead(ackID); err != nil {
+			return nil, err
+		}
+		if c.spoolSub != nil {
+			c.spoolHead = head
+		}
+	}
+	if head.msg != nil && !c.spoolHeadSince.IsZero() {
+		spoolDeliveryLatency.Observe(time.Since(c.spoolHeadSince).Seconds())
+		c.spoolHeadSince = time.Time{}
+	}
+	c.retrID = head.id
+	return head, nil
+}
+
+func (c *incomingConn) getSpoolHead(ackID uint64) (*spoolHead, error) {
+	var h spoolHead
+	var err error
+	if c.spoolSub != nil {
+		h.msg, h.surbID, h.id, h.remaining, err = c.spoolSub.Get(ackID)
+	} else {
+		var creds *wire.PeerCredentials
+		if creds, err = c.w.PeerCredentials(); err != nil {
+			return nil, err
+		}
+		h.msg, h.surbID, h.id, h.remaining, err = c.l.glue.Provider().Spool().Get(creds.AdditionalData, ackID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func (c *incomingConn) prefetchSpoolHead() {
+	head, err := c.getSpoolHead(0)
+	if err != nil {
+		// Leave it to the next RetrieveMessage to report the error.
+		c.log.Debugf("Failed to prefetch spool head: %v", err)
+		c.spoolHead = nil
+		return
+	}
+	prev := c.spoolHead
+	c.spoolHead = head
+
+	// Track how long a message that arrived while connected is spooled for,
+	// restarting whenever the head is replaced by a message that has not
+	// been retrieved yet.
+	switch {
+	case head.msg == nil, head.id == c.retrID:
+		c.spoolHeadSince = time.Time{}
+	case prev == nil || prev.id != head.id || c.spoolHeadSince.IsZero():
+		c.spoolHeadSince = time.Now()
+	}
+}
+
 func (c *incomingConn) onSendPacket(cmd *commands.SendPacket) error {
 	pkt, err := packet.New(cmd.SphinxPacket)
 	if err != nil {
@@ -451,31 +556,20 @@ func (c *incomingConn) onSendPacket(cmd *commands.SendPacket) error {
 	pkt.MustForward = c.fromClient
 	pkt.MustTerminate = c.l.glue.Config().Server.IsProvider && !c.fromClient
 
-	// If the packet was from the client, and there is a SendShift for the
-	// current epoch, enforce SendShift based rate limits.
-	if c.fromClient && c.sendTokenIncr != 0 {
-		// Update the token bucket for the time that we were idle.
-		deltaT := monotime.Now() - c.sendTokenLast
-		c.log.Debugf("Rate limit: DeltaT: %v Tokens: %v", deltaT, c.sendTokens)
-		incrCount := uint64(deltaT / c.sendTokenIncr)
-		if incrCount > 0 {
-			c.sendTokenLast += c.sendTokenIncr * time.Duration(incrCount)
-			c.sendTokens += incrCount
-
-			// Leaky bucket.
-			if c.sendTokens > c.maxSendTokens {
-				c.sendTokens = c.maxSendTokens
-			}
+	// If the packet was from a client, enforce the user's rate limit, which
+	// is shared by all of the user's connections.
+	if c.fromClient && !c.l.glue.Config().Debug.DisableRateLimit {
+		creds, err := c.w.PeerCredentials()
+		if err != nil {
+			return err
 		}
-
-		if c.sendTokens == 0 {
-			c.log.Debugf("Dropping packet: %v (Rate limited)", pkt.ID)
+		if reason, ok := c.l.glue.Provider().RateLimiter().Allow(creds.AdditionalData); !ok {
+			c.log.Debugf("Dropping packet: %v (Rate limited: %v)", pkt.ID, reason)
 			packetsDropped.Inc()
+			packetsRateLimited.With(prometheus.Labels{"reason": string(reason)}).Inc()
 			pkt.Dispose()
 			return nil
 		}
-		c.sendTokens--
-		c.log.Debugf("Rate limit: Remaining tokens: %v", c.sendTokens)
 	}
 
 	c.log.Debugf("Handing off packet: %v", pkt.ID)
@@ -489,13 +583,12 @@ func (c *incomingConn) onSendPacket(cmd *commands.SendPacket) error {
 	return nil
 }
 
-func newIncomingConn(l *listener, conn net.Conn) *incomingConn {
+func newIncomingConn(l *listener, conn net.Conn, slot *connSlot) *incomingConn {
 	c := &incomingConn{
 		l:                 l,
 		c:                 conn,
+		slot:              slot,
 		id:                atomic.AddUint64(&incomingConnID, 1), // Diagnostic only, wrapping is fine.
-		sendTokenLast:     monotime.Now(),
-		maxSendTokens:     4, // Reasonable burst to avoid some unnecessary rate limiting.
 		closeConnectionCh: make(chan bool),
 	}
 	c.log = l.glue.LogBackend().GetLogger(fmt.Sprintf("incoming:%d", c.id))
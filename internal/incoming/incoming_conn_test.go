@@ -0,0 +1,97 @@
+// incoming_conn_test.go - Incoming connection tests.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package incoming
+
+import (
+	"testing"
+
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/server/spool"
+	"github.com/katzenpost/server/spool/memspool"
+	"github.com/katzenpost/server/spool/notifyspool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetrieveSpoolHead(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err, "log.New()")
+
+	u := []byte("alice")
+	s := notifyspool.New(memspool.New())
+	s.SetQuota(&spool.Quota{
+		MaxMessages: 2,
+		Policy:      spool.PolicyEvict,
+	})
+	c := &incomingConn{
+		log:      logBackend.GetLogger("incoming_conn_test"),
+		spoolSub: s.Subscribe(u),
+	}
+	defer c.spoolSub.Cancel()
+
+	var msgs [][]byte
+	for i := 0; i < 3; i++ {
+		msg := make([]byte, constants.UserForwardPayloadLength)
+		msg[0] = byte(i)
+		msgs = append(msgs, msg)
+	}
+
+	// Messages stored while connected are prefetched.
+	require.NoError(s.StoreMessage(u, msgs[0]), "StoreMessage(0)")
+	head, err := c.retrieveSpoolHead(0)
+	require.NoError(err, "retrieveSpoolHead(0)")
+	assert.Equal(msgs[0], head.msg, "retrieveSpoolHead(0): message")
+	assert.Equal(0, head.remaining, "retrieveSpoolHead(0): remaining")
+
+	// Retrieving the same sequence number again returns the same head, even
+	// after another message is stored.
+	require.NoError(s.StoreMessage(u, msgs[1]), "StoreMessage(1)")
+	head, err = c.retrieveSpoolHead(0)
+	require.NoError(err, "retrieveSpoolHead(0): repeated")
+	assert.Equal(msgs[0], head.msg, "retrieveSpoolHead(0): repeated message")
+	assert.Equal(1, head.remaining, "retrieveSpoolHead(0): repeated remaining")
+
+	// Evict the retrieved head before it is acknowledged, without the
+	// change being applied yet.  Advancing must not delete its successor.
+	require.NoError(s.StoreMessage(u, msgs[2]), "StoreMessage(2): evict")
+	head, err = c.retrieveSpoolHead(1)
+	require.NoError(err, "retrieveSpoolHead(1)")
+	assert.Equal(msgs[1], head.msg, "retrieveSpoolHead(1): successor of evicted head")
+	assert.Equal(1, head.remaining, "retrieveSpoolHead(1): remaining")
+
+	// Changes made elsewhere are applied before serving the prefetched head.
+	_, _, _, _, err = s.Get(u, head.id)
+	require.NoError(err, "Get(): acknowledge elsewhere")
+	head, err = c.retrieveSpoolHead(1)
+	require.NoError(err, "retrieveSpoolHead(1): repeated")
+	assert.Equal(msgs[2], head.msg, "retrieveSpoolHead(1): changed elsewhere")
+
+	// Advancing past the last message drains the spool.
+	head, err = c.retrieveSpoolHead(2)
+	require.NoError(err, "retrieveSpoolHead(2)")
+	assert.Nil(head.msg, "retrieveSpoolHead(2): drained")
+	count, _, err := s.Usage(u)
+	require.NoError(err, "Usage()")
+	assert.Zero(count, "Usage(): drained")
+
+	_, err = c.retrieveSpoolHead(4)
+	assert.Error(err, "retrieveSpoolHead(4): out of sequence")
+}
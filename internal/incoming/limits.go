@@ -0,0 +1,217 @@
+// limits.go - Incoming connection limits.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package incoming
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/server/config"
+	internalConstants "github.com/katzenpost/server/internal/constants"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// mixExemptionTTL is how long a source address stays exempt from the
+	// limits after a connection from it last authenticated as a mix.  Mix
+	// connections reauthenticate every ReauthInterval, which keeps the
+	// exemption fresh for as long as one is established.
+	mixExemptionTTL = 10 * time.Minute
+
+	// limitsPruneInterval is the interval between sweeps for idle state.
+	limitsPruneInterval = time.Minute
+
+	rejectMaxConnections      = "max_connections"
+	rejectMaxConnectionsPerIP = "max_connections_per_ip"
+	rejectHandshakeRate       = "handshake_rate"
+)
+
+var connsRejected = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: internalConstants.Namespace,
+		Name:      "rejected_connections_total",
+		Subsystem: internalConstants.IncomingConnSubsystem,
+		Help:      "Number of incoming connections rejected by the connection limits",
+	},
+	[]string{"reason"},
+)
+
+func init() {
+	prometheus.MustRegister(connsRejected)
+}
+
+type handshakeBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// ConnLimits is the set of incoming connection limits shared by all of the
+// listeners.
+type ConnLimits struct {
+	sync.Mutex
+
+	cfg *config.Listener
+
+	total      int
+	perPrefix  map[string]int
+	handshakes map[string]*handshakeBucket
+	exempt     map[string]time.Time
+	lastPrune  time.Time
+
+	now func() time.Time
+}
+
+// connSlot is an incoming connection's share of the limits.
+type connSlot struct {
+	prefix  string
+	counted bool
+}
+
+func (cl *ConnLimits) prefixOf(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(cl.cfg.IPv4PrefixLength, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(cl.cfg.IPv6PrefixLength, 128)).String()
+}
+
+// acquire accounts for a new incoming connection from addr, returning the
+// connection's slot, or the reason that it was rejected.
+func (cl *ConnLimits) acquire(addr net.Addr) (*connSlot, string) {
+	cl.Lock()
+	defer cl.Unlock()
+
+	now := cl.now()
+	if now.Sub(cl.lastPrune) >= limitsPruneInterval {
+		cl.prune(now)
+	}
+
+	// Source addresses without an IP address (eg: unix domain sockets) are
+	// only subject to the overall limit.
+	slot := new(connSlot)
+	ip := addrIP(addr)
+	if ip != nil {
+		if exp, ok := cl.exempt[ip.String()]; ok && now.Before(exp) {
+			return slot, ""
+		}
+		slot.prefix = cl.prefixOf(ip)
+	}
+
+	if max := cl.cfg.MaxConnections; max > 0 && cl.total >= max {
+		return nil, rejectMaxConnections
+	}
+	if ip != nil {
+		if max := cl.cfg.MaxConnectionsPerIP; max > 0 && cl.perPrefix[slot.prefix] >= max {
+			return nil, rejectMaxConnectionsPerIP
+		}
+		if rate := cl.cfg.HandshakeRate; rate > 0 {
+			burst := float64(cl.cfg.HandshakeBurst)
+			b, ok := cl.handshakes[slot.prefix]
+			if !ok {
+				b = &handshakeBucket{tokens: burst, last: now}
+				cl.handshakes[slot.prefix] = b
+			}
+			b.refill(now, rate, burst)
+			if b.tokens < 1 {
+				return nil, rejectHandshakeRate
+			}
+			b.tokens--
+		}
+		cl.perPrefix[slot.prefix]++
+	}
+	cl.total++
+	slot.counted = true
+
+	return slot, ""
+}
+
+// release returns the slot's share of the limits.  It is safe to call more
+// than once.
+func (cl *ConnLimits) release(slot *connSlot) {
+	cl.Lock()
+	defer cl.Unlock()
+
+	if slot == nil || !slot.counted {
+		return
+	}
+	slot.counted = false
+	cl.total--
+	if slot.prefix != "" {
+		if cl.perPrefix[slot.prefix]--; cl.perPrefix[slot.prefix] <= 0 {
+			delete(cl.perPrefix, slot.prefix)
+		}
+	}
+}
+
+// onMixAuthenticated exempts the mix's source address from the limits, and
+// releases the connection's slot.
+func (cl *ConnLimits) onMixAuthenticated(addr net.Addr, slot *connSlot) {
+	if ip := addrIP(addr); ip != nil {
+		cl.Lock()
+		cl.exempt[ip.String()] = cl.now().Add(mixExemptionTTL)
+		cl.Unlock()
+	}
+	cl.release(slot)
+}
+
+func (cl *ConnLimits) prune(now time.Time) {
+	cl.lastPrune = now
+	for ip, exp := range cl.exempt {
+		if !now.Before(exp) {
+			delete(cl.exempt, ip)
+		}
+	}
+	if rate := cl.cfg.HandshakeRate; rate > 0 {
+		burst := float64(cl.cfg.HandshakeBurst)
+		for prefix, b := range cl.handshakes {
+			if b.refill(now, rate, burst); b.tokens >= burst {
+				delete(cl.handshakes, prefix)
+			}
+		}
+	}
+}
+
+func (b *handshakeBucket) refill(now time.Time, rate, burst float64) {
+	if dt := now.Sub(b.last); dt > 0 {
+		b.tokens += dt.Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	default:
+		return nil
+	}
+}
+
+// NewConnLimits creates the incoming connection limits for the listener
+// configuration cfg.
+func NewConnLimits(cfg *config.Listener) *ConnLimits {
+	return &ConnLimits{
+		cfg:        cfg,
+		perPrefix:  make(map[string]int),
+		handshakes: make(map[string]*handshakeBucket),
+		exempt:     make(map[string]time.Time),
+		now:        time.Now,
+	}
+}
@@ -0,0 +1,153 @@
+// limits_test.go - Incoming connection limit tests.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package incoming
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/server/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestConnLimits(cfg *config.Listener) (*ConnLimits, *time.Time) {
+	if cfg.IPv4PrefixLength == 0 {
+		cfg.IPv4PrefixLength = 24
+	}
+	if cfg.IPv6PrefixLength == 0 {
+		cfg.IPv6PrefixLength = 64
+	}
+	now := time.Unix(1600000000, 0)
+	cl := NewConnLimits(cfg)
+	cl.now = func() time.Time { return now }
+	return cl, &now
+}
+
+func tcpAddr(s string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(s), Port: 29483}
+}
+
+func TestConnLimitsConcurrency(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	cl, _ := newTestConnLimits(&config.Listener{MaxConnections: 5, MaxConnectionsPerIP: 2})
+
+	// The per-IP limit applies to the whole prefix.
+	a, _ := cl.acquire(tcpAddr("192.0.2.1"))
+	require.NotNil(a, "acquire(): first")
+	b, _ := cl.acquire(tcpAddr("192.0.2.2"))
+	require.NotNil(b, "acquire(): same prefix")
+	_, reason := cl.acquire(tcpAddr("192.0.2.3"))
+	assert.Equal(rejectMaxConnectionsPerIP, reason, "acquire(): per-IP limit")
+
+	// IPv6 addresses are grouped by their own prefix length.
+	c, _ := cl.acquire(tcpAddr("2001:db8::1"))
+	require.NotNil(c, "acquire(): IPv6")
+	d, _ := cl.acquire(tcpAddr("2001:db8::2:1"))
+	require.NotNil(d, "acquire(): IPv6 same prefix")
+	_, reason = cl.acquire(tcpAddr("2001:db8::3:1"))
+	assert.Equal(rejectMaxConnectionsPerIP, reason, "acquire(): IPv6 per-IP limit")
+
+	// The overall limit applies to everyone, including non-IP peers.
+	u, _ := cl.acquire(&net.UnixAddr{Name: "@", Net: "unix"})
+	require.NotNil(u, "acquire(): unix")
+	_, reason = cl.acquire(tcpAddr("198.51.100.1"))
+	assert.Equal(rejectMaxConnections, reason, "acquire(): overall limit")
+	_, reason = cl.acquire(&net.UnixAddr{Name: "@", Net: "unix"})
+	assert.Equal(rejectMaxConnections, reason, "acquire(): overall limit, unix")
+
+	// Releasing is idempotent.
+	cl.release(a)
+	cl.release(a)
+	assert.Equal(4, cl.total, "release(): total")
+	e, _ := cl.acquire(tcpAddr("192.0.2.3"))
+	require.NotNil(e, "acquire(): after release")
+	_, reason = cl.acquire(tcpAddr("192.0.2.4"))
+	assert.Equal(rejectMaxConnections, reason, "acquire(): overall limit after release")
+
+	for _, s := range []*connSlot{b, c, d, e, u} {
+		cl.release(s)
+	}
+	assert.Zero(cl.total, "release(): total")
+	assert.Empty(cl.perPrefix, "release(): per-prefix counts")
+}
+
+func TestConnLimitsHandshakeRate(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	cl, now := newTestConnLimits(&config.Listener{HandshakeRate: 2, HandshakeBurst: 3})
+	addr := tcpAddr("192.0.2.1")
+
+	for i := 0; i < 3; i++ {
+		s, _ := cl.acquire(addr)
+		require.NotNil(s, "acquire(): burst %d", i)
+		cl.release(s)
+	}
+	_, reason := cl.acquire(addr)
+	assert.Equal(rejectHandshakeRate, reason, "acquire(): burst exhausted")
+	s, _ := cl.acquire(tcpAddr("198.51.100.1"))
+	assert.NotNil(s, "acquire(): other prefix")
+
+	*now = now.Add(500 * time.Millisecond)
+	s, _ = cl.acquire(addr)
+	assert.NotNil(s, "acquire(): refilled")
+	_, reason = cl.acquire(addr)
+	assert.Equal(rejectHandshakeRate, reason, "acquire(): refill exhausted")
+
+	// Full buckets are pruned.
+	*now = now.Add(limitsPruneInterval)
+	cl.acquire(tcpAddr("203.0.113.1"))
+	assert.Len(cl.handshakes, 1, "prune(): full buckets")
+}
+
+func TestConnLimitsMixExemption(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	cl, now := newTestConnLimits(&config.Listener{MaxConnections: 1, HandshakeRate: 1, HandshakeBurst: 1})
+	mix, client := tcpAddr("192.0.2.1"), tcpAddr("198.51.100.1")
+
+	// Authenticating as a mix releases the connection's slot.
+	s, _ := cl.acquire(mix)
+	require.NotNil(s, "acquire(): mix")
+	cl.onMixAuthenticated(mix, s)
+	assert.Zero(cl.total, "onMixAuthenticated(): total")
+
+	c, _ := cl.acquire(client)
+	require.NotNil(c, "acquire(): client")
+
+	// Mixes are exempt, while others are limited.
+	for i := 0; i < 3; i++ {
+		s, _ = cl.acquire(mix)
+		require.NotNil(s, "acquire(): exempt mix %d", i)
+		assert.False(s.counted, "acquire(): exempt mix slot")
+	}
+	_, reason := cl.acquire(tcpAddr("192.0.2.2"))
+	assert.Equal(rejectMaxConnections, reason, "acquire(): same prefix as mix")
+
+	// The exemption expires.
+	cl.release(c)
+	*now = now.Add(mixExemptionTTL)
+	s, _ = cl.acquire(mix)
+	require.NotNil(s, "acquire(): expired exemption")
+	assert.True(s.counted, "acquire(): expired exemption slot")
+	assert.Empty(cl.exempt, "prune(): expired exemptions")
+}
@@ -22,12 +22,19 @@ import (
 	"container/list"
 	"fmt"
 	"net"
+	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/katzenpost/core/utils"
 	"github.com/katzenpost/core/worker"
+	"github.com/katzenpost/server/config"
 	"github.com/katzenpost/server/internal/constants"
+	"github.com/katzenpost/server/internal/debug"
 	"github.com/katzenpost/server/internal/glue"
+	"github.com/prometheus/client_golang/prometheus"
 	"gopkg.in/op/go-logging.v1"
 )
 
@@ -38,15 +45,20 @@ type listener struct {
 	glue glue.Glue
 	log  *logging.Logger
 
-	l     net.Listener
-	conns *list.List
+	l      net.Listener
+	conns  *list.List
+	limits *ConnLimits
+
+	// proxyProtocol is set iff connections start with a PROXY protocol
+	// header, which is only accepted from the trustedProxies.
+	proxyProtocol  bool
+	trustedProxies []*net.IPNet
 
 	incomingCh chan<- interface{}
 	closeAllCh chan interface{}
 	closeAllWg sync.WaitGroup
 
-	sendRatePerMinute uint64
-	sendBurst         uint64
+	isListening uint32
 }
 
 func (l *listener) Halt() {
@@ -63,18 +75,29 @@ func (l *listener) Halt() {
 }
 
 func (l *listener) OnNewSendRatePerMinute(sendRatePerMinute uint64) {
-	atomic.StoreUint64(&l.sendRatePerMinute, sendRatePerMinute)
+	// The rate limits are per-user, and thus shared by all the listeners.
+	if p := l.glue.Provider(); p != nil {
+		p.RateLimiter().SetSendRatePerMinute(sendRatePerMinute)
+	}
 }
 
 func (l *listener) OnNewSendBurst(sendBurst uint64) {
-	atomic.StoreUint64(&l.sendBurst, sendBurst)
+	if p := l.glue.Provider(); p != nil {
+		p.RateLimiter().SetSendBurst(sendBurst)
+	}
+}
+
+func (l *listener) IsListening() bool {
+	return atomic.LoadUint32(&l.isListening) == 1
 }
 
 func (l *listener) worker() {
 	addr := l.l.Addr()
 	l.log.Noticef("Listening on: %v", addr)
+	atomic.StoreUint32(&l.isListening, 1)
 	defer func() {
 		l.log.Noticef("Stopping listening on: %v", addr)
+		atomic.StoreUint32(&l.isListening, 0)
 		l.l.Close() // Usually redundant, but harmless.
 	}()
 	for {
@@ -87,20 +110,48 @@ func (l *listener) worker() {
 			continue
 		}
 
-		tcpConn := conn.(*net.TCPConn)
-		tcpConn.SetKeepAlive(true)
-		tcpConn.SetKeepAlivePeriod(constants.KeepAliveInterval)
+		// Enforce the connection limits before committing any resources
+		// to the handshake, unless the source address is yet to be read
+		// from the PROXY protocol header.
+		var slot *connSlot
+		if !l.proxyProtocol {
+			if slot = l.acquireSlot(conn.RemoteAddr()); slot == nil {
+				conn.Close()
+				continue
+			}
+		}
+
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetKeepAlive(true)
+			tcpConn.SetKeepAlivePeriod(constants.KeepAliveInterval)
+		}
 
 		l.log.Debugf("Accepted new connection: %v", conn.RemoteAddr())
 
-		l.onNewConn(conn)
+		l.onNewConn(conn, slot)
 	}
 
 	// NOTREACHED
 }
 
-func (l *listener) onNewConn(conn net.Conn) {
-	c := newIncomingConn(l, conn)
+func (l *listener) acquireSlot(addr net.Addr) *connSlot {
+	slot, reason := l.limits.acquire(addr)
+	if slot == nil {
+		l.log.Debugf("Rejecting connection: %v (%v)", addr, reason)
+		connsRejected.With(prometheus.Labels{"reason": reason}).Inc()
+	}
+	return slot
+}
+
+func (l *listener) acceptProxyConn(conn net.Conn) (net.Conn, error) {
+	if !isTrustedProxy(conn.RemoteAddr(), l.trustedProxies) {
+		return nil, errUntrustedProxy
+	}
+	return newProxyConn(conn)
+}
+
+func (l *listener) onNewConn(conn net.Conn, slot *connSlot) {
+	c := newIncomingConn(l, conn, slot)
 
 	l.closeAllWg.Add(1)
 	l.Lock()
@@ -116,6 +167,8 @@ func (l *listener) onInitializedConn(c *incomingConn) {
 	defer l.Unlock()
 
 	c.isInitialized = true
+	c.initializedAt = time.Now()
+	c.wasClient = c.fromClient
 }
 
 func (l *listener) onClosedConn(c *incomingConn) {
@@ -125,6 +178,37 @@ func (l *listener) onClosedConn(c *incomingConn) {
 		l.closeAllWg.Done()
 	}()
 	l.conns.Remove(c.e)
+	l.limits.release(c.slot)
+}
+
+func (l *listener) Connections() []glue.ConnInfo {
+	l.Lock()
+	defer l.Unlock()
+
+	conns := make([]glue.ConnInfo, 0, l.conns.Len())
+	for e := l.conns.Front(); e != nil; e = e.Next() {
+		c := e.Value.(*incomingConn)
+		if c.w == nil || !c.isInitialized {
+			continue
+		}
+		creds, err := c.w.PeerCredentials()
+		if err != nil {
+			continue
+		}
+
+		info := glue.ConnInfo{
+			Addr:     c.c.RemoteAddr().String(),
+			IsClient: c.wasClient,
+			Since:    c.initializedAt,
+		}
+		if c.wasClient {
+			info.Peer = utils.ASCIIBytesToPrintString(creds.AdditionalData)
+		} else {
+			info.Peer = debug.BytesToPrintString(creds.AdditionalData)
+		}
+		conns = append(conns, info)
+	}
+	return conns
 }
 
 func (l *listener) CloseOldConns(ptr interface{}) error {
@@ -147,7 +231,11 @@ func (l *listener) CloseOldConns(ptr interface{}) error {
 			continue
 		}
 
-		// Compare both by AdditionalData and PublicKey.
+		// Compare both by AdditionalData and PublicKey, as a user may
+		// have multiple link keys (one per device), each of which is
+		// permitted a concurrent connection.  The devices may safely share
+		// the user's spool, as each only deletes the entries that it has
+		// acknowledged.
 		b, err := cc.w.PeerCredentials()
 		if err != nil {
 			continue
@@ -165,23 +253,60 @@ func (l *listener) CloseOldConns(ptr interface{}) error {
 	return nil
 }
 
-// New creates a new listener.
-func New(glue glue.Glue, incomingCh chan<- interface{}, id int, addr string) (glue.Listener, error) {
+// New creates a new listener, subject to the shared connection limits.
+func New(glue glue.Glue, incomingCh chan<- interface{}, id int, addr string, limits *ConnLimits) (glue.Listener, error) {
 	var err error
 
 	l := &listener{
 		glue:       glue,
 		log:        glue.LogBackend().GetLogger(fmt.Sprintf("listener:%d", id)),
 		conns:      list.New(),
+		limits:     limits,
 		incomingCh: incomingCh,
 		closeAllCh: make(chan interface{}),
 	}
 
-	l.l, err = net.Listen("tcp", addr)
-	if err != nil {
+	lCfg := glue.Config().Listener
+	for _, v := range lCfg.ProxyProtocolAddresses {
+		if v == addr {
+			l.proxyProtocol = true
+		}
+	}
+	if l.proxyProtocol {
+		for _, v := range lCfg.TrustedProxies {
+			_, ipNet, err := net.ParseCIDR(v)
+			if err != nil {
+				return nil, err
+			}
+			l.trustedProxies = append(l.trustedProxies, ipNet)
+		}
+	}
+
+	if l.l, err = listen(l.log, addr); err != nil {
 		return nil, err
 	}
 
 	l.Go(l.worker)
 	return l, nil
 }
+
+// listen returns a listener for the configured address addr, which is
+// either a TCP address, a unix domain socket path, or the name of a socket
+// inherited via systemd socket activation.
+func listen(log *logging.Logger, addr string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, config.AddressUnixPrefix):
+		unixPath := strings.TrimPrefix(addr, config.AddressUnixPrefix)
+		if _, err := os.Stat(unixPath); err == nil {
+			log.Warningf("Socket file '%s' already exists, deleting it.", unixPath)
+			if err = os.Remove(unixPath); err != nil {
+				return nil, err
+			}
+		}
+		return net.Listen("unix", unixPath)
+	case strings.HasPrefix(addr, config.AddressSystemdPrefix):
+		return listenInherited(strings.TrimPrefix(addr, config.AddressSystemdPrefix))
+	default:
+		return net.Listen("tcp", addr)
+	}
+}
@@ -0,0 +1,68 @@
+// listener_test.go - Incoming listener tests.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package incoming
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/server/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListen(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err, "log.New()")
+	logger := logBackend.GetLogger("listener_test")
+
+	dir, err := ioutil.TempDir("", "incoming_listener")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	// A stale socket file is replaced.
+	unixPath := filepath.Join(dir, "mix.sock")
+	require.NoError(ioutil.WriteFile(unixPath, nil, 0600), "WriteFile()")
+	l, err := listen(logger, config.AddressUnixPrefix+unixPath)
+	require.NoError(err, "listen(unix)")
+	defer l.Close()
+	assert.Equal("unix", l.Addr().Network(), "listen(unix): Network()")
+	assert.Equal(unixPath, l.Addr().String(), "listen(unix): Addr()")
+
+	conn, err := net.Dial("unix", unixPath)
+	require.NoError(err, "Dial(unix)")
+	conn.Close()
+	conn, err = l.Accept()
+	require.NoError(err, "Accept(unix)")
+	assert.Nil(addrIP(conn.RemoteAddr()), "unix: no source IP")
+	conn.Close()
+
+	l, err = listen(logger, "127.0.0.1:0")
+	require.NoError(err, "listen(tcp)")
+	defer l.Close()
+	assert.Equal("tcp", l.Addr().Network(), "listen(tcp): Network()")
+
+	_, err = listen(logger, config.AddressSystemdPrefix+"missing")
+	assert.Error(err, "listen(systemd): missing")
+}
@@ -0,0 +1,211 @@
+// proxyproto.go - HAProxy PROXY protocol support.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package incoming
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// proxyV1MaxLength is the maximum length of a v1 header, including the
+	// trailing CRLF.
+	proxyV1MaxLength = 107
+
+	proxyV2HeaderLength = 16
+
+	proxyV2CmdLocal = 0x0
+	proxyV2CmdProxy = 0x1
+
+	proxyV2FamInet   = 0x1
+	proxyV2FamInet6  = 0x2
+	proxyV2TransStrm = 0x1
+)
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errUntrustedProxy   = errors.New("incoming: PROXY protocol header from an untrusted address")
+	errNoProxyHeader    = errors.New("incoming: missing PROXY protocol header")
+	errInvalidV1Header  = errors.New("incoming: invalid PROXY protocol v1 header")
+	errInvalidV2Header  = errors.New("incoming: invalid PROXY protocol v2 header")
+	errProxyV1TooLong   = errors.New("incoming: PROXY protocol v1 header too long")
+	errUnsupportedProxy = errors.New("incoming: unsupported PROXY protocol address family")
+)
+
+// proxyConn is a net.Conn that reports the source address carried in the
+// PROXY protocol header as the remote address.
+type proxyConn struct {
+	net.Conn
+
+	r          *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// newProxyConn reads the PROXY protocol header from conn, and returns a
+// net.Conn with the carried source address.  Headers that do not carry a
+// source address (eg: the proxy's own health checks) leave the remote
+// address as is.
+func newProxyConn(conn net.Conn) (net.Conn, error) {
+	c := &proxyConn{
+		Conn:       conn,
+		r:          bufio.NewReader(conn),
+		remoteAddr: conn.RemoteAddr(),
+	}
+	addr, err := readProxyHeader(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if addr != nil {
+		c.remoteAddr = addr
+	}
+	return c, nil
+}
+
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b, proxyV1Prefix) {
+		return readProxyV1Header(r)
+	}
+	if b, err = r.Peek(len(proxyV2Signature)); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b, proxyV2Signature) {
+		return readProxyV2Header(r)
+	}
+	return nil, errNoProxyHeader
+}
+
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, errProxyV1TooLong
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+	}
+
+	// PROXY TCP4|TCP6 <src> <dst> <sport> <dport>, or PROXY UNKNOWN ...
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 {
+		return nil, errInvalidV1Header
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errInvalidV1Header
+	}
+	if len(fields) != 6 {
+		return nil, errInvalidV1Header
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, errInvalidV1Header
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errInvalidV1Header
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	var hdr [proxyV2HeaderLength]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, errInvalidV2Header
+	}
+	cmd, fam, trans := hdr[12]&0x0f, hdr[13]>>4, hdr[13]&0x0f
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch cmd {
+	case proxyV2CmdLocal:
+		return nil, nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, errInvalidV2Header
+	}
+	if trans != proxyV2TransStrm {
+		return nil, errUnsupportedProxy
+	}
+
+	// The source address and port, followed by the destination address and
+	// port, and optional TLVs that are ignored.
+	var ipLen int
+	switch fam {
+	case proxyV2FamInet:
+		ipLen = net.IPv4len
+	case proxyV2FamInet6:
+		ipLen = net.IPv6len
+	default:
+		return nil, errUnsupportedProxy
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, fmt.Errorf("incoming: PROXY protocol v2 address block too short: %v", len(body))
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, body[:ipLen])
+	port := binary.BigEndian.Uint16(body[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func isTrustedProxy(addr net.Addr, trusted []*net.IPNet) bool {
+	// Access to unix domain sockets is controlled by the file system.
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return true
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+// proxyproto_test.go - HAProxy PROXY protocol tests.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package incoming
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func proxyV2Header(cmd, fam byte, addrs []byte) []byte {
+	var b bytes.Buffer
+	b.Write(proxyV2Signature)
+	b.WriteByte(0x20 | cmd)
+	b.WriteByte(fam<<4 | proxyV2TransStrm)
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(addrs)))
+	b.Write(l[:])
+	b.Write(addrs)
+	return b.Bytes()
+}
+
+func TestProxyHeader(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	const payload = "handshake"
+	read := func(hdr []byte) (net.Addr, error) {
+		r := bufio.NewReader(bytes.NewReader(append(hdr, payload...)))
+		addr, err := readProxyHeader(r)
+		if err == nil {
+			rest, _ := ioutil.ReadAll(r)
+			assert.Equal(payload, string(rest), "readProxyHeader(): trailing data")
+		}
+		return addr, err
+	}
+
+	// v1
+	addr, err := read([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 29483\r\n"))
+	require.NoError(err, "v1 TCP4")
+	assert.Equal("192.0.2.1:56324", addr.String(), "v1 TCP4")
+	addr, err = read([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 29483\r\n"))
+	require.NoError(err, "v1 TCP6")
+	assert.Equal("[2001:db8::1]:56324", addr.String(), "v1 TCP6")
+	addr, err = read([]byte("PROXY UNKNOWN\r\n"))
+	require.NoError(err, "v1 UNKNOWN")
+	assert.Nil(addr, "v1 UNKNOWN")
+	_, err = read([]byte("PROXY TCP4 2001:db8::1 198.51.100.1 56324 29483\r\n"))
+	assert.Equal(errInvalidV1Header, err, "v1 family mismatch")
+	_, err = read([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 563240 29483\r\n"))
+	assert.Equal(errInvalidV1Header, err, "v1 invalid port")
+	_, err = read([]byte("PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLength) + "\r\n"))
+	assert.Equal(errProxyV1TooLong, err, "v1 too long")
+
+	// v2
+	inet := append(append(net.ParseIP("192.0.2.1").To4(), net.ParseIP("198.51.100.1").To4()...), 0xdc, 0x04, 0x73, 0x2b)
+	addr, err = read(proxyV2Header(proxyV2CmdProxy, proxyV2FamInet, inet))
+	require.NoError(err, "v2 INET")
+	assert.Equal("192.0.2.1:56324", addr.String(), "v2 INET")
+	inet6 := append(append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...), 0xdc, 0x04, 0x73, 0x2b)
+	inet6 = append(inet6, 0x04, 0x00, 0x01, 0x00) // A TLV.
+	addr, err = read(proxyV2Header(proxyV2CmdProxy, proxyV2FamInet6, inet6))
+	require.NoError(err, "v2 INET6")
+	assert.Equal("[2001:db8::1]:56324", addr.String(), "v2 INET6 with TLV")
+	addr, err = read(proxyV2Header(proxyV2CmdLocal, 0, nil))
+	require.NoError(err, "v2 LOCAL")
+	assert.Nil(addr, "v2 LOCAL")
+	_, err = read(proxyV2Header(proxyV2CmdProxy, proxyV2FamInet6, inet))
+	assert.Error(err, "v2 short address block")
+	_, err = read(proxyV2Header(proxyV2CmdProxy, 0x3, make([]byte, 216)))
+	assert.Equal(errUnsupportedProxy, err, "v2 AF_UNIX")
+
+	// No header.
+	_, err = read([]byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b"))
+	assert.Equal(errNoProxyHeader, err, "no header")
+}
+
+func TestIsTrustedProxy(t *testing.T) {
+	assert := assert.New(t)
+
+	var trusted []*net.IPNet
+	for _, v := range []string{"10.0.0.0/8", "2001:db8::/32"} {
+		_, n, err := net.ParseCIDR(v)
+		require.NoError(t, err, "ParseCIDR()")
+		trusted = append(trusted, n)
+	}
+
+	assert.True(isTrustedProxy(tcpAddr("10.1.2.3"), trusted), "IPv4 proxy")
+	assert.True(isTrustedProxy(tcpAddr("2001:db8::1"), trusted), "IPv6 proxy")
+	assert.False(isTrustedProxy(tcpAddr("192.0.2.1"), trusted), "untrusted")
+	assert.True(isTrustedProxy(&net.UnixAddr{Name: "@", Net: "unix"}, trusted), "unix")
+}
@@ -0,0 +1,149 @@
+// systemd.go - systemd socket activation support.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package incoming
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// sdListenFdsStart is the first file descriptor passed by systemd, which is
+// only changed by the tests.
+var sdListenFdsStart = 3
+
+type inheritedSocket struct {
+	name string
+	fd   int
+	used bool
+	addr net.Addr // Set once used.
+}
+
+var (
+	inheritedLock    sync.Mutex
+	inheritedSockets []*inheritedSocket
+	inheritedOnce    sync.Once
+)
+
+// loadInheritedSockets parses the systemd socket activation environment,
+// which is then cleared so that it is not passed on to child processes.
+func loadInheritedSockets() {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return
+	}
+	var names []string
+	if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+	for i := 0; i < n; i++ {
+		fd := sdListenFdsStart + i
+		syscall.CloseOnExec(fd)
+		s := &inheritedSocket{fd: fd}
+		if i < len(names) {
+			s.name = names[i]
+		}
+		inheritedSockets = append(inheritedSockets, s)
+	}
+}
+
+// findInherited returns the socket inherited via systemd socket activation
+// with the FileDescriptorName name, or failing that with the index name in
+// LISTEN_FDS.  The caller must hold inheritedLock.
+func findInherited(name string) (*inheritedSocket, error) {
+	inheritedOnce.Do(loadInheritedSockets)
+
+	for _, v := range inheritedSockets {
+		if v.name == name {
+			return v, nil
+		}
+	}
+	if idx, err := strconv.Atoi(name); err == nil && idx >= 0 && idx < len(inheritedSockets) {
+		return inheritedSockets[idx], nil
+	}
+	return nil, fmt.Errorf("incoming: no inherited socket '%v'", name)
+}
+
+// InheritedAddr returns the local address of the socket inherited via
+// systemd socket activation with the name, as used in a `systemd:` listener
+// address, without using the socket.
+func InheritedAddr(name string) (net.Addr, error) {
+	inheritedLock.Lock()
+	defer inheritedLock.Unlock()
+
+	s, err := findInherited(name)
+	if err != nil {
+		return nil, err
+	}
+	if s.used {
+		return s.addr, nil
+	}
+	sa, err := syscall.Getsockname(s.fd)
+	if err != nil {
+		return nil, fmt.Errorf("incoming: inherited socket '%v' has no address: %v", name, err)
+	}
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.TCPAddr{IP: net.IP(append([]byte{}, sa.Addr[:]...)), Port: sa.Port}, nil
+	case *syscall.SockaddrInet6:
+		return &net.TCPAddr{IP: net.IP(append([]byte{}, sa.Addr[:]...)), Port: sa.Port}, nil
+	case *syscall.SockaddrUnix:
+		return &net.UnixAddr{Name: sa.Name, Net: "unix"}, nil
+	default:
+		return nil, fmt.Errorf("incoming: inherited socket '%v' has an unsupported address type: %T", name, sa)
+	}
+}
+
+// listenInherited returns a listener for the socket inherited via systemd
+// socket activation with the name, as accepted by findInherited.  Each
+// socket may only be used once.
+func listenInherited(name string) (net.Listener, error) {
+	inheritedLock.Lock()
+	defer inheritedLock.Unlock()
+
+	s, err := findInherited(name)
+	if err != nil {
+		return nil, err
+	}
+	if s.used {
+		return nil, fmt.Errorf("incoming: inherited socket '%v' is already in use", name)
+	}
+
+	// net.FileListener duplicates the descriptor, so the original is closed.
+	f := os.NewFile(uintptr(s.fd), "systemd:"+name)
+	l, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("incoming: inherited socket '%v' is not a listener: %v", name, err)
+	}
+	s.used = true
+	s.addr = l.Addr()
+	return l, nil
+}
@@ -0,0 +1,121 @@
+// systemd_test.go - systemd socket activation tests.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package incoming
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testListenFdsStart is where the tests place the inherited sockets, well
+// clear of the descriptors used by the test binary itself.
+const testListenFdsStart = 200
+
+// inheritSockets sets up the listeners as if they were passed by systemd
+// with the FileDescriptorNames names.
+func inheritSockets(t *testing.T, names string, lns ...net.Listener) {
+	require := require.New(t)
+
+	inheritedLock.Lock()
+	defer inheritedLock.Unlock()
+
+	for i, ln := range lns {
+		f, err := ln.(interface {
+			File() (*os.File, error)
+		}).File()
+		require.NoError(err, "File()")
+		require.NoError(syscall.Dup3(int(f.Fd()), testListenFdsStart+i, 0), "Dup3()")
+		f.Close()
+	}
+	sdListenFdsStart = testListenFdsStart
+	inheritedSockets = nil
+	inheritedOnce = sync.Once{}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", strconv.Itoa(len(lns)))
+	os.Setenv("LISTEN_FDNAMES", names)
+}
+
+func TestListenInherited(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "incoming_systemd")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err, "Listen(tcp)")
+	defer tcpLn.Close()
+	unixLn, err := net.Listen("unix", filepath.Join(dir, "mix.sock"))
+	require.NoError(err, "Listen(unix)")
+	defer unixLn.Close()
+	inheritSockets(t, "mix:", tcpLn, unixLn)
+
+	// The sockets are found by name, or by index, and the environment is
+	// cleared once it has been parsed.
+	addr, err := InheritedAddr("mix")
+	require.NoError(err, "InheritedAddr(mix)")
+	assert.Equal(tcpLn.Addr().String(), addr.String(), "InheritedAddr(mix)")
+	assert.Empty(os.Getenv("LISTEN_FDS"), "LISTEN_FDS cleared")
+	addr, err = InheritedAddr("1")
+	require.NoError(err, "InheritedAddr(1)")
+	assert.Equal(unixLn.Addr().String(), addr.String(), "InheritedAddr(1)")
+	_, err = InheritedAddr("missing")
+	assert.Error(err, "InheritedAddr(missing)")
+
+	// The inherited socket accepts connections.
+	l, err := listenInherited("mix")
+	require.NoError(err, "listenInherited(mix)")
+	defer l.Close()
+	assert.Equal(tcpLn.Addr().String(), l.Addr().String(), "listenInherited(mix): Addr()")
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(err, "Dial()")
+	conn.Close()
+	conn, err = l.Accept()
+	require.NoError(err, "Accept()")
+	conn.Close()
+
+	// Each socket may only be used once, but its address remains known.
+	_, err = listenInherited("0")
+	assert.Error(err, "listenInherited(0): already in use")
+	addr, err = InheritedAddr("mix")
+	require.NoError(err, "InheritedAddr(mix): in use")
+	assert.Equal(tcpLn.Addr().String(), addr.String(), "InheritedAddr(mix): in use")
+	_, err = listenInherited("missing")
+	assert.Error(err, "listenInherited(missing)")
+
+	syscall.Close(testListenFdsStart + 1)
+
+	// Sockets passed to another process are ignored.
+	inheritSockets(t, "mix", tcpLn)
+	os.Setenv("LISTEN_PID", "1")
+	_, err = InheritedAddr("mix")
+	assert.Error(err, "InheritedAddr(mix): other process")
+	syscall.Close(testListenFdsStart)
+}
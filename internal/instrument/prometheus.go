@@ -1,14 +1,212 @@
+// prometheus.go - Katzenpost server metrics and health check listener.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package instrument implements the metrics and health check HTTP listener.
 package instrument
 
 import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/server/config"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/op/go-logging.v1"
 )
 
-// Init initialize instrumentation
-func Init() {
-	// Expose registered metrics via HTTP
-	http.Handle("/metrics", promhttp.Handler())
-	go http.ListenAndServe(":6543", nil)
+// CheckFn is a readiness check, returning a non-nil error iff the checked
+// component is not ready.
+type CheckFn func() error
+
+// Server is the metrics and health check HTTP listener.
+type Server struct {
+	sync.RWMutex
+
+	cfg *config.Metrics
+	log *logging.Logger
+
+	l      net.Listener
+	srv    *http.Server
+	checks map[string]CheckFn
+}
+
+// RegisterCheck registers a named readiness check, to be queried by the
+// `/readyz` endpoint.
+func (s *Server) RegisterCheck(name string, fn CheckFn) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.checks[name] = fn
+}
+
+// Halt stops the listener.
+func (s *Server) Halt() {
+	if err := s.srv.Shutdown(context.Background()); err != nil {
+		s.log.Errorf("Shutdown error: %v", err)
+	}
+	if unixPath := s.unixPath(); unixPath != "" {
+		os.Remove(unixPath)
+	}
+}
+
+func (s *Server) unixPath() string {
+	if !strings.HasPrefix(s.cfg.Address, config.MetricsUnixPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(s.cfg.Address, config.MetricsUnixPrefix)
+}
+
+func (s *Server) onHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *Server) onReadyz(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	names := make([]string, 0, len(s.checks))
+	for name := range s.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	checks := make([]CheckFn, 0, len(names))
+	for _, name := range names {
+		checks = append(checks, s.checks[name])
+	}
+	s.RUnlock()
+
+	var b strings.Builder
+	isReady := true
+	for i, fn := range checks {
+		if err := fn(); err != nil {
+			isReady = false
+			fmt.Fprintf(&b, "%s: %v\n", names[i], err)
+		} else {
+			fmt.Fprintf(&b, "%s: ok\n", names[i])
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !isReady {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write([]byte(b.String()))
+}
+
+func (s *Server) withAuth(h http.Handler) http.Handler {
+	switch {
+	case s.cfg.BasicAuthUser != "":
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u, p, ok := r.BasicAuth()
+			if !ok || !constantTimeEq(u, s.cfg.BasicAuthUser) || !constantTimeEq(p, s.cfg.BasicAuthPassword) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="katzenpost"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	case s.cfg.BearerToken != "":
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			const prefix = "Bearer "
+			hdr := r.Header.Get("Authorization")
+			if !strings.HasPrefix(hdr, prefix) || !constantTimeEq(strings.TrimPrefix(hdr, prefix), s.cfg.BearerToken) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	default:
+		return h
+	}
+}
+
+func constantTimeEq(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// New creates a new metrics and health check listener, and starts serving
+// requests.  Failure to bind to the configured address is returned as an
+// error.
+func New(cfg *config.Metrics, logBackend *log.Backend) (*Server, error) {
+	s := &Server{
+		cfg:    cfg,
+		log:    logBackend.GetLogger("metrics"),
+		checks: make(map[string]CheckFn),
+	}
+
+	// Load the TLS certificate up front, so that failures are reported at
+	// startup rather than from the serving go routine.
+	var tlsCfg *tls.Config
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("instrument: failed to load TLS certificate: %v", err)
+		}
+		tlsCfg = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	var err error
+	if unixPath := s.unixPath(); unixPath != "" {
+		if _, err = os.Stat(unixPath); err == nil {
+			s.log.Warningf("Metrics socket file '%s' already exists, deleting it.", unixPath)
+			if err = os.Remove(unixPath); err != nil {
+				return nil, err
+			}
+		}
+		s.l, err = net.Listen("unix", unixPath)
+	} else {
+		s.l, err = net.Listen("tcp", cfg.Address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("instrument: failed to listen on '%v': %v", cfg.Address, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", s.onHealthz)
+	mux.HandleFunc("/readyz", s.onReadyz)
+	s.srv = &http.Server{
+		Handler:   s.withAuth(mux),
+		TLSConfig: tlsCfg,
+		ErrorLog:  logBackend.GetGoLogger("metrics_http", "info"),
+	}
+
+	useTLS := tlsCfg != nil
+	go func() {
+		var err error
+		if useTLS {
+			err = s.srv.ServeTLS(s.l, "", "")
+		} else {
+			err = s.srv.Serve(s.l)
+		}
+		if err != http.ErrServerClosed {
+			s.log.Errorf("Serve error: %v", err)
+		}
+	}()
+	s.log.Noticef("Listening on: %v (TLS: %v)", s.l.Addr(), useTLS)
+
+	return s, nil
 }
@@ -172,6 +172,37 @@ func (co *connector) onClosedConn(c *outgoingConn) {
 	delete(co.conns, nodeID)
 }
 
+func (co *connector) onConnEstablished(c *outgoingConn, remoteAddr string) {
+	co.Lock()
+	defer co.Unlock()
+
+	// An empty address signifies that the connection was torn down.
+	c.remoteAddr = remoteAddr
+	if remoteAddr != "" {
+		c.establishedAt = time.Now()
+	} else {
+		c.establishedAt = time.Time{}
+	}
+}
+
+func (co *connector) Connections() []glue.ConnInfo {
+	co.RLock()
+	defer co.RUnlock()
+
+	conns := make([]glue.ConnInfo, 0, len(co.conns))
+	for id, c := range co.conns {
+		if c.establishedAt.IsZero() {
+			continue
+		}
+		conns = append(conns, glue.ConnInfo{
+			Peer:  debug.NodeIDToPrintString(&id),
+			Addr:  c.remoteAddr,
+			Since: c.establishedAt,
+		})
+	}
+	return conns
+}
+
 func (co *connector) IsValidForwardDest(id *[constants.NodeIDLength]byte) bool {
 	// This doesn't need to be super accurate, just enough to prevent packets
 	// destined to la-la land from being scheduled.
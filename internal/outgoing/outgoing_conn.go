@@ -48,6 +48,9 @@ type outgoingConn struct {
 	id         uint64
 	retryDelay time.Duration
 	canSend    bool
+
+	remoteAddr    string    // Protected by the connector lock.
+	establishedAt time.Time // Protected by the connector lock.
 }
 
 var (
@@ -283,6 +286,8 @@ func (c *outgoingConn) onConnEstablished(conn net.Conn, closeCh <-chan struct{})
 	c.log.Debugf("Handshake completed.")
 	conn.SetDeadline(time.Time{})
 	c.retryDelay = 0 // Reset the retry delay on successful handshakes.
+	c.co.onConnEstablished(c, conn.RemoteAddr().String())
+	defer c.co.onConnEstablished(c, "")
 
 	// Since outgoing connections have no reverse traffic, read from the
 	// reverse path to detect that the connection has been closed.
@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -40,6 +41,7 @@ import (
 	"github.com/katzenpost/server/internal/constants"
 	"github.com/katzenpost/server/internal/debug"
 	"github.com/katzenpost/server/internal/glue"
+	"github.com/katzenpost/server/internal/incoming"
 	"github.com/katzenpost/server/internal/pkicache"
 	"github.com/prometheus/client_golang/prometheus"
 	"gopkg.in/op/go-logging.v1"
@@ -68,6 +70,8 @@ type pki struct {
 	failedFetches      map[uint64]error
 	lastPublishedEpoch uint64
 	lastWarnedEpoch    uint64
+	lastPublishAt      time.Time
+	lastPublishErr     error
 }
 
 var (
@@ -439,6 +443,10 @@ func (p *pki) publishDescriptorIfNeeded(pkiCtx context.Context) error {
 
 	// Post the descriptor to all the authorities.
 	err := p.impl.Post(pkiCtx, doPublishEpoch, p.glue.IdentityKey(), desc)
+	p.Lock()
+	defer p.Unlock()
+	p.lastPublishAt = time.Now()
+	p.lastPublishErr = err
 	switch err {
 	case nil:
 		p.log.Debugf("Posted descriptor for epoch: %v", doPublishEpoch)
@@ -656,6 +664,29 @@ func (p *pki) GetRawConsensus(epoch uint64) ([]byte, error) {
 	return val, nil
 }
 
+// LastPublish returns the epoch, time, and result of the most recent attempt
+// to post the descriptor.
+func (p *pki) LastPublish() (uint64, time.Time, error) {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.lastPublishedEpoch, p.lastPublishAt, p.lastPublishErr
+}
+
+// DocumentEpochs returns the epochs for which a PKI document is cached, in
+// ascending order.
+func (p *pki) DocumentEpochs() []uint64 {
+	p.RLock()
+	defer p.RUnlock()
+
+	epochs := make([]uint64, 0, len(p.docs))
+	for epoch := range p.docs {
+		epochs = append(epochs, epoch)
+	}
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] < epochs[j] })
+	return epochs
+}
+
 // New reuturns a new pki.
 func New(glue glue.Glue) (glue.PKI, error) {
 	p := &pki{
@@ -731,6 +762,26 @@ func New(glue glue.Glue) (glue.PKI, error) {
 func makeDescAddrMap(addrs []string) (map[cpki.Transport][]string, error) {
 	m := make(map[cpki.Transport][]string)
 	for _, addr := range addrs {
+		// Unix domain sockets are only reachable via a front-end, which is
+		// advertised with the AltAddresses.
+		if strings.HasPrefix(addr, config.AddressUnixPrefix) {
+			continue
+		}
+
+		// Inherited sockets are advertised with the address that they are
+		// actually bound to, iff it is a specific TCP address.
+		if strings.HasPrefix(addr, config.AddressSystemdPrefix) {
+			a, err := incoming.InheritedAddr(strings.TrimPrefix(addr, config.AddressSystemdPrefix))
+			if err != nil {
+				return nil, err
+			}
+			tcpAddr, ok := a.(*net.TCPAddr)
+			if !ok || tcpAddr.IP.IsUnspecified() {
+				continue
+			}
+			addr = tcpAddr.String()
+		}
+
 		h, p, err := net.SplitHostPort(addr)
 		if err != nil {
 			return nil, err
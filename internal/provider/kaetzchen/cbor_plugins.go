@@ -21,6 +21,8 @@ package kaetzchen
 import (
 	"errors"
 	"fmt"
+	"os"
+	"sort"
 	"sync"
 	"time"
 
@@ -28,6 +30,7 @@ import (
 	sConstants "github.com/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/core/worker"
 	"github.com/katzenpost/server/cborplugin"
+	"github.com/katzenpost/server/config"
 	"github.com/katzenpost/server/internal/glue"
 	"github.com/katzenpost/server/internal/packet"
 	"github.com/prometheus/client_golang/prometheus"
@@ -60,9 +63,9 @@ type CBORPluginWorker struct {
 	glue glue.Glue
 	log  *logging.Logger
 
-	haltOnce    sync.Once
 	pluginChans PluginChans
-	clients     []*cborplugin.Client
+	plugins     map[[sConstants.RecipientIDLength]byte][]*pluginInstance
+	privateDirs []string
 }
 
 // OnKaetzchen enqueues the pkt for processing by our thread pool of plugins.
@@ -72,16 +75,39 @@ func (k *CBORPluginWorker) OnKaetzchen(pkt *packet.Packet) {
 		k.log.Debugf("Failed to find handler. Dropping Kaetzchen request: %v", pkt.ID)
 		return
 	}
+	if !k.anyUp(pkt.Recipient.ID) {
+		k.log.Debugf("No plugin available. Dropping Kaetzchen request: %v", pkt.ID)
+		kaetzchenRequestsDropped.Inc()
+		pkt.Dispose()
+		return
+	}
 	handlerCh.In() <- pkt
 }
 
-func (k *CBORPluginWorker) worker(recipient [sConstants.RecipientIDLength]byte, pluginClient cborplugin.ServicePlugin) {
+func (k *CBORPluginWorker) anyUp(recipient [sConstants.RecipientIDLength]byte) bool {
+	for _, p := range k.plugins[recipient] {
+		if c, _ := p.get(); c != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// QueueLen returns the number of requests awaiting processing, summed across
+// all of the plugins.
+func (k *CBORPluginWorker) QueueLen() int {
+	n := 0
+	for _, ch := range k.pluginChans {
+		n += ch.Len()
+	}
+	return n
+}
+
+func (k *CBORPluginWorker) worker(recipient [sConstants.RecipientIDLength]byte, plugin *pluginInstance) {
 
 	// Kaetzchen delay is our max dwell time.
 	maxDwell := time.Duration(k.glue.Config().Debug.KaetzchenDelay) * time.Millisecond
 
-	defer k.haltOnce.Do(k.haltAllClients)
-
 	handlerCh, ok := k.pluginChans[recipient]
 	if !ok {
 		k.log.Debugf("Failed to find handler. Dropping Kaetzchen request: %v", recipient)
@@ -91,6 +117,18 @@ func (k *CBORPluginWorker) worker(recipient [sConstants.RecipientIDLength]byte,
 	ch := handlerCh.Out()
 
 	for {
+		// Wait for the plugin to come back up, while it is restarting.
+		pluginClient, readyCh := plugin.get()
+		if pluginClient == nil {
+			select {
+			case <-k.HaltCh():
+				k.log.Debugf("Terminating gracefully.")
+				return
+			case <-readyCh:
+			}
+			continue
+		}
+
 		var pkt *packet.Packet
 		select {
 		case <-k.HaltCh():
@@ -111,13 +149,6 @@ func (k *CBORPluginWorker) worker(recipient [sConstants.RecipientIDLength]byte,
 	}
 }
 
-func (k *CBORPluginWorker) haltAllClients() {
-	k.log.Debug("Halting plugin clients.")
-	for _, client := range k.clients {
-		go client.Halt()
-	}
-}
-
 func (k *CBORPluginWorker) processKaetzchen(pkt *packet.Packet, pluginClient cborplugin.ServicePlugin) {
 	kaetzchenRequestsTimer = prometheus.NewTimer(kaetzchenRequestsDuration)
 	defer kaetzchenRequestsTimer.ObserveDuration()
@@ -171,47 +202,118 @@ func (k *CBORPluginWorker) processKaetzchen(pkt *packet.Packet, pluginClient cbo
 // KaetzchenForPKI returns the plugins Parameters map for publication in the PKI doc.
 func (k *CBORPluginWorker) KaetzchenForPKI() ServiceMap {
 	s := make(ServiceMap)
-	for _, k := range k.clients {
-		capa := k.Capability()
-		if _, ok :=  s[capa]; ok {
-			// skip adding twice
-			continue
-		}
-		params := make(PluginParameters)
-		p := k.GetParameters()
-		if p != nil {
-			for key, value := range *p {
-				params[key] = value
+	for _, plugins := range k.plugins {
+		for _, plugin := range plugins {
+			k, _ := plugin.get()
+			if k == nil {
+				continue
+			}
+			capa := k.Capability()
+			if _, ok := s[capa]; ok {
+				// skip adding twice
+				continue
 			}
+			params := make(PluginParameters)
+			p := k.GetParameters()
+			if p != nil {
+				for key, value := range *p {
+					params[key] = value
+				}
+			}
+			s[capa] = params
 		}
-		s[capa] = params
 	}
 	return s
 }
 
+// PluginStatus returns the status of each of the plugin processes.
+func (k *CBORPluginWorker) PluginStatus() []glue.PluginInfo {
+	var s []glue.PluginInfo
+	for _, plugins := range k.plugins {
+		for _, plugin := range plugins {
+			s = append(s, plugin.info())
+		}
+	}
+	sort.Slice(s, func(i, j int) bool {
+		if s[i].Capability != s[j].Capability {
+			return s[i].Capability < s[j].Capability
+		}
+		return s[i].Instance < s[j].Instance
+	})
+	return s
+}
+
 // IsKaetzchen returns true if the given recipient is one of our workers.
 func (k *CBORPluginWorker) IsKaetzchen(recipient [sConstants.RecipientIDLength]byte) bool {
 	_, ok := k.pluginChans[recipient]
 	return ok
 }
 
-func (k *CBORPluginWorker) launch(command, capability, endpoint string, args []string) (*cborplugin.Client, error) {
-	k.log.Debugf("Launching plugin: %s", command)
-	plugin := cborplugin.New(command, capability, endpoint, k.glue.LogBackend())
-	err := plugin.Start(command, args)
+// launchOptions returns the options that the plugin is launched with.
+func (k *CBORPluginWorker) launchOptions(pluginConf *config.CBORPluginKaetzchen) (*cborplugin.LaunchOptions, error) {
+	opts := &cborplugin.LaunchOptions{
+		Env: pluginConf.Env,
+		Dir: pluginConf.WorkingDirectory,
+	}
+	if !pluginConf.LegacyConfigArgs {
+		opts.Config = pluginConf.Config
+		if opts.Config == nil {
+			opts.Config = make(map[string]interface{})
+		}
+	}
+	if err := k.sandboxOptions(pluginConf, opts); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+func (k *CBORPluginWorker) launch(pluginConf *config.CBORPluginKaetzchen, opts *cborplugin.LaunchOptions) (*cborplugin.Client, error) {
+	k.log.Debugf("Launching plugin: %s", pluginConf.Command)
+
+	var args []string
+	if pluginConf.LegacyConfigArgs {
+		keys := make([]string, 0, len(pluginConf.Config))
+		for key := range pluginConf.Config {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			args = append(args, fmt.Sprintf("-%s", key), fmt.Sprintf("%v", pluginConf.Config[key]))
+		}
+	}
+
+	plugin := cborplugin.New(pluginConf.Command, pluginConf.Capability, pluginConf.Endpoint, k.glue.LogBackend())
+	err := plugin.StartWithOptions(pluginConf.Command, args, opts)
 	return plugin, err
 }
 
+// Halt stops the plugins, and removes their private working directories.
+func (k *CBORPluginWorker) Halt() {
+	k.Worker.Halt()
+	for _, dir := range k.privateDirs {
+		os.RemoveAll(dir)
+	}
+}
+
 // NewCBORPluginWorker returns a new CBORPluginWorker
-func NewCBORPluginWorker(glue glue.Glue) (*CBORPluginWorker, error) {
+func NewCBORPluginWorker(glue glue.Glue) (_ *CBORPluginWorker, err error) {
 
 	kaetzchenWorker := CBORPluginWorker{
 		glue:        glue,
 		log:         glue.LogBackend().GetLogger("CBOR plugin worker"),
 		pluginChans: make(PluginChans),
-		clients:     make([]*cborplugin.Client, 0),
+		plugins:     make(map[[sConstants.RecipientIDLength]byte][]*pluginInstance),
 	}
 
+	// Stop the plugins that were started, and remove their private working
+	// directories on failure.  This runs after the deferred workers are
+	// started below.
+	defer func() {
+		if err != nil {
+			kaetzchenWorker.Halt()
+		}
+	}()
+
 	capaMap := make(map[string]bool)
 
 	for _, pluginConf := range glue.Config().Provider.CBORPluginKaetzchen {
@@ -248,32 +350,45 @@ func NewCBORPluginWorker(glue glue.Glue) (*CBORPluginWorker, error) {
 		copy(endpoint[:], rawEp)
 		kaetzchenWorker.pluginChans[endpoint] = channels.NewInfiniteChannel()
 
+		opts, err := kaetzchenWorker.launchOptions(pluginConf)
+		if err != nil {
+			return nil, err
+		}
+
 		// Start the plugin clients.
 		for i := 0; i < pluginConf.MaxConcurrency; i++ {
 			kaetzchenWorker.log.Noticef("Starting Kaetzchen plugin client: %s %d", capa, i)
 
-			var args []string
-			if len(pluginConf.Config) > 0 {
-				args = []string{}
-				for key, val := range pluginConf.Config {
-					args = append(args, fmt.Sprintf("-%s", key), val.(string))
-				}
-			}
-
-			pluginClient, err := kaetzchenWorker.launch(pluginConf.Command, pluginConf.Capability, pluginConf.Endpoint, args)
+			pluginClient, err := kaetzchenWorker.launch(pluginConf, opts)
 			if err != nil {
 				kaetzchenWorker.log.Error("Failed to start a plugin client: %s", err)
 				return nil, err
 			}
 
-			// Accumulate a list of all clients to facilitate clean shutdown.
-			kaetzchenWorker.clients = append(kaetzchenWorker.clients, pluginClient)
+			plugin := newPluginInstance(&kaetzchenWorker, pluginConf, opts, i, pluginClient)
+			kaetzchenWorker.plugins[endpoint] = append(kaetzchenWorker.plugins[endpoint], plugin)
+
+			// Plugins that speak protocol v2 handle concurrent requests
+			// themselves, so a single process is shared by all of the
+			// workers.
+			isMultiplexed := pluginClient.ProtocolVersion() >= cborplugin.ProtocolV2
+			nWorkers := 1
+			if isMultiplexed {
+				nWorkers = pluginConf.MaxConcurrency
+			}
 
 			// Start the workers _after_ we have added all of the entries to pluginChans
-			// otherwise the worker() goroutines race this thread.
-			defer kaetzchenWorker.Go(func() {
-				kaetzchenWorker.worker(endpoint, pluginClient)
-			})
+			// otherwise the worker() goroutines race this thread.  The
+			// supervisor halts the plugin once the worker is halted.
+			defer kaetzchenWorker.Go(plugin.supervise)
+			for j := 0; j < nWorkers; j++ {
+				defer kaetzchenWorker.Go(func() {
+					kaetzchenWorker.worker(endpoint, plugin)
+				})
+			}
+			if isMultiplexed {
+				break
+			}
 		}
 
 		capaMap[capa] = true
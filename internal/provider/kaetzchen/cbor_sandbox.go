@@ -0,0 +1,111 @@
+// cbor_sandbox.go - cbor plugin process hardening
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/katzenpost/server/cborplugin"
+	"github.com/katzenpost/server/config"
+)
+
+// sandboxOptions applies the plugin's Sandbox configuration to opts.
+func (k *CBORPluginWorker) sandboxOptions(pluginConf *config.CBORPluginKaetzchen, opts *cborplugin.LaunchOptions) error {
+	sb := pluginConf.Sandbox
+	if sb == nil {
+		return nil
+	}
+	capa := pluginConf.Capability
+
+	opts.ClearEnv = sb.ClearEnv
+	opts.NoNewPrivileges = sb.NoNewPrivileges
+	opts.RLimits = cborplugin.RLimits{
+		CPU:          sb.MaxCPUTime,
+		AddressSpace: sb.MaxAddressSpace,
+		OpenFiles:    sb.MaxOpenFiles,
+	}
+
+	if sb.User != "" {
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("provider: Kaetzchen: '%v' Sandbox User requires running as root", capa)
+		}
+		cred, err := lookupCredential(sb.User, sb.Group)
+		if err != nil {
+			return fmt.Errorf("provider: Kaetzchen: '%v' invalid Sandbox User/Group: %v", capa, err)
+		}
+		if cred.UID == 0 {
+			return fmt.Errorf("provider: Kaetzchen: '%v' Sandbox User must not be root", capa)
+		}
+		opts.Credential = cred
+	}
+
+	if sb.PrivateWorkingDirectory {
+		dir, err := ioutil.TempDir("", "katzenpost-plugin-")
+		if err != nil {
+			return fmt.Errorf("provider: Kaetzchen: '%v' failed to create private working directory: %v", capa, err)
+		}
+		k.privateDirs = append(k.privateDirs, dir)
+		if cred := opts.Credential; cred != nil {
+			if err = os.Chown(dir, int(cred.UID), int(cred.GID)); err != nil {
+				return fmt.Errorf("provider: Kaetzchen: '%v' failed to chown private working directory: %v", capa, err)
+			}
+		}
+		opts.Dir = dir
+	}
+
+	return nil
+}
+
+// lookupCredential resolves the user and group names or ids, defaulting to
+// the user's primary group.
+func lookupCredential(userName, groupName string) (*cborplugin.Credential, error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		var idErr error
+		if u, idErr = user.LookupId(userName); idErr != nil {
+			return nil, err
+		}
+	}
+	gid := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			var idErr error
+			if g, idErr = user.LookupGroupId(groupName); idErr != nil {
+				return nil, err
+			}
+		}
+		gid = g.Gid
+	}
+
+	cred := new(cborplugin.Credential)
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("non-numeric uid '%v'", u.Uid)
+	}
+	cred.UID = uint32(uid)
+	g, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("non-numeric gid '%v'", gid)
+	}
+	cred.GID = uint32(g)
+	return cred, nil
+}
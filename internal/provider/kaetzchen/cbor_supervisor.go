@@ -0,0 +1,234 @@
+// cbor_supervisor.go - cbor plugin process supervision
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/server/cborplugin"
+	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/internal/constants"
+	"github.com/katzenpost/server/internal/glue"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	// maxHealthCheckFailures is the number of consecutive failed health
+	// checks after which a plugin is restarted.
+	maxHealthCheckFailures = 3
+
+	minRestartBackoff = time.Second
+	maxRestartBackoff = time.Minute
+
+	// backoffResetInterval is how long a plugin must stay up for the
+	// restart backoff to be reset.
+	backoffResetInterval = 5 * time.Minute
+)
+
+var (
+	pluginRestarts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: constants.Namespace,
+			Name:      "plugin_restarts_total",
+			Subsystem: constants.KaetzchenSubsystem,
+			Help:      "Number of CBOR plugin process restarts",
+		},
+		[]string{"capability"},
+	)
+	pluginUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: constants.Namespace,
+			Name:      "plugin_up",
+			Subsystem: constants.KaetzchenSubsystem,
+			Help:      "Whether each CBOR plugin process is up (1) or restarting (0)",
+		},
+		[]string{"capability", "instance"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(pluginRestarts)
+	prometheus.MustRegister(pluginUp)
+}
+
+// pluginInstance is a supervised plugin process.
+type pluginInstance struct {
+	sync.Mutex
+
+	k    *CBORPluginWorker
+	log  *logging.Logger
+	cfg  *config.CBORPluginKaetzchen
+	opts *cborplugin.LaunchOptions
+	idx  int
+
+	client   *cborplugin.Client
+	readyCh  chan struct{} // Closed while up.
+	isUp     bool
+	restarts uint64
+	since    time.Time
+}
+
+// get returns the plugin client iff the plugin is up, or a channel that is
+// closed once it is back up otherwise.
+func (p *pluginInstance) get() (*cborplugin.Client, <-chan struct{}) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.isUp {
+		return p.client, nil
+	}
+	return nil, p.readyCh
+}
+
+func (p *pluginInstance) setUp(client *cborplugin.Client) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.client = client
+	p.isUp = true
+	p.since = time.Now()
+	close(p.readyCh)
+	pluginUp.With(p.labels()).Set(1)
+}
+
+func (p *pluginInstance) setDown() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.isUp = false
+	p.since = time.Now()
+	p.readyCh = make(chan struct{})
+	pluginUp.With(p.labels()).Set(0)
+}
+
+func (p *pluginInstance) labels() prometheus.Labels {
+	return prometheus.Labels{"capability": p.cfg.Capability, "instance": strconv.Itoa(p.idx)}
+}
+
+func (p *pluginInstance) info() glue.PluginInfo {
+	p.Lock()
+	defer p.Unlock()
+
+	return glue.PluginInfo{
+		Capability: p.cfg.Capability,
+		Instance:   p.idx,
+		IsUp:       p.isUp,
+		Restarts:   p.restarts,
+		Since:      p.since,
+	}
+}
+
+// supervise restarts the plugin whenever it exits or fails its health
+// checks, until the worker is halted.
+func (p *pluginInstance) supervise() {
+	client, _ := p.get()
+	defer func() {
+		if client != nil {
+			client.Halt()
+		}
+	}()
+
+	var probeCh <-chan time.Time
+	if p.cfg.HealthCheckInterval > 0 {
+		t := time.NewTicker(time.Duration(p.cfg.HealthCheckInterval) * time.Second)
+		defer t.Stop()
+		probeCh = t.C
+	}
+
+	backoff := minRestartBackoff
+	for {
+		upAt := time.Now()
+		if !p.waitForFailure(client, probeCh) {
+			return
+		}
+		p.setDown()
+		client.Halt()
+		client = nil
+		if time.Since(upAt) >= backoffResetInterval {
+			backoff = minRestartBackoff
+		}
+
+		for client == nil {
+			p.log.Noticef("Restarting plugin in %v.", backoff)
+			select {
+			case <-p.k.HaltCh():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxRestartBackoff {
+				backoff = maxRestartBackoff
+			}
+
+			p.Lock()
+			p.restarts++
+			p.Unlock()
+			pluginRestarts.With(prometheus.Labels{"capability": p.cfg.Capability}).Inc()
+
+			c, err := p.k.launch(p.cfg, p.opts)
+			if err != nil {
+				p.log.Errorf("Failed to restart plugin: %v", err)
+				continue
+			}
+			client = c
+		}
+		p.log.Noticef("Plugin restarted.")
+		p.setUp(client)
+	}
+}
+
+// waitForFailure returns true once the plugin exits or fails its health
+// checks, or false if the worker is halted first.
+func (p *pluginInstance) waitForFailure(client *cborplugin.Client, probeCh <-chan time.Time) bool {
+	failures := 0
+	for {
+		select {
+		case <-p.k.HaltCh():
+			return false
+		case <-client.Exited():
+			p.log.Errorf("Plugin exited unexpectedly: %v", client.ExitErr())
+			return true
+		case <-probeCh:
+			err := client.Ping()
+			if err == nil {
+				failures = 0
+				continue
+			}
+			failures++
+			p.log.Warningf("Plugin health check failed (%d/%d): %v", failures, maxHealthCheckFailures, err)
+			if failures >= maxHealthCheckFailures {
+				return true
+			}
+		}
+	}
+}
+
+func newPluginInstance(k *CBORPluginWorker, cfg *config.CBORPluginKaetzchen, opts *cborplugin.LaunchOptions, idx int, client *cborplugin.Client) *pluginInstance {
+	p := &pluginInstance{
+		k:       k,
+		log:     k.glue.LogBackend().GetLogger(fmt.Sprintf("CBOR plugin %s:%d", cfg.Capability, idx)),
+		cfg:     cfg,
+		opts:    opts,
+		idx:     idx,
+		readyCh: make(chan struct{}),
+	}
+	p.setUp(client)
+	return p
+}
@@ -0,0 +1,177 @@
+// cbor_supervisor_test.go - cbor plugin process supervision tests.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/server/cborplugin"
+	"github.com/katzenpost/server/cborplugin/server"
+	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/internal/constants"
+	"github.com/katzenpost/server/internal/glue"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const supervisorHelperEnv = "KAETZCHEN_TEST_SUPERVISOR_HELPER"
+
+type pidHandler struct{}
+
+func (h *pidHandler) OnRequest(*cborplugin.Request) ([]byte, error) {
+	return []byte(strconv.Itoa(os.Getpid())), nil
+}
+
+func (h *pidHandler) GetParameters() *cborplugin.Parameters {
+	return nil
+}
+
+// TestSupervisorHelperProcess is the plugin launched by TestSupervisor,
+// which responds to every request with its process ID.
+func TestSupervisorHelperProcess(t *testing.T) {
+	if os.Getenv(supervisorHelperEnv) != "1" {
+		return
+	}
+	if err := server.Run(&pidHandler{}); err != nil {
+		fmt.Fprintf(os.Stderr, "Run(): %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// gatheredValue returns the value of the named metric with the labels from
+// the default registry.
+func gatheredValue(t *testing.T, name string, labels prometheus.Labels) float64 {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err, "Gather()")
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	metricLoop:
+		for _, m := range mf.GetMetric() {
+			if len(m.GetLabel()) != len(labels) {
+				continue
+			}
+			for _, l := range m.GetLabel() {
+				if labels[l.GetName()] != l.GetValue() {
+					continue metricLoop
+				}
+			}
+			if g := m.GetGauge(); g != nil {
+				return g.GetValue()
+			}
+			return m.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestSupervisor(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	idKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "eddsa.NewKeypair()")
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "ecdh.NewKeypair()")
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err, "log.New()")
+
+	// The helper is passed the flag selecting it as a legacy argument.
+	goo := getGlue(logBackend, &mockProvider{}, linkKey, idKey)
+	goo.s.cfg.Provider.CBORPluginKaetzchen = []*config.CBORPluginKaetzchen{
+		&config.CBORPluginKaetzchen{
+			Capability:       "supervised",
+			Endpoint:         "supervised",
+			Config:           map[string]interface{}{"test.run": "TestSupervisorHelperProcess"},
+			LegacyConfigArgs: true,
+			Command:          os.Args[0],
+			Env:              map[string]string{supervisorHelperEnv: "1"},
+			MaxConcurrency:   1,
+		},
+	}
+
+	upName := prometheus.BuildFQName(constants.Namespace, constants.KaetzchenSubsystem, "plugin_up")
+	restartsName := prometheus.BuildFQName(constants.Namespace, constants.KaetzchenSubsystem, "plugin_restarts_total")
+	upLabels := prometheus.Labels{"capability": "supervised", "instance": "0"}
+	restartsLabels := prometheus.Labels{"capability": "supervised"}
+	restartsBefore := gatheredValue(t, restartsName, restartsLabels)
+
+	k, err := NewCBORPluginWorker(goo)
+	require.NoError(err, "NewCBORPluginWorker()")
+	defer k.Halt()
+
+	var plugin *pluginInstance
+	for _, plugins := range k.plugins {
+		require.Len(plugins, 1, "NewCBORPluginWorker(): instances")
+		plugin = plugins[0]
+	}
+	require.NotNil(plugin, "NewCBORPluginWorker(): plugin")
+
+	pid := func() int {
+		client, _ := plugin.get()
+		require.NotNil(client, "get(): up")
+		b, err := client.OnRequest(&cborplugin.Request{Payload: []byte("pid")})
+		require.NoError(err, "OnRequest()")
+		pid, err := strconv.Atoi(string(b))
+		require.NoError(err, "OnRequest(): pid")
+		return pid
+	}
+
+	status := k.PluginStatus()
+	require.Len(status, 1, "PluginStatus()")
+	assert.True(status[0].IsUp, "PluginStatus(): up")
+	assert.Zero(status[0].Restarts, "PluginStatus(): restarts")
+	assert.Equal(float64(1), gatheredValue(t, upName, upLabels), "plugin_up: started")
+	oldPid := pid()
+
+	// Killing the plugin marks it down until it is restarted after the
+	// minimum backoff.
+	require.NoError(syscall.Kill(oldPid, syscall.SIGKILL), "Kill()")
+	waitForStatus := func(isUp bool) glue.PluginInfo {
+		var info glue.PluginInfo
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if info = k.PluginStatus()[0]; info.IsUp == isUp {
+				break
+			}
+		}
+		return info
+	}
+	info := waitForStatus(false)
+	require.False(info.IsUp, "PluginStatus(): killed")
+	assert.Equal(float64(0), gatheredValue(t, upName, upLabels), "plugin_up: killed")
+	assert.Equal(fmt.Sprintf("supervised 0 down Restarts: 0 Since: %v", info.Since.UTC().Format(time.RFC3339)), info.String(), "PLUGIN_STATUS: killed")
+
+	info = waitForStatus(true)
+	require.True(info.IsUp, "PluginStatus(): restarted")
+	assert.Equal(uint64(1), info.Restarts, "PluginStatus(): restarts")
+	assert.Equal(fmt.Sprintf("supervised 0 up Restarts: 1 Since: %v", info.Since.UTC().Format(time.RFC3339)), info.String(), "PLUGIN_STATUS: restarted")
+	assert.Equal(float64(1), gatheredValue(t, upName, upLabels), "plugin_up: restarted")
+	assert.Equal(float64(1), gatheredValue(t, restartsName, restartsLabels)-restartsBefore, "plugin_restarts_total")
+	assert.NotEqual(oldPid, pid(), "restarted plugin process")
+}
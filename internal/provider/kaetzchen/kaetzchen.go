@@ -200,6 +200,11 @@ func (k *KaetzchenWorker) OnKaetzchen(pkt *packet.Packet) {
 	k.ch.In() <- pkt
 }
 
+// QueueLen returns the number of requests awaiting processing.
+func (k *KaetzchenWorker) QueueLen() int {
+	return k.ch.Len()
+}
+
 func (k *KaetzchenWorker) getDropCounter() uint64 {
 	return atomic.LoadUint64(&k.dropCounter)
 }
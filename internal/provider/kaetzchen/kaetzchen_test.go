@@ -35,7 +35,9 @@ import (
 	"github.com/katzenpost/server/internal/glue"
 	"github.com/katzenpost/server/internal/packet"
 	"github.com/katzenpost/server/internal/pkicache"
+	"github.com/katzenpost/server/internal/ratelimit"
 	"github.com/katzenpost/server/spool"
+	"github.com/katzenpost/server/spool/notifyspool"
 	"github.com/katzenpost/server/userdb"
 	"github.com/stretchr/testify/require"
 )
@@ -52,6 +54,12 @@ func (u *mockUserDB) IsValid([]byte, *ecdh.PublicKey) bool { return true }
 
 func (u *mockUserDB) Add([]byte, *ecdh.PublicKey, bool) error { return nil }
 
+func (u *mockUserDB) AddLinkKey([]byte, string, *ecdh.PublicKey) error { return nil }
+
+func (u *mockUserDB) RemoveLinkKey([]byte, string) error { return nil }
+
+func (u *mockUserDB) LinkKeys([]byte) (map[string]*ecdh.PublicKey, error) { return nil, nil }
+
 func (u *mockUserDB) SetIdentity([]byte, *ecdh.PublicKey) error { return nil }
 
 func (u *mockUserDB) Link([]byte) (*ecdh.PublicKey, error) {
@@ -64,6 +72,18 @@ func (u *mockUserDB) Identity([]byte) (*ecdh.PublicKey, error) {
 
 func (u *mockUserDB) Remove([]byte) error { return nil }
 
+func (u *mockUserDB) ForEach(func([]byte, *userdb.UserInfo) error) error { return nil }
+
+func (u *mockUserDB) Count() (int, error) { return 0, nil }
+
+func (u *mockUserDB) Info([]byte) (*userdb.UserInfo, error) { return &userdb.UserInfo{}, nil }
+
+func (u *mockUserDB) SetDisabled([]byte, bool) error { return nil }
+
+func (u *mockUserDB) SetLastAuthenticated([]byte, time.Time) error { return nil }
+
+func (u *mockUserDB) SetRateLimit([]byte, *userdb.RateLimit) error { return nil }
+
 func (u *mockUserDB) Close() {}
 
 type mockSpool struct{}
@@ -74,14 +94,20 @@ func (s *mockSpool) StoreSURBReply(u []byte, id *[constants.SURBIDLength]byte, m
 	return nil
 }
 
-func (s *mockSpool) Get(u []byte, advance bool) (msg, surbID []byte, remaining int, err error) {
-	return []byte{1, 2, 3}, nil, 1, nil
+func (s *mockSpool) Get(u []byte, ackID uint64) (msg, surbID []byte, id uint64, remaining int, err error) {
+	return []byte{1, 2, 3}, nil, 1, 1, nil
 }
 
+func (s *mockSpool) ForEach(u []byte, fn func(msg, surbID []byte) error) error { return nil }
+
+func (s *mockSpool) Usage(u []byte) (count, size int, err error) { return 0, 0, nil }
+
 func (s *mockSpool) Remove(u []byte) error { return nil }
 
 func (s *mockSpool) Vacuum(udb userdb.UserDB) error { return nil }
 
+func (s *mockSpool) SetQuota(q *spool.Quota) {}
+
 func (s *mockSpool) Close() {}
 
 type mockProvider struct {
@@ -101,6 +127,14 @@ func (p *mockProvider) Spool() spool.Spool {
 	return &mockSpool{}
 }
 
+func (p *mockProvider) SubscribeSpool(u []byte) *notifyspool.Subscription {
+	return notifyspool.New(p.Spool()).Subscribe(u)
+}
+
+func (p *mockProvider) RateLimiter() *ratelimit.Limiter {
+	return ratelimit.New()
+}
+
 func (p *mockProvider) AuthenticateClient(*wire.PeerCredentials) bool {
 	return true
 }
@@ -115,6 +149,18 @@ func (p *mockProvider) AdvertiseRegistrationHTTPAddresses() []string {
 	return nil
 }
 
+func (p *mockProvider) Ping() error {
+	return nil
+}
+
+func (p *mockProvider) QueueStats() map[string]int {
+	return nil
+}
+
+func (p *mockProvider) PluginStatus() []glue.PluginInfo {
+	return nil
+}
+
 type mockDecoy struct{}
 
 func (d *mockDecoy) Halt() {}
@@ -84,3 +84,21 @@ func TestCBORInvalidCommandWithPluginKaetzchenWorker(t *testing.T) {
 	_, err = NewCBORPluginWorker(goo)
 	require.Error(err)
 }
+
+func TestLookupCredential(t *testing.T) {
+	require := require.New(t)
+
+	cred, err := lookupCredential("root", "")
+	require.NoError(err, "lookupCredential(): by name")
+	require.Equal(uint32(0), cred.UID, "lookupCredential(): UID")
+	require.Equal(uint32(0), cred.GID, "lookupCredential(): GID")
+
+	cred, err = lookupCredential("0", "0")
+	require.NoError(err, "lookupCredential(): by id")
+	require.Equal(uint32(0), cred.UID, "lookupCredential(): UID")
+
+	_, err = lookupCredential("katzenpost-no-such-user", "")
+	require.Error(err, "lookupCredential(): unknown user")
+	_, err = lookupCredential("root", "katzenpost-no-such-group")
+	require.Error(err, "lookupCredential(): unknown group")
+}
@@ -20,9 +20,12 @@ package provider
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -43,19 +46,29 @@ import (
 	"github.com/katzenpost/server/internal/glue"
 	"github.com/katzenpost/server/internal/packet"
 	"github.com/katzenpost/server/internal/provider/kaetzchen"
+	"github.com/katzenpost/server/internal/ratelimit"
 	"github.com/katzenpost/server/internal/sqldb"
 	"github.com/katzenpost/server/registration"
 	"github.com/katzenpost/server/spool"
 	"github.com/katzenpost/server/spool/boltspool"
+	"github.com/katzenpost/server/spool/memspool"
+	"github.com/katzenpost/server/spool/notifyspool"
+	"github.com/katzenpost/server/spool/spoolcrypt"
 	"github.com/katzenpost/server/userdb"
 	"github.com/katzenpost/server/userdb/boltuserdb"
+	"github.com/katzenpost/server/userdb/cacheduserdb"
 	"github.com/katzenpost/server/userdb/externuserdb"
+	"github.com/katzenpost/server/userdb/memuserdb"
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/text/secure/precis"
 	"gopkg.in/eapache/channels.v1"
 	"gopkg.in/op/go-logging.v1"
 )
 
+// lastAuthenticatedInterval is the minimum interval between updates of a
+// user's last authenticated time.
+const lastAuthenticatedInterval = 10 * time.Minute
+
 type registerIdentityRequest struct {
 	User              string
 	IdentityPublicKey string
@@ -73,10 +86,25 @@ type provider struct {
 	userDB userdb.UserDB
 	spool  spool.Spool
 
+	// notifySpool is spool, as seen by the spool change subscribers.
+	notifySpool *notifyspool.Spool
+
+	// rateLimiter is the per-user client send rate limiter, shared by all
+	// of the listeners.
+	rateLimiter *ratelimit.Limiter
+
+	// maintenanceLock serializes the spool maintenance runs.
+	maintenanceLock sync.Mutex
+
 	kaetzchenWorker           *kaetzchen.KaetzchenWorker
 	cborPluginKaetzchenWorker *kaetzchen.CBORPluginWorker
 
 	httpServers []*http.Server
+
+	// linkKeyRequests is the time after which each of the recently
+	// accepted link key management requests, keyed by MAC, would be
+	// rejected as stale, and can be forgotten.
+	linkKeyRequests map[string]time.Time
 }
 
 var (
@@ -88,10 +116,58 @@ var (
 			Help:      "Number of dropped packets",
 		},
 	)
+	spoolEvictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: internalConstants.Namespace,
+			Name:      "spool_evictions_total",
+			Subsystem: internalConstants.ProviderSubsystem,
+			Help:      "Number of messages evicted from user spools",
+		},
+		[]string{"reason"},
+	)
+	spoolQuotaRejections = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: internalConstants.Namespace,
+			Name:      "spool_quota_rejections_total",
+			Subsystem: internalConstants.ProviderSubsystem,
+			Help:      "Number of messages rejected due to user spool quotas",
+		},
+	)
+	userDBCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: internalConstants.Namespace,
+			Name:      "userdb_cache_lookups_total",
+			Subsystem: internalConstants.ProviderSubsystem,
+			Help:      "Number of cacheable user database lookups",
+		},
+		[]string{"op", "result"},
+	)
+	spoolMaintenanceDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: internalConstants.Namespace,
+			Name:      "spool_maintenance_duration_seconds",
+			Subsystem: internalConstants.ProviderSubsystem,
+			Help:      "Time taken by the spool maintenance operations",
+		},
+		[]string{"op"},
+	)
+	spoolCompactionReclaimed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: internalConstants.Namespace,
+			Name:      "spool_compaction_reclaimed_bytes_total",
+			Subsystem: internalConstants.ProviderSubsystem,
+			Help:      "Number of bytes reclaimed by compacting the spool",
+		},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(packetsDropped)
+	prometheus.MustRegister(spoolEvictions)
+	prometheus.MustRegister(spoolQuotaRejections)
+	prometheus.MustRegister(userDBCacheLookups)
+	prometheus.MustRegister(spoolMaintenanceDuration)
+	prometheus.MustRegister(spoolCompactionReclaimed)
 }
 
 func (p *provider) Halt() {
@@ -118,10 +194,39 @@ func (p *provider) Spool() spool.Spool {
 	return p.spool
 }
 
+// SubscribeSpool subscribes to the changes to the user u's spool.
+func (p *provider) SubscribeSpool(u []byte) *notifyspool.Subscription {
+	return p.notifySpool.Subscribe(u)
+}
+
+// RateLimiter returns the per-user client send rate limiter.
+func (p *provider) RateLimiter() *ratelimit.Limiter {
+	return p.rateLimiter
+}
+
 func (p *provider) UserDB() userdb.UserDB {
 	return p.userDB
 }
 
+func (p *provider) Ping() error {
+	if p.sqlDB != nil {
+		return p.sqlDB.Ping()
+	}
+	return nil
+}
+
+func (p *provider) QueueStats() map[string]int {
+	return map[string]int{
+		"provider":     p.ch.Len(),
+		"kaetzchen":    p.kaetzchenWorker.QueueLen(),
+		"cbor_plugins": p.cborPluginKaetzchenWorker.QueueLen(),
+	}
+}
+
+func (p *provider) PluginStatus() []glue.PluginInfo {
+	return p.cborPluginKaetzchenWorker.PluginStatus()
+}
+
 func (p *provider) AuthenticateClient(c *wire.PeerCredentials) bool {
 	ad, err := p.fixupUserNameCase(c.AdditionalData)
 	if err != nil {
@@ -134,8 +239,32 @@ func (p *provider) AuthenticateClient(c *wire.PeerCredentials) bool {
 		} else {
 			p.log.Errorf("Authentication failed: User: '%v', Key: '%v'", utils.ASCIIBytesToPrintString(c.AdditionalData), c.PublicKey)
 		}
+		return false
+	}
+
+	info, err := p.userDB.Info(ad)
+	if err != nil {
+		p.log.Errorf("Authentication failed: User: '%v', failed to query user info: %v", utils.ASCIIBytesToPrintString(ad), err)
+		return false
+	}
+	if info.Disabled {
+		p.log.Errorf("Authentication failed: User: '%v' is disabled", utils.ASCIIBytesToPrintString(ad))
+		return false
+	}
+
+	// Pick up any change to the user's rate limit override made behind
+	// the provider's back, by an external UserDB.
+	p.rateLimiter.SetOverride(ad, info.RateLimit)
+
+	// Record the authentication time, limiting the write rate since
+	// clients reauthenticate frequently.
+	if now := time.Now(); now.Sub(info.LastAuthenticated) >= lastAuthenticatedInterval {
+		if err = p.userDB.SetLastAuthenticated(ad, now); err != nil {
+			p.log.Warningf("Failed to update last authenticated time for user '%v': %v", utils.ASCIIBytesToPrintString(ad), err)
+		}
 	}
-	return isValid
+
+	return true
 }
 
 func (p *provider) OnPacket(pkt *packet.Packet) {
@@ -291,6 +420,61 @@ func (p *provider) worker() {
 	}
 }
 
+func (p *provider) maintenanceWorker() {
+	sCfg := p.glue.Config().Provider.SpoolDB
+
+	defer p.log.Debugf("Halting spool maintenance worker.")
+
+	ticker := time.NewTicker(time.Duration(sCfg.VacuumInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.HaltCh():
+			p.log.Debugf("Terminating gracefully.")
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := p.doSpoolMaintenance(sCfg.CompactionThreshold); err != nil {
+			p.log.Errorf("Failed spool maintenance: %v", err)
+		}
+	}
+}
+
+// doSpoolMaintenance vacuums the spool, and if supported, compacts it iff
+// the fraction of the spool's storage that is unused is at least threshold,
+// returning the number of bytes reclaimed.
+func (p *provider) doSpoolMaintenance(threshold float64) (int64, error) {
+	p.maintenanceLock.Lock()
+	defer p.maintenanceLock.Unlock()
+
+	start := time.Now()
+	if err := p.spool.Vacuum(p.userDB); err != nil {
+		return 0, err
+	}
+	spoolMaintenanceDuration.With(prometheus.Labels{"op": "vacuum"}).Observe(time.Since(start).Seconds())
+
+	c, ok := p.spool.(spool.Compactor)
+	if !ok {
+		return 0, nil
+	}
+	start = time.Now()
+	reclaimed, compacted, err := c.Compact(threshold)
+	if err != nil {
+		return 0, err
+	}
+	if compacted {
+		spoolMaintenanceDuration.With(prometheus.Labels{"op": "compact"}).Observe(time.Since(start).Seconds())
+		p.log.Noticef("Compacted the spool, reclaiming %v bytes.", reclaimed)
+	}
+	if reclaimed <= 0 {
+		return 0, nil
+	}
+	spoolCompactionReclaimed.Add(float64(reclaimed))
+	return reclaimed, nil
+}
+
 func (p *provider) onSURBReply(pkt *packet.Packet, recipient []byte) {
 	if len(pkt.Payload) != sphinx.PayloadTagLength+constants.ForwardPayloadLength {
 		p.log.Debugf("Refusing to store mis-sized SURB-Reply: %v (%v)", pkt.ID, len(pkt.Payload))
@@ -299,6 +483,9 @@ func (p *provider) onSURBReply(pkt *packet.Packet, recipient []byte) {
 
 	// Store the payload in the spool.
 	if err := p.spool.StoreSURBReply(recipient, &pkt.SurbReply.ID, pkt.Payload); err != nil {
+		if err == spool.ErrQuotaExceeded {
+			spoolQuotaRejections.Inc()
+		}
 		p.log.Debugf("Failed to store SURB-Reply: %v (%v)", pkt.ID, err)
 	} else {
 		p.log.Debugf("Stored SURB-Reply: %v", pkt.ID)
@@ -313,8 +500,13 @@ func (p *provider) onToUser(pkt *packet.Packet, recipient []byte) {
 		return
 	}
 
-	// Store the ciphertext in the spool.
+	// Store the ciphertext in the spool.  This returns once the store is
+	// committed, even if it was batched with other workers' stores, so the
+	// SURB-ACK is never sent for a message that is yet to be spooled.
 	if err := p.spool.StoreMessage(recipient, ct); err != nil {
+		if err == spool.ErrQuotaExceeded {
+			spoolQuotaRejections.Inc()
+		}
 		p.log.Debugf("Failed to store message payload: %v (%v)", pkt.ID, err)
 		return
 	}
@@ -401,6 +593,7 @@ func (p *provider) onRemoveUser(c *thwack.Conn, l string) error {
 		// user has been obliterated from the UserDB at this point.
 		c.Log().Errorf("Failed to remove spool '%v': %v", u, err)
 	}
+	p.rateLimiter.Remove(u)
 
 	return c.WriteReply(thwack.StatusOk)
 }
@@ -515,6 +708,267 @@ func (p *provider) onUserIdentity(c *thwack.Conn, l string) error {
 	return c.Writer().PrintfLine("%v %v", thwack.StatusOk, pubKey)
 }
 
+func (p *provider) onAddUserLinkKey(c *thwack.Conn, l string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	sp := strings.Split(l, " ")
+	if len(sp) != 4 {
+		c.Log().Debugf("ADD_USER_LINK_KEY invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	u, err := p.fixupUserNameCase([]byte(sp[1]))
+	if err != nil {
+		c.Log().Errorf("ADD_USER_LINK_KEY invalid user: %v", err)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	if !userdb.IsValidLinkKeyName(sp[2]) {
+		c.Log().Errorf("ADD_USER_LINK_KEY invalid link key name: '%v'", sp[2])
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	var pubKey ecdh.PublicKey
+	if err = pubKey.FromString(sp[3]); err != nil {
+		c.Log().Errorf("ADD_USER_LINK_KEY invalid public key: %v", err)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	if err = p.userDB.AddLinkKey(u, sp[2], &pubKey); err != nil {
+		c.Log().Errorf("Failed to add link key '%v' for user '%v': %v", sp[2], u, err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (p *provider) onRemoveUserLinkKey(c *thwack.Conn, l string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	sp := strings.Split(l, " ")
+	if len(sp) != 3 {
+		c.Log().Debugf("REMOVE_USER_LINK_KEY invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	u, err := p.fixupUserNameCase([]byte(sp[1]))
+	if err != nil {
+		c.Log().Errorf("REMOVE_USER_LINK_KEY invalid user: %v", err)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	if err = p.userDB.RemoveLinkKey(u, sp[2]); err != nil {
+		c.Log().Errorf("Failed to remove link key '%v' for user '%v': %v", sp[2], u, err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (p *provider) onUserLinkKeys(c *thwack.Conn, l string) error {
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 {
+		c.Log().Debugf("USER_LINK_KEYS invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	u, err := p.fixupUserNameCase([]byte(sp[1]))
+	if err != nil {
+		c.Log().Errorf("USER_LINK_KEYS invalid user: %v", err)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	keys, err := p.userDB.LinkKeys(u)
+	if err != nil {
+		c.Log().Errorf("Failed to query link keys for user '%s': %v", string(u), err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err = c.Writer().PrintfLine("%v-%v %v", thwack.StatusOk, name, keys[name]); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (p *provider) onSpoolCount(c *thwack.Conn, l string) error {
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 {
+		c.Log().Debugf("SPOOL_COUNT invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	u, err := p.fixupUserNameCase([]byte(sp[1]))
+	if err != nil {
+		c.Log().Errorf("SPOOL_COUNT invalid user: %v", err)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	count, size, err := p.spool.Usage(u)
+	if err != nil {
+		c.Log().Errorf("Failed to query spool usage for user '%v': %v", u, err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	return c.Writer().PrintfLine("%v %v %v", thwack.StatusOk, count, size)
+}
+
+func (p *provider) onSpoolVacuum(c *thwack.Conn, l string) error {
+	threshold := p.glue.Config().Provider.SpoolDB.CompactionThreshold
+
+	sp := strings.Split(l, " ")
+	switch {
+	case len(sp) == 1:
+	case len(sp) == 2 && strings.ToUpper(sp[1]) == "FORCE":
+		threshold = 0
+	default:
+		c.Log().Debugf("SPOOL_VACUUM invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	reclaimed, err := p.doSpoolMaintenance(threshold)
+	if err != nil {
+		c.Log().Errorf("Failed spool maintenance: %v", err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	return c.Writer().PrintfLine("%v %v", thwack.StatusOk, reclaimed)
+}
+
+func (p *provider) onListUsers(c *thwack.Conn, l string) error {
+	if sp := strings.Split(l, " "); len(sp) != 1 {
+		c.Log().Debugf("LIST_USERS invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	var lines []string
+	if err := p.userDB.ForEach(func(u []byte, info *userdb.UserInfo) error {
+		lines = append(lines, fmt.Sprintf("%v Created: %v LastAuthenticated: %v Disabled: %v RateLimit: %v", utils.ASCIIBytesToPrintString(u), fmtUserInfoTime(info.CreatedAt), fmtUserInfoTime(info.LastAuthenticated), info.Disabled, fmtUserInfoRateLimit(info.RateLimit)))
+		return nil
+	}); err != nil {
+		c.Log().Errorf("Failed to enumerate users: %v", err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	for _, v := range lines {
+		if err := c.Writer().PrintfLine("%v-%v", thwack.StatusOk, v); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func fmtUserInfoTime(t time.Time) string {
+	if t.IsZero() {
+		return "unknown"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func fmtUserInfoRateLimit(rl *userdb.RateLimit) string {
+	if rl == nil {
+		return "default"
+	}
+	return fmt.Sprintf("%v/%v", rl.SendRatePerMinute, rl.SendBurst)
+}
+
+func (p *provider) onDisableUser(c *thwack.Conn, l string) error {
+	return p.doSetUserDisabled(c, l, true)
+}
+
+func (p *provider) onEnableUser(c *thwack.Conn, l string) error {
+	return p.doSetUserDisabled(c, l, false)
+}
+
+func (p *provider) doSetUserDisabled(c *thwack.Conn, l string, disabled bool) error {
+	p.Lock()
+	defer p.Unlock()
+
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 {
+		c.Log().Debugf("%v invalid syntax: '%v'", sp[0], l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	u, err := p.fixupUserNameCase([]byte(sp[1]))
+	if err != nil {
+		c.Log().Errorf("%v invalid user: %v", sp[0], err)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	if err = p.userDB.SetDisabled(u, disabled); err != nil {
+		c.Log().Errorf("Failed to set disabled=%v for user '%v': %v", disabled, u, err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (p *provider) onSetUserRateLimit(c *thwack.Conn, l string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	sp := strings.Split(l, " ")
+	if len(sp) != 4 {
+		c.Log().Debugf("SET_USER_RATE_LIMIT invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	u, err := p.fixupUserNameCase([]byte(sp[1]))
+	if err != nil {
+		c.Log().Errorf("SET_USER_RATE_LIMIT invalid user: %v", err)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	rl := new(userdb.RateLimit)
+	if rl.SendRatePerMinute, err = strconv.ParseUint(sp[2], 10, 64); err != nil {
+		c.Log().Errorf("SET_USER_RATE_LIMIT invalid rate: %v", err)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	if rl.SendBurst, err = strconv.ParseUint(sp[3], 10, 64); err != nil {
+		c.Log().Errorf("SET_USER_RATE_LIMIT invalid burst: %v", err)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	if err = p.userDB.SetRateLimit(u, rl); err != nil {
+		c.Log().Errorf("Failed to set rate limit for user '%v': %v", u, err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	p.rateLimiter.SetOverride(u, rl)
+
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (p *provider) onRemoveUserRateLimit(c *thwack.Conn, l string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 {
+		c.Log().Debugf("REMOVE_USER_RATE_LIMIT invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	u, err := p.fixupUserNameCase([]byte(sp[1]))
+	if err != nil {
+		c.Log().Errorf("REMOVE_USER_RATE_LIMIT invalid user: %v", err)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	if err = p.userDB.SetRateLimit(u, nil); err != nil {
+		c.Log().Errorf("Failed to remove rate limit for user '%v': %v", u, err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	p.rateLimiter.SetOverride(u, nil)
+
+	return c.WriteReply(thwack.StatusOk)
+}
+
 func (p *provider) onSendRate(c *thwack.Conn, l string) error {
 	p.Lock()
 	defer p.Unlock()
@@ -585,6 +1039,9 @@ func (p *provider) ServeHTTP(response http.ResponseWriter, request *http.Request
 	case registration.RegisterLinkAndIdentityCommand:
 		p.processIdentityRegistration(user, response, request)
 		return
+	case registration.AddLinkKeyCommand, registration.RemoveLinkKeyCommand:
+		p.processLinkKeyManagement(command, user, response, request)
+		return
 	default:
 		p.log.Error("Provider ServeHTTP invalid registration type error")
 		response.WriteHeader(http.StatusInternalServerError)
@@ -699,6 +1156,117 @@ func (p *provider) processIdentityRegistration(user []byte, response http.Respon
 	response.Write([]byte(message))
 }
 
+func (p *provider) processLinkKeyManagement(command string, user []byte, response http.ResponseWriter, request *http.Request) {
+	name := request.FormValue(registration.LinkKeyNameField)
+	if !userdb.IsValidLinkKeyName(name) {
+		p.log.Error("Provider ServeHTTP invalid link key name error")
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rawLinkKey := request.FormValue(registration.LinkKeyField)
+	if !p.authenticateLinkKeyRequest(command, user, name, rawLinkKey, request) {
+		response.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch command {
+	case registration.AddLinkKeyCommand:
+		linkKey := new(ecdh.PublicKey)
+		if err := linkKey.FromString(rawLinkKey); err != nil {
+			p.log.Errorf("Provider ServeHTTP pub key from string error: %s", err)
+			response.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := p.userDB.AddLinkKey(user, name, linkKey); err != nil {
+			p.log.Errorf("Provider ServeHTTP AddLinkKey error: %s", err)
+			response.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		p.log.Noticef("HTTP Registration added link key '%s' for user: %s", name, user)
+	case registration.RemoveLinkKeyCommand:
+		if err := p.userDB.RemoveLinkKey(user, name); err != nil {
+			p.log.Errorf("Provider ServeHTTP RemoveLinkKey error: %s", err)
+			response.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		p.log.Noticef("HTTP Registration removed link key '%s' for user: %s", name, user)
+	}
+
+	// Send a response back to the client.
+	message := "OK\n"
+	response.Write([]byte(message))
+}
+
+// authenticateLinkKeyRequest authenticates a link key management request,
+// which must be MACed with the shared secret derived from one of the user's
+// existing link keys and the Provider's link key.
+func (p *provider) authenticateLinkKeyRequest(command string, user []byte, name, rawLinkKey string, request *http.Request) bool {
+	rawAuthKey := request.FormValue(registration.AuthKeyField)
+	authKey := new(ecdh.PublicKey)
+	if err := authKey.FromString(rawAuthKey); err != nil {
+		p.log.Errorf("Provider ServeHTTP auth key from string error: %s", err)
+		return false
+	}
+	if !p.userDB.IsValid(user, authKey) {
+		p.log.Errorf("Provider ServeHTTP auth key is not valid for user: %s", user)
+		return false
+	}
+	if info, err := p.userDB.Info(user); err != nil || info.Disabled {
+		p.log.Errorf("Provider ServeHTTP user is disabled or unknown: %s", user)
+		return false
+	}
+
+	rawTimestamp := request.FormValue(registration.TimestampField)
+	timestamp, err := strconv.ParseInt(rawTimestamp, 10, 64)
+	if err != nil {
+		p.log.Errorf("Provider ServeHTTP invalid timestamp: %s", err)
+		return false
+	}
+	if skew := time.Since(time.Unix(timestamp, 0)); skew > registration.MaxClockSkew || skew < -registration.MaxClockSkew {
+		p.log.Errorf("Provider ServeHTTP timestamp skew too large: %v", skew)
+		return false
+	}
+
+	mac, err := hex.DecodeString(request.FormValue(registration.MACField))
+	if err != nil {
+		p.log.Errorf("Provider ServeHTTP invalid MAC: %s", err)
+		return false
+	}
+	var sharedSecret [ecdh.GroupElementLength]byte
+	p.glue.LinkKey().Exp(&sharedSecret, authKey)
+	expected := registration.LinkKeyRequestMAC(sharedSecret[:], command, request.FormValue(registration.UserField), name, rawLinkKey, rawTimestamp)
+	if !hmac.Equal(mac, expected) {
+		p.log.Errorf("Provider ServeHTTP MAC mismatch for user: %s", user)
+		return false
+	}
+	if !p.recordLinkKeyRequest(mac, time.Unix(timestamp, 0)) {
+		p.log.Errorf("Provider ServeHTTP replayed request for user: %s", user)
+		return false
+	}
+	return true
+}
+
+// recordLinkKeyRequest records the MAC of an authenticated link key
+// management request, and returns false iff the request is a replay.  As a
+// request is only accepted within MaxClockSkew of its timestamp, the MAC is
+// only remembered until then.
+func (p *provider) recordLinkKeyRequest(mac []byte, timestamp time.Time) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
+	for k, expiry := range p.linkKeyRequests {
+		if now.After(expiry) {
+			delete(p.linkKeyRequests, k)
+		}
+	}
+	if _, ok := p.linkKeyRequests[string(mac)]; ok {
+		return false
+	}
+	p.linkKeyRequests[string(mac)] = timestamp.Add(registration.MaxClockSkew)
+	return true
+}
+
 func (p *provider) stopUserRegistrationHTTP() {
 	if !p.glue.Config().Provider.EnableUserRegistrationHTTP {
 		return
@@ -736,6 +1304,25 @@ func (p *provider) AdvertiseRegistrationHTTPAddresses() []string {
 	return p.glue.Config().Provider.AdvertiseUserRegistrationHTTPAddresses
 }
 
+func newSpoolQuota(sCfg *config.SpoolDB) *spool.Quota {
+	if sCfg.MaxMessages <= 0 && sCfg.MaxBytes <= 0 && sCfg.MaxMessageAge <= 0 {
+		return nil
+	}
+
+	q := &spool.Quota{
+		MaxMessages: sCfg.MaxMessages,
+		MaxBytes:    sCfg.MaxBytes,
+		MaxAge:      time.Duration(sCfg.MaxMessageAge) * time.Second,
+		OnEvict: func(reason spool.EvictReason) {
+			spoolEvictions.With(prometheus.Labels{"reason": string(reason)}).Inc()
+		},
+	}
+	if sCfg.QuotaPolicy == config.QuotaPolicyEvict {
+		q.Policy = spool.PolicyEvict
+	}
+	return q
+}
+
 // New constructs a new provider instance.
 func New(glue glue.Glue) (glue.Provider, error) {
 	kaetzchenWorker, err := kaetzchen.New(glue)
@@ -750,8 +1337,10 @@ func New(glue glue.Glue) (glue.Provider, error) {
 		glue:                      glue,
 		log:                       glue.LogBackend().GetLogger("provider"),
 		ch:                        channels.NewInfiniteChannel(),
+		rateLimiter:               ratelimit.New(),
 		kaetzchenWorker:           kaetzchenWorker,
 		cborPluginKaetzchenWorker: cborPluginWorker,
+		linkKeyRequests:           make(map[string]time.Time),
 	}
 
 	cfg := glue.Config()
@@ -778,35 +1367,78 @@ func New(glue glue.Glue) (glue.Provider, error) {
 	case config.BackendBolt:
 		p.userDB, err = boltuserdb.New(cfg.Provider.UserDB.Bolt.UserDB)
 	case config.BackendExtern:
-		p.userDB, err = externuserdb.New(cfg.Provider.UserDB.Extern.ProviderURL)
+		eCfg := cfg.Provider.UserDB.Extern
+		p.userDB, err = externuserdb.New(&externuserdb.Config{
+			ProviderURL:       eCfg.ProviderURL,
+			Timeout:           time.Duration(eCfg.RequestTimeout) * time.Millisecond,
+			BearerToken:       eCfg.BearerToken,
+			TLSClientCertFile: eCfg.TLSClientCertFile,
+			TLSClientKeyFile:  eCfg.TLSClientKeyFile,
+			TLSCACertFile:     eCfg.TLSCACertFile,
+			LegacyProtocol:    eCfg.LegacyProtocol,
+		})
 	case config.BackendSQL:
 		if p.sqlDB != nil {
 			p.userDB, err = p.sqlDB.UserDB()
 		} else {
 			err = errors.New("provider: SQL UserDB backend with no SQL database")
 		}
+	case config.BackendMemory:
+		p.log.Warningf("Using the in-memory UserDB, users will be lost on shutdown.")
+		p.userDB = memuserdb.New()
 	default:
 		return nil, fmt.Errorf("provider: Unknown UserDB backend: %v", cfg.Provider.UserDB.Backend)
 	}
 	if err != nil {
 		return nil, err
 	}
+	if cCfg := cfg.Provider.UserDB.Cache; cCfg != nil {
+		p.userDB = cacheduserdb.New(p.userDB, &cacheduserdb.Config{
+			MaxEntries:  cCfg.MaxEntries,
+			PositiveTTL: time.Duration(cCfg.PositiveTTL) * time.Second,
+			NegativeTTL: time.Duration(cCfg.NegativeTTL) * time.Second,
+			OnLookup: func(op string, hit bool) {
+				result := "miss"
+				if hit {
+					result = "hit"
+				}
+				userDBCacheLookups.With(prometheus.Labels{"op": op, "result": result}).Inc()
+			},
+		})
+	}
 
 	switch cfg.Provider.SpoolDB.Backend {
 	case config.BackendBolt:
-		p.spool, err = boltspool.New(cfg.Provider.SpoolDB.Bolt.SpoolDB)
+		if eCfg := cfg.Provider.SpoolDB.Encryption; eCfg != nil {
+			var k *spoolcrypt.Key
+			if k, err = spoolcrypt.Load(eCfg.KeyFile, eCfg.Passphrase); err == nil {
+				p.spool, err = boltspool.NewEncrypted(cfg.Provider.SpoolDB.Bolt.SpoolDB, k)
+			}
+		} else {
+			p.spool, err = boltspool.New(cfg.Provider.SpoolDB.Bolt.SpoolDB)
+		}
+		if b, ok := p.spool.(spool.Batcher); ok && cfg.Provider.SpoolDB.Bolt.MaxBatchDelay > 0 {
+			// Each provider worker has at most one store in flight.
+			b.SetBatchLimits(cfg.Debug.NumProviderWorkers, time.Duration(cfg.Provider.SpoolDB.Bolt.MaxBatchDelay)*time.Millisecond)
+		}
 	case config.BackendSQL:
 		if p.sqlDB != nil {
 			p.spool = p.sqlDB.Spool()
 		} else {
 			err = errors.New("provider: SQL SpoolDB backend with no SQL database")
 		}
+	case config.BackendMemory:
+		p.log.Warningf("Using the in-memory SpoolDB, spooled messages will be lost on shutdown.")
+		p.spool = memspool.New()
 	default:
 		err = fmt.Errorf("provider: Unknown SpoolDB backend: %v", cfg.Provider.SpoolDB.Backend)
 	}
 	if err != nil {
 		return nil, err
 	}
+	p.spool.SetQuota(newSpoolQuota(cfg.Provider.SpoolDB))
+	p.notifySpool = notifyspool.New(p.spool)
+	p.spool = p.notifySpool
 
 	// Purge spools that belong to users that no longer exist in the user db.
 	if err = p.spool.Vacuum(p.userDB); err != nil {
@@ -825,6 +1457,16 @@ func New(glue glue.Glue) (glue.Provider, error) {
 			cmdUserLink           = "USER_LINK"
 			cmdSendRate           = "SEND_RATE"
 			cmdSendBurst          = "SEND_BURST"
+			cmdSpoolCount         = "SPOOL_COUNT"
+			cmdListUsers          = "LIST_USERS"
+			cmdAddUserLinkKey     = "ADD_USER_LINK_KEY"
+			cmdRemoveUserLinkKey  = "REMOVE_USER_LINK_KEY"
+			cmdUserLinkKeys       = "USER_LINK_KEYS"
+			cmdDisableUser        = "DISABLE_USER"
+			cmdEnableUser         = "ENABLE_USER"
+			cmdSpoolVacuum        = "SPOOL_VACUUM"
+			cmdSetUserRateLimit   = "SET_USER_RATE_LIMIT"
+			cmdRemoveUserRateLim  = "REMOVE_USER_RATE_LIMIT"
 		)
 
 		glue.Management().RegisterCommand(cmdAddUser, p.onAddUser)
@@ -836,6 +1478,16 @@ func New(glue glue.Glue) (glue.Provider, error) {
 		glue.Management().RegisterCommand(cmdUserLink, p.onUserLink)
 		glue.Management().RegisterCommand(cmdSendRate, p.onSendRate)
 		glue.Management().RegisterCommand(cmdSendBurst, p.onSendBurst)
+		glue.Management().RegisterCommand(cmdSpoolCount, p.onSpoolCount)
+		glue.Management().RegisterCommand(cmdListUsers, p.onListUsers)
+		glue.Management().RegisterCommand(cmdAddUserLinkKey, p.onAddUserLinkKey)
+		glue.Management().RegisterCommand(cmdRemoveUserLinkKey, p.onRemoveUserLinkKey)
+		glue.Management().RegisterCommand(cmdUserLinkKeys, p.onUserLinkKeys)
+		glue.Management().RegisterCommand(cmdDisableUser, p.onDisableUser)
+		glue.Management().RegisterCommand(cmdEnableUser, p.onEnableUser)
+		glue.Management().RegisterCommand(cmdSpoolVacuum, p.onSpoolVacuum)
+		glue.Management().RegisterCommand(cmdSetUserRateLimit, p.onSetUserRateLimit)
+		glue.Management().RegisterCommand(cmdRemoveUserRateLim, p.onRemoveUserRateLimit)
 	}
 
 	// Start the User Registration HTTP service listener(s).
@@ -847,6 +1499,9 @@ func New(glue glue.Glue) (glue.Provider, error) {
 	for i := 0; i < cfg.Debug.NumProviderWorkers; i++ {
 		p.Go(p.worker)
 	}
+	if cfg.Provider.SpoolDB.VacuumInterval > 0 {
+		p.Go(p.maintenanceWorker)
+	}
 
 	isOk = true
 	return p, nil
@@ -0,0 +1,43 @@
+// provider_test.go - Tests for the provider.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/server/registration"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordLinkKeyRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &provider{linkKeyRequests: make(map[string]time.Time)}
+	now := time.Now()
+
+	assert.True(p.recordLinkKeyRequest([]byte("mac0"), now), "first request")
+	assert.False(p.recordLinkKeyRequest([]byte("mac0"), now), "replayed request")
+	assert.True(p.recordLinkKeyRequest([]byte("mac1"), now), "distinct request")
+
+	// MACs are forgotten once their requests would be rejected as stale.
+	stale := now.Add(-2 * registration.MaxClockSkew)
+	assert.True(p.recordLinkKeyRequest([]byte("mac2"), stale), "stale request")
+	assert.True(p.recordLinkKeyRequest([]byte("mac3"), now), "prune")
+	assert.NotContains(p.linkKeyRequests, "mac2", "stale MAC pruned")
+	assert.Contains(p.linkKeyRequests, "mac0", "fresh MAC retained")
+}
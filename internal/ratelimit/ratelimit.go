@@ -0,0 +1,199 @@
+// ratelimit.go - Katzenpost server client send rate limits.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package ratelimit implements the per-user client send rate limits.
+//
+// Each user has a token bucket that is shared by all of the user's
+// connections, and that outlives them, so that the send budget can not be
+// reset by reconnecting.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/monotime"
+	"github.com/katzenpost/server/userdb"
+)
+
+const (
+	// pruneInterval is the interval between sweeps for idle buckets.
+	pruneInterval = time.Minute
+
+	// idleTimeout is how long a bucket must go unused before it is pruned.
+	idleTimeout = 10 * time.Minute
+)
+
+// Reason is the reason that a packet was rate limited.
+type Reason string
+
+const (
+	// ReasonDefault is the reason for drops caused by the provider's
+	// default limit.
+	ReasonDefault Reason = "default"
+
+	// ReasonOverride is the reason for drops caused by a user's limit
+	// override.
+	ReasonOverride Reason = "override"
+)
+
+type bucket struct {
+	tokens   uint64
+	last     time.Duration
+	lastUsed time.Duration
+}
+
+// refill adds the tokens accrued since the bucket was last refilled, at one
+// token per incr, up to burst.
+func (b *bucket) refill(now, incr time.Duration, burst uint64) {
+	n := uint64((now - b.last) / incr)
+	if b.tokens >= burst || n >= burst-b.tokens {
+		b.tokens = burst
+		b.last = now
+		return
+	}
+	b.tokens += n
+	b.last += incr * time.Duration(n)
+}
+
+// Limiter is the set of per-user send rate limits.
+type Limiter struct {
+	sync.Mutex
+
+	sendRatePerMinute uint64
+	sendBurst         uint64
+
+	buckets   map[string]*bucket
+	overrides map[string]userdb.RateLimit
+	lastPrune time.Duration
+
+	now func() time.Duration
+}
+
+// SetSendRatePerMinute sets the default number of packets that each user may
+// send per minute.  A value of 0 disables the default limit.
+func (l *Limiter) SetSendRatePerMinute(sendRatePerMinute uint64) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.sendRatePerMinute = sendRatePerMinute
+}
+
+// SetSendBurst sets the default maximum number of packets that each user may
+// send in a burst.  A value of 0 disables the default limit.
+func (l *Limiter) SetSendBurst(sendBurst uint64) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.sendBurst = sendBurst
+}
+
+// SetOverride sets the user u's limit override, which takes the place of the
+// default limit.  Providing a nil override removes the user's override.
+func (l *Limiter) SetOverride(u []byte, rl *userdb.RateLimit) {
+	l.Lock()
+	defer l.Unlock()
+
+	if rl == nil {
+		delete(l.overrides, string(u))
+	} else {
+		l.overrides[string(u)] = *rl
+	}
+}
+
+// Remove removes all of the state held for the user u.
+func (l *Limiter) Remove(u []byte) {
+	l.Lock()
+	defer l.Unlock()
+
+	delete(l.buckets, string(u))
+	delete(l.overrides, string(u))
+}
+
+// Allow returns true iff the user u may send a packet, consuming a token
+// from the user's bucket, or the reason and false otherwise.
+func (l *Limiter) Allow(u []byte) (Reason, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	if now-l.lastPrune >= pruneInterval {
+		l.prune(now)
+	}
+
+	rate, burst, reason := l.limitFor(string(u))
+	if rate == 0 || burst == 0 {
+		return "", true
+	}
+	incr := time.Minute / time.Duration(rate)
+	if incr <= 0 {
+		// The rate is too high to be meaningful.
+		return "", true
+	}
+
+	b, ok := l.buckets[string(u)]
+	if !ok {
+		// New buckets start with a single token, so that the budget is
+		// not replenished by the bucket being pruned.
+		b = &bucket{tokens: 1, last: now}
+		l.buckets[string(u)] = b
+	}
+	b.refill(now, incr, burst)
+	b.lastUsed = now
+
+	if b.tokens == 0 {
+		return reason, false
+	}
+	b.tokens--
+	return "", true
+}
+
+func (l *Limiter) limitFor(u string) (rate, burst uint64, reason Reason) {
+	if rl, ok := l.overrides[u]; ok {
+		return rl.SendRatePerMinute, rl.SendBurst, ReasonOverride
+	}
+	return l.sendRatePerMinute, l.sendBurst, ReasonDefault
+}
+
+// prune removes the buckets that have been idle for long enough to have
+// accrued at least the single token that a new bucket starts with.
+func (l *Limiter) prune(now time.Duration) {
+	l.lastPrune = now
+	for u, b := range l.buckets {
+		if now-b.lastUsed < idleTimeout {
+			continue
+		}
+		rate, burst, _ := l.limitFor(u)
+		if rate != 0 && burst != 0 {
+			if incr := time.Minute / time.Duration(rate); incr > 0 {
+				b.refill(now, incr, burst)
+				if b.tokens == 0 {
+					continue
+				}
+			}
+		}
+		delete(l.buckets, u)
+	}
+}
+
+// New creates a new Limiter, with the default limit disabled.
+func New() *Limiter {
+	return &Limiter{
+		buckets:   make(map[string]*bucket),
+		overrides: make(map[string]userdb.RateLimit),
+		now:       monotime.Now,
+	}
+}
@@ -0,0 +1,98 @@
+// ratelimit_test.go - Katzenpost server client send rate limit tests.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/server/userdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	var now time.Duration
+	l := New()
+	l.now = func() time.Duration { return now }
+
+	alice, bob := []byte("alice"), []byte("bob")
+	allow := func(u []byte) bool {
+		_, ok := l.Allow(u)
+		return ok
+	}
+
+	// The default limit is disabled.
+	for i := 0; i < 10; i++ {
+		assert.True(allow(alice), "Allow(): no limit")
+	}
+
+	// New buckets start with a single token, and accrue a token per
+	// minute/rate, up to the burst.
+	l.SetSendRatePerMinute(60)
+	l.SetSendBurst(3)
+	assert.True(allow(bob), "Allow(): initial token")
+	reason, ok := l.Allow(bob)
+	assert.False(ok, "Allow(): empty bucket")
+	assert.Equal(ReasonDefault, reason, "Allow(): reason")
+	now += 10 * time.Second
+	for i := 0; i < 3; i++ {
+		assert.True(allow(bob), "Allow(): burst %d", i)
+	}
+	assert.False(allow(bob), "Allow(): burst exhausted")
+	now += 1500 * time.Millisecond
+	assert.True(allow(bob), "Allow(): refilled")
+	assert.False(allow(bob), "Allow(): partial token not credited")
+	now += 500 * time.Millisecond
+	assert.True(allow(bob), "Allow(): partial token credited")
+
+	// Overrides take the place of the default limit.
+	l.SetOverride(bob, &userdb.RateLimit{SendRatePerMinute: 1, SendBurst: 1})
+	now += time.Minute
+	assert.True(allow(bob), "Allow(): override")
+	reason, ok = l.Allow(bob)
+	assert.False(ok, "Allow(): override exhausted")
+	assert.Equal(ReasonOverride, reason, "Allow(): override reason")
+	l.SetOverride(bob, &userdb.RateLimit{})
+	assert.True(allow(bob), "Allow(): unlimited override")
+	l.SetOverride(bob, nil)
+	now += time.Second
+	assert.True(allow(bob), "Allow(): override removed")
+
+	// State outlives idle periods shorter than the idle timeout, and is
+	// only pruned once it would have accrued a token.
+	l.SetOverride(alice, &userdb.RateLimit{SendRatePerMinute: 1, SendBurst: 1})
+	for allow(alice) {
+	}
+	now += idleTimeout + pruneInterval
+	l.Allow(bob)
+	assert.NotContains(l.buckets, "alice", "Allow(): refilled idle bucket pruned")
+	assert.True(allow(alice), "Allow(): after prune")
+
+	l.SetOverride(alice, &userdb.RateLimit{SendRatePerMinute: 1, SendBurst: 1})
+	now += pruneInterval
+	l.buckets["alice"].lastUsed = 0
+	l.buckets["alice"].last = now
+	l.buckets["alice"].tokens = 0
+	l.Allow(bob)
+	assert.Contains(l.buckets, "alice", "Allow(): empty idle bucket retained")
+
+	l.Remove(alice)
+	assert.NotContains(l.buckets, "alice", "Remove(): bucket")
+	assert.NotContains(l.overrides, "alice", "Remove(): override")
+}
@@ -95,6 +95,7 @@ func TestMemoryQueueBulkEnqueue(t *testing.T) {
 	}
 	last := pkts[0].Delay
 	q.BulkEnqueue(pkts)
+	require.Equal(100, q.Len())
 	for i := 0; i < 100; i++ {
 		_, pkt := q.Peek()
 		require.NotNil(pkt)
@@ -19,6 +19,7 @@ package scheduler
 
 import (
 	"math"
+	"sync/atomic"
 	"time"
 
 	"github.com/katzenpost/core/epochtime"
@@ -38,6 +39,7 @@ type queueImpl interface {
 	Peek() (time.Duration, *packet.Packet)
 	Pop()
 	BulkEnqueue([]*packet.Packet)
+	Len() int
 }
 
 type scheduler struct {
@@ -50,6 +52,8 @@ type scheduler struct {
 	inCh       *channels.InfiniteChannel
 	outCh      *channels.BatchingChannel
 	maxDelayCh chan uint64
+
+	queueLen int64
 }
 
 var (
@@ -99,6 +103,10 @@ func (sch *scheduler) OnPacket(pkt *packet.Packet) {
 	sch.inCh.In() <- pkt
 }
 
+func (sch *scheduler) QueueLen() int {
+	return int(atomic.LoadInt64(&sch.queueLen))
+}
+
 func (sch *scheduler) worker() {
 
 	var absoluteMaxDelay = epochtime.Period * constants.NumMixKeys
@@ -234,6 +242,10 @@ func (sch *scheduler) worker() {
 				sch.glue.Connector().DispatchPacket(pkt)
 			}
 		}
+
+		// The queue implementations are not thread safe, so publish the
+		// length for the benefit of the management interface.
+		atomic.StoreInt64(&sch.queueLen, int64(sch.q.Len()))
 	}
 
 	// NOTREACHED
@@ -19,7 +19,10 @@ package sqldb
 import (
 	"errors"
 	"fmt"
+	"math"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/jackc/pgx"
 	"github.com/katzenpost/core/constants"
@@ -39,10 +42,26 @@ const (
 	pgxTagUserSetAuthKey  = "user_set_authentication_key"
 	pgxTagUserGetIdentKey = "user_get_identity_key"
 	pgxTagUserSetIdentKey = "user_set_identity_key"
+	pgxTagUserList        = "user_list"
+	pgxTagUserCount       = "user_count"
+	pgxTagUserGetInfo     = "user_get_info"
+	pgxTagUserSetDisabled = "user_set_disabled"
+	pgxTagUserSetLastAuth = "user_set_last_authenticated"
+	pgxTagUserSetRateLim  = "user_set_rate_limit"
+	pgxTagUserAddLinkKey  = "user_add_link_key"
+	pgxTagUserRemLinkKey  = "user_remove_link_key"
+	pgxTagUserGetLinkKeys = "user_get_link_keys"
 	pgxTagSpoolStore      = "spool_store"
 	pgxTagSpoolGet        = "spool_get"
-
-	pgCodeNoDataFound = "P0002" // `no_data_found`
+	pgxTagSpoolList       = "spool_list"
+	pgxTagSpoolUsage      = "spool_usage"
+	pgxTagSpoolEvict      = "spool_evict_oldest"
+	pgxTagSpoolExpire     = "spool_expire"
+
+	pgCodeNoDataFound     = "P0002" // `no_data_found`
+	pgCodeUniqueViolation = "23505" // `unique_violation`
+	pgCodeLastLinkKey     = "KP001" // Removal of the last link key.
+	pgCodeNoSuchLinkKey   = "KP002" // Removal of a non-existent link key.
 )
 
 type pgxImpl struct {
@@ -68,6 +87,24 @@ func (p *pgxImpl) Spool() spool.Spool {
 	return newPgxSpool(p)
 }
 
+func (p *pgxImpl) spoolSample() (uid, msg, surbID []byte, err error) {
+	const sampleQuery = "SELECT users.user_name, spool.message_body, spool.surb_id FROM spool JOIN users ON spool.user_id = users.user_id ORDER BY spool.message_id LIMIT 1;"
+	switch err = p.pool.QueryRow(sampleQuery).Scan(&uid, &msg, &surbID); err {
+	case nil:
+		if !p.IsSpoolOnly() {
+			uid = p.d.spoolUserID(uid)
+		}
+	case pgx.ErrNoRows:
+		err = nil
+	}
+	return
+}
+
+func (p *pgxImpl) Ping() error {
+	_, err := p.pool.Exec("SELECT 1;")
+	return err
+}
+
 func (p *pgxImpl) Close() {
 	p.pool.Close()
 }
@@ -97,10 +134,7 @@ func (p *pgxImpl) Log(level pgx.LogLevel, msg string, data map[string]interface{
 }
 
 func (p *pgxImpl) initMetadata() error {
-	const (
-		metadataQuery    = "SELECT * FROM metadata_get() AS (schema_version smallint, spool_only boolean);"
-		pgxSchemaVersion = 0
-	)
+	const metadataQuery = "SELECT * FROM metadata_get() AS (schema_version smallint, spool_only boolean);"
 
 	var schemaVersion int
 	err := p.pool.QueryRow(metadataQuery).Scan(&schemaVersion, &p.spoolOnly)
@@ -108,16 +142,63 @@ func (p *pgxImpl) initMetadata() error {
 	case err == pgx.ErrNoRows:
 		return fmt.Errorf("sql/pgx: database missing metadata table?")
 	case err != nil:
-		return fmt.Errorf("sql/pgx: metadata_get() failed: %v", err)
-	default:
-		if schemaVersion != pgxSchemaVersion {
-			return fmt.Errorf("sql/pgx: invalid schema version: %v", schemaVersion)
-		}
+		return fmt.Errorf("sql/pgx: metadata_get() failed (schema not created?, run the server with -migrate): %v", err)
+	case schemaVersion < pgxSchemaVersion:
+		return fmt.Errorf("sql/pgx: schema version %v is older than the expected version %v, run the server with -migrate", schemaVersion, pgxSchemaVersion)
+	case schemaVersion > pgxSchemaVersion:
+		return fmt.Errorf("sql/pgx: schema version %v is newer than the expected version %v", schemaVersion, pgxSchemaVersion)
 	}
 
 	return nil
 }
 
+// migrate creates the schema if the database is empty, and applies any
+// pending schema migrations, in a single transaction.
+func (p *pgxImpl) migrate(spoolOnly bool) error {
+	// Serialize migrations, in case multiple servers share the database.
+	const migrateLockID = 0x6b617a70 // "kazp"
+
+	tx, err := p.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("SELECT pg_advisory_xact_lock($1);", int64(migrateLockID)); err != nil {
+		return fmt.Errorf("sql/pgx: failed to acquire migration lock: %v", err)
+	}
+
+	var hasMetadata bool
+	if err = tx.QueryRow("SELECT to_regclass('metadata') IS NOT NULL;").Scan(&hasMetadata); err != nil {
+		return err
+	}
+	if !hasMetadata {
+		p.d.log.Noticef("Creating the database schema (spool only: %v).", spoolOnly)
+		if _, err = tx.Exec(fmt.Sprintf("SET LOCAL katzenpost.spool_only = %v;", spoolOnly)); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(pgxSchemaCreate); err != nil {
+			return fmt.Errorf("sql/pgx: failed to create schema: %v", err)
+		}
+	}
+
+	var schemaVersion int
+	if err = tx.QueryRow("SELECT schema_version FROM metadata;").Scan(&schemaVersion); err != nil {
+		return fmt.Errorf("sql/pgx: failed to query schema version: %v", err)
+	}
+	if schemaVersion > pgxSchemaVersion {
+		return fmt.Errorf("sql/pgx: schema version %v is newer than the expected version %v", schemaVersion, pgxSchemaVersion)
+	}
+	for v := schemaVersion; v < pgxSchemaVersion; v++ {
+		p.d.log.Noticef("Migrating the database to schema version %v.", v+1)
+		if _, err = tx.Exec(pgxMigrations[v]); err != nil {
+			return fmt.Errorf("sql/pgx: failed to migrate to schema version %v: %v", v+1, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
 func (p *pgxImpl) initStatements() error {
 	stmts := []struct {
 		tag, query string
@@ -127,8 +208,21 @@ func (p *pgxImpl) initStatements() error {
 		{pgxTagUserSetAuthKey, "SELECT user_set_authentication_key($1, $2, $3);"},
 		{pgxTagUserGetIdentKey, "SELECT user_get_identity_key($1);"},
 		{pgxTagUserSetIdentKey, "SELECT user_set_identity_key($1, $2);"},
+		{pgxTagUserList, "SELECT * FROM user_list() AS (username bytea, created_at timestamptz, last_authenticated timestamptz, disabled boolean, send_rate_per_minute bigint, send_burst bigint);"},
+		{pgxTagUserCount, "SELECT user_count();"},
+		{pgxTagUserGetInfo, "SELECT * FROM user_get_info($1) AS (created_at timestamptz, last_authenticated timestamptz, disabled boolean, send_rate_per_minute bigint, send_burst bigint);"},
+		{pgxTagUserSetDisabled, "SELECT user_set_disabled($1, $2);"},
+		{pgxTagUserSetLastAuth, "SELECT user_set_last_authenticated($1, $2);"},
+		{pgxTagUserSetRateLim, "SELECT user_set_rate_limit($1, $2, $3);"},
+		{pgxTagUserAddLinkKey, "SELECT user_add_link_key($1, $2, $3);"},
+		{pgxTagUserRemLinkKey, "SELECT user_remove_link_key($1, $2);"},
+		{pgxTagUserGetLinkKeys, "SELECT * FROM user_get_link_keys($1) AS (name text, link_key bytea);"},
 		{pgxTagSpoolStore, "SELECT spool_store($1, $2, $3);"},
-		{pgxTagSpoolGet, "SELECT * FROM spool_get($1, $2) AS (message_body bytea, surb_id bytea, remaining integer);"},
+		{pgxTagSpoolGet, "SELECT * FROM spool_get($1, $2, $3) AS (message_id bigint, message_body bytea, surb_id bytea, remaining integer);"},
+		{pgxTagSpoolList, "SELECT * FROM spool_list($1) AS (message_body bytea, surb_id bytea);"},
+		{pgxTagSpoolUsage, "SELECT * FROM spool_usage($1) AS (message_count integer, message_bytes bigint);"},
+		{pgxTagSpoolEvict, "SELECT spool_evict_oldest($1);"},
+		{pgxTagSpoolExpire, "SELECT spool_expire($1, $2);"},
 	}
 
 	for _, v := range stmts {
@@ -146,7 +240,7 @@ func (p *pgxImpl) doUserDelete(u []byte) error {
 	return err
 }
 
-func newPgxImpl(db *SQLDB, dataSourceName string) (dbImpl, error) {
+func newPgxImpl(db *SQLDB, dataSourceName string, migrate bool) (dbImpl, error) {
 	// The pgx connection pool code requires at least 2 conns, and internally
 	// will default to 5 if unspecified.  At a minimum all of the provider
 	// workers should be able to hit up the database simultaneously, while
@@ -183,6 +277,11 @@ func newPgxImpl(db *SQLDB, dataSourceName string) (dbImpl, error) {
 	if p.pool, err = pgx.NewConnPool(poolCfg); err != nil {
 		return nil, err
 	}
+	if migrate {
+		if err = p.migrate(db.glue.Config().Provider.SQLDB.SpoolOnly); err != nil {
+			return nil, err
+		}
+	}
 	if err = p.initMetadata(); err != nil {
 		return nil, err
 	}
@@ -206,11 +305,19 @@ func (d *pgxUserDB) Exists(u []byte) bool {
 }
 
 func (d *pgxUserDB) IsValid(u []byte, k *ecdh.PublicKey) bool {
-	dbKey := d.getAuthKey(u)
-	if dbKey == nil {
+	keys, err := d.LinkKeys(u)
+	if err != nil {
+		d.pgx.d.log.Debugf("user_get_link_keys() failed: %v", err)
 		return false
 	}
-	return dbKey.Equal(k)
+
+	isValid := false
+	for _, dbKey := range keys {
+		if dbKey.Equal(k) {
+			isValid = true
+		}
+	}
+	return isValid
 }
 
 func (d *pgxUserDB) getAuthKey(u []byte) *ecdh.PublicKey {
@@ -237,6 +344,73 @@ func (d *pgxUserDB) Add(u []byte, k *ecdh.PublicKey, update bool) error {
 	return err
 }
 
+func (d *pgxUserDB) AddLinkKey(u []byte, name string, k *ecdh.PublicKey) error {
+	if !userdb.IsValidLinkKeyName(name) {
+		return fmt.Errorf("pgx/userdb: invalid link key name: `%v`", name)
+	}
+	if k == nil {
+		return errors.New("pgx/userdb: must provide a public key")
+	}
+
+	if _, err := d.pgx.pool.Exec(pgxTagUserAddLinkKey, u, name, k.Bytes()); err != nil {
+		switch {
+		case isPgNoDataFound(err):
+			return userdb.ErrNoSuchUser
+		case isPgError(err, pgCodeUniqueViolation):
+			return userdb.ErrLinkKeyExists
+		}
+		return err
+	}
+	return nil
+}
+
+func (d *pgxUserDB) RemoveLinkKey(u []byte, name string) error {
+	if _, err := d.pgx.pool.Exec(pgxTagUserRemLinkKey, u, name); err != nil {
+		switch {
+		case isPgNoDataFound(err):
+			return userdb.ErrNoSuchUser
+		case isPgError(err, pgCodeNoSuchLinkKey):
+			return userdb.ErrNoSuchLinkKey
+		case isPgError(err, pgCodeLastLinkKey):
+			return userdb.ErrLastLinkKey
+		}
+		return err
+	}
+	return nil
+}
+
+func (d *pgxUserDB) LinkKeys(u []byte) (map[string]*ecdh.PublicKey, error) {
+	rows, err := d.pgx.pool.Query(pgxTagUserGetLinkKeys, u)
+	if err != nil {
+		if isPgNoDataFound(err) {
+			return nil, userdb.ErrNoSuchUser
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make(map[string]*ecdh.PublicKey)
+	for rows.Next() {
+		var name string
+		var raw []byte
+		if err = rows.Scan(&name, &raw); err != nil {
+			return nil, err
+		}
+		pk := new(ecdh.PublicKey)
+		if err = pk.FromBytes(raw); err != nil {
+			return nil, err
+		}
+		keys[name] = pk
+	}
+	if err = rows.Err(); err != nil {
+		if isPgNoDataFound(err) {
+			return nil, userdb.ErrNoSuchUser
+		}
+		return nil, err
+	}
+	return keys, nil
+}
+
 func (d *pgxUserDB) SetIdentity(u []byte, k *ecdh.PublicKey) error {
 	var kBytes []byte
 	if k != nil {
@@ -284,6 +458,115 @@ func (d *pgxUserDB) Remove(u []byte) error {
 	return d.pgx.doUserDelete(u)
 }
 
+func (d *pgxUserDB) ForEach(fn func([]byte, *userdb.UserInfo) error) error {
+	type userEnt struct {
+		u    []byte
+		info *userdb.UserInfo
+	}
+
+	// Buffer the users, so that fn is not called with a pool connection
+	// held.
+	rows, err := d.pgx.pool.Query(pgxTagUserList)
+	if err != nil {
+		return err
+	}
+	var users []userEnt
+	for rows.Next() {
+		var u []byte
+		var createdAt, lastAuth pgx.NullTime
+		var rate, burst pgx.NullInt64
+		info := new(userdb.UserInfo)
+		if err = rows.Scan(&u, &createdAt, &lastAuth, &info.Disabled, &rate, &burst); err != nil {
+			rows.Close()
+			return err
+		}
+		info.CreatedAt, info.LastAuthenticated = createdAt.Time, lastAuth.Time
+		info.RateLimit = pgxToRateLimit(rate, burst)
+		users = append(users, userEnt{u, info})
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, ent := range users {
+		if err = fn(ent.u, ent.info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *pgxUserDB) Count() (int, error) {
+	var n int64
+	if err := d.pgx.pool.QueryRow(pgxTagUserCount).Scan(&n); err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+func (d *pgxUserDB) Info(u []byte) (*userdb.UserInfo, error) {
+	var createdAt, lastAuth pgx.NullTime
+	var rate, burst pgx.NullInt64
+	info := new(userdb.UserInfo)
+	if err := d.pgx.pool.QueryRow(pgxTagUserGetInfo, u).Scan(&createdAt, &lastAuth, &info.Disabled, &rate, &burst); err != nil {
+		if isPgNoDataFound(err) {
+			return nil, userdb.ErrNoSuchUser
+		}
+		return nil, err
+	}
+	info.CreatedAt, info.LastAuthenticated = createdAt.Time, lastAuth.Time
+	info.RateLimit = pgxToRateLimit(rate, burst)
+	return info, nil
+}
+
+func (d *pgxUserDB) SetDisabled(u []byte, disabled bool) error {
+	if _, err := d.pgx.pool.Exec(pgxTagUserSetDisabled, u, disabled); err != nil {
+		if isPgNoDataFound(err) {
+			return userdb.ErrNoSuchUser
+		}
+		return err
+	}
+	return nil
+}
+
+func (d *pgxUserDB) SetLastAuthenticated(u []byte, t time.Time) error {
+	if _, err := d.pgx.pool.Exec(pgxTagUserSetLastAuth, u, t); err != nil {
+		if isPgNoDataFound(err) {
+			return userdb.ErrNoSuchUser
+		}
+		return err
+	}
+	return nil
+}
+
+func (d *pgxUserDB) SetRateLimit(u []byte, rl *userdb.RateLimit) error {
+	var rate, burst pgx.NullInt64
+	if rl != nil {
+		if rl.SendRatePerMinute > math.MaxInt64 || rl.SendBurst > math.MaxInt64 {
+			return errors.New("sql/pgx: rate limit out of range")
+		}
+		rate = pgx.NullInt64{Int64: int64(rl.SendRatePerMinute), Valid: true}
+		burst = pgx.NullInt64{Int64: int64(rl.SendBurst), Valid: true}
+	}
+	if _, err := d.pgx.pool.Exec(pgxTagUserSetRateLim, u, rate, burst); err != nil {
+		if isPgNoDataFound(err) {
+			return userdb.ErrNoSuchUser
+		}
+		return err
+	}
+	return nil
+}
+
+func pgxToRateLimit(rate, burst pgx.NullInt64) *userdb.RateLimit {
+	if !rate.Valid || !burst.Valid {
+		return nil
+	}
+	return &userdb.RateLimit{
+		SendRatePerMinute: uint64(rate.Int64),
+		SendBurst:         uint64(burst.Int64),
+	}
+}
+
 func (d *pgxUserDB) Close() {
 	// Nothing to do.
 }
@@ -295,7 +578,24 @@ func newPgxUserDB(p *pgxImpl) *pgxUserDB {
 }
 
 type pgxSpool struct {
-	pgx *pgxImpl
+	sync.RWMutex
+
+	pgx   *pgxImpl
+	quota *spool.Quota
+}
+
+func (s *pgxSpool) SetQuota(q *spool.Quota) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.quota = q
+}
+
+func (s *pgxSpool) getQuota() *spool.Quota {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.quota
 }
 
 func (s *pgxSpool) StoreMessage(u, msg []byte) error {
@@ -315,16 +615,146 @@ func (s *pgxSpool) StoreSURBReply(u []byte, id *[sConstants.SURBIDLength]byte, m
 	return s.doStore(u, id[:], msg)
 }
 
+// spoolUser returns the username that the user's spool is stored under,
+// which is the spoolcrypt user ID iff the database is spool only, as the
+// users table then exists solely to hold the spools.
+func (s *pgxSpool) spoolUser(u []byte) []byte {
+	if !s.pgx.IsSpoolOnly() {
+		return u
+	}
+	return s.pgx.d.spoolUserID(u)
+}
+
 func (s *pgxSpool) doStore(u, id, msg []byte) error {
-	_, err := s.pgx.pool.Exec(pgxTagSpoolStore, u, id, msg)
-	return err
+	q := s.getQuota()
+	msgLen, overhead := len(msg), s.pgx.d.spoolOverhead()
+	msg, id = s.pgx.d.sealSpoolEntry(u, msg, id)
+	u = s.spoolUser(u)
+	if q == nil {
+		_, err := s.pgx.pool.Exec(pgxTagSpoolStore, u, id, msg)
+		return err
+	}
+
+	tx, err := s.pgx.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var evicted []spool.EvictReason
+	if q.MaxAge > 0 {
+		var nExpired int
+		if err = tx.QueryRow(pgxTagSpoolExpire, u, int64(q.MaxAge/time.Second)).Scan(&nExpired); err != nil {
+			return err
+		}
+		for i := 0; i < nExpired; i++ {
+			evicted = append(evicted, spool.EvictMaxAge)
+		}
+	}
+
+	if q.MaxMessages > 0 || q.MaxBytes > 0 {
+		var count int
+		var size int64
+		if err = tx.QueryRow(pgxTagSpoolUsage, u).Scan(&count, &size); err != nil {
+			return err
+		}
+		size -= int64(count * overhead)
+		for {
+			reason, exceeds := q.Exceeds(count, int(size), msgLen)
+			if !exceeds {
+				break
+			}
+			if q.Policy != spool.PolicyEvict || count == 0 {
+				return spool.ErrQuotaExceeded
+			}
+
+			// Evict the oldest message.
+			var evictedSize int64
+			if err = tx.QueryRow(pgxTagSpoolEvict, u).Scan(&evictedSize); err != nil {
+				return err
+			}
+			count--
+			size -= evictedSize - int64(overhead)
+			evicted = append(evicted, reason)
+		}
+	}
+
+	if _, err = tx.Exec(pgxTagSpoolStore, u, id, msg); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	q.NotifyEvicted(evicted)
+	return nil
 }
 
-func (s *pgxSpool) Get(u []byte, advance bool) (msg, surbID []byte, remaining int, err error) {
-	if err = s.pgx.pool.QueryRow(pgxTagSpoolGet, u, advance).Scan(&msg, &surbID, &remaining); err != nil {
+func (s *pgxSpool) Get(u []byte, ackID uint64) (msg, surbID []byte, id uint64, remaining int, err error) {
+	var ack, maxAge interface{}
+	if ackID != 0 {
+		ack = int64(ackID)
+	}
+	if q := s.getQuota(); q != nil && q.MaxAge > 0 {
+		maxAge = int64(q.MaxAge / time.Second)
+	}
+
+	var msgID *int64
+	if err = s.pgx.pool.QueryRow(pgxTagSpoolGet, s.spoolUser(u), ack, maxAge).Scan(&msgID, &msg, &surbID, &remaining); err != nil {
 		s.pgx.d.log.Debugf("spool_get() failed: %v", err)
 		return
 	}
+	if msg, surbID, err = s.pgx.d.openSpoolEntry(u, msg, surbID); err != nil {
+		msg, surbID, remaining = nil, nil, 0
+		return
+	}
+	if msgID != nil {
+		id = uint64(*msgID)
+	}
+	return
+}
+
+func (s *pgxSpool) ForEach(u []byte, fn func(msg, surbID []byte) error) error {
+	type entry struct {
+		msg, surbID []byte
+	}
+
+	// Buffer the user's spool, so that fn is not called with a pool
+	// connection held.
+	rows, err := s.pgx.pool.Query(pgxTagSpoolList, s.spoolUser(u))
+	if err != nil {
+		return err
+	}
+	var entries []entry
+	for rows.Next() {
+		var ent entry
+		if err = rows.Scan(&ent.msg, &ent.surbID); err != nil {
+			rows.Close()
+			return err
+		}
+		entries = append(entries, ent)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, ent := range entries {
+		msg, surbID, err := s.pgx.d.openSpoolEntry(u, ent.msg, ent.surbID)
+		if err != nil {
+			return err
+		}
+		if err = fn(msg, surbID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *pgxSpool) Usage(u []byte) (count, size int, err error) {
+	var sz int64
+	if err = s.pgx.pool.QueryRow(pgxTagSpoolUsage, s.spoolUser(u)).Scan(&count, &sz); err != nil {
+		return
+	}
+	size = int(sz) - count*s.pgx.d.spoolOverhead()
 	return
 }
 
@@ -335,10 +765,21 @@ func (s *pgxSpool) Remove(u []byte) error {
 		return nil
 	}
 
-	return s.pgx.doUserDelete(u)
+	return s.pgx.doUserDelete(s.spoolUser(u))
 }
 
 func (s *pgxSpool) Vacuum(udb userdb.UserDB) error {
+	// Purge the expired messages from every user's spool.
+	if q := s.getQuota(); q != nil && q.MaxAge > 0 {
+		var nExpired int
+		if err := s.pgx.pool.QueryRow(pgxTagSpoolExpire, nil, int64(q.MaxAge/time.Second)).Scan(&nExpired); err != nil {
+			return err
+		}
+		for i := 0; i < nExpired; i++ {
+			q.NotifyEvicted([]spool.EvictReason{spool.EvictMaxAge})
+		}
+	}
+
 	// This never needs to happen iff the database is acting as both the
 	// UserDB and spool.
 	if !s.pgx.IsSpoolOnly() {
@@ -374,6 +815,13 @@ func toPgxLogLevel(cfgLevel string) pgx.LogLevel {
 	}
 }
 
+func isPgError(err error, code string) bool {
+	if pgxErr, ok := err.(pgx.PgError); ok {
+		return pgxErr.Code == code
+	}
+	return false
+}
+
 func isPgNoDataFound(err error) bool {
 	if pgxErr, ok := err.(pgx.PgError); ok {
 		if pgxErr.Code == pgCodeNoDataFound {
@@ -0,0 +1,487 @@
+// pgx_schema.go - Postgresql schema and migrations.
+// Copyright (C) 2018  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sqldb
+
+// pgxSchemaVersion is the schema version expected by this implementation.
+var pgxSchemaVersion = len(pgxMigrations)
+
+// pgxSchemaCreate creates the initial (version 0) schema.  It is executed
+// in a transaction with `katzenpost.spool_only` set to true iff the database
+// will only be used for the spool (and not the authentication database).
+//
+// All Katzenpost server -> RDBMS interactions happen via functions so that:
+//
+//   - The user the server uses can have an extremely limited set of access
+//     privileges to prevent horrific things from happening.
+//   - People that are good at database development can contribute without
+//     having to deal with the server code at all.
+const pgxSchemaCreate = `
+  DO $$
+  DECLARE
+    pgsql_version  integer := current_setting('server_version_num')::integer;
+    schema_version smallint := 0;
+    spool_only     boolean := current_setting('katzenpost.spool_only')::boolean;
+  BEGIN
+    -- Ensure that Postgresql is sufficiently recent.
+    --
+    --  - INSERT ... ON CONFLICT [UPDATE, DO NOTHING] (>= 9.5).
+    IF pgsql_version < 90500 THEN
+      RAISE 'Insufficiently recent database: %', pgsql_version USING HINT = '9.5 or newer is requred';
+    END IF;
+
+    -- Write the database metadata.
+    CREATE TABLE metadata (
+      schema_version smallint NOT NULL,
+      spool_only     boolean NOT NULL
+    );
+    INSERT INTO metadata(schema_version, spool_only) VALUES (schema_version, spool_only);
+
+    -- Create the user table.
+    CREATE TABLE users (
+      user_id    bigserial PRIMARY KEY,
+      user_name  bytea NOT NULL UNIQUE
+    );
+    IF spool_only = false THEN
+      -- If the user table is an actual user database, then it needs a
+      -- column for the user's authentication key and identity key.
+      ALTER TABLE users ADD COLUMN authentication_key bytea NOT NULL;
+      ALTER TABLE users ADD COLUMN identity_key bytea;
+    END IF;
+
+    -- Create the spool table.
+    CREATE TABLE spool (
+      message_id   bigserial PRIMARY KEY,
+      user_id      bigint REFERENCES users ON DELETE CASCADE,
+      surb_id      bytea,
+      message_body bytea NOT NULL
+    );
+    CREATE INDEX ON spool(user_id);
+
+    -- Create the functions.
+    --
+    -- All Katzenpost server -> RDBMS interactions will happen via functions
+    -- so that:
+    --
+    --  - The user the server uses can have an extremely limit set of access
+    --    priviledges to prevent horrific things from happening.
+    --  - People that are good at database development can contribute without
+    --    having to deal with the server code at all.
+
+    CREATE FUNCTION metadata_get() RETURNS record AS $METADATA_GET$
+    DECLARE
+      ret record;
+    BEGIN
+      SELECT * INTO STRICT ret FROM metadata;
+      RETURN ret;
+    END $METADATA_GET$ LANGUAGE plpgsql STABLE;
+
+    IF spool_only = false THEN
+
+      CREATE FUNCTION user_get_authentication_key(user_name bytea) RETURNS bytea AS $USER_GET_AUTH$
+      DECLARE
+        ret bytea;
+      BEGIN
+        SELECT authentication_key INTO STRICT ret FROM users WHERE users.user_name = $1;
+        RETURN ret;
+      END $USER_GET_AUTH$ LANGUAGE plpgsql STABLE;
+
+      CREATE FUNCTION user_set_authentication_key(user_name bytea, authentication_key bytea, is_update boolean) RETURNS void AS $USER_SET_AUTH$
+      BEGIN
+        IF $3 = true THEN
+          UPDATE users SET authentication_key = $2 WHERE user_name = $1;
+          IF NOT FOUND THEN
+            RAISE SQLSTATE 'P0002'; -- no_data_found
+          END IF;
+        ELSE
+          INSERT INTO users(user_id, user_name, authentication_key) VALUES (DEFAULT, $1, $2);
+        END IF;
+      END $USER_SET_AUTH$ LANGUAGE plpgsql;
+
+      CREATE FUNCTION user_get_identity_key(user_name bytea) RETURNS bytea AS $USER_GET_IDENT$
+      DECLARE
+        ret bytea;
+      BEGIN
+        SELECT identity_key INTO STRICT ret FROM users WHERE users.user_name = $1;
+        RETURN ret;
+      END $USER_GET_IDENT$ LANGUAGE plpgsql STABLE;
+
+      CREATE FUNCTION user_set_identity_key(user_name bytea, identity_key bytea) RETURNS void AS $USER_SET_IDENT$
+      BEGIN
+        UPDATE users SET identity_key = $2 WHERE users.user_name = $1;
+        IF NOT FOUND THEN
+          RAISE SQLSTATE 'P0002'; -- no_data_found
+        END IF;
+      END $USER_SET_IDENT$ LANGUAGE plpgsql;
+
+      -- user_delete() is defined as a spool database routine, because it is
+      -- what is used to remove the user's spool entries.
+    END IF;
+
+    CREATE FUNCTION user_delete(user_name bytea) RETURNS void AS $USER_DELETE$
+    DECLARE
+      deleted integer;
+    BEGIN
+      DELETE FROM users WHERE users.user_name = $1 RETURNING 1 INTO STRICT deleted;
+    END $USER_DELETE$ LANGUAGE plpgsql;
+
+    CREATE FUNCTION spool_get(user_name bytea, advance boolean) RETURNS record AS $SPOOL_GET$
+    DECLARE
+      spool_cursor refcursor;
+      spool_row    record;
+      surb_id      bytea;
+      message_body bytea;
+      remaining    integer;
+      ret          record;
+    BEGIN
+      -- Note: If there ever are going to be multiple simultanious accesses to
+      -- a given user's spool (currently prohibited by the caller), then this
+      -- probably needs to acquire an advisory lock at the begining.
+      OPEN spool_cursor NO SCROLL FOR SELECT * from spool WHERE user_id = (SELECT user_id FROM users WHERE users.user_name = $1) ORDER BY message_id FOR UPDATE;
+
+      -- Set the output to something sane.
+      ret := (NULL::bytea, NULL::bytea, 0);
+
+      -- Grab the first message.
+      FETCH spool_cursor INTO spool_row;
+      IF NOT FOUND THEN
+        -- The user's spool is empty, bail out.
+        RETURN ret;
+      ELSIF $2 = true THEN
+        -- Delete the first row, and advance the cursor.
+        DELETE FROM spool WHERE CURRENT OF spool_cursor;
+        FETCH spool_cursor INTO spool_row;
+        IF NOT FOUND THEN
+          -- The delete drained the user's spool, bail out.
+          RETURN ret;
+        END IF;
+      END IF;
+
+      -- Copy the (new) head of the user's spool into the output.
+      surb_id := spool_row.surb_id;
+      message_body := spool_row.message_body;
+
+      -- Figure out if there is at least one more message in the user's spool.
+      MOVE spool_cursor;
+      IF FOUND THEN
+        -- At least one more message in the user's spool.
+        --
+        -- TODO: It's probably better if this returns a more accurate count,
+        -- but it is adequate to return a "yes/no".
+        remaining := 1;
+      ELSE
+        remaining := 0;
+      END IF;
+
+      ret := (message_body, surb_id, remaining);
+      RETURN ret;
+    END $SPOOL_GET$ LANGUAGE plpgsql;
+
+    IF spool_only = false THEN
+
+      CREATE FUNCTION spool_store(user_name bytea, surb_id bytea, msg bytea) RETURNS void AS $SPOOL_STORE$
+      BEGIN
+        INSERT INTO spool(message_id, user_id, surb_id, message_body) VALUES (DEFAULT, (SELECT user_id FROM users WHERE users.user_name = $1), $2, $3);
+      END $SPOOL_STORE$ LANGUAGE plpgsql;
+
+    ELSE
+
+      CREATE FUNCTION spool_store(user_name bytea, surb_id bytea, msg bytea) RETURNS void AS $SPOOL_STORE$
+      BEGIN
+        -- Can't use RETURNING to get the user_id, because when nothing is
+        -- updated, nothing is returned.
+        INSERT INTO users(user_id, user_name) VALUES (DEFAULT, $1) ON CONFLICT DO NOTHING;
+        INSERT INTO spool(message_id, user_id, surb_id, message_body) VALUES (DEFAULT, (SELECT user_id FROM users WHERE users.user_name = $1), $2, $3);
+      END $SPOOL_STORE$ LANGUAGE plpgsql;
+
+    END IF;
+
+  END $$ LANGUAGE plpgsql;
+`
+
+// pgxMigrations is the list of schema migrations, where the i-th entry
+// migrates the schema from version i to version i+1, and is responsible
+// for updating the version in the metadata table.  Existing entries must
+// never be modified, only appended to.
+var pgxMigrations = []string{
+	// Version 1: Spool quotas and message expiry, user metadata, and
+	// multiple named link keys per user.
+	`
+  DO $$
+  DECLARE
+    spool_only boolean;
+  BEGIN
+    SELECT metadata.spool_only INTO STRICT spool_only FROM metadata;
+
+    -- Record when each message was stored, for expiry.
+    ALTER TABLE spool ADD COLUMN stored_at timestamptz NOT NULL DEFAULT now();
+
+    IF spool_only = false THEN
+      -- Add the user's metadata.
+      ALTER TABLE users ADD COLUMN created_at timestamptz NOT NULL DEFAULT now();
+      ALTER TABLE users ADD COLUMN last_authenticated timestamptz;
+      ALTER TABLE users ADD COLUMN disabled boolean NOT NULL DEFAULT false;
+
+      -- Move the authentication keys to the link key table, as the user's
+      -- 'default' link key.
+      CREATE TABLE user_link_keys (
+        user_id  bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+        key_name text NOT NULL,
+        link_key bytea NOT NULL,
+        PRIMARY KEY (user_id, key_name)
+      );
+      INSERT INTO user_link_keys(user_id, key_name, link_key) SELECT users.user_id, 'default', users.authentication_key FROM users;
+      ALTER TABLE users DROP COLUMN authentication_key;
+
+      -- user_get_authentication_key() returns the user's 'default' link key,
+      -- or the first link key by name if it has been removed.
+      CREATE OR REPLACE FUNCTION user_get_authentication_key(user_name bytea) RETURNS bytea AS $USER_GET_AUTH$
+      DECLARE
+        ret bytea;
+      BEGIN
+        SELECT user_link_keys.link_key INTO STRICT ret FROM user_link_keys
+          WHERE user_link_keys.user_id = (SELECT users.user_id FROM users WHERE users.user_name = $1)
+          ORDER BY user_link_keys.key_name = 'default' DESC, user_link_keys.key_name COLLATE "C"
+          LIMIT 1;
+        RETURN ret;
+      END $USER_GET_AUTH$ LANGUAGE plpgsql STABLE;
+
+      -- user_set_authentication_key() sets the user's 'default' link key.
+      CREATE OR REPLACE FUNCTION user_set_authentication_key(user_name bytea, authentication_key bytea, is_update boolean) RETURNS void AS $USER_SET_AUTH$
+      DECLARE
+        uid bigint;
+      BEGIN
+        IF $3 = true THEN
+          SELECT users.user_id INTO STRICT uid FROM users WHERE users.user_name = $1;
+        ELSE
+          INSERT INTO users(user_id, user_name) VALUES (DEFAULT, $1) RETURNING users.user_id INTO uid;
+        END IF;
+        INSERT INTO user_link_keys(user_id, key_name, link_key) VALUES (uid, 'default', $2)
+          ON CONFLICT (user_id, key_name) DO UPDATE SET link_key = EXCLUDED.link_key;
+      END $USER_SET_AUTH$ LANGUAGE plpgsql;
+
+      CREATE FUNCTION user_add_link_key(user_name bytea, link_key_name text, new_link_key bytea) RETURNS void AS $USER_ADD_LINK$
+      DECLARE
+        uid bigint;
+      BEGIN
+        SELECT users.user_id INTO STRICT uid FROM users WHERE users.user_name = $1;
+        -- Duplicate names will raise unique_violation.
+        INSERT INTO user_link_keys(user_id, key_name, link_key) VALUES (uid, $2, $3);
+      END $USER_ADD_LINK$ LANGUAGE plpgsql;
+
+      CREATE FUNCTION user_remove_link_key(user_name bytea, link_key_name text) RETURNS void AS $USER_REM_LINK$
+      DECLARE
+        uid     bigint;
+        nr_keys integer;
+      BEGIN
+        -- Lock the user, so that concurrent removals can't remove the last key.
+        SELECT users.user_id INTO STRICT uid FROM users WHERE users.user_name = $1 FOR UPDATE;
+        PERFORM 1 FROM user_link_keys WHERE user_link_keys.user_id = uid AND user_link_keys.key_name = $2;
+        IF NOT FOUND THEN
+          RAISE SQLSTATE 'KP002'; -- No such link key.
+        END IF;
+        SELECT count(*) INTO nr_keys FROM user_link_keys WHERE user_link_keys.user_id = uid;
+        IF nr_keys <= 1 THEN
+          RAISE SQLSTATE 'KP001'; -- Removal of the last link key.
+        END IF;
+        DELETE FROM user_link_keys WHERE user_link_keys.user_id = uid AND user_link_keys.key_name = $2;
+      END $USER_REM_LINK$ LANGUAGE plpgsql;
+
+      CREATE FUNCTION user_get_link_keys(user_name bytea) RETURNS SETOF record AS $USER_GET_LINKS$
+      DECLARE
+        uid bigint;
+      BEGIN
+        SELECT users.user_id INTO STRICT uid FROM users WHERE users.user_name = $1;
+        RETURN QUERY SELECT user_link_keys.key_name, user_link_keys.link_key FROM user_link_keys WHERE user_link_keys.user_id = uid;
+      END $USER_GET_LINKS$ LANGUAGE plpgsql STABLE;
+
+      CREATE FUNCTION user_list() RETURNS SETOF record AS $USER_LIST$
+      BEGIN
+        RETURN QUERY SELECT users.user_name, users.created_at, users.last_authenticated, users.disabled FROM users ORDER BY users.user_name;
+      END $USER_LIST$ LANGUAGE plpgsql STABLE;
+
+      CREATE FUNCTION user_count() RETURNS bigint AS $USER_COUNT$
+      DECLARE
+        ret bigint;
+      BEGIN
+        SELECT count(*) INTO ret FROM users;
+        RETURN ret;
+      END $USER_COUNT$ LANGUAGE plpgsql STABLE;
+
+      CREATE FUNCTION user_get_info(user_name bytea) RETURNS record AS $USER_GET_INFO$
+      DECLARE
+        ret record;
+      BEGIN
+        SELECT users.created_at, users.last_authenticated, users.disabled INTO STRICT ret FROM users WHERE users.user_name = $1;
+        RETURN ret;
+      END $USER_GET_INFO$ LANGUAGE plpgsql STABLE;
+
+      CREATE FUNCTION user_set_disabled(user_name bytea, is_disabled boolean) RETURNS void AS $USER_SET_DISABLED$
+      BEGIN
+        UPDATE users SET disabled = $2 WHERE users.user_name = $1;
+        IF NOT FOUND THEN
+          RAISE SQLSTATE 'P0002'; -- no_data_found
+        END IF;
+      END $USER_SET_DISABLED$ LANGUAGE plpgsql;
+
+      CREATE FUNCTION user_set_last_authenticated(user_name bytea, last_auth timestamptz) RETURNS void AS $USER_SET_LAST_AUTH$
+      BEGIN
+        UPDATE users SET last_authenticated = $2 WHERE users.user_name = $1;
+        IF NOT FOUND THEN
+          RAISE SQLSTATE 'P0002'; -- no_data_found
+        END IF;
+      END $USER_SET_LAST_AUTH$ LANGUAGE plpgsql;
+
+    END IF;
+
+    CREATE FUNCTION spool_list(user_name bytea) RETURNS SETOF record AS $SPOOL_LIST$
+    BEGIN
+      RETURN QUERY SELECT spool.message_body, spool.surb_id FROM spool
+        WHERE spool.user_id = (SELECT users.user_id FROM users WHERE users.user_name = $1)
+        ORDER BY spool.message_id;
+    END $SPOOL_LIST$ LANGUAGE plpgsql STABLE;
+
+    CREATE FUNCTION spool_usage(user_name bytea) RETURNS record AS $SPOOL_USAGE$
+    DECLARE
+      ret record;
+    BEGIN
+      SELECT count(*)::integer, coalesce(sum(octet_length(spool.message_body)), 0)::bigint INTO ret
+        FROM spool WHERE spool.user_id = (SELECT users.user_id FROM users WHERE users.user_name = $1);
+      RETURN ret;
+    END $SPOOL_USAGE$ LANGUAGE plpgsql STABLE;
+
+    -- spool_evict_oldest() deletes the first message in the user's spool,
+    -- and returns its size.
+    CREATE FUNCTION spool_evict_oldest(user_name bytea) RETURNS bigint AS $SPOOL_EVICT$
+    DECLARE
+      evicted bigint;
+    BEGIN
+      DELETE FROM spool WHERE spool.message_id = (
+        SELECT spool.message_id FROM spool
+          WHERE spool.user_id = (SELECT users.user_id FROM users WHERE users.user_name = $1)
+          ORDER BY spool.message_id LIMIT 1
+      ) RETURNING octet_length(spool.message_body) INTO STRICT evicted;
+      RETURN evicted;
+    END $SPOOL_EVICT$ LANGUAGE plpgsql;
+
+    -- spool_expire() deletes the messages older than max_age seconds from
+    -- the user's spool, or every spool if user_name is NULL, and returns the
+    -- number of messages deleted.
+    CREATE FUNCTION spool_expire(user_name bytea, max_age bigint) RETURNS integer AS $SPOOL_EXPIRE$
+    DECLARE
+      nr_expired integer;
+    BEGIN
+      DELETE FROM spool WHERE spool.stored_at < now() - $2 * interval '1 second'
+        AND ($1 IS NULL OR spool.user_id = (SELECT users.user_id FROM users WHERE users.user_name = $1));
+      GET DIAGNOSTICS nr_expired = ROW_COUNT;
+      RETURN nr_expired;
+    END $SPOOL_EXPIRE$ LANGUAGE plpgsql;
+
+    UPDATE metadata SET schema_version = 1;
+  END $$ LANGUAGE plpgsql;
+`,
+
+	// Version 2: Per-user send rate limit overrides.
+	`
+  DO $$
+  DECLARE
+    spool_only boolean;
+  BEGIN
+    SELECT metadata.spool_only INTO STRICT spool_only FROM metadata;
+
+    IF spool_only = false THEN
+      -- The override is either entirely NULL (none), or entirely set.
+      ALTER TABLE users ADD COLUMN send_rate_per_minute bigint;
+      ALTER TABLE users ADD COLUMN send_burst bigint;
+
+      CREATE OR REPLACE FUNCTION user_list() RETURNS SETOF record AS $USER_LIST$
+      BEGIN
+        RETURN QUERY SELECT users.user_name, users.created_at, users.last_authenticated, users.disabled, users.send_rate_per_minute, users.send_burst FROM users ORDER BY users.user_name;
+      END $USER_LIST$ LANGUAGE plpgsql STABLE;
+
+      CREATE OR REPLACE FUNCTION user_get_info(user_name bytea) RETURNS record AS $USER_GET_INFO$
+      DECLARE
+        ret record;
+      BEGIN
+        SELECT users.created_at, users.last_authenticated, users.disabled, users.send_rate_per_minute, users.send_burst INTO STRICT ret FROM users WHERE users.user_name = $1;
+        RETURN ret;
+      END $USER_GET_INFO$ LANGUAGE plpgsql STABLE;
+
+      CREATE FUNCTION user_set_rate_limit(user_name bytea, rate_per_minute bigint, burst bigint) RETURNS void AS $USER_SET_RATE_LIMIT$
+      BEGIN
+        UPDATE users SET send_rate_per_minute = $2, send_burst = $3 WHERE users.user_name = $1;
+        IF NOT FOUND THEN
+          RAISE SQLSTATE 'P0002'; -- no_data_found
+        END IF;
+      END $USER_SET_RATE_LIMIT$ LANGUAGE plpgsql;
+    END IF;
+
+    UPDATE metadata SET schema_version = 2;
+  END $$ LANGUAGE plpgsql;
+`,
+
+	// Version 3: Spool entries are retrieved along with their IDs, and
+	// deleted by ID once acknowledged, and expired entries are skipped.
+	`
+  DO $$
+  BEGIN
+    DROP FUNCTION spool_get(bytea, boolean);
+
+    -- spool_get() deletes the message identified by ack_id (if any) iff it
+    -- is still in the user's spool, and returns the first message that is
+    -- no older than max_age seconds (if set).
+    CREATE FUNCTION spool_get(user_name bytea, ack_id bigint, max_age bigint) RETURNS record AS $SPOOL_GET$
+    DECLARE
+      uid       bigint;
+      spool_row record;
+      remaining integer := 0;
+      ret       record;
+    BEGIN
+      -- Set the output to something sane.
+      ret := (NULL::bigint, NULL::bytea, NULL::bytea, 0);
+
+      SELECT users.user_id INTO uid FROM users WHERE users.user_name = $1;
+      IF NOT FOUND THEN
+        -- The user's spool is empty, bail out.
+        RETURN ret;
+      END IF;
+
+      IF $2 IS NOT NULL THEN
+        DELETE FROM spool WHERE spool.user_id = uid AND spool.message_id = $2;
+      END IF;
+
+      -- Grab the first unexpired message.
+      SELECT spool.message_id, spool.message_body, spool.surb_id INTO spool_row FROM spool
+        WHERE spool.user_id = uid AND ($3 IS NULL OR spool.stored_at >= now() - $3 * interval '1 second')
+        ORDER BY spool.message_id LIMIT 1;
+      IF NOT FOUND THEN
+        RETURN ret;
+      END IF;
+
+      -- Figure out if there is at least one more message in the user's spool.
+      PERFORM 1 FROM spool WHERE spool.user_id = uid AND spool.message_id > spool_row.message_id;
+      IF FOUND THEN
+        remaining := 1;
+      END IF;
+
+      ret := (spool_row.message_id, spool_row.message_body, spool_row.surb_id, remaining);
+      RETURN ret;
+    END $SPOOL_GET$ LANGUAGE plpgsql;
+
+    UPDATE metadata SET schema_version = 3;
+  END $$ LANGUAGE plpgsql;
+`,
+}
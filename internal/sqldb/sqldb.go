@@ -19,9 +19,13 @@ package sqldb
 
 import (
 	"fmt"
+	"path/filepath"
+	"strings"
 
+	"github.com/katzenpost/server/config"
 	"github.com/katzenpost/server/internal/glue"
 	"github.com/katzenpost/server/spool"
+	"github.com/katzenpost/server/spool/spoolcrypt"
 	"github.com/katzenpost/server/userdb"
 	"gopkg.in/op/go-logging.v1"
 )
@@ -30,7 +34,13 @@ type dbImpl interface {
 	IsSpoolOnly() bool
 	UserDB() (userdb.UserDB, error)
 	Spool() spool.Spool
+	Ping() error
 	Close()
+
+	// spoolSample returns the spoolcrypt user ID (see spoolUserID), message
+	// body and SURB ID of the first message found in the spool, or nil if
+	// the spool is empty.
+	spoolSample() (uid, msg, surbID []byte, err error)
 }
 
 // SQLDB is a SQL database instance.
@@ -38,7 +48,8 @@ type SQLDB struct {
 	glue glue.Glue
 	log  *logging.Logger
 
-	impl dbImpl
+	impl     dbImpl
+	spoolKey *spoolcrypt.Key
 }
 
 // IsSpoolOnly returns true iff the database is configured to only support
@@ -57,13 +68,122 @@ func (d *SQLDB) Spool() spool.Spool {
 	return d.impl.Spool()
 }
 
+// Ping returns a non-nil error iff the SQL database is unreachable.
+func (d *SQLDB) Ping() error {
+	return d.impl.Ping()
+}
+
 // Close closes the SQL database connection(s).
 func (d *SQLDB) Close() {
 	d.impl.Close()
 }
 
-// New constructs a new SQLDB instance.
+// New constructs a new SQLDB instance.  The schema migrations are applied
+// first, unless disabled in the configuration, in which case the database
+// must already have the expected schema version.
 func New(glue glue.Glue) (*SQLDB, error) {
+	db, err := newSQLDB(glue, !glue.Config().Provider.SQLDB.DisableAutoMigrate)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.initSpoolKey(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Migrate creates the schema and applies the schema migrations to the SQL
+// database as required, and closes the database.
+func Migrate(glue glue.Glue) error {
+	db, err := newSQLDB(glue, true)
+	if err != nil {
+		return err
+	}
+	db.Close()
+	return nil
+}
+
+// initSpoolKey loads the spool storage key iff the database is used as an
+// encrypted spool, and ensures that the spool contents are consistent with
+// it.  The message bodies and SURB IDs are encrypted, and where the spool is
+// keyed by username rather than relating to the users table, as with SQLite
+// and spool only PostgreSQL databases, the usernames are replaced by the
+// spoolcrypt user IDs.
+func (d *SQLDB) initSpoolKey() error {
+	sCfg := d.glue.Config().Provider.SpoolDB
+	if sCfg.Backend != config.BackendSQL {
+		return nil
+	}
+	if eCfg := sCfg.Encryption; eCfg != nil {
+		var err error
+		if d.spoolKey, err = spoolcrypt.Load(eCfg.KeyFile, eCfg.Passphrase); err != nil {
+			return err
+		}
+	}
+
+	uid, msg, surbID, err := d.impl.spoolSample()
+	if err != nil || msg == nil {
+		return err
+	}
+	if err = spoolcrypt.CheckSample(d.spoolKey, uid, msg, surbID); err != nil {
+		return fmt.Errorf("sqldb: %v", err)
+	}
+	return nil
+}
+
+// spoolUserID returns the identifier that the user's spool is keyed by,
+// which is the spoolcrypt user ID iff the spool is encrypted, and the
+// username otherwise.
+func (d *SQLDB) spoolUserID(u []byte) []byte {
+	if d.spoolKey == nil {
+		return u
+	}
+	return d.spoolKey.UserID(u)
+}
+
+// spoolOverhead returns the number of bytes that the storage encryption (if
+// any) adds to each stored message body.
+func (d *SQLDB) spoolOverhead() int {
+	if d.spoolKey == nil {
+		return 0
+	}
+	return spoolcrypt.Overhead
+}
+
+// sealSpoolEntry encrypts the user's message body and (optional) SURB ID
+// for storage, iff the spool is encrypted.
+func (d *SQLDB) sealSpoolEntry(u, msg, surbID []byte) ([]byte, []byte) {
+	if d.spoolKey == nil {
+		return msg, surbID
+	}
+	userID := d.spoolKey.UserID(u)
+	if surbID != nil {
+		surbID = d.spoolKey.SealSURBID(userID, surbID)
+	}
+	return d.spoolKey.SealMessage(userID, msg), surbID
+}
+
+// openSpoolEntry decrypts the user's stored message body and (optional)
+// SURB ID, iff the spool is encrypted.
+func (d *SQLDB) openSpoolEntry(u, msg, surbID []byte) ([]byte, []byte, error) {
+	if d.spoolKey == nil || msg == nil {
+		return msg, surbID, nil
+	}
+	userID := d.spoolKey.UserID(u)
+	msg, err := d.spoolKey.OpenMessage(userID, msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if surbID != nil {
+		if surbID, err = d.spoolKey.OpenSURBID(userID, surbID); err != nil {
+			return nil, nil, err
+		}
+	}
+	return msg, surbID, nil
+}
+
+func newSQLDB(glue glue.Glue, migrate bool) (*SQLDB, error) {
 	db := &SQLDB{
 		glue: glue,
 		log:  glue.LogBackend().GetLogger("sqldb"),
@@ -74,7 +194,19 @@ func New(glue glue.Glue) (*SQLDB, error) {
 	switch sCfg.Backend {
 	case implPgx:
 		var err error
-		db.impl, err = newPgxImpl(db, sCfg.DataSourceName)
+		db.impl, err = newPgxImpl(db, sCfg.DataSourceName, migrate)
+		if err != nil {
+			return nil, err
+		}
+	case implSQLite:
+		// Relative database paths are relative to the DataDir, as with the
+		// bolt databases.
+		dsn := sCfg.DataSourceName
+		if !filepath.IsAbs(dsn) && !strings.HasPrefix(dsn, "file:") {
+			dsn = filepath.Join(glue.Config().Server.DataDir, dsn)
+		}
+		var err error
+		db.impl, err = newSQLiteImpl(db, dsn, migrate)
 		if err != nil {
 			return nil, err
 		}
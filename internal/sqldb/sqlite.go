@@ -0,0 +1,922 @@
+// sqlite.go - SQLite backed database.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sqldb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/sphinx"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/utils"
+	"github.com/katzenpost/server/spool"
+	"github.com/katzenpost/server/userdb"
+
+	// The pure Go SQLite driver, registered as `sqlite`.
+	_ "modernc.org/sqlite"
+)
+
+const implSQLite = "sqlite"
+
+// sqliteMigrations is the list of schema migrations, each of which is a
+// list of statements.  The schema version of a database is the number of
+// migrations applied to it, as tracked by `PRAGMA user_version`.
+//
+// Times are stored as nanoseconds since the UNIX epoch, with NULL standing
+// in for the zero time.  Unlike the PostgreSQL database, the spool is keyed
+// by username, or by the spoolcrypt user ID iff the spool is encrypted,
+// rather than referencing the users table, so that the spool may be used
+// with any UserDB backend.
+var sqliteMigrations = [][]string{
+	// Version 1: The initial schema.
+	{
+		`CREATE TABLE users (
+			user_name          BLOB PRIMARY KEY NOT NULL,
+			identity_key       BLOB,
+			created_at         INTEGER NOT NULL,
+			last_authenticated INTEGER,
+			disabled           INTEGER NOT NULL DEFAULT 0
+		);`,
+		`CREATE TABLE user_link_keys (
+			user_name BLOB NOT NULL,
+			key_name  TEXT NOT NULL,
+			link_key  BLOB NOT NULL,
+			PRIMARY KEY (user_name, key_name)
+		);`,
+		`CREATE TABLE spool (
+			message_id   INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_name    BLOB NOT NULL,
+			surb_id      BLOB,
+			message_body BLOB NOT NULL,
+			stored_at    INTEGER NOT NULL
+		);`,
+		`CREATE INDEX spool_user_name ON spool (user_name, message_id);`,
+	},
+
+	// Version 2: Per-user send rate limit overrides, which are either
+	// entirely NULL (none), or entirely set.
+	{
+		`ALTER TABLE users ADD COLUMN send_rate_per_minute INTEGER;`,
+		`ALTER TABLE users ADD COLUMN send_burst INTEGER;`,
+	},
+}
+
+// sqliteQuerier is the subset of the query interface common to sql.DB and
+// sql.Tx.
+type sqliteQuerier interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}
+
+type sqliteImpl struct {
+	d *SQLDB
+
+	db *sql.DB
+}
+
+func (s *sqliteImpl) IsSpoolOnly() bool {
+	return false
+}
+
+func (s *sqliteImpl) UserDB() (userdb.UserDB, error) {
+	return newSQLiteUserDB(s), nil
+}
+
+func (s *sqliteImpl) Spool() spool.Spool {
+	return newSQLiteSpool(s)
+}
+
+func (s *sqliteImpl) spoolSample() (u, msg, surbID []byte, err error) {
+	if err = s.db.QueryRow("SELECT user_name, message_body, surb_id FROM spool ORDER BY message_id LIMIT 1;").Scan(&u, &msg, &surbID); err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+func (s *sqliteImpl) Ping() error {
+	return s.db.Ping()
+}
+
+func (s *sqliteImpl) Close() {
+	s.db.Close()
+}
+
+func (s *sqliteImpl) doTx(fn func(*sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteImpl) migrate(apply bool) error {
+	var schemaVersion int
+	if err := s.db.QueryRow("PRAGMA user_version;").Scan(&schemaVersion); err != nil {
+		return fmt.Errorf("sql/sqlite: failed to query schema version: %v", err)
+	}
+	switch {
+	case schemaVersion > len(sqliteMigrations):
+		return fmt.Errorf("sql/sqlite: schema version %v is newer than the expected version %v", schemaVersion, len(sqliteMigrations))
+	case schemaVersion < len(sqliteMigrations) && !apply:
+		return fmt.Errorf("sql/sqlite: schema version %v is older than the expected version %v, run the server with -migrate", schemaVersion, len(sqliteMigrations))
+	}
+
+	for i := schemaVersion; i < len(sqliteMigrations); i++ {
+		newVersion := i + 1
+		err := s.doTx(func(tx *sql.Tx) error {
+			for _, stmt := range sqliteMigrations[i] {
+				if _, err := tx.Exec(stmt); err != nil {
+					return err
+				}
+			}
+			// PRAGMA does not support bound parameters.
+			_, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d;", newVersion))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("sql/sqlite: failed to migrate to schema version %v: %v", newVersion, err)
+		}
+		s.d.log.Noticef("Migrated database to schema version %v.", newVersion)
+	}
+
+	return nil
+}
+
+func newSQLiteImpl(db *SQLDB, dataSourceName string, migrate bool) (dbImpl, error) {
+	s := &sqliteImpl{
+		d: db,
+	}
+
+	var err error
+	if s.db, err = sql.Open(implSQLite, dataSourceName); err != nil {
+		return nil, err
+	}
+
+	// SQLite only allows a single writer at a time, so serialize all access
+	// through one connection instead of contending for the database lock.
+	s.db.SetMaxOpenConns(1)
+
+	if err = s.migrate(migrate); err != nil {
+		s.db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+type sqliteUserDB struct {
+	sqlite *sqliteImpl
+}
+
+func (d *sqliteUserDB) Exists(u []byte) bool {
+	if !sqliteUserOk(u) {
+		return false
+	}
+
+	ok, err := sqliteUserExists(d.sqlite.db, u)
+	if err != nil {
+		d.sqlite.d.log.Debugf("Exists() failed: %v", err)
+	}
+	return ok
+}
+
+func (d *sqliteUserDB) IsValid(u []byte, k *ecdh.PublicKey) bool {
+	if k == nil {
+		return false
+	}
+
+	keys, err := d.LinkKeys(u)
+	if err != nil {
+		return false
+	}
+
+	isValid := false
+	for _, dbKey := range keys {
+		if dbKey.Equal(k) {
+			isValid = true
+		}
+	}
+	return isValid
+}
+
+func (d *sqliteUserDB) Link(u []byte) (*ecdh.PublicKey, error) {
+	if !sqliteUserOk(u) {
+		return nil, fmt.Errorf("sqlite/userdb: invalid username: `%v`", u)
+	}
+
+	// Fall back to the first key, if the default key was removed.
+	var raw []byte
+	err := d.sqlite.db.QueryRow("SELECT link_key FROM user_link_keys WHERE user_name = ? ORDER BY key_name = ? DESC, key_name LIMIT 1;", u, userdb.DefaultLinkKeyName).Scan(&raw)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		if !d.Exists(u) {
+			return nil, userdb.ErrNoSuchUser
+		}
+		return nil, fmt.Errorf("sqlite/userdb: user %s does not have a link key", utils.ASCIIBytesToPrintString(u))
+	default:
+		return nil, err
+	}
+	return sqliteBytesToPublicKey(raw)
+}
+
+func (d *sqliteUserDB) Add(u []byte, k *ecdh.PublicKey, update bool) error {
+	if !sqliteUserOk(u) {
+		return fmt.Errorf("sqlite/userdb: invalid username: `%v`", u)
+	}
+	if k == nil {
+		return errors.New("sqlite/userdb: must provide a public key")
+	}
+
+	return d.sqlite.doTx(func(tx *sql.Tx) error {
+		exists, err := sqliteUserExists(tx, u)
+		switch {
+		case err != nil:
+			return err
+		case exists && !update:
+			return errors.New("sqlite/userdb: user already exists")
+		case !exists && update:
+			return userdb.ErrNoSuchUser
+		case !exists:
+			if _, err = tx.Exec("INSERT INTO users (user_name, created_at) VALUES (?, ?);", u, time.Now().UnixNano()); err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec("INSERT OR REPLACE INTO user_link_keys (user_name, key_name, link_key) VALUES (?, ?, ?);", u, userdb.DefaultLinkKeyName, k.Bytes())
+		return err
+	})
+}
+
+func (d *sqliteUserDB) AddLinkKey(u []byte, name string, k *ecdh.PublicKey) error {
+	if !sqliteUserOk(u) {
+		return fmt.Errorf("sqlite/userdb: invalid username: `%v`", u)
+	}
+	if !userdb.IsValidLinkKeyName(name) {
+		return fmt.Errorf("sqlite/userdb: invalid link key name: `%v`", name)
+	}
+	if k == nil {
+		return errors.New("sqlite/userdb: must provide a public key")
+	}
+
+	return d.sqlite.doTx(func(tx *sql.Tx) error {
+		if exists, err := sqliteUserExists(tx, u); err != nil {
+			return err
+		} else if !exists {
+			return userdb.ErrNoSuchUser
+		}
+		if exists, err := sqliteLinkKeyExists(tx, u, name); err != nil {
+			return err
+		} else if exists {
+			return userdb.ErrLinkKeyExists
+		}
+		_, err := tx.Exec("INSERT INTO user_link_keys (user_name, key_name, link_key) VALUES (?, ?, ?);", u, name, k.Bytes())
+		return err
+	})
+}
+
+func (d *sqliteUserDB) RemoveLinkKey(u []byte, name string) error {
+	if !sqliteUserOk(u) {
+		return fmt.Errorf("sqlite/userdb: invalid username: `%v`", u)
+	}
+
+	return d.sqlite.doTx(func(tx *sql.Tx) error {
+		if exists, err := sqliteUserExists(tx, u); err != nil {
+			return err
+		} else if !exists {
+			return userdb.ErrNoSuchUser
+		}
+		if exists, err := sqliteLinkKeyExists(tx, u, name); err != nil {
+			return err
+		} else if !exists {
+			return userdb.ErrNoSuchLinkKey
+		}
+		var nrKeys int
+		if err := tx.QueryRow("SELECT count(*) FROM user_link_keys WHERE user_name = ?;", u).Scan(&nrKeys); err != nil {
+			return err
+		}
+		if nrKeys <= 1 {
+			return userdb.ErrLastLinkKey
+		}
+		_, err := tx.Exec("DELETE FROM user_link_keys WHERE user_name = ? AND key_name = ?;", u, name)
+		return err
+	})
+}
+
+func (d *sqliteUserDB) LinkKeys(u []byte) (map[string]*ecdh.PublicKey, error) {
+	if !sqliteUserOk(u) {
+		return nil, fmt.Errorf("sqlite/userdb: invalid username: `%v`", u)
+	}
+
+	rows, err := d.sqlite.db.Query("SELECT key_name, link_key FROM user_link_keys WHERE user_name = ?;", u)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make(map[string]*ecdh.PublicKey)
+	for rows.Next() {
+		var name string
+		var raw []byte
+		if err = rows.Scan(&name, &raw); err != nil {
+			return nil, err
+		}
+		if keys[name], err = sqliteBytesToPublicKey(raw); err != nil {
+			return nil, err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// Every user has at least one link key.
+	if len(keys) == 0 {
+		return nil, userdb.ErrNoSuchUser
+	}
+	return keys, nil
+}
+
+func (d *sqliteUserDB) SetIdentity(u []byte, k *ecdh.PublicKey) error {
+	if !sqliteUserOk(u) {
+		return fmt.Errorf("sqlite/userdb: invalid username: `%v`", u)
+	}
+
+	var raw interface{}
+	if k != nil {
+		raw = k.Bytes()
+	}
+	return d.updateUser(u, "UPDATE users SET identity_key = ? WHERE user_name = ?;", raw)
+}
+
+func (d *sqliteUserDB) Identity(u []byte) (*ecdh.PublicKey, error) {
+	if !sqliteUserOk(u) {
+		return nil, fmt.Errorf("sqlite/userdb: invalid username: `%v`", u)
+	}
+
+	var raw []byte
+	switch err := d.sqlite.db.QueryRow("SELECT identity_key FROM users WHERE user_name = ?;", u).Scan(&raw); err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil, userdb.ErrNoSuchUser
+	default:
+		return nil, err
+	}
+	if raw == nil {
+		return nil, userdb.ErrNoIdentity
+	}
+	return sqliteBytesToPublicKey(raw)
+}
+
+func (d *sqliteUserDB) Remove(u []byte) error {
+	if !sqliteUserOk(u) {
+		return fmt.Errorf("sqlite/userdb: invalid username: `%v`", u)
+	}
+
+	return d.sqlite.doTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec("DELETE FROM users WHERE user_name = ?;", u)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return userdb.ErrNoSuchUser
+		}
+		_, err = tx.Exec("DELETE FROM user_link_keys WHERE user_name = ?;", u)
+		return err
+	})
+}
+
+func (d *sqliteUserDB) ForEach(fn func([]byte, *userdb.UserInfo) error) error {
+	type userEnt struct {
+		u    []byte
+		info *userdb.UserInfo
+	}
+
+	// Buffer the users, so that fn is not called with the connection held.
+	rows, err := d.sqlite.db.Query("SELECT user_name, created_at, last_authenticated, disabled, send_rate_per_minute, send_burst FROM users ORDER BY user_name;")
+	if err != nil {
+		return err
+	}
+	var users []userEnt
+	for rows.Next() {
+		var u []byte
+		var info *userdb.UserInfo
+		if info, err = sqliteScanUserInfo(rows, &u); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, userEnt{u, info})
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, ent := range users {
+		if err = fn(ent.u, ent.info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *sqliteUserDB) Count() (int, error) {
+	var n int
+	if err := d.sqlite.db.QueryRow("SELECT count(*) FROM users;").Scan(&n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (d *sqliteUserDB) Info(u []byte) (*userdb.UserInfo, error) {
+	if !sqliteUserOk(u) {
+		return nil, fmt.Errorf("sqlite/userdb: invalid username: `%v`", u)
+	}
+
+	row := d.sqlite.db.QueryRow("SELECT created_at, last_authenticated, disabled, send_rate_per_minute, send_burst FROM users WHERE user_name = ?;", u)
+	info, err := sqliteScanUserInfo(row)
+	if err == sql.ErrNoRows {
+		return nil, userdb.ErrNoSuchUser
+	}
+	return info, err
+}
+
+func (d *sqliteUserDB) SetDisabled(u []byte, disabled bool) error {
+	if !sqliteUserOk(u) {
+		return fmt.Errorf("sqlite/userdb: invalid username: `%v`", u)
+	}
+
+	return d.updateUser(u, "UPDATE users SET disabled = ? WHERE user_name = ?;", disabled)
+}
+
+func (d *sqliteUserDB) SetLastAuthenticated(u []byte, t time.Time) error {
+	if !sqliteUserOk(u) {
+		return fmt.Errorf("sqlite/userdb: invalid username: `%v`", u)
+	}
+
+	return d.updateUser(u, "UPDATE users SET last_authenticated = ? WHERE user_name = ?;", sqliteTime(t))
+}
+
+func (d *sqliteUserDB) SetRateLimit(u []byte, rl *userdb.RateLimit) error {
+	if !sqliteUserOk(u) {
+		return fmt.Errorf("sqlite/userdb: invalid username: `%v`", u)
+	}
+
+	var rate, burst interface{}
+	if rl != nil {
+		if rl.SendRatePerMinute > math.MaxInt64 || rl.SendBurst > math.MaxInt64 {
+			return errors.New("sqlite/userdb: rate limit out of range")
+		}
+		rate, burst = int64(rl.SendRatePerMinute), int64(rl.SendBurst)
+	}
+	return d.updateUser(u, "UPDATE users SET send_rate_per_minute = ?, send_burst = ? WHERE user_name = ?;", rate, burst)
+}
+
+func (d *sqliteUserDB) updateUser(u []byte, query string, values ...interface{}) error {
+	res, err := d.sqlite.db.Exec(query, append(values, u)...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return userdb.ErrNoSuchUser
+	}
+	return nil
+}
+
+func (d *sqliteUserDB) Close() {
+	// Nothing to do.
+}
+
+func newSQLiteUserDB(s *sqliteImpl) *sqliteUserDB {
+	return &sqliteUserDB{
+		sqlite: s,
+	}
+}
+
+type sqliteSpool struct {
+	sync.RWMutex
+
+	sqlite *sqliteImpl
+	quota  *spool.Quota
+}
+
+func (s *sqliteSpool) SetQuota(q *spool.Quota) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.quota = q
+}
+
+func (s *sqliteSpool) getQuota() *spool.Quota {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.quota
+}
+
+func (s *sqliteSpool) StoreMessage(u, msg []byte) error {
+	if len(msg) != constants.UserForwardPayloadLength {
+		return fmt.Errorf("sqlite/spool: invalid user message size: %d", len(msg))
+	}
+	return s.doStore(u, nil, msg)
+}
+
+func (s *sqliteSpool) StoreSURBReply(u []byte, id *[sConstants.SURBIDLength]byte, msg []byte) error {
+	if len(msg) != sphinx.PayloadTagLength+constants.ForwardPayloadLength {
+		return fmt.Errorf("sqlite/spool: invalid SURBReply message size: %d", len(msg))
+	}
+	if id == nil {
+		return fmt.Errorf("sqlite/spool: SURBReply is missing ID")
+	}
+	return s.doStore(u, id[:], msg)
+}
+
+func (s *sqliteSpool) doStore(u, id, msg []byte) error {
+	if !sqliteUserOk(u) {
+		return fmt.Errorf("sqlite/spool: invalid username: `%v`", u)
+	}
+
+	q := s.getQuota()
+	now := time.Now()
+
+	uid := s.sqlite.d.spoolUserID(u)
+	msgLen, overhead := len(msg), s.sqlite.d.spoolOverhead()
+	msg, id = s.sqlite.d.sealSpoolEntry(u, msg, id)
+	var surbID interface{}
+	if id != nil {
+		surbID = id
+	}
+
+	var evicted []spool.EvictReason
+	err := s.sqlite.doTx(func(tx *sql.Tx) error {
+		// Enforce the quota (if any), before adding the new message.
+		if q != nil {
+			var err error
+			if evicted, err = sqliteEnforceQuota(tx, uid, q, msgLen, overhead, now); err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.Exec("INSERT INTO spool (user_name, surb_id, message_body, stored_at) VALUES (?, ?, ?, ?);", uid, surbID, msg, now.UnixNano())
+		return err
+	})
+	if err == nil && q != nil {
+		q.NotifyEvicted(evicted)
+	}
+	return err
+}
+
+func sqliteEnforceQuota(tx *sql.Tx, u []byte, q *spool.Quota, msgLen, overhead int, now time.Time) ([]spool.EvictReason, error) {
+	// Purge the expired messages first, since they do not count against
+	// the rest of the quota.
+	nExpired, err := sqliteExpire(tx, u, q, now)
+	if err != nil {
+		return nil, err
+	}
+	evicted := make([]spool.EvictReason, 0, nExpired)
+	for i := 0; i < nExpired; i++ {
+		evicted = append(evicted, spool.EvictMaxAge)
+	}
+
+	if q.MaxMessages <= 0 && q.MaxBytes <= 0 {
+		return evicted, nil
+	}
+
+	count, size, err := sqliteUsage(tx, u, overhead)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		reason, exceeds := q.Exceeds(count, size, msgLen)
+		if !exceeds {
+			return evicted, nil
+		}
+		if q.Policy != spool.PolicyEvict || count == 0 {
+			return nil, spool.ErrQuotaExceeded
+		}
+
+		// Evict the oldest message.
+		var msgID int64
+		var msgSize int
+		if err = tx.QueryRow("SELECT message_id, length(message_body) FROM spool WHERE user_name = ? ORDER BY message_id LIMIT 1;", u).Scan(&msgID, &msgSize); err != nil {
+			return nil, err
+		}
+		if _, err = tx.Exec("DELETE FROM spool WHERE message_id = ?;", msgID); err != nil {
+			return nil, err
+		}
+		count--
+		size -= msgSize - overhead
+		evicted = append(evicted, reason)
+	}
+}
+
+// sqliteExpire deletes the messages that exceed the quota's maximum age
+// from the user's spool, or from every spool if u is nil, and returns the
+// number of messages deleted.
+func sqliteExpire(tx *sql.Tx, u []byte, q *spool.Quota, now time.Time) (int, error) {
+	if q.MaxAge <= 0 {
+		return 0, nil
+	}
+
+	cutoff := now.Add(-q.MaxAge).UnixNano()
+	var res sql.Result
+	var err error
+	if u == nil {
+		res, err = tx.Exec("DELETE FROM spool WHERE stored_at < ?;", cutoff)
+	} else {
+		res, err = tx.Exec("DELETE FROM spool WHERE user_name = ? AND stored_at < ?;", u, cutoff)
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// sqliteUsage returns the number of messages in the user's spool, and their
+// total size, excluding the per-message storage overhead.
+func sqliteUsage(q sqliteQuerier, u []byte, overhead int) (count, size int, err error) {
+	if err = q.QueryRow("SELECT count(*), coalesce(sum(length(message_body)), 0) FROM spool WHERE user_name = ?;", u).Scan(&count, &size); err != nil {
+		return
+	}
+	size -= count * overhead
+	return
+}
+
+func (s *sqliteSpool) Get(u []byte, ackID uint64) (msg, surbID []byte, id uint64, remaining int, err error) {
+	type entry struct {
+		id          int64
+		msg, surbID []byte
+	}
+
+	// Expired messages are skipped, and left for the next store or Vacuum
+	// to delete.
+	cutoff := int64(math.MinInt64)
+	if q := s.getQuota(); q != nil && q.MaxAge > 0 {
+		cutoff = time.Now().Add(-q.MaxAge).UnixNano()
+	}
+
+	uid := s.sqlite.d.spoolUserID(u)
+	err = s.sqlite.doTx(func(tx *sql.Tx) error {
+		if ackID != 0 {
+			// Delete the acknowledged message, iff it is still in the spool.
+			if _, err := tx.Exec("DELETE FROM spool WHERE user_name = ? AND message_id = ?;", uid, int64(ackID)); err != nil {
+				return err
+			}
+		}
+
+		// Only the first 2 messages are needed to service the request.
+		rows, err := tx.Query("SELECT message_id, message_body, surb_id FROM spool WHERE user_name = ? AND stored_at >= ? ORDER BY message_id LIMIT 2;", uid, cutoff)
+		if err != nil {
+			return err
+		}
+		var entries []entry
+		for rows.Next() {
+			var ent entry
+			if err = rows.Scan(&ent.id, &ent.msg, &ent.surbID); err != nil {
+				rows.Close()
+				return err
+			}
+			entries = append(entries, ent)
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		if len(entries) == 0 {
+			// If the user's spool is empty, the spool is empty.
+			return nil
+		}
+
+		// The remaining count is merely a hint, so just return 0 if there is
+		// only one message, and 1 if there are any number of messages,
+		// "excluding the current message".
+		if len(entries) > 1 {
+			remaining = 1
+		}
+		id = uint64(entries[0].id)
+		msg, surbID, err = s.sqlite.d.openSpoolEntry(u, entries[0].msg, entries[0].surbID)
+		return err
+	})
+	if err != nil {
+		msg, surbID, id, remaining = nil, nil, 0, 0
+	}
+	return
+}
+
+func (s *sqliteSpool) ForEach(u []byte, fn func(msg, surbID []byte) error) error {
+	type entry struct {
+		msg, surbID []byte
+	}
+
+	// Buffer the user's spool, so that fn is not called with the connection
+	// held.
+	rows, err := s.sqlite.db.Query("SELECT message_body, surb_id FROM spool WHERE user_name = ? ORDER BY message_id;", s.sqlite.d.spoolUserID(u))
+	if err != nil {
+		return err
+	}
+	var entries []entry
+	for rows.Next() {
+		var ent entry
+		if err = rows.Scan(&ent.msg, &ent.surbID); err != nil {
+			rows.Close()
+			return err
+		}
+		entries = append(entries, ent)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, ent := range entries {
+		msg, surbID, err := s.sqlite.d.openSpoolEntry(u, ent.msg, ent.surbID)
+		if err != nil {
+			return err
+		}
+		if err = fn(msg, surbID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteSpool) Usage(u []byte) (count, size int, err error) {
+	return sqliteUsage(s.sqlite.db, s.sqlite.d.spoolUserID(u), s.sqlite.d.spoolOverhead())
+}
+
+func (s *sqliteSpool) Remove(u []byte) error {
+	_, err := s.sqlite.db.Exec("DELETE FROM spool WHERE user_name = ?;", s.sqlite.d.spoolUserID(u))
+	return err
+}
+
+func (s *sqliteSpool) Vacuum(udb userdb.UserDB) error {
+	q := s.getQuota()
+	now := time.Now()
+
+	// Collect the users with spools first, since the UserDB may well be
+	// backed by this database's one connection.
+	rows, err := s.sqlite.db.Query("SELECT DISTINCT user_name FROM spool;")
+	if err != nil {
+		return err
+	}
+	var users [][]byte
+	for rows.Next() {
+		var u []byte
+		if err = rows.Scan(&u); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, u)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	// The usernames of an encrypted spool can not be recovered, so build
+	// the set of the valid users' IDs instead.
+	exists := udb.Exists
+	if d := s.sqlite.d; d.spoolKey != nil {
+		uids := make(map[string]bool)
+		if err = udb.ForEach(func(u []byte, _ *userdb.UserInfo) error {
+			uids[string(d.spoolUserID(u))] = true
+			return nil
+		}); err != nil {
+			return err
+		}
+		exists = func(uid []byte) bool {
+			return uids[string(uid)]
+		}
+	}
+
+	var toDelete [][]byte
+	for _, u := range users {
+		if !exists(u) {
+			toDelete = append(toDelete, u)
+		}
+	}
+
+	var nExpired int
+	err = s.sqlite.doTx(func(tx *sql.Tx) error {
+		for _, u := range toDelete {
+			if _, err := tx.Exec("DELETE FROM spool WHERE user_name = ?;", u); err != nil {
+				return err
+			}
+		}
+
+		// Purge the expired messages from every remaining spool.
+		if q != nil {
+			var err error
+			if nExpired, err = sqliteExpire(tx, nil, q, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil && q != nil {
+		for i := 0; i < nExpired; i++ {
+			q.NotifyEvicted([]spool.EvictReason{spool.EvictMaxAge})
+		}
+	}
+	return err
+}
+
+func (s *sqliteSpool) Close() {
+	// Nothing to do.
+}
+
+func newSQLiteSpool(s *sqliteImpl) *sqliteSpool {
+	return &sqliteSpool{
+		sqlite: s,
+	}
+}
+
+func sqliteUserExists(q sqliteQuerier, u []byte) (bool, error) {
+	var dummy int
+	switch err := q.QueryRow("SELECT 1 FROM users WHERE user_name = ?;", u).Scan(&dummy); err {
+	case nil:
+		return true, nil
+	case sql.ErrNoRows:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func sqliteLinkKeyExists(q sqliteQuerier, u []byte, name string) (bool, error) {
+	var dummy int
+	switch err := q.QueryRow("SELECT 1 FROM user_link_keys WHERE user_name = ? AND key_name = ?;", u, name).Scan(&dummy); err {
+	case nil:
+		return true, nil
+	case sql.ErrNoRows:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// sqliteScanUserInfo scans a (created_at, last_authenticated, disabled,
+// send_rate_per_minute, send_burst) row,
+// preceded by the destinations in prefix, if any.
+func sqliteScanUserInfo(row interface{ Scan(...interface{}) error }, prefix ...interface{}) (*userdb.UserInfo, error) {
+	var createdAt int64
+	var lastAuth, rate, burst sql.NullInt64
+	info := new(userdb.UserInfo)
+	if err := row.Scan(append(prefix, &createdAt, &lastAuth, &info.Disabled, &rate, &burst)...); err != nil {
+		return nil, err
+	}
+	info.CreatedAt = time.Unix(0, createdAt)
+	if lastAuth.Valid {
+		info.LastAuthenticated = time.Unix(0, lastAuth.Int64)
+	}
+	if rate.Valid && burst.Valid {
+		info.RateLimit = &userdb.RateLimit{
+			SendRatePerMinute: uint64(rate.Int64),
+			SendBurst:         uint64(burst.Int64),
+		}
+	}
+	return info, nil
+}
+
+func sqliteTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UnixNano()
+}
+
+func sqliteBytesToPublicKey(b []byte) (*ecdh.PublicKey, error) {
+	pubKey := new(ecdh.PublicKey)
+	if err := pubKey.FromBytes(b); err != nil {
+		return nil, err
+	}
+	return pubKey, nil
+}
+
+func sqliteUserOk(u []byte) bool {
+	return len(u) > 0 && len(u) <= userdb.MaxUsernameSize
+}
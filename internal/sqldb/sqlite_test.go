@@ -0,0 +1,149 @@
+// sqlite_test.go - SQLite backed database tests.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sqldb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/server/spool"
+	"github.com/katzenpost/server/spool/spoolcrypt"
+	"github.com/katzenpost/server/spool/spooltest"
+	"github.com/katzenpost/server/userdb"
+	"github.com/katzenpost/server/userdb/userdbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// sqliteTestEnv creates SQLite databases under a temporary directory, and
+// closes them when the test completes.
+type sqliteTestEnv struct {
+	dir      string
+	impls    []dbImpl
+	spoolKey *spoolcrypt.Key
+}
+
+func newSQLiteTestEnv(t *testing.T) *sqliteTestEnv {
+	dir, err := ioutil.TempDir("", "sqldb_sqlite_tests")
+	require.NoError(t, err, "TempDir()")
+	return &sqliteTestEnv{dir: dir}
+}
+
+func (e *sqliteTestEnv) open(t *testing.T, name string) dbImpl {
+	db := &SQLDB{
+		log:      logging.MustGetLogger("sqldb"),
+		spoolKey: e.spoolKey,
+	}
+	impl, err := newSQLiteImpl(db, filepath.Join(e.dir, name), true)
+	require.NoError(t, err, "newSQLiteImpl()")
+	e.impls = append(e.impls, impl)
+	return impl
+}
+
+func (e *sqliteTestEnv) cleanup() {
+	for _, impl := range e.impls {
+		impl.Close()
+	}
+	os.RemoveAll(e.dir)
+}
+
+func TestSQLiteUserDBConformance(t *testing.T) {
+	e := newSQLiteTestEnv(t)
+	defer e.cleanup()
+
+	n := 0
+	userdbtest.Run(t, func(t *testing.T) userdb.UserDB {
+		n++
+		d, err := e.open(t, fmt.Sprintf("userdb-%d.sqlite3", n)).UserDB()
+		require.NoError(t, err, "UserDB()")
+		return d
+	})
+}
+
+func TestSQLiteSpoolConformance(t *testing.T) {
+	e := newSQLiteTestEnv(t)
+	defer e.cleanup()
+
+	n := 0
+	spooltest.Run(t, func(t *testing.T) spool.Spool {
+		n++
+		return e.open(t, fmt.Sprintf("spool-%d.sqlite3", n)).Spool()
+	})
+}
+
+func TestSQLiteEncryptedSpool(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	e := newSQLiteTestEnv(t)
+	defer e.cleanup()
+
+	var err error
+	e.spoolKey, err = spoolcrypt.Load(filepath.Join(e.dir, "spool.key"), "correct horse battery staple")
+	require.NoError(err, "spoolcrypt.Load()")
+
+	n := 0
+	spooltest.Run(t, func(t *testing.T) spool.Spool {
+		n++
+		return e.open(t, fmt.Sprintf("spool-%d.sqlite3", n)).Spool()
+	})
+
+	// The stored usernames are the user IDs, the stored message bodies are
+	// the ciphertext, and the sample check requires a matching key.
+	s := e.open(t, "sample.sqlite3").(*sqliteImpl)
+	msg := make([]byte, constants.UserForwardPayloadLength)
+	require.NoError(s.Spool().StoreMessage([]byte("alice"), msg), "StoreMessage()")
+	uid, stored, _, err := s.spoolSample()
+	require.NoError(err, "spoolSample()")
+	assert.Equal(e.spoolKey.UserID([]byte("alice")), uid, "spoolSample(): user ID")
+	assert.Len(stored, len(msg)+spoolcrypt.Overhead, "spoolSample(): message")
+	var nrPlaintext int
+	require.NoError(s.db.QueryRow("SELECT count(*) FROM spool WHERE user_name = ?;", []byte("alice")).Scan(&nrPlaintext), "SELECT")
+	assert.Zero(nrPlaintext, "Plaintext usernames stored")
+	assert.NoError(spoolcrypt.CheckSample(e.spoolKey, uid, stored, nil), "CheckSample()")
+	assert.Equal(spoolcrypt.ErrEncrypted, spoolcrypt.CheckSample(nil, uid, stored, nil), "CheckSample(): no key")
+}
+
+func TestSQLiteMigrate(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	e := newSQLiteTestEnv(t)
+	defer e.cleanup()
+
+	// Reopening an existing database is a no-op.
+	e.open(t, "migrate.sqlite3")
+	s := e.open(t, "migrate.sqlite3").(*sqliteImpl)
+	var schemaVersion int
+	require.NoError(s.db.QueryRow("PRAGMA user_version;").Scan(&schemaVersion), "user_version")
+	assert.Equal(len(sqliteMigrations), schemaVersion, "Schema version")
+
+	// Databases from the future are rejected.
+	_, err := s.db.Exec(fmt.Sprintf("PRAGMA user_version = %d;", len(sqliteMigrations)+1))
+	require.NoError(err, "Set user_version")
+	_, err = newSQLiteImpl(s.d, filepath.Join(e.dir, "migrate.sqlite3"), true)
+	assert.Error(err, "newSQLiteImpl(): newer schema")
+
+	// Databases needing migration are rejected iff migration is disabled.
+	_, err = newSQLiteImpl(s.d, filepath.Join(e.dir, "unmigrated.sqlite3"), false)
+	assert.Error(err, "newSQLiteImpl(): migration disabled")
+}
@@ -0,0 +1,177 @@
+// management.go - Katzenpost server management commands.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/server/internal/glue"
+)
+
+const (
+	cmdStatus       = "STATUS"
+	cmdListConns    = "LIST_CONNS"
+	cmdQueueStats   = "QUEUE_STATS"
+	cmdPKIStatus    = "PKI_STATUS"
+	cmdPluginStatus = "PLUGIN_STATUS"
+)
+
+func (s *Server) registerManagementCommands() {
+	s.management.RegisterCommand(cmdStatus, s.onStatus)
+	s.management.RegisterCommand(cmdListConns, s.onListConns)
+	s.management.RegisterCommand(cmdQueueStats, s.onQueueStats)
+	s.management.RegisterCommand(cmdPKIStatus, s.onPKIStatus)
+	s.management.RegisterCommand(cmdPluginStatus, s.onPluginStatus)
+}
+
+// writeMultiLineReply writes each of the lines as a continuation line,
+// followed by a terminal StatusOk reply.
+func writeMultiLineReply(c *thwack.Conn, lines []string) error {
+	for _, l := range lines {
+		if err := c.Writer().PrintfLine("%v-%v", thwack.StatusOk, l); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func checkNoArgs(c *thwack.Conn, l string) bool {
+	if sp := strings.Split(l, " "); len(sp) != 1 {
+		c.Log().Debugf("%v invalid syntax: '%v'", sp[0], l)
+		return false
+	}
+	return true
+}
+
+func (s *Server) onStatus(c *thwack.Conn, l string) error {
+	if !checkNoArgs(c, l) {
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	role := "mix"
+	if s.cfg.Server.IsProvider {
+		role = "provider"
+	}
+	epoch, elapsed, till := epochtime.Now()
+
+	return writeMultiLineReply(c, []string{
+		fmt.Sprintf("Identifier: %v", s.cfg.Server.Identifier),
+		fmt.Sprintf("Role: %v", role),
+		fmt.Sprintf("Epoch: %v (Elapsed: %v, Till: %v)", epoch, elapsed.Round(time.Second), till.Round(time.Second)),
+		fmt.Sprintf("Uptime: %v", time.Since(s.startTime).Round(time.Second)),
+	})
+}
+
+func (s *Server) onListConns(c *thwack.Conn, l string) error {
+	if !checkNoArgs(c, l) {
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	connToLine := func(direction string, info glue.ConnInfo) string {
+		kind := "mix"
+		if info.IsClient {
+			kind = "client"
+		}
+		return fmt.Sprintf("%v %v %v %v %v", direction, kind, info.Peer, info.Addr, info.Since.UTC().Format(time.RFC3339))
+	}
+
+	var lines []string
+	for i, listener := range s.listeners {
+		for _, info := range listener.Connections() {
+			lines = append(lines, connToLine(fmt.Sprintf("incoming:%d", i), info))
+		}
+	}
+	for _, info := range s.connector.Connections() {
+		lines = append(lines, connToLine("outgoing", info))
+	}
+
+	return writeMultiLineReply(c, lines)
+}
+
+func (s *Server) onQueueStats(c *thwack.Conn, l string) error {
+	if !checkNoArgs(c, l) {
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	lines := []string{
+		fmt.Sprintf("crypto_workers: %v", s.inboundPackets.Len()),
+		fmt.Sprintf("scheduler: %v", s.scheduler.QueueLen()),
+	}
+	if s.provider != nil {
+		stats := s.provider.QueueStats()
+		names := make([]string, 0, len(stats))
+		for name := range stats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			lines = append(lines, fmt.Sprintf("%v: %v", name, stats[name]))
+		}
+	}
+
+	return writeMultiLineReply(c, lines)
+}
+
+func (s *Server) onPKIStatus(c *thwack.Conn, l string) error {
+	if !checkNoArgs(c, l) {
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	epochs := s.pki.DocumentEpochs()
+	epochStrs := make([]string, 0, len(epochs))
+	for _, e := range epochs {
+		epochStrs = append(epochStrs, fmt.Sprintf("%d", e))
+	}
+
+	lines := []string{fmt.Sprintf("CachedEpochs: %v", strings.Join(epochStrs, " "))}
+	pubEpoch, pubAt, pubErr := s.pki.LastPublish()
+	if pubAt.IsZero() {
+		lines = append(lines, "LastPublish: never")
+	} else {
+		result := "ok"
+		if pubErr != nil {
+			result = pubErr.Error()
+		}
+		lines = append(lines,
+			fmt.Sprintf("LastPublishEpoch: %v", pubEpoch),
+			fmt.Sprintf("LastPublishAt: %v", pubAt.UTC().Format(time.RFC3339)),
+			fmt.Sprintf("LastPublishResult: %v", result),
+		)
+	}
+
+	return writeMultiLineReply(c, lines)
+}
+
+func (s *Server) onPluginStatus(c *thwack.Conn, l string) error {
+	if !checkNoArgs(c, l) {
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	var lines []string
+	if s.provider != nil {
+		for _, info := range s.provider.PluginStatus() {
+			lines = append(lines, info.String())
+		}
+	}
+
+	return writeMultiLineReply(c, lines)
+}
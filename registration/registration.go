@@ -17,6 +17,13 @@
 // Package provides registration protocol constants
 package registration
 
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
 const (
 	URLBase = "/registration"
 	Version = "0"
@@ -27,8 +34,41 @@ const (
 	UserField        = "user"
 	LinkKeyField     = "link_key"
 	IdentityKeyField = "identity_key"
+	LinkKeyNameField = "link_key_name"
+	AuthKeyField     = "auth_key"
+	TimestampField   = "timestamp"
+	MACField         = "mac"
 
 	// registration types
 	RegisterLinkCommand            = "register_link_key"
 	RegisterLinkAndIdentityCommand = "register_link_and_identity_key"
+
+	// link key management types, authenticated by an existing link key
+	AddLinkKeyCommand    = "add_link_key"
+	RemoveLinkKeyCommand = "remove_link_key"
+
+	// MaxClockSkew is the maximum permitted difference between the
+	// timestamp of an authenticated request and the Provider's clock.
+	MaxClockSkew = 5 * time.Minute
+
+	macContext = "katzenpost-registration-link-key-v0"
 )
+
+// LinkKeyRequestMAC returns the MAC authenticating a link key management
+// request, keyed with the ECDH shared secret between the requesting
+// device's existing link key and the Provider's link key.  The MAC is sent
+// hex encoded in the MACField, with the timestamp as decimal seconds since
+// the Unix epoch.  The Provider rejects a request with a MAC that it has
+// already accepted, so an identical request can not be repeated within the
+// same second.
+func LinkKeyRequestMAC(sharedSecret []byte, command, user, linkKeyName, linkKey, timestamp string) []byte {
+	m := hmac.New(sha256.New, sharedSecret)
+	m.Write([]byte(macContext))
+	for _, v := range []string{command, user, linkKeyName, linkKey, timestamp} {
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(v)))
+		m.Write(l[:])
+		m.Write([]byte(v))
+	}
+	return m.Sum(nil)
+}
@@ -23,11 +23,14 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"git.schwanenlied.me/yawning/aez.git"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/crypto/eddsa"
 	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/epochtime"
 	"github.com/katzenpost/core/log"
 	"github.com/katzenpost/core/thwack"
 	"github.com/katzenpost/core/utils"
@@ -41,6 +44,7 @@ import (
 	"github.com/katzenpost/server/internal/pki"
 	"github.com/katzenpost/server/internal/provider"
 	"github.com/katzenpost/server/internal/scheduler"
+	"github.com/katzenpost/server/internal/sqldb"
 	"gopkg.in/eapache/channels.v1"
 	"gopkg.in/op/go-logging.v1"
 )
@@ -71,7 +75,10 @@ type Server struct {
 	provider      glue.Provider
 	decoy         glue.Decoy
 	management    *thwack.Server
+	metrics       *instrument.Server
 
+	startTime  time.Time
+	isReady    uint32
 	fatalErrCh chan error
 	haltedCh   chan interface{}
 	haltOnce   sync.Once
@@ -137,6 +144,12 @@ func (s *Server) halt() {
 		s.periodic = nil
 	}
 
+	// Stop the metrics and health check listener.
+	if s.metrics != nil {
+		s.metrics.Halt()
+		s.metrics = nil
+	}
+
 	// Stop the management interface.
 	if s.management != nil {
 		s.management.Halt()
@@ -211,11 +224,37 @@ func (s *Server) halt() {
 	close(s.haltedCh)
 }
 
+// MigrateDatabase creates the schema and applies the schema migrations to
+// the configured SQL database as required, without starting the server.
+func MigrateDatabase(cfg *config.Config) error {
+	if cfg.Provider == nil || cfg.Provider.SQLDB == nil {
+		return errors.New("server: no SQL database configured")
+	}
+
+	s := &Server{
+		cfg: cfg,
+	}
+	if err := utils.MkDataDir(s.cfg.Server.DataDir); err != nil {
+		return err
+	}
+	if err := s.initLogging(); err != nil {
+		return err
+	}
+
+	if err := sqldb.Migrate(&serverGlue{s}); err != nil {
+		s.log.Errorf("Failed to migrate the SQL database: %v", err)
+		return err
+	}
+	s.log.Noticef("SQL database schema is up to date.")
+	return nil
+}
+
 // New returns a new Server instance parameterized with the specified
 // configuration.
 func New(cfg *config.Config) (*Server, error) {
 	s := &Server{
 		cfg:        cfg,
+		startTime:  time.Now(),
 		fatalErrCh: make(chan error),
 		haltedCh:   make(chan interface{}),
 	}
@@ -228,8 +267,6 @@ func New(cfg *config.Config) (*Server, error) {
 	if err := s.initLogging(); err != nil {
 		return nil, err
 	}
-	instrument.Init()
-
 	s.log.Notice("Katzenpost is still pre-alpha.  DO NOT DEPEND ON IT FOR STRONG SECURITY OR ANONYMITY.")
 	if s.cfg.Debug.IsUnsafe() {
 		s.log.Warning("Unsafe Debug configuration options are set.")
@@ -297,6 +334,21 @@ func New(cfg *config.Config) (*Server, error) {
 		s.Shutdown()
 	}()
 
+	// Bring the metrics and health check listener online if enabled, so
+	// that the server can be observed while the rest of it starts up.
+	if s.cfg.Metrics.Enable {
+		if s.metrics, err = instrument.New(s.cfg.Metrics, s.logBackend); err != nil {
+			s.log.Errorf("Failed to initialize metrics listener: %v", err)
+			return nil, err
+		}
+		s.metrics.RegisterCheck("server", func() error {
+			if atomic.LoadUint32(&s.isReady) == 0 {
+				return errors.New("starting up")
+			}
+			return nil
+		})
+	}
+
 	// Initialize the management interface if enabled.
 	//
 	// Note: This is done first so that other subsystems may register commands.
@@ -326,6 +378,7 @@ func New(cfg *config.Config) (*Server, error) {
 			s.fatalErrCh <- fmt.Errorf("user requested shutdown via mgmt interface")
 			return nil
 		})
+		s.registerManagementCommands()
 	}
 
 	// Initialize the PKI interface.
@@ -366,8 +419,9 @@ func New(cfg *config.Config) (*Server, error) {
 
 	// Bring the listener(s) online.
 	s.listeners = make([]glue.Listener, 0, len(s.cfg.Server.Addresses))
+	connLimits := incoming.NewConnLimits(s.cfg.Listener)
 	for i, addr := range s.cfg.Server.Addresses {
-		l, err := incoming.New(goo, s.inboundPackets.In(), i, addr)
+		l, err := incoming.New(goo, s.inboundPackets.In(), i, addr, connLimits)
 		if err != nil {
 			s.log.Errorf("Failed to spawn listener on address: %v (%v).", addr, err)
 			return nil, err
@@ -387,10 +441,49 @@ func New(cfg *config.Config) (*Server, error) {
 		s.management.Start()
 	}
 
+	s.registerReadinessChecks()
+	atomic.StoreUint32(&s.isReady, 1)
+
 	isOk = true
 	return s, nil
 }
 
+func (s *Server) registerReadinessChecks() {
+	if s.metrics == nil {
+		return
+	}
+
+	// Note: All of the components are torn down after the metrics listener
+	// during shutdown, so the checks can safely reference them directly.
+	s.metrics.RegisterCheck("pki", func() error {
+		now, _, _ := epochtime.Now()
+		for _, epoch := range s.pki.DocumentEpochs() {
+			if epoch == now {
+				return nil
+			}
+		}
+		return fmt.Errorf("no document for current epoch %v", now)
+	})
+	s.metrics.RegisterCheck("mixkeys", func() error {
+		now, _, _ := epochtime.Now()
+		if _, ok := s.mixKeys.Get(now); !ok {
+			return fmt.Errorf("no mix key for current epoch %v", now)
+		}
+		return nil
+	})
+	s.metrics.RegisterCheck("listeners", func() error {
+		for i, l := range s.listeners {
+			if !l.IsListening() {
+				return fmt.Errorf("listener %v is not accepting connections", i)
+			}
+		}
+		return nil
+	})
+	if s.provider != nil {
+		s.metrics.RegisterCheck("provider", s.provider.Ping)
+	}
+}
+
 type serverGlue struct {
 	s *Server
 }
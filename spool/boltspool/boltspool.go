@@ -21,26 +21,128 @@ package boltspool
 import (
 	"encoding/binary"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 	"github.com/katzenpost/core/constants"
 	"github.com/katzenpost/core/sphinx"
 	sConstants "github.com/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/server/spool"
+	"github.com/katzenpost/server/spool/spoolcrypt"
 	"github.com/katzenpost/server/userdb"
 )
 
 const (
-	usersBucket = "users"
-	msgKey      = "message"
-	surbIDKey   = "surbID"
+	usersBucket  = "users"
+	msgKey       = "message"
+	surbIDKey    = "surbID"
+	timestampKey = "timestamp"
 )
 
 type boltSpool struct {
-	db *bolt.DB
+	sync.RWMutex
+
+	// dbLock is held for writing while Compact replaces db, or the batch
+	// limits are changed.
+	dbLock sync.RWMutex
+
+	db    *bolt.DB
+	key   *spoolcrypt.Key
+	quota *spool.Quota
+
+	maxBatchSize  int
+	maxBatchDelay time.Duration
+
+	// isClosed is set iff Compact failed to reopen db, which is left closed
+	// so that every other operation fails, until a later Compact reopens it.
+	isClosed bool
+}
+
+// bucketName returns the name of the user's spool bucket, which is a keyed
+// hash of the username iff the spool is encrypted.
+func (s *boltSpool) bucketName(u []byte) []byte {
+	if s.key == nil {
+		return u
+	}
+	return s.key.UserID(u)
+}
+
+// msgLen returns the size of the plaintext of the stored message body b.
+func (s *boltSpool) msgLen(b []byte) int {
+	if s.key == nil {
+		return len(b)
+	}
+	return len(b) - spoolcrypt.Overhead
+}
+
+// getEntry returns the (decrypted) message body and SURB ID stored in
+// mBkt, under the user's spool bucket named bName.
+func (s *boltSpool) getEntry(bName []byte, mBkt *bolt.Bucket) (msg, surbID []byte, err error) {
+	if m := mBkt.Get([]byte(msgKey)); m != nil {
+		if s.key != nil {
+			if msg, err = s.key.OpenMessage(bName, m); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			msg = append(make([]byte, 0, len(m)), m...)
+		}
+	}
+	if id := mBkt.Get([]byte(surbIDKey)); id != nil {
+		if s.key != nil {
+			if surbID, err = s.key.OpenSURBID(bName, id); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			surbID = append(make([]byte, 0, len(id)), id...)
+		}
+	}
+	return
+}
+
+func (s *boltSpool) SetQuota(q *spool.Quota) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.quota = q
+}
+
+func (s *boltSpool) getQuota() *spool.Quota {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.quota
+}
+
+// SetBatchLimits sets the maximum number of concurrent stores that are
+// committed in a single transaction, and the maximum time that a store will
+// wait for others to join its transaction.  A maxSize <= 1 disables
+// batching.
+func (s *boltSpool) SetBatchLimits(maxSize int, maxDelay time.Duration) {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+
+	s.maxBatchSize = maxSize
+	s.maxBatchDelay = maxDelay
+	s.applyBatchLimits()
+}
+
+func (s *boltSpool) applyBatchLimits() {
+	if s.maxBatchSize > 1 {
+		s.db.MaxBatchSize = s.maxBatchSize
+		s.db.MaxBatchDelay = s.maxBatchDelay
+	}
 }
 
 func (s *boltSpool) Close() {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+
+	if s.isClosed {
+		return
+	}
 	s.db.Sync()
 	s.db.Close()
 }
@@ -64,20 +166,48 @@ func (s *boltSpool) StoreSURBReply(u []byte, id *[sConstants.SURBIDLength]byte,
 }
 
 func (s *boltSpool) doStore(u []byte, id *[sConstants.SURBIDLength]byte, msg []byte) error {
+	s.dbLock.RLock()
+	defer s.dbLock.RUnlock()
+
 	if len(u) == 0 || len(u) > userdb.MaxUsernameSize {
 		return fmt.Errorf("spool: invalid username: `%v`", u)
 	}
 
-	return s.db.Update(func(tx *bolt.Tx) error {
+	q := s.getQuota()
+	now := time.Now()
+
+	// When batching, concurrent stores share a single transaction (and
+	// fsync), at the cost of a store being retried on its own if the
+	// transaction fails, so the function must be idempotent.
+	update := s.db.Update
+	if s.maxBatchSize > 1 {
+		// Stores that the quota will reject are rejected up front, as
+		// they would otherwise fail the whole batch.
+		if q != nil && q.Policy == spool.PolicyReject && s.exceedsQuota(u, q, len(msg), now) {
+			return spool.ErrQuotaExceeded
+		}
+		update = s.db.Batch
+	}
+
+	var evicted []spool.EvictReason
+	err := update(func(tx *bolt.Tx) error {
 		// Grab the `users` bucket.
 		uBkt := tx.Bucket([]byte(usersBucket))
 
 		// Grab or create the user's spool bucket.
-		sBkt, err := uBkt.CreateBucketIfNotExists(u)
+		bName := s.bucketName(u)
+		sBkt, err := uBkt.CreateBucketIfNotExists(bName)
 		if err != nil {
 			return err
 		}
 
+		// Enforce the quota (if any), before adding the new message.
+		if q != nil {
+			if evicted, err = s.enforceQuota(sBkt, q, len(msg), now); err != nil {
+				return err
+			}
+		}
+
 		// Allocate a unique identifier for this message.
 		seq, err := sBkt.NextSequence()
 		if err != nil {
@@ -92,26 +222,174 @@ func (s *boltSpool) doStore(u []byte, id *[sConstants.SURBIDLength]byte, msg []b
 			return err
 		}
 
-		// Store the message and (optional) SURB ID.
-		mBkt.Put([]byte(msgKey), msg)
+		// Store the message, timestamp and (optional) SURB ID.
+		var ts [8]byte
+		binary.BigEndian.PutUint64(ts[:], uint64(now.Unix()))
+		if s.key != nil {
+			mBkt.Put([]byte(msgKey), s.key.SealMessage(bName, msg))
+		} else {
+			mBkt.Put([]byte(msgKey), msg)
+		}
+		mBkt.Put([]byte(timestampKey), ts[:])
 		if id != nil {
-			mBkt.Put([]byte(surbIDKey), id[:])
+			if s.key != nil {
+				mBkt.Put([]byte(surbIDKey), s.key.SealSURBID(bName, id[:]))
+			} else {
+				mBkt.Put([]byte(surbIDKey), id[:])
+			}
 		}
 		return nil
 	})
+	if err == nil && q != nil {
+		q.NotifyEvicted(evicted)
+	}
+	return err
 }
 
-func (s *boltSpool) Get(u []byte, advance bool) (msg, surbID []byte, remaining int, err error) {
+func (s *boltSpool) enforceQuota(sBkt *bolt.Bucket, q *spool.Quota, msgLen int, now time.Time) ([]spool.EvictReason, error) {
+	// Purge the expired messages first, since they do not count against
+	// the rest of the quota.
+	evicted := expireMessages(sBkt, q, now)
+
+	if q.MaxMessages <= 0 && q.MaxBytes <= 0 {
+		return evicted, nil
+	}
+
+	// Tally up the current size of the user's spool.
+	//
+	// Note: Iterating over the spool is somewhat expensive, but it is
+	// bounded by MaxMessages, and avoids having to maintain a running
+	// total that could get out of sync with the actual spool contents.
+	type entry struct {
+		key  []byte
+		size int
+	}
+	var entries []entry
+	size := 0
+	cur := sBkt.Cursor()
+	for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+		mBkt := sBkt.Bucket(k)
+		if mBkt == nil {
+			continue
+		}
+		l := s.msgLen(mBkt.Get([]byte(msgKey)))
+		entries = append(entries, entry{append([]byte{}, k...), l})
+		size += l
+	}
+
+	for {
+		reason, exceeds := q.Exceeds(len(entries), size, msgLen)
+		if !exceeds {
+			return evicted, nil
+		}
+		if q.Policy != spool.PolicyEvict || len(entries) == 0 {
+			return nil, spool.ErrQuotaExceeded
+		}
+
+		// Evict the oldest message.
+		if err := sBkt.DeleteBucket(entries[0].key); err != nil {
+			return nil, err
+		}
+		size -= entries[0].size
+		entries = entries[1:]
+		evicted = append(evicted, reason)
+	}
+}
+
+// exceedsQuota returns true iff storing a msgLen byte message in the user's
+// spool would currently exceed the quota, once the expired messages are
+// purged.
+func (s *boltSpool) exceedsQuota(u []byte, q *spool.Quota, msgLen int, now time.Time) bool {
+	if q.MaxMessages <= 0 && q.MaxBytes <= 0 {
+		return false
+	}
+
+	count, size := 0, 0
+	s.db.View(func(tx *bolt.Tx) error {
+		sBkt := tx.Bucket([]byte(usersBucket)).Bucket(s.bucketName(u))
+		if sBkt == nil {
+			return nil
+		}
+
+		cur := sBkt.Cursor()
+		for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+			mBkt := sBkt.Bucket(k)
+			if mBkt == nil || isExpired(mBkt, q, now) {
+				continue
+			}
+			count++
+			size += s.msgLen(mBkt.Get([]byte(msgKey)))
+		}
+		return nil
+	})
+	_, exceeds := q.Exceeds(count, size, msgLen)
+	return exceeds
+}
+
+func expireMessages(sBkt *bolt.Bucket, q *spool.Quota, now time.Time) []spool.EvictReason {
+	if q.MaxAge <= 0 {
+		return nil
+	}
+
+	// Messages are stored in order, so stop at the first unexpired one.
+	// Messages stored prior to timestamps being recorded are skipped.
+	var toDelete [][]byte
+	cur := sBkt.Cursor()
+	for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+		mBkt := sBkt.Bucket(k)
+		if mBkt == nil {
+			continue
+		}
+		if len(mBkt.Get([]byte(timestampKey))) != 8 {
+			continue
+		}
+		if !isExpired(mBkt, q, now) {
+			break
+		}
+		toDelete = append(toDelete, append([]byte{}, k...))
+	}
+
+	evicted := make([]spool.EvictReason, 0, len(toDelete))
+	for _, k := range toDelete {
+		if err := sBkt.DeleteBucket(k); err != nil {
+			break
+		}
+		evicted = append(evicted, spool.EvictMaxAge)
+	}
+	return evicted
+}
+
+// isExpired returns true iff the message stored in mBkt has exceeded the
+// quota's maximum message age.  Messages stored prior to timestamps being
+// recorded never expire.
+func isExpired(mBkt *bolt.Bucket, q *spool.Quota, now time.Time) bool {
+	if mBkt == nil {
+		return false
+	}
+	ts := mBkt.Get([]byte(timestampKey))
+	if len(ts) != 8 {
+		return false
+	}
+	return q.IsExpired(time.Unix(int64(binary.BigEndian.Uint64(ts)), 0), now)
+}
+
+func (s *boltSpool) Get(u []byte, ackID uint64) (msg, surbID []byte, id uint64, remaining int, err error) {
 	// This uses manual transaction management because there is a trivial
-	// amount of extra work for the `advance == true` case that requires
-	// a writeable transaction.
+	// amount of extra work for the `ackID != 0` case that requires a
+	// writeable transaction.
 	//
 	// Doing it this way avoids a considrable amount of code duplication,
 	// and the common case is likely that the user's spool is empty, which
 	// doesn't require updating the database at all (concurrency).
 
+	s.dbLock.RLock()
+	defer s.dbLock.RUnlock()
+
+	q := s.getQuota()
+	now := time.Now()
+
 	var tx *bolt.Tx
-	tx, err = s.db.Begin(advance)
+	tx, err = s.db.Begin(ackID != 0)
 	if err != nil {
 		return
 	}
@@ -121,104 +399,364 @@ func (s *boltSpool) Get(u []byte, advance bool) (msg, surbID []byte, remaining i
 	uBkt := tx.Bucket([]byte(usersBucket))
 
 	// Grab the user's spool bucket.
-	sBkt := uBkt.Bucket(u)
+	bName := s.bucketName(u)
+	sBkt := uBkt.Bucket(bName)
 	if sBkt == nil {
 		// If the user's spool bucket is missing, the spool is empty.
 		return
 	}
 
-	// Grab a cursor into the user's spool.
+	if ackID != 0 {
+		// Delete the acknowledged message, iff it is still in the spool.
+		var ackKey [8]byte
+		binary.BigEndian.PutUint64(ackKey[:], ackID)
+		if sBkt.Bucket(ackKey[:]) != nil {
+			if err = sBkt.DeleteBucket(ackKey[:]); err != nil {
+				return
+			}
+		}
+	}
+
+	// Grab a cursor into the user's spool, and skip the expired messages,
+	// which are left for the next store or Vacuum to delete.
 	cur := sBkt.Cursor()
 	mKey, _ := cur.First()
-	if mKey == nil {
-		// If the user's spool bucket is empty, the spool is empty.
+	if mKey == nil && ackID != 0 {
+		// Deleting the message drained the queue.
+		sBkt.SetSequence(0) // Don't keep a lifetime message count.
+		err = tx.Commit()
 		return
 	}
-
-	// Well, there has to be at least one message in the spool, and this
-	// is merely a hint, so just return 0 if the queue is empty or there
-	// is only one message, and 1 if there are any number of messages.
-	remaining = 1
-	next, _ := cur.Next()
-
-	if advance {
-		// Delete the 0th message.
-		if err = sBkt.DeleteBucket(mKey); err != nil {
-			return
+	for ; mKey != nil; mKey, _ = cur.Next() {
+		if !isExpired(sBkt.Bucket(mKey), q, now) {
+			break
 		}
-
-		if next == nil {
-			// Deleting the message drained the queue.
-			sBkt.SetSequence(0) // Don't keep a lifetime message count.
-			remaining = 0
+	}
+	if mKey == nil {
+		// If the user's spool has no unexpired messages, the spool is
+		// empty.
+		if ackID != 0 {
 			err = tx.Commit()
-			return
 		}
-		mKey = next
-		next, _ = cur.Next()
+		return
 	}
 
-	if next == nil {
-		// "excluding the current message".
-		remaining = 0
+	// Well, there has to be at least one message in the spool, and this
+	// is merely a hint, so just return 0 if there is only one message,
+	// and 1 if there are any number of messages, "excluding the current
+	// message".
+	if next, _ := cur.Next(); next != nil {
+		remaining = 1
 	}
 
 	// Retrieve the stored message and (optional) SURB ID.
-	mBkt := sBkt.Bucket(mKey)
-	if m := mBkt.Get([]byte(msgKey)); m != nil {
-		msg = make([]byte, 0, len(m))
-		msg = append(msg, m...)
-	}
-	if id := mBkt.Get([]byte(surbIDKey)); id != nil {
-		surbID = make([]byte, 0, len(id))
-		surbID = append(surbID, id...)
+	if msg, surbID, err = s.getEntry(bName, sBkt.Bucket(mKey)); err != nil {
+		return
 	}
+	id = binary.BigEndian.Uint64(mKey)
 
 	// If we modified the database, commit the transaction.
-	if advance {
+	if ackID != 0 {
 		err = tx.Commit()
 	}
 	return
 }
 
+func (s *boltSpool) ForEach(u []byte, fn func(msg, surbID []byte) error) error {
+	type entry struct {
+		msg, surbID []byte
+	}
+
+	// Snapshot the user's spool first, so that fn is not called with the
+	// transaction open.
+	var entries []entry
+	s.dbLock.RLock()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// Grab the `users` bucket.
+		uBkt := tx.Bucket([]byte(usersBucket))
+
+		// Grab the user's spool bucket.
+		bName := s.bucketName(u)
+		sBkt := uBkt.Bucket(bName)
+		if sBkt == nil {
+			// If the user's spool bucket is missing, the spool is empty.
+			return nil
+		}
+
+		cur := sBkt.Cursor()
+		for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+			mBkt := sBkt.Bucket(k)
+			if mBkt == nil {
+				continue
+			}
+			var ent entry
+			var err error
+			if ent.msg, ent.surbID, err = s.getEntry(bName, mBkt); err != nil {
+				return err
+			}
+			if ent.msg == nil {
+				ent.msg = []byte{}
+			}
+			entries = append(entries, ent)
+		}
+		return nil
+	})
+	s.dbLock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	for _, ent := range entries {
+		if err = fn(ent.msg, ent.surbID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltSpool) Usage(u []byte) (count, size int, err error) {
+	s.dbLock.RLock()
+	defer s.dbLock.RUnlock()
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		// Grab the `users` bucket.
+		uBkt := tx.Bucket([]byte(usersBucket))
+
+		// Grab the user's spool bucket.
+		sBkt := uBkt.Bucket(s.bucketName(u))
+		if sBkt == nil {
+			// If the user's spool bucket is missing, the spool is empty.
+			return nil
+		}
+
+		cur := sBkt.Cursor()
+		for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+			mBkt := sBkt.Bucket(k)
+			if mBkt == nil {
+				continue
+			}
+			count++
+			size += s.msgLen(mBkt.Get([]byte(msgKey)))
+		}
+		return nil
+	})
+	return
+}
+
 func (s *boltSpool) Remove(u []byte) error {
+	s.dbLock.RLock()
+	defer s.dbLock.RUnlock()
+
 	return s.db.Update(func(tx *bolt.Tx) error {
 		// Grab the `users` bucket.
 		uBkt := tx.Bucket([]byte(usersBucket))
 
 		// Grab the user's spool bucket.
-		sBkt := uBkt.Bucket(u)
+		bName := s.bucketName(u)
+		sBkt := uBkt.Bucket(bName)
 		if sBkt == nil {
 			// If the user's spool bucket is missing, just return.
 			return nil
 		}
 
-		return uBkt.DeleteBucket(u)
+		return uBkt.DeleteBucket(bName)
 	})
 }
 
 func (s *boltSpool) Vacuum(udb userdb.UserDB) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
+	s.dbLock.RLock()
+	defer s.dbLock.RUnlock()
+
+	q := s.getQuota()
+	now := time.Now()
+
+	// The usernames of an encrypted spool can not be recovered, so build
+	// the set of the valid users' bucket names instead.
+	exists := udb.Exists
+	if s.key != nil {
+		bNames := make(map[string]bool)
+		if err := udb.ForEach(func(u []byte, _ *userdb.UserInfo) error {
+			bNames[string(s.key.UserID(u))] = true
+			return nil
+		}); err != nil {
+			return err
+		}
+		exists = func(bName []byte) bool {
+			return bNames[string(bName)]
+		}
+	}
+
+	var evicted []spool.EvictReason
+	err := s.db.Update(func(tx *bolt.Tx) error {
 		// Grab the `users` bucket.
 		uBkt := tx.Bucket([]byte(usersBucket))
 
+		var toDelete [][]byte
 		cur := uBkt.Cursor()
 		for u, _ := cur.First(); u != nil; u, _ = cur.Next() {
 			// Note: If the provided UserDB doesn't do something intelligent
 			// like cache the valid users, this will really suck.
-			if udb.Exists(u) {
+			if exists(u) {
+				// Purge the expired messages from valid users' spools.
+				if q != nil {
+					if sBkt := uBkt.Bucket(u); sBkt != nil {
+						evicted = append(evicted, expireMessages(sBkt, q, now)...)
+					}
+				}
 				continue
 			}
+			toDelete = append(toDelete, append([]byte{}, u...))
+		}
+		for _, u := range toDelete {
 			if err := uBkt.DeleteBucket(u); err != nil {
 				return err
 			}
 		}
 		return nil
 	})
+	if err == nil && q != nil {
+		q.NotifyEvicted(evicted)
+	}
+	return err
+}
+
+// Compact copies the live contents of the spool to a new file and replaces
+// the existing file with it, iff the fraction of the existing file that is
+// unused is at least threshold.  All other spool operations are blocked
+// while this is in progress.
+func (s *boltSpool) Compact(threshold float64) (int64, bool, error) {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+
+	f := s.db.Path()
+	if s.isClosed {
+		if err := s.reopen(f); err != nil {
+			return 0, false, err
+		}
+	}
+	fi, err := os.Stat(f)
+	if err != nil {
+		return 0, false, err
+	}
+	oldSize := fi.Size()
+
+	// The file consists of the pages below the high water mark, some of
+	// which are on the freelist, and the space preallocated past it.
+	var hwmSize int64
+	if err = s.db.View(func(tx *bolt.Tx) error {
+		hwmSize = tx.Size()
+		return nil
+	}); err != nil {
+		return 0, false, err
+	}
+	inUse := hwmSize - int64(s.db.Stats().FreeAlloc)
+	if oldSize <= 0 || 1-float64(inUse)/float64(oldSize) < threshold {
+		return 0, false, nil
+	}
+
+	// Copy everything to a new database.  The write transaction holds the
+	// entire spool, but the spool is expected to be mostly empty space by
+	// the time that this is called.
+	tmp := f + ".compact"
+	os.Remove(tmp)
+	dst, err := bolt.Open(tmp, 0600, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return dst.Update(func(dTx *bolt.Tx) error {
+			return tx.ForEach(func(name []byte, bkt *bolt.Bucket) error {
+				dBkt, err := dTx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(dBkt, bkt)
+			})
+		})
+	})
+	if cErr := dst.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, false, err
+	}
+
+	// Swap in the new database, which requires closing the old one to
+	// release the file lock.
+	s.db.Close()
+	if err = os.Rename(tmp, f); err != nil {
+		os.Remove(tmp)
+	} else if d, dErr := os.Open(filepath.Dir(f)); dErr == nil {
+		d.Sync()
+		d.Close()
+	}
+	if oErr := s.reopen(f); oErr != nil {
+		return 0, false, oErr
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	if fi, err = os.Stat(f); err != nil {
+		return 0, true, err
+	}
+	return oldSize - fi.Size(), true, nil
+}
+
+// reopen reopens the database at f after it was closed by Compact.  On
+// failure the closed database is kept, as operations on it return
+// bolt.ErrDatabaseNotOpen, rather than panicking.
+func (s *boltSpool) reopen(f string) error {
+	db, err := openDB(f, 0600, nil)
+	if err != nil {
+		s.isClosed = true
+		return fmt.Errorf("spool: failed to reopen database after compaction: %v", err)
+	}
+	s.db = db
+	s.isClosed = false
+	s.applyBatchLimits()
+	return nil
+}
+
+func copyBucket(dst, src *bolt.Bucket) error {
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+
+		// A nil value denotes a nested bucket.
+		child, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(child, src.Bucket(k))
+	})
 }
 
 // New creates (or loads) a user message spool with the given file name f.
 func New(f string) (spool.Spool, error) {
+	return newSpool(f, nil)
+}
+
+// NewEncrypted creates (or loads) a user message spool with the given file
+// name f, with the contents encrypted under the storage key k.  Existing
+// plaintext spools must be migrated to a new encrypted spool.
+func NewEncrypted(f string, k *spoolcrypt.Key) (spool.Spool, error) {
+	if k == nil {
+		return nil, fmt.Errorf("spool: no storage key provided")
+	}
+	return newSpool(f, k)
+}
+
+// openDB opens a bolt database, and is overridden by the tests to simulate
+// failures.
+var openDB = bolt.Open
+
+func newSpool(f string, k *spoolcrypt.Key) (spool.Spool, error) {
 	const (
 		metadataBucket = "metadata"
 		versionKey     = "version"
@@ -226,7 +764,7 @@ func New(f string) (spool.Spool, error) {
 
 	var err error
 
-	s := new(boltSpool)
+	s := &boltSpool{key: k}
 	s.db, err = bolt.Open(f, 0600, nil)
 	if err != nil {
 		return nil, err
@@ -238,7 +776,8 @@ func New(f string) (spool.Spool, error) {
 		if err != nil {
 			return err
 		}
-		if _, err = tx.CreateBucketIfNotExists([]byte(usersBucket)); err != nil {
+		uBkt, err := tx.CreateBucketIfNotExists([]byte(usersBucket))
+		if err != nil {
 			return err
 		}
 
@@ -247,7 +786,7 @@ func New(f string) (spool.Spool, error) {
 			if len(b) != 1 || b[0] != 0 {
 				return fmt.Errorf("spool: incompatible version: %d", uint(b[0]))
 			}
-			return nil
+			return checkSample(uBkt, k)
 		}
 
 		// We created a new database, so populate the new `metadata` bucket.
@@ -262,3 +801,30 @@ func New(f string) (spool.Spool, error) {
 
 	return s, nil
 }
+
+// checkSample ensures that the first message found in the spool is
+// consistent with the storage key k (or lack thereof), as opening a
+// plaintext spool as an encrypted one (or vice versa) would lead to Vacuum
+// discarding every spool.
+func checkSample(uBkt *bolt.Bucket, k *spoolcrypt.Key) error {
+	cur := uBkt.Cursor()
+	for bName, _ := cur.First(); bName != nil; bName, _ = cur.Next() {
+		sBkt := uBkt.Bucket(bName)
+		if sBkt == nil {
+			continue
+		}
+		mKey, _ := sBkt.Cursor().First()
+		if mKey == nil {
+			continue
+		}
+		mBkt := sBkt.Bucket(mKey)
+		if mBkt == nil {
+			continue
+		}
+		if err := spoolcrypt.CheckSample(k, bName, mBkt.Get([]byte(msgKey)), mBkt.Get([]byte(surbIDKey))); err != nil {
+			return fmt.Errorf("spool: %v", err)
+		}
+		return nil
+	}
+	return nil
+}
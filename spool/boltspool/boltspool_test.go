@@ -18,16 +18,25 @@ package boltspool
 
 import (
 	"crypto/rand"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/katzenpost/core/constants"
 	"github.com/katzenpost/core/sphinx"
 	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/server/spool"
+	"github.com/katzenpost/server/spool/spoolcrypt"
+	"github.com/katzenpost/server/spool/spooltest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
 )
 
 const (
@@ -94,7 +103,7 @@ func doTestLoad(t *testing.T) {
 	defer s.Close()
 
 	// Query 0th message without discard.
-	msg, id, remaining, err := s.Get([]byte(testUser), false)
+	msg, id, msgID, remaining, err := s.Get([]byte(testUser), 0)
 	assert.NoError(err, "Get(): testMsg")
 	assert.Equal(testMsg, msg, "Loaded Message")
 	assert.Nil(id, "Message should have no SURB ID")
@@ -102,8 +111,13 @@ func doTestLoad(t *testing.T) {
 
 	// Query the 0th message with discard, and then without.  Both cases
 	// should return the SURBReply,
+	var surbMsgID uint64
 	for i := 0; i < 2; i++ {
-		msg, id, remaining, err = s.Get([]byte(testUser), i != 1)
+		var ackID uint64
+		if i != 1 {
+			ackID = msgID
+		}
+		msg, id, surbMsgID, remaining, err = s.Get([]byte(testUser), ackID)
 		assert.NoError(err, "Get(): testSurbMsg")
 		assert.Equal(testSurbMsg, msg, "Loaded SURBReply")
 		assert.Equal(testSurbID[:], id, "Loaded SURB ID")
@@ -112,7 +126,7 @@ func doTestLoad(t *testing.T) {
 
 	// Query the 0th message with discard, should be an empty queue since the
 	// SURBReply will be discarded.
-	msg, id, remaining, err = s.Get([]byte(testUser), true)
+	msg, id, _, remaining, err = s.Get([]byte(testUser), surbMsgID)
 	assert.NoError(err, "Get(): discard -> empty")
 	assert.Nil(msg, "Loaded Empty")
 	assert.Nil(id, "Loaded Empty SURB ID")
@@ -123,6 +137,391 @@ func doTestLoad(t *testing.T) {
 	assert.NoError(err, "Delete(u)")
 }
 
+func TestBoltSpoolQuota(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "boltspool_quota_tests")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	s, err := New(filepath.Join(dir, testSpool))
+	require.NoError(err, "New()")
+	defer s.Close()
+
+	msgs := make([][]byte, 3)
+	for i := range msgs {
+		msgs[i] = make([]byte, constants.UserForwardPayloadLength)
+		msgs[i][0] = byte(i)
+	}
+
+	var evictions []spool.EvictReason
+	q := &spool.Quota{
+		MaxMessages: 2,
+		Policy:      spool.PolicyReject,
+		OnEvict: func(r spool.EvictReason) {
+			evictions = append(evictions, r)
+		},
+	}
+	s.SetQuota(q)
+
+	u := []byte(testUser)
+	require.NoError(s.StoreMessage(u, msgs[0]), "StoreMessage(0)")
+	require.NoError(s.StoreMessage(u, msgs[1]), "StoreMessage(1)")
+	err = s.StoreMessage(u, msgs[2])
+	assert.Equal(spool.ErrQuotaExceeded, err, "StoreMessage(2): reject")
+
+	msg, _, _, _, err := s.Get(u, 0)
+	assert.NoError(err, "Get(): reject")
+	assert.Equal(msgs[0], msg, "Head unchanged after reject")
+
+	q.Policy = spool.PolicyEvict
+	require.NoError(s.StoreMessage(u, msgs[2]), "StoreMessage(2): evict")
+	assert.Equal([]spool.EvictReason{spool.EvictMaxMessages}, evictions, "Eviction reasons")
+
+	msg, _, _, remaining, err := s.Get(u, 0)
+	assert.NoError(err, "Get(): evict")
+	assert.Equal(msgs[1], msg, "Oldest message evicted")
+	assert.Equal(1, remaining, "Should be 1 since there's more in the queue")
+
+	count, size, err := s.Usage(u)
+	assert.NoError(err, "Usage()")
+	assert.Equal(2, count, "Usage(): count")
+	assert.Equal(len(msgs[1])+len(msgs[2]), size, "Usage(): size")
+}
+
+func TestBoltSpoolCompact(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "boltspool_compact_tests")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	f := filepath.Join(dir, testSpool)
+	s, err := New(f)
+	require.NoError(err, "New()")
+	defer func() { s.Close() }()
+
+	// Fill two spools, and remove one of them, leaving most of the file
+	// unused.
+	alice, bob := []byte("alice"), []byte("bob")
+	var msgs [][]byte
+	for i := 0; i < 256; i++ {
+		msg := make([]byte, constants.UserForwardPayloadLength)
+		_, err = rand.Read(msg)
+		require.NoError(err, "rand.Read()")
+		require.NoError(s.StoreMessage(bob, msg), "StoreMessage(bob)")
+		if i%16 == 0 {
+			require.NoError(s.StoreMessage(alice, msg), "StoreMessage(alice)")
+			msgs = append(msgs, msg)
+		}
+	}
+	require.NoError(s.Remove(bob), "Remove(bob)")
+
+	c := s.(spool.Compactor)
+	reclaimed, compacted, err := c.Compact(1)
+	require.NoError(err, "Compact(1)")
+	assert.False(compacted, "Compact(1): compacted")
+	assert.Zero(reclaimed, "Compact(1): reclaimed")
+
+	reclaimed, compacted, err = c.Compact(0.5)
+	require.NoError(err, "Compact(0.5)")
+	assert.True(compacted, "Compact(0.5): compacted")
+	assert.True(reclaimed > 0, "Compact(0.5): reclaimed")
+	_, err = os.Stat(f + ".compact")
+	assert.True(os.IsNotExist(err), "Compact(0.5): temporary file removed")
+
+	// The remaining spool survives intact, and keeps working across a
+	// reload.
+	require.NoError(s.StoreMessage(alice, msgs[0]), "StoreMessage(alice): after Compact()")
+	msgs = append(msgs, msgs[0])
+	s.Close()
+	s, err = New(f)
+	require.NoError(err, "New(): after Compact()")
+
+	var got [][]byte
+	require.NoError(s.ForEach(alice, func(msg, surbID []byte) error {
+		got = append(got, msg)
+		return nil
+	}), "ForEach(alice)")
+	assert.Equal(msgs, got, "ForEach(alice): after Compact()")
+}
+
+func TestBoltSpoolCompactReopenFailure(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "boltspool_compact_tests")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	f := filepath.Join(dir, testSpool)
+	s, err := New(f)
+	require.NoError(err, "New()")
+	defer s.Close()
+
+	alice := []byte("alice")
+	msg := make([]byte, constants.UserForwardPayloadLength)
+	require.NoError(s.StoreMessage(alice, msg), "StoreMessage()")
+
+	// Fail to reopen the database after compacting it.
+	defer func() { openDB = bolt.Open }()
+	openDB = func(path string, mode os.FileMode, opts *bolt.Options) (*bolt.DB, error) {
+		if path == f {
+			return nil, errors.New("injected failure")
+		}
+		return bolt.Open(path, mode, opts)
+	}
+	c := s.(spool.Compactor)
+	_, _, err = c.Compact(0)
+	require.Error(err, "Compact(): reopen failure")
+
+	// Every operation fails, rather than panicking.
+	assert.Error(s.StoreMessage(alice, msg), "StoreMessage(): closed")
+	_, _, _, _, err = s.Get(alice, 0)
+	assert.Error(err, "Get(): closed")
+	_, _, err = s.Usage(alice)
+	assert.Error(err, "Usage(): closed")
+
+	// A later Compact reopens the database.
+	openDB = bolt.Open
+	_, _, err = c.Compact(1)
+	require.NoError(err, "Compact(): reopen")
+	count, _, err := s.Usage(alice)
+	require.NoError(err, "Usage(): reopened")
+	assert.Equal(1, count, "Usage(): reopened")
+}
+
+func TestBoltSpoolConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltspool_conformance_tests")
+	require.NoError(t, err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	n := 0
+	spooltest.Run(t, func(t *testing.T) spool.Spool {
+		n++
+		s, err := New(filepath.Join(dir, fmt.Sprintf("spool-%d.db", n)))
+		require.NoError(t, err, "New()")
+		return s
+	})
+}
+
+func TestBoltSpoolBatchedConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltspool_batched_conformance_tests")
+	require.NoError(t, err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	n := 0
+	spooltest.Run(t, func(t *testing.T) spool.Spool {
+		n++
+		s, err := New(filepath.Join(dir, fmt.Sprintf("spool-%d.db", n)))
+		require.NoError(t, err, "New()")
+		s.(spool.Batcher).SetBatchLimits(4, time.Millisecond)
+		return s
+	})
+}
+
+func TestBoltSpoolBatched(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "boltspool_batched_tests")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	s, err := New(filepath.Join(dir, testSpool))
+	require.NoError(err, "New()")
+	defer s.Close()
+
+	const (
+		nrWorkers   = 8
+		nrPerUser   = 16
+		maxMessages = 100
+	)
+	s.(spool.Batcher).SetBatchLimits(nrWorkers, 10*time.Millisecond)
+	s.SetQuota(&spool.Quota{MaxMessages: maxMessages})
+
+	msg := make([]byte, constants.UserForwardPayloadLength)
+	_, err = rand.Read(msg)
+	require.NoError(err, "rand.Read()")
+
+	// Concurrent stores are batched, and a store rejected due to the quota
+	// only fails itself, and not the rest of its batch.
+	alice := []byte("alice")
+	var wg sync.WaitGroup
+	var nrStored, nrRejected int64
+	for i := 0; i < nrWorkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			u := []byte(fmt.Sprintf("user-%d", i))
+			for j := 0; j < nrPerUser; j++ {
+				assert.NoError(s.StoreMessage(u, msg), "StoreMessage(u)")
+				switch err := s.StoreMessage(alice, msg); err {
+				case nil:
+					atomic.AddInt64(&nrStored, 1)
+				case spool.ErrQuotaExceeded:
+					atomic.AddInt64(&nrRejected, 1)
+				default:
+					assert.NoError(err, "StoreMessage(alice)")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.EqualValues(maxMessages, nrStored, "StoreMessage(alice): stored")
+	assert.EqualValues(nrWorkers*nrPerUser-maxMessages, nrRejected, "StoreMessage(alice): rejected")
+	count, _, err := s.Usage(alice)
+	require.NoError(err, "Usage(alice)")
+	assert.Equal(maxMessages, count, "Usage(alice): count")
+	for i := 0; i < nrWorkers; i++ {
+		count, _, err = s.Usage([]byte(fmt.Sprintf("user-%d", i)))
+		require.NoError(err, "Usage(u)")
+		assert.Equal(nrPerUser, count, "Usage(u): count")
+	}
+}
+
+func TestBoltSpoolEncryptedConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltspool_encrypted_conformance_tests")
+	require.NoError(t, err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	k, err := spoolcrypt.Load(filepath.Join(dir, "spool.key"), "")
+	require.NoError(t, err, "spoolcrypt.Load()")
+
+	n := 0
+	spooltest.Run(t, func(t *testing.T) spool.Spool {
+		n++
+		s, err := NewEncrypted(filepath.Join(dir, fmt.Sprintf("spool-%d.db", n)), k)
+		require.NoError(t, err, "NewEncrypted()")
+		return s
+	})
+}
+
+func TestBoltSpoolEncrypted(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "boltspool_encrypted_tests")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	k, err := spoolcrypt.Load(filepath.Join(dir, "spool.key"), "")
+	require.NoError(err, "spoolcrypt.Load()")
+	otherKey, err := spoolcrypt.Load(filepath.Join(dir, "other.key"), "")
+	require.NoError(err, "spoolcrypt.Load(): other")
+
+	msg := make([]byte, constants.UserForwardPayloadLength)
+	_, err = rand.Read(msg)
+	require.NoError(err, "rand.Read()")
+
+	f := filepath.Join(dir, testSpool)
+	s, err := NewEncrypted(f, k)
+	require.NoError(err, "NewEncrypted()")
+	u := []byte(testUser)
+	require.NoError(s.StoreMessage(u, msg), "StoreMessage()")
+	count, size, err := s.Usage(u)
+	require.NoError(err, "Usage()")
+	assert.Equal(1, count, "Usage(): count")
+	assert.Equal(len(msg), size, "Usage(): size is that of the plaintext")
+
+	// Neither the username nor the message are stored in the clear.
+	bs := s.(*boltSpool)
+	require.NoError(bs.db.View(func(tx *bolt.Tx) error {
+		uBkt := tx.Bucket([]byte(usersBucket))
+		assert.Nil(uBkt.Bucket(u), "Plaintext username bucket")
+		sBkt := uBkt.Bucket(k.UserID(u))
+		require.NotNil(sBkt, "Hashed username bucket")
+		mKey, _ := sBkt.Cursor().First()
+		assert.NotEqual(msg, sBkt.Bucket(mKey).Get([]byte(msgKey)), "Stored message")
+		return nil
+	}), "View()")
+	s.Close()
+
+	// The spool can only be reopened with the same key.
+	_, err = New(f)
+	assert.Error(err, "New(): encrypted spool")
+	_, err = NewEncrypted(f, otherKey)
+	assert.Error(err, "NewEncrypted(): wrong key")
+
+	s, err = NewEncrypted(f, k)
+	require.NoError(err, "NewEncrypted(): reload")
+	got, _, _, _, err := s.Get(u, 0)
+	require.NoError(err, "Get()")
+	assert.Equal(msg, got, "Get(): decrypted message")
+	s.Close()
+
+	// Plaintext spools can not be opened as encrypted ones.
+	f = filepath.Join(dir, "plaintext.db")
+	s, err = New(f)
+	require.NoError(err, "New(): plaintext")
+	require.NoError(s.StoreMessage(u, msg), "StoreMessage(): plaintext")
+	s.Close()
+	_, err = NewEncrypted(f, k)
+	assert.EqualError(err, "spool: "+spoolcrypt.ErrNotEncrypted.Error(), "NewEncrypted(): plaintext spool")
+}
+
+func BenchmarkBoltSpoolStore(b *testing.B) {
+	msg := make([]byte, constants.UserForwardPayloadLength)
+	if _, err := rand.Read(msg); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, nrWorkers := range []int{1, 4, 16} {
+		for _, batched := range []bool{false, true} {
+			if batched && nrWorkers == 1 {
+				continue
+			}
+			name := fmt.Sprintf("workers-%d", nrWorkers)
+			if batched {
+				name += "-batched"
+			}
+			b.Run(name, func(b *testing.B) {
+				benchmarkStore(b, msg, nrWorkers, batched)
+			})
+		}
+	}
+}
+
+func benchmarkStore(b *testing.B, msg []byte, nrWorkers int, batched bool) {
+	dir, err := ioutil.TempDir("", "boltspool_benchmarks")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(filepath.Join(dir, testSpool))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	if batched {
+		s.(spool.Batcher).SetBatchLimits(nrWorkers, 2*time.Millisecond)
+	}
+
+	// Each worker stores to a distinct user, like the provider workers
+	// handling the packets for many recipients.
+	remaining := int64(b.N)
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for i := 0; i < nrWorkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			u := []byte(fmt.Sprintf("user-%d", i))
+			for atomic.AddInt64(&remaining, -1) >= 0 {
+				if err := s.StoreMessage(u, msg); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
 func init() {
 	var err error
 	tmpDir, err = ioutil.TempDir("", "boltspool_tests")
@@ -0,0 +1,284 @@
+// memspool.go - In-memory Katzenpost server user message spool.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package memspool implements the Katzenpost server user message spool with
+// a volatile in-memory backend, suitable for tests and ephemeral nodes.
+package memspool
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/sphinx"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/server/spool"
+	"github.com/katzenpost/server/userdb"
+)
+
+type message struct {
+	id       uint64
+	msg      []byte
+	surbID   []byte
+	storedAt time.Time
+}
+
+type memSpool struct {
+	sync.Mutex
+
+	spools map[string][]*message
+	quota  *spool.Quota
+	lastID uint64
+}
+
+func (s *memSpool) SetQuota(q *spool.Quota) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.quota = q
+}
+
+func (s *memSpool) Close() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.spools = make(map[string][]*message)
+}
+
+func (s *memSpool) StoreMessage(u, msg []byte) error {
+	if len(msg) != constants.UserForwardPayloadLength {
+		return fmt.Errorf("spool: invalid user message size: %d", len(msg))
+	}
+	return s.doStore(u, nil, msg)
+}
+
+func (s *memSpool) StoreSURBReply(u []byte, id *[sConstants.SURBIDLength]byte, msg []byte) error {
+	if len(msg) != sphinx.PayloadTagLength+constants.ForwardPayloadLength {
+		return fmt.Errorf("spool: invalid SURBReply message size: %d", len(msg))
+	}
+	if id == nil {
+		return fmt.Errorf("spool: SURBReply is missing ID")
+	}
+
+	return s.doStore(u, id, msg)
+}
+
+func (s *memSpool) doStore(u []byte, id *[sConstants.SURBIDLength]byte, msg []byte) error {
+	if len(u) == 0 || len(u) > userdb.MaxUsernameSize {
+		return fmt.Errorf("spool: invalid username: `%v`", u)
+	}
+
+	ent := &message{
+		msg:      append([]byte{}, msg...),
+		storedAt: time.Now(),
+	}
+	if id != nil {
+		ent.surbID = append([]byte{}, id[:]...)
+	}
+
+	s.Lock()
+	q := s.quota
+	msgs := s.spools[string(u)]
+	s.lastID++
+	ent.id = s.lastID
+
+	// Enforce the quota (if any), before adding the new message.
+	var evicted []spool.EvictReason
+	if q != nil {
+		var err error
+		if msgs, evicted, err = enforceQuota(msgs, q, len(msg), ent.storedAt); err != nil {
+			s.Unlock()
+			return err
+		}
+	}
+	s.spools[string(u)] = append(msgs, ent)
+	s.Unlock()
+
+	if q != nil {
+		q.NotifyEvicted(evicted)
+	}
+	return nil
+}
+
+func enforceQuota(msgs []*message, q *spool.Quota, msgLen int, now time.Time) ([]*message, []spool.EvictReason, error) {
+	// Purge the expired messages first, since they do not count against
+	// the rest of the quota.
+	msgs, evicted := expireMessages(msgs, q, now)
+
+	if q.MaxMessages <= 0 && q.MaxBytes <= 0 {
+		return msgs, evicted, nil
+	}
+
+	size := 0
+	for _, m := range msgs {
+		size += len(m.msg)
+	}
+
+	for {
+		reason, exceeds := q.Exceeds(len(msgs), size, msgLen)
+		if !exceeds {
+			return msgs, evicted, nil
+		}
+		if q.Policy != spool.PolicyEvict || len(msgs) == 0 {
+			return nil, nil, spool.ErrQuotaExceeded
+		}
+
+		// Evict the oldest message.
+		size -= len(msgs[0].msg)
+		msgs = msgs[1:]
+		evicted = append(evicted, reason)
+	}
+}
+
+func expireMessages(msgs []*message, q *spool.Quota, now time.Time) ([]*message, []spool.EvictReason) {
+	// Messages are stored in order, so stop at the first unexpired one.
+	n := 0
+	for n < len(msgs) && q.IsExpired(msgs[n].storedAt, now) {
+		n++
+	}
+
+	evicted := make([]spool.EvictReason, 0, n)
+	for i := 0; i < n; i++ {
+		evicted = append(evicted, spool.EvictMaxAge)
+	}
+	return msgs[n:], evicted
+}
+
+func (s *memSpool) Get(u []byte, ackID uint64) (msg, surbID []byte, id uint64, remaining int, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	msgs := s.spools[string(u)]
+	if ackID != 0 {
+		// Delete the acknowledged message, iff it is still in the spool.
+		for i, m := range msgs {
+			if m.id == ackID {
+				msgs = append(msgs[:i:i], msgs[i+1:]...)
+				break
+			}
+		}
+		if len(msgs) == 0 {
+			// Deleting the message drained the queue.
+			delete(s.spools, string(u))
+			return
+		}
+		s.spools[string(u)] = msgs
+	}
+
+	// Skip the expired messages, which are left for the next store or
+	// Vacuum to delete.
+	now := time.Now()
+	for len(msgs) > 0 && s.quota.IsExpired(msgs[0].storedAt, now) {
+		msgs = msgs[1:]
+	}
+	if len(msgs) == 0 {
+		// If the user's spool is missing or empty, the spool is empty.
+		return
+	}
+
+	// The remaining count is merely a hint, so just return 0 if there is
+	// only one message, and 1 if there are any number of messages,
+	// "excluding the current message".
+	if len(msgs) > 1 {
+		remaining = 1
+	}
+
+	// Return copies of the stored message and (optional) SURB ID.
+	msg = append([]byte{}, msgs[0].msg...)
+	if msgs[0].surbID != nil {
+		surbID = append([]byte{}, msgs[0].surbID...)
+	}
+	id = msgs[0].id
+	return
+}
+
+func (s *memSpool) ForEach(u []byte, fn func(msg, surbID []byte) error) error {
+	// The stored messages are never mutated, so a copy of the slice is a
+	// sufficient snapshot to avoid calling fn with the lock held.
+	s.Lock()
+	msgs := append([]*message{}, s.spools[string(u)]...)
+	s.Unlock()
+
+	for _, m := range msgs {
+		var surbID []byte
+		if m.surbID != nil {
+			surbID = append([]byte{}, m.surbID...)
+		}
+		if err := fn(append([]byte{}, m.msg...), surbID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memSpool) Usage(u []byte) (count, size int, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, m := range s.spools[string(u)] {
+		count++
+		size += len(m.msg)
+	}
+	return
+}
+
+func (s *memSpool) Remove(u []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.spools, string(u))
+	return nil
+}
+
+func (s *memSpool) Vacuum(udb userdb.UserDB) error {
+	now := time.Now()
+
+	s.Lock()
+	q := s.quota
+	var evicted []spool.EvictReason
+	for u, msgs := range s.spools {
+		if !udb.Exists([]byte(u)) {
+			delete(s.spools, u)
+			continue
+		}
+
+		// Purge the expired messages from valid users' spools.
+		if q != nil {
+			var expired []spool.EvictReason
+			msgs, expired = expireMessages(msgs, q, now)
+			evicted = append(evicted, expired...)
+			if len(msgs) == 0 {
+				delete(s.spools, u)
+			} else {
+				s.spools[u] = msgs
+			}
+		}
+	}
+	s.Unlock()
+
+	if q != nil {
+		q.NotifyEvicted(evicted)
+	}
+	return nil
+}
+
+// New creates a new empty in-memory user message spool.
+func New() spool.Spool {
+	return &memSpool{
+		spools: make(map[string][]*message),
+	}
+}
@@ -0,0 +1,185 @@
+// notifyspool.go - Change notifying Katzenpost server user message spool.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package notifyspool implements a change notification decorator for any
+// Katzenpost server user message spool.
+//
+// Subscribers are notified after every change made to a user's spool via the
+// decorator: messages being stored, the head being removed, and the spool
+// being removed or vacuumed.  Notifications are coalesced, so a subscriber is
+// only guaranteed that the spool has changed at least once since it last
+// received one.  Changes made to the underlying spool by other means are not
+// notified.
+package notifyspool
+
+import (
+	"sync"
+
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/server/spool"
+	"github.com/katzenpost/server/userdb"
+)
+
+// Subscription is a subscription to the changes to a user's spool.
+type Subscription struct {
+	s *Spool
+	u string
+
+	// C receives a value after the user's spool changes.
+	C <-chan struct{}
+	c chan struct{}
+}
+
+// Cancel cancels the subscription.  C will not be closed.
+func (sub *Subscription) Cancel() {
+	sub.s.Lock()
+	defer sub.s.Unlock()
+
+	subs := sub.s.subs[sub.u]
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(sub.s.subs, sub.u)
+	}
+}
+
+// Get is Spool.Get on the subscribed user's spool, except that the change
+// made by acknowledging an entry is only notified to the other
+// subscriptions.
+func (sub *Subscription) Get(ackID uint64) (msg, surbID []byte, id uint64, remaining int, err error) {
+	msg, surbID, id, remaining, err = sub.s.Spool.Get([]byte(sub.u), ackID)
+	if err == nil && ackID != 0 {
+		sub.s.notify([]byte(sub.u), sub)
+	}
+	return
+}
+
+// Spool is a spool.Spool that notifies subscribers of changes.
+type Spool struct {
+	sync.Mutex
+	spool.Spool
+
+	subs map[string]map[*Subscription]bool
+}
+
+// Subscribe subscribes to the changes to the user u's spool.
+func (s *Spool) Subscribe(u []byte) *Subscription {
+	sub := &Subscription{
+		s: s,
+		u: string(u),
+		c: make(chan struct{}, 1),
+	}
+	sub.C = sub.c
+
+	s.Lock()
+	defer s.Unlock()
+
+	subs, ok := s.subs[sub.u]
+	if !ok {
+		subs = make(map[*Subscription]bool)
+		s.subs[sub.u] = subs
+	}
+	subs[sub] = true
+	return sub
+}
+
+func (s *Spool) notify(u []byte, except *Subscription) {
+	s.Lock()
+	defer s.Unlock()
+
+	for sub := range s.subs[string(u)] {
+		if sub == except {
+			continue
+		}
+		select {
+		case sub.c <- struct{}{}:
+		default:
+			// A notification is already pending.
+		}
+	}
+}
+
+func (s *Spool) notifyAll() {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, subs := range s.subs {
+		for sub := range subs {
+			select {
+			case sub.c <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// StoreMessage stores a message in the user's spool.
+func (s *Spool) StoreMessage(u, msg []byte) error {
+	if err := s.Spool.StoreMessage(u, msg); err != nil {
+		return err
+	}
+	s.notify(u, nil)
+	return nil
+}
+
+// StoreSURBReply stores a SURBReply in the user's spool.
+func (s *Spool) StoreSURBReply(u []byte, id *[sConstants.SURBIDLength]byte, msg []byte) error {
+	if err := s.Spool.StoreSURBReply(u, id, msg); err != nil {
+		return err
+	}
+	s.notify(u, nil)
+	return nil
+}
+
+// Get optionally deletes an acknowledged entry from a user's spool, and
+// returns the first entry.
+func (s *Spool) Get(u []byte, ackID uint64) (msg, surbID []byte, id uint64, remaining int, err error) {
+	msg, surbID, id, remaining, err = s.Spool.Get(u, ackID)
+	if err == nil && ackID != 0 {
+		s.notify(u, nil)
+	}
+	return
+}
+
+// Remove removes the user's spool.
+func (s *Spool) Remove(u []byte) error {
+	err := s.Spool.Remove(u)
+	s.notify(u, nil)
+	return err
+}
+
+// Vacuum vacuums the underlying spool.
+func (s *Spool) Vacuum(udb userdb.UserDB) error {
+	err := s.Spool.Vacuum(udb)
+	s.notifyAll()
+	return err
+}
+
+// Compact compacts the underlying spool, iff it is a spool.Compactor.
+func (s *Spool) Compact(threshold float64) (int64, bool, error) {
+	c, ok := s.Spool.(spool.Compactor)
+	if !ok {
+		return 0, false, nil
+	}
+	return c.Compact(threshold)
+}
+
+// New constructs a new change notifying decorator around the spool s.
+func New(s spool.Spool) *Spool {
+	return &Spool{
+		Spool: s,
+		subs:  make(map[string]map[*Subscription]bool),
+	}
+}
@@ -0,0 +1,107 @@
+// notifyspool_test.go - Change notifying Katzenpost server user message spool tests.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package notifyspool
+
+import (
+	"testing"
+
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/sphinx"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/server/spool"
+	"github.com/katzenpost/server/spool/memspool"
+	"github.com/katzenpost/server/spool/spooltest"
+	"github.com/katzenpost/server/userdb/memuserdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifySpoolConformance(t *testing.T) {
+	spooltest.Run(t, func(t *testing.T) spool.Spool {
+		return New(memspool.New())
+	})
+}
+
+func isNotified(sub *Subscription) bool {
+	select {
+	case <-sub.C:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestNotifySpool(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	s := New(memspool.New())
+	defer s.Close()
+
+	u, other := []byte("alice"), []byte("bob")
+	sub := s.Subscribe(u)
+	sub2 := s.Subscribe(u)
+	otherSub := s.Subscribe(other)
+	defer otherSub.Cancel()
+
+	msg := make([]byte, constants.UserForwardPayloadLength)
+	_, err := rand.Reader.Read(msg)
+	require.NoError(err, "rand.Read(msg)")
+	var id [sConstants.SURBIDLength]byte
+	surbReply := make([]byte, sphinx.PayloadTagLength+constants.ForwardPayloadLength)
+
+	// Stores notify the user's subscriptions, coalescing notifications.
+	require.NoError(s.StoreMessage(u, msg), "StoreMessage()")
+	require.NoError(s.StoreSURBReply(u, &id, surbReply), "StoreSURBReply()")
+	assert.True(isNotified(sub), "Store: notified")
+	assert.False(isNotified(sub), "Store: notifications coalesced")
+	assert.True(isNotified(sub2), "Store: all subscriptions notified")
+	assert.False(isNotified(otherSub), "Store: other users not notified")
+
+	// Failed stores do not notify.
+	require.Error(s.StoreMessage(u, msg[1:]), "StoreMessage(truncated)")
+	assert.False(isNotified(sub), "Failed store: not notified")
+
+	// Only acknowledging an entry changes the spool.
+	_, _, msgID, _, err := s.Get(u, 0)
+	require.NoError(err, "Get(u, 0)")
+	assert.False(isNotified(sub), "Get(u, 0): not notified")
+	_, _, surbMsgID, _, err := s.Get(u, msgID)
+	require.NoError(err, "Get(u, msgID)")
+	assert.True(isNotified(sub), "Get(u, msgID): notified")
+	assert.True(isNotified(sub2), "Get(u, msgID): notified")
+
+	// Acknowledging via a subscription only notifies the others.
+	_, surbID, _, _, err := sub.Get(surbMsgID)
+	require.NoError(err, "sub.Get(surbMsgID)")
+	assert.Nil(surbID, "sub.Get(surbMsgID): SURB ID")
+	assert.False(isNotified(sub), "sub.Get(surbMsgID): self not notified")
+	assert.True(isNotified(sub2), "sub.Get(surbMsgID): others notified")
+
+	// Vacuuming notifies everyone.
+	require.NoError(s.Vacuum(memuserdb.New()), "Vacuum()")
+	assert.True(isNotified(sub), "Vacuum(): notified")
+	assert.True(isNotified(otherSub), "Vacuum(): other users notified")
+
+	// Cancelled subscriptions are not notified.
+	sub.Cancel()
+	sub2.Cancel()
+	require.NoError(s.Remove(u), "Remove()")
+	assert.False(isNotified(sub), "Cancelled: not notified")
+	assert.Len(s.subs, 1, "Cancelled: subscriptions removed")
+}
@@ -19,10 +19,98 @@
 package spool
 
 import (
+	"errors"
+	"time"
+
 	"github.com/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/server/userdb"
 )
 
+// ErrQuotaExceeded is the error returned when a message can not be stored
+// because doing so would exceed the user's spool quota.
+var ErrQuotaExceeded = errors.New("spool: user quota exceeded")
+
+// QuotaPolicy is the action taken when storing a message would exceed a
+// user's spool quota.
+type QuotaPolicy int
+
+const (
+	// PolicyReject rejects the new message, leaving the spool untouched.
+	PolicyReject QuotaPolicy = iota
+
+	// PolicyEvict evicts the oldest message(s) in the spool to make room
+	// for the new message.
+	PolicyEvict
+)
+
+// EvictReason is the reason a message was evicted from a user's spool.
+type EvictReason string
+
+const (
+	// EvictMaxMessages is the reason for evictions caused by the per-user
+	// message count limit.
+	EvictMaxMessages EvictReason = "max_messages"
+
+	// EvictMaxBytes is the reason for evictions caused by the per-user
+	// total size limit.
+	EvictMaxBytes EvictReason = "max_bytes"
+
+	// EvictMaxAge is the reason for evictions caused by messages exceeding
+	// the maximum message age.
+	EvictMaxAge EvictReason = "max_age"
+)
+
+// Quota is the per-user spool quota.  A zero value for any of the limits
+// disables that particular limit.
+type Quota struct {
+	// MaxMessages is the maximum number of messages in a user's spool.
+	MaxMessages int
+
+	// MaxBytes is the maximum total size of the messages in a user's spool.
+	MaxBytes int
+
+	// MaxAge is the maximum age of a message in a user's spool.
+	MaxAge time.Duration
+
+	// Policy is the action taken when a store would exceed the quota.
+	Policy QuotaPolicy
+
+	// OnEvict, if set, is called once for every message evicted from a
+	// spool, after the eviction has been committed.
+	OnEvict func(EvictReason)
+}
+
+// Exceeds returns the reason and true iff a spool currently holding count
+// messages totalling size bytes can not accept another msgLen byte message.
+func (q *Quota) Exceeds(count, size, msgLen int) (EvictReason, bool) {
+	if q.MaxMessages > 0 && count+1 > q.MaxMessages {
+		return EvictMaxMessages, true
+	}
+	if q.MaxBytes > 0 && size+msgLen > q.MaxBytes {
+		return EvictMaxBytes, true
+	}
+	return "", false
+}
+
+// IsExpired returns true iff a message stored at storedAt has exceeded the
+// maximum message age as of now.  A nil quota never expires messages.
+func (q *Quota) IsExpired(storedAt, now time.Time) bool {
+	if q == nil || q.MaxAge <= 0 {
+		return false
+	}
+	return now.Sub(storedAt) > q.MaxAge
+}
+
+// NotifyEvicted invokes the OnEvict hook for each of the provided reasons.
+func (q *Quota) NotifyEvicted(reasons []EvictReason) {
+	if q.OnEvict == nil {
+		return
+	}
+	for _, r := range reasons {
+		q.OnEvict(r)
+	}
+}
+
 // Spool is the interface provided by all user messgage spool implementations.
 type Spool interface {
 	// StoreMessage stores a message in the user's spool.
@@ -31,17 +119,61 @@ type Spool interface {
 	// StoreSURBReply stores a SURBReply in the user's spool.
 	StoreSURBReply(u []byte, id *[constants.SURBIDLength]byte, msg []byte) error
 
-	// Get optionally deletes the first entry in a user's spool, and returns
-	// the (new) first entry.  Both messages and SURBReplies may be returned.
-	Get(u []byte, advance bool) (msg, surbID []byte, remaining int, err error)
+	// Get returns the first entry in a user's spool, and the non-zero ID
+	// that identifies it.  Both messages and SURBReplies may be returned,
+	// but entries that have exceeded the maximum message age of the current
+	// quota are not.
+	//
+	// If ackID is non-zero, the entry that it identifies, as returned by a
+	// previous call, is deleted first iff it is still in the spool.  An
+	// entry that was evicted or expired after being returned therefore
+	// never causes the entry that replaced it to be deleted unseen.
+	Get(u []byte, ackID uint64) (msg, surbID []byte, id uint64, remaining int, err error)
+
+	// ForEach calls fn with each of the messages, and the corresponding
+	// SURB ID for SURBReplies, in the user's spool, in delivery order.  The
+	// spool is not modified.
+	ForEach(u []byte, fn func(msg, surbID []byte) error) error
+
+	// Usage returns the number of messages, and their total size in bytes
+	// in the user's spool.
+	Usage(u []byte) (count, size int, err error)
 
 	// Remove removes the spool identified by the username from the database.
 	Remove(u []byte) error
 
 	// Vacuum removes the spools that do not correspond to valid users in the
-	// provided UserDB.
+	// provided UserDB, along with any messages that have exceeded the
+	// maximum message age of the current quota.
 	Vacuum(udb userdb.UserDB) error
 
+	// SetQuota sets the per-user quota enforced by all subsequent store
+	// operations.  Providing a nil quota disables enforcement.
+	SetQuota(q *Quota)
+
 	// Close closes the Spool instance.
 	Close()
 }
+
+// Compactor is the interface provided by spool implementations that can
+// reclaim the unused space in their backing storage.
+type Compactor interface {
+	// Compact rewrites the spool's backing storage iff the fraction of it
+	// that is unused is at least threshold, and returns the number of bytes
+	// reclaimed, and if the compaction was done.
+	Compact(threshold float64) (reclaimed int64, compacted bool, err error)
+}
+
+// Batcher is the interface provided by spool implementations that can commit
+// concurrent stores in a single transaction.
+type Batcher interface {
+	// SetBatchLimits sets the maximum number of concurrent stores that are
+	// committed in a single transaction, and the maximum time that a store
+	// will wait for others to join its transaction.  A maxSize <= 1
+	// disables batching.
+	//
+	// A store that fails, such as one rejected by the quota, fails the
+	// shared transaction, and each of the other stores in it is then
+	// retried in a transaction of its own.
+	SetBatchLimits(maxSize int, maxDelay time.Duration)
+}
@@ -0,0 +1,229 @@
+// spoolcrypt.go - Katzenpost server user message spool encryption.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package spoolcrypt implements the at-rest encryption of the user message
+// spool contents, shared by the persistent spool backends.
+//
+// Users are identified by a keyed hash of the username, and the message
+// bodies and SURB IDs are encrypted with XChaCha20-Poly1305, with the user's
+// identifier and the field as the associated data, so that entries can not
+// be moved between users or fields undetected.
+package spoolcrypt
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/sphinx"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// KeySize is the size of a storage key (or passphrase salt) in bytes.
+	KeySize = 32
+
+	// Overhead is the number of bytes that encryption adds to each message
+	// body or SURB ID.
+	Overhead = chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+
+	userIDLabel  = "katzenpost spool user id v0"
+	aeadKeyLabel = "katzenpost spool aead key v0"
+	msgLabel     = "message"
+	surbIDLabel  = "surbID"
+
+	// The Argon2id parameters used to derive a storage key from a
+	// passphrase.
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+)
+
+var (
+	// ErrDecrypt is the error returned when a spool entry fails to decrypt.
+	ErrDecrypt = errors.New("spoolcrypt: failed to decrypt spool entry")
+
+	// ErrNotEncrypted is the error returned by CheckSample when a storage
+	// key is provided for a spool that is not encrypted.
+	ErrNotEncrypted = errors.New("spoolcrypt: spool is not encrypted")
+
+	// ErrEncrypted is the error returned by CheckSample when no storage key
+	// is provided for a spool that is encrypted.
+	ErrEncrypted = errors.New("spoolcrypt: spool is encrypted, but no storage key was provided")
+)
+
+// Key is a spool storage key.
+type Key struct {
+	userIDKey []byte
+	aead      cipher.AEAD
+}
+
+// UserID returns the identifier that the spool uses in place of the username
+// u.
+func (k *Key) UserID(u []byte) []byte {
+	m := hmac.New(sha256.New, k.userIDKey)
+	m.Write(u)
+	return m.Sum(nil)
+}
+
+// SealMessage encrypts the message body msg belonging to userID.
+func (k *Key) SealMessage(userID, msg []byte) []byte {
+	return k.seal(userID, msgLabel, msg)
+}
+
+// OpenMessage decrypts the message body ct belonging to userID.
+func (k *Key) OpenMessage(userID, ct []byte) ([]byte, error) {
+	return k.open(userID, msgLabel, ct)
+}
+
+// SealSURBID encrypts the SURB ID id belonging to userID.
+func (k *Key) SealSURBID(userID, id []byte) []byte {
+	return k.seal(userID, surbIDLabel, id)
+}
+
+// OpenSURBID decrypts the SURB ID ct belonging to userID.
+func (k *Key) OpenSURBID(userID, ct []byte) ([]byte, error) {
+	return k.open(userID, surbIDLabel, ct)
+}
+
+func (k *Key) seal(userID []byte, label string, pt []byte) []byte {
+	ct := make([]byte, chacha20poly1305.NonceSizeX, chacha20poly1305.NonceSizeX+len(pt)+chacha20poly1305.Overhead)
+	if _, err := rand.Reader.Read(ct); err != nil {
+		panic("spoolcrypt: failed to generate nonce: " + err.Error())
+	}
+	return k.aead.Seal(ct, ct, pt, additionalData(userID, label))
+}
+
+func (k *Key) open(userID []byte, label string, ct []byte) ([]byte, error) {
+	if len(ct) < Overhead {
+		return nil, ErrDecrypt
+	}
+	nonce, ct := ct[:chacha20poly1305.NonceSizeX], ct[chacha20poly1305.NonceSizeX:]
+	pt, err := k.aead.Open(nil, nonce, ct, additionalData(userID, label))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return pt, nil
+}
+
+func additionalData(userID []byte, label string) []byte {
+	ad := make([]byte, 0, len(userID)+len(label))
+	ad = append(ad, userID...)
+	return append(ad, label...)
+}
+
+// CheckSample checks that a message body msg and the (optional) SURB ID
+// surbID, as stored in the spool under userID, are consistent with the
+// storage key k, which may be nil if the spool is not meant to be encrypted.
+// This is intended to catch misconfiguration when opening a spool.
+func CheckSample(k *Key, userID, msg, surbID []byte) error {
+	isPlaintext := len(msg) == constants.UserForwardPayloadLength || len(msg) == sphinx.PayloadTagLength+constants.ForwardPayloadLength
+	if surbID != nil && len(surbID) != sConstants.SURBIDLength {
+		isPlaintext = false
+	}
+
+	switch {
+	case k == nil && !isPlaintext:
+		return ErrEncrypted
+	case k == nil:
+		return nil
+	case isPlaintext:
+		return ErrNotEncrypted
+	}
+	if _, err := k.OpenMessage(userID, msg); err != nil {
+		return errors.New("spoolcrypt: spool is not encrypted under the provided storage key")
+	}
+	return nil
+}
+
+// New derives a Key from the storageKey.
+func New(storageKey []byte) (*Key, error) {
+	if len(storageKey) != KeySize {
+		return nil, fmt.Errorf("spoolcrypt: invalid storage key size: %d", len(storageKey))
+	}
+
+	aead, err := chacha20poly1305.NewX(deriveKey(storageKey, aeadKeyLabel))
+	if err != nil {
+		return nil, err
+	}
+	return &Key{
+		userIDKey: deriveKey(storageKey, userIDLabel),
+		aead:      aead,
+	}, nil
+}
+
+func deriveKey(storageKey []byte, label string) []byte {
+	m := hmac.New(sha256.New, storageKey)
+	m.Write([]byte(label))
+	return m.Sum(nil)
+}
+
+// Load loads (or generates) the storage key in the file f, and derives a
+// Key from it.  If a passphrase is provided, the file instead holds the
+// random salt, and the storage key is derived from the passphrase with
+// Argon2id, so that the storage key itself never touches the disk.
+func Load(f, passphrase string) (*Key, error) {
+	b, err := ioutil.ReadFile(f)
+	switch {
+	case err == nil:
+		if len(b) != KeySize {
+			return nil, fmt.Errorf("spoolcrypt: invalid key file '%v': size %d", f, len(b))
+		}
+	case os.IsNotExist(err):
+		if b, err = generate(f); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	if passphrase != "" {
+		b = argon2.IDKey([]byte(passphrase), b, argon2Time, argon2Memory, argon2Threads, KeySize)
+	}
+	return New(b)
+}
+
+func generate(f string) ([]byte, error) {
+	b := make([]byte, KeySize)
+	if _, err := rand.Reader.Read(b); err != nil {
+		return nil, err
+	}
+
+	// Refuse to clobber a file created in the meantime.
+	fd, err := os.OpenFile(f, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fd.Write(b); err == nil {
+		err = fd.Sync()
+	}
+	if cErr := fd.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(f)
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,77 @@
+// spoolcrypt_test.go - Spool encryption tests.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package spoolcrypt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/katzenpost/core/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpoolCrypt(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "spoolcrypt_tests")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	// Load generates the key file, and reloading it yields the same key.
+	f := filepath.Join(dir, "spool.key")
+	k, err := Load(f, "")
+	require.NoError(err, "Load(): generate")
+	b, err := ioutil.ReadFile(f)
+	require.NoError(err, "ReadFile()")
+	assert.Len(b, KeySize, "Key file size")
+	k2, err := Load(f, "")
+	require.NoError(err, "Load(): reload")
+	assert.Equal(k.UserID([]byte("alice")), k2.UserID([]byte("alice")), "UserID(): reloaded key")
+	assert.NotEqual(k.UserID([]byte("alice")), k.UserID([]byte("bob")), "UserID(): distinct users")
+
+	// The same file with a passphrase is a salt, yielding a different key.
+	kp, err := Load(f, "correct horse battery staple")
+	require.NoError(err, "Load(): passphrase")
+	assert.NotEqual(k.UserID([]byte("alice")), kp.UserID([]byte("alice")), "UserID(): passphrase key")
+
+	alice, bob := k.UserID([]byte("alice")), k.UserID([]byte("bob"))
+	msg := make([]byte, constants.UserForwardPayloadLength)
+	msg[0] = 0x42
+	ct := k.SealMessage(alice, msg)
+	assert.Len(ct, len(msg)+Overhead, "SealMessage(): length")
+	pt, err := k.OpenMessage(alice, ct)
+	require.NoError(err, "OpenMessage()")
+	assert.Equal(msg, pt, "OpenMessage(): plaintext")
+
+	// Ciphertexts are bound to the user, field and key.
+	_, err = k.OpenMessage(bob, ct)
+	assert.Equal(ErrDecrypt, err, "OpenMessage(): wrong user")
+	_, err = k.OpenSURBID(alice, ct)
+	assert.Equal(ErrDecrypt, err, "OpenSURBID(): message ciphertext")
+	_, err = kp.OpenMessage(alice, ct)
+	assert.Equal(ErrDecrypt, err, "OpenMessage(): wrong key")
+
+	assert.NoError(CheckSample(k, alice, ct, nil), "CheckSample()")
+	assert.Error(CheckSample(kp, alice, ct, nil), "CheckSample(): wrong key")
+	assert.Equal(ErrEncrypted, CheckSample(nil, alice, ct, nil), "CheckSample(): no key")
+	assert.Equal(ErrNotEncrypted, CheckSample(k, []byte("alice"), msg, nil), "CheckSample(): plaintext")
+	assert.NoError(CheckSample(nil, []byte("alice"), msg, nil), "CheckSample(): plaintext, no key")
+}
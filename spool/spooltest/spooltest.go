@@ -0,0 +1,329 @@
+// spooltest.go - Katzenpost server user message spool conformance tests.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package spooltest provides a conformance test suite that every
+// spool.Spool implementation is expected to pass.
+package spooltest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/sphinx"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/server/spool"
+	"github.com/katzenpost/server/userdb/memuserdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Run runs the conformance test suite, calling newSpool to create a new
+// empty spool for each test.  The suite will close each spool when the test
+// completes.
+func Run(t *testing.T, newSpool func(t *testing.T) spool.Spool) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, spool.Spool)
+	}{
+		{"StoreGet", testStoreGet},
+		{"InvalidStore", testInvalidStore},
+		{"Remove", testRemove},
+		{"Quota", testQuota},
+		{"AckEvicted", testAckEvicted},
+		{"GetExpired", testGetExpired},
+		{"Vacuum", testVacuum},
+	}
+
+	for _, v := range tests {
+		fn := v.fn
+		t.Run(v.name, func(t *testing.T) {
+			s := newSpool(t)
+			defer s.Close()
+			fn(t, s)
+		})
+	}
+}
+
+func newMessage(t *testing.T) []byte {
+	msg := make([]byte, constants.UserForwardPayloadLength)
+	_, err := rand.Reader.Read(msg)
+	require.NoError(t, err, "rand.Read(msg)")
+	return msg
+}
+
+func newSURBReply(t *testing.T) (*[sConstants.SURBIDLength]byte, []byte) {
+	var id [sConstants.SURBIDLength]byte
+	_, err := rand.Reader.Read(id[:])
+	require.NoError(t, err, "rand.Read(id)")
+	msg := make([]byte, sphinx.PayloadTagLength+constants.ForwardPayloadLength)
+	_, err = rand.Reader.Read(msg)
+	require.NoError(t, err, "rand.Read(msg)")
+	return &id, msg
+}
+
+func testStoreGet(t *testing.T, s spool.Spool) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	u := []byte("alice")
+
+	// Empty spools return nothing, regardless of the acknowledged ID.
+	for _, ackID := range []uint64{0, 1} {
+		msg, id, msgID, remaining, err := s.Get(u, ackID)
+		require.NoError(err, "Get(): empty")
+		assert.Nil(msg, "Get(): empty message")
+		assert.Nil(id, "Get(): empty SURB ID")
+		assert.Zero(msgID, "Get(): empty ID")
+		assert.Equal(0, remaining, "Get(): empty remaining")
+	}
+
+	msg0, msg1 := newMessage(t), newMessage(t)
+	surbID, surbMsg := newSURBReply(t)
+	require.NoError(s.StoreMessage(u, msg0), "StoreMessage(0)")
+	require.NoError(s.StoreSURBReply(u, surbID, surbMsg), "StoreSURBReply()")
+	require.NoError(s.StoreMessage(u, msg1), "StoreMessage(1)")
+
+	count, size, err := s.Usage(u)
+	require.NoError(err, "Usage()")
+	assert.Equal(3, count, "Usage(): count")
+	assert.Equal(len(msg0)+len(surbMsg)+len(msg1), size, "Usage(): size")
+
+	// ForEach returns every message in order, without modifying the spool.
+	var msgs, ids [][]byte
+	err = s.ForEach(u, func(msg, surbID []byte) error {
+		msgs = append(msgs, msg)
+		ids = append(ids, surbID)
+		return nil
+	})
+	require.NoError(err, "ForEach()")
+	assert.Equal([][]byte{msg0, surbMsg, msg1}, msgs, "ForEach(): messages")
+	assert.Equal([][]byte{nil, surbID[:], nil}, ids, "ForEach(): SURB IDs")
+
+	// Get without acknowledging is idempotent.
+	var headID uint64
+	for i := 0; i < 2; i++ {
+		msg, id, msgID, remaining, err := s.Get(u, 0)
+		require.NoError(err, "Get(): head")
+		assert.Equal(msg0, msg, "Get(): head message")
+		assert.Nil(id, "Get(): head SURB ID")
+		assert.NotZero(msgID, "Get(): head ID")
+		assert.Equal(1, remaining, "Get(): head remaining")
+		headID = msgID
+	}
+
+	msg, id, surbMsgID, remaining, err := s.Get(u, headID)
+	require.NoError(err, "Get(): advance to SURBReply")
+	assert.Equal(surbMsg, msg, "Get(): SURBReply message")
+	assert.Equal(surbID[:], id, "Get(): SURBReply SURB ID")
+	assert.NotEqual(headID, surbMsgID, "Get(): SURBReply ID")
+	assert.Equal(1, remaining, "Get(): SURBReply remaining")
+
+	// Acknowledging an entry that was already deleted is a no-op.
+	msg, _, msgID, _, err := s.Get(u, headID)
+	require.NoError(err, "Get(): stale acknowledgement")
+	assert.Equal(surbMsg, msg, "Get(): stale acknowledgement message")
+	assert.Equal(surbMsgID, msgID, "Get(): stale acknowledgement ID")
+
+	msg, id, lastID, remaining, err := s.Get(u, surbMsgID)
+	require.NoError(err, "Get(): advance to last")
+	assert.Equal(msg1, msg, "Get(): last message")
+	assert.Nil(id, "Get(): last SURB ID")
+	assert.Equal(0, remaining, "Get(): last remaining")
+
+	msg, id, msgID, remaining, err = s.Get(u, lastID)
+	require.NoError(err, "Get(): advance to empty")
+	assert.Nil(msg, "Get(): drained message")
+	assert.Nil(id, "Get(): drained SURB ID")
+	assert.Zero(msgID, "Get(): drained ID")
+	assert.Equal(0, remaining, "Get(): drained remaining")
+
+	count, size, err = s.Usage(u)
+	require.NoError(err, "Usage(): drained")
+	assert.Equal(0, count, "Usage(): drained count")
+	assert.Equal(0, size, "Usage(): drained size")
+}
+
+func testInvalidStore(t *testing.T, s spool.Spool) {
+	assert := assert.New(t)
+
+	u := []byte("alice")
+	surbID, surbMsg := newSURBReply(t)
+
+	assert.Error(s.StoreMessage(u, surbMsg), "StoreMessage(): invalid size")
+	assert.Error(s.StoreSURBReply(u, surbID, newMessage(t)), "StoreSURBReply(): invalid size")
+	assert.Error(s.StoreSURBReply(u, nil, surbMsg), "StoreSURBReply(): missing ID")
+}
+
+func testRemove(t *testing.T, s spool.Spool) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	alice, bob := []byte("alice"), []byte("bob")
+	msg := newMessage(t)
+	require.NoError(s.StoreMessage(alice, msg), "StoreMessage(alice)")
+	require.NoError(s.StoreMessage(bob, msg), "StoreMessage(bob)")
+
+	require.NoError(s.Remove(alice), "Remove(alice)")
+	count, _, err := s.Usage(alice)
+	require.NoError(err, "Usage(alice)")
+	assert.Equal(0, count, "Usage(alice): removed")
+	count, _, err = s.Usage(bob)
+	require.NoError(err, "Usage(bob)")
+	assert.Equal(1, count, "Usage(bob): untouched")
+
+	assert.NoError(s.Remove(alice), "Remove(alice): already removed")
+}
+
+func testQuota(t *testing.T, s spool.Spool) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	u := []byte("alice")
+	msgs := [][]byte{newMessage(t), newMessage(t), newMessage(t)}
+
+	var evictions []spool.EvictReason
+	q := &spool.Quota{
+		MaxMessages: 2,
+		Policy:      spool.PolicyReject,
+		OnEvict: func(r spool.EvictReason) {
+			evictions = append(evictions, r)
+		},
+	}
+	s.SetQuota(q)
+
+	require.NoError(s.StoreMessage(u, msgs[0]), "StoreMessage(0)")
+	require.NoError(s.StoreMessage(u, msgs[1]), "StoreMessage(1)")
+	assert.Equal(spool.ErrQuotaExceeded, s.StoreMessage(u, msgs[2]), "StoreMessage(2): reject")
+	msg, _, _, _, err := s.Get(u, 0)
+	require.NoError(err, "Get(): reject")
+	assert.Equal(msgs[0], msg, "Get(): head unchanged after reject")
+
+	q.Policy = spool.PolicyEvict
+	require.NoError(s.StoreMessage(u, msgs[2]), "StoreMessage(2): evict")
+	assert.Equal([]spool.EvictReason{spool.EvictMaxMessages}, evictions, "Eviction reasons")
+	msg, _, _, remaining, err := s.Get(u, 0)
+	require.NoError(err, "Get(): evict")
+	assert.Equal(msgs[1], msg, "Get(): oldest message evicted")
+	assert.Equal(1, remaining, "Get(): evict remaining")
+
+	// MaxBytes is enforced in terms of the message size.
+	evictions = nil
+	q.MaxMessages = 0
+	q.MaxBytes = len(msgs[0])
+	require.NoError(s.StoreMessage(u, msgs[0]), "StoreMessage(0): MaxBytes evict")
+	assert.Equal([]spool.EvictReason{spool.EvictMaxBytes, spool.EvictMaxBytes}, evictions, "Eviction reasons: MaxBytes")
+	count, size, err := s.Usage(u)
+	require.NoError(err, "Usage()")
+	assert.Equal(1, count, "Usage(): count")
+	assert.Equal(len(msgs[0]), size, "Usage(): size")
+
+	// Removing the quota disables enforcement.
+	s.SetQuota(nil)
+	require.NoError(s.StoreMessage(u, msgs[1]), "StoreMessage(): no quota")
+}
+
+func testAckEvicted(t *testing.T, s spool.Spool) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	u := []byte("alice")
+	msgs := [][]byte{newMessage(t), newMessage(t), newMessage(t)}
+	s.SetQuota(&spool.Quota{
+		MaxMessages: 2,
+		Policy:      spool.PolicyEvict,
+	})
+
+	require.NoError(s.StoreMessage(u, msgs[0]), "StoreMessage(0)")
+	require.NoError(s.StoreMessage(u, msgs[1]), "StoreMessage(1)")
+	msg, _, headID, _, err := s.Get(u, 0)
+	require.NoError(err, "Get(): head")
+	assert.Equal(msgs[0], msg, "Get(): head message")
+
+	// Evict the returned head, and store another message.
+	require.NoError(s.StoreMessage(u, msgs[2]), "StoreMessage(2): evict")
+
+	// Acknowledging the evicted head must not delete its successor unseen.
+	msg, _, _, remaining, err := s.Get(u, headID)
+	require.NoError(err, "Get(): acknowledge evicted")
+	assert.Equal(msgs[1], msg, "Get(): successor of evicted head")
+	assert.Equal(1, remaining, "Get(): acknowledge evicted remaining")
+	count, _, err := s.Usage(u)
+	require.NoError(err, "Usage()")
+	assert.Equal(2, count, "Usage(): count")
+}
+
+func testGetExpired(t *testing.T, s spool.Spool) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	u := []byte("alice")
+	require.NoError(s.StoreMessage(u, newMessage(t)), "StoreMessage()")
+
+	// Messages exceeding the maximum age are never returned, even before
+	// they are deleted.
+	s.SetQuota(&spool.Quota{
+		MaxAge: time.Nanosecond,
+	})
+	time.Sleep(time.Millisecond)
+	msg, _, msgID, remaining, err := s.Get(u, 0)
+	require.NoError(err, "Get(): expired")
+	assert.Nil(msg, "Get(): expired message")
+	assert.Zero(msgID, "Get(): expired ID")
+	assert.Equal(0, remaining, "Get(): expired remaining")
+}
+
+func testVacuum(t *testing.T, s spool.Spool) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	alice, bob := []byte("alice"), []byte("bob")
+	udb := memuserdb.New()
+	defer udb.Close()
+	privKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair()")
+	require.NoError(udb.Add(alice, privKey.PublicKey(), false), "Add(alice)")
+
+	msg := newMessage(t)
+	require.NoError(s.StoreMessage(alice, msg), "StoreMessage(alice)")
+	require.NoError(s.StoreMessage(bob, msg), "StoreMessage(bob)")
+
+	// Spools of non-existent users are removed.
+	require.NoError(s.Vacuum(udb), "Vacuum()")
+	count, _, err := s.Usage(alice)
+	require.NoError(err, "Usage(alice)")
+	assert.Equal(1, count, "Usage(alice): valid user retained")
+	count, _, err = s.Usage(bob)
+	require.NoError(err, "Usage(bob)")
+	assert.Equal(0, count, "Usage(bob): invalid user vacuumed")
+
+	// Messages exceeding the maximum age are expired.
+	var evictions []spool.EvictReason
+	s.SetQuota(&spool.Quota{
+		MaxAge: time.Nanosecond,
+		OnEvict: func(r spool.EvictReason) {
+			evictions = append(evictions, r)
+		},
+	})
+	time.Sleep(time.Millisecond)
+	require.NoError(s.Vacuum(udb), "Vacuum(): MaxAge")
+	count, _, err = s.Usage(alice)
+	require.NoError(err, "Usage(alice)")
+	assert.Equal(0, count, "Usage(alice): expired")
+	assert.Equal([]spool.EvictReason{spool.EvictMaxAge}, evictions, "Eviction reasons: MaxAge")
+}
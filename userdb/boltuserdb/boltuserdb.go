@@ -20,8 +20,10 @@ package boltuserdb
 
 import (
 	"crypto/subtle"
+	"encoding/binary"
 	"fmt"
 	"sync"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 	"github.com/katzenpost/core/crypto/ecdh"
@@ -31,8 +33,30 @@ import (
 const (
 	usersBucket      = "users"
 	identitiesBucket = "identities"
+	userInfoBucket   = "userinfo"
+	linkKeysBucket   = "linkkeys"
+
+	// dbVersion is the current database version.  Version 0 databases
+	// stored a single link key per user as the `users` bucket value, while
+	// version 1 databases store named link keys in a per-user bucket under
+	// the `linkkeys` bucket.
+	dbVersion = 1
+
+	// userInfoLength is the length of a serialized `userinfo` entry:
+	// CreatedAt (8 bytes), LastAuthenticated (8 bytes), flags (1 byte),
+	// followed iff flagRateLimit is set by the RateLimit SendRatePerMinute
+	// (8 bytes) and SendBurst (8 bytes).
+	userInfoLength          = 8 + 8 + 1
+	userInfoRateLimitLength = 8 + 8
+
+	flagDisabled  = 1 << 0
+	flagRateLimit = 1 << 1
 )
 
+// userMarker is the `users` bucket value, as the bucket serves only as the
+// index of existing users.
+var userMarker = []byte{1}
+
 type boltUserDB struct {
 	sync.RWMutex
 
@@ -59,17 +83,21 @@ func (d *boltUserDB) IsValid(u []byte, k *ecdh.PublicKey) bool {
 	}
 
 	// Query the database to see if the user is present, and if the public
-	// keys match.
+	// key matches any of the user's link keys.
 	isValid := false
 	if err := d.db.View(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket([]byte(usersBucket))
-
-		// If the user exists in the `users` bucket, then compare public keys.
-		rawPubKey := bkt.Get(u)
-		if rawPubKey != nil {
-			isValid = subtle.ConstantTimeCompare(rawPubKey, k.Bytes()) == 1
+		bkt := tx.Bucket([]byte(linkKeysBucket)).Bucket(u)
+		if bkt == nil {
+			return nil
 		}
-		return nil
+
+		kBytes := k.Bytes()
+		return bkt.ForEach(func(name, rawPubKey []byte) error {
+			if subtle.ConstantTimeCompare(rawPubKey, kBytes) == 1 {
+				isValid = true
+			}
+			return nil
+		})
 	}); err != nil {
 		return false
 	}
@@ -96,7 +124,23 @@ func (d *boltUserDB) Add(u []byte, k *ecdh.PublicKey, update bool) error {
 
 	err := d.db.Update(func(tx *bolt.Tx) error {
 		bkt := tx.Bucket([]byte(usersBucket))
-		return bkt.Put(u, k.Bytes())
+		if err := bkt.Put(u, userMarker); err != nil {
+			return err
+		}
+		lkBkt, err := tx.Bucket([]byte(linkKeysBucket)).CreateBucketIfNotExists(u)
+		if err != nil {
+			return err
+		}
+		if err = lkBkt.Put([]byte(userdb.DefaultLinkKeyName), k.Bytes()); err != nil {
+			return err
+		}
+
+		// Record the creation time for new users.
+		infoBkt := tx.Bucket([]byte(userInfoBucket))
+		if infoBkt.Get(u) != nil {
+			return nil
+		}
+		return infoBkt.Put(u, serializeUserInfo(&userdb.UserInfo{CreatedAt: time.Now()}))
 	})
 	if err == nil {
 		k := userToCacheKey(u)
@@ -134,13 +178,18 @@ func (d *boltUserDB) Link(u []byte) (*ecdh.PublicKey, error) {
 		return nil, fmt.Errorf("userdb: invalid username: `%v`", u)
 	}
 	if !d.Exists(u) {
-		return nil, fmt.Errorf("userdb: user does not exist")
+		return nil, userdb.ErrNoSuchUser
 	}
 
 	var pubKey *ecdh.PublicKey
 	err := d.db.View(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket([]byte(usersBucket))
-		rawPubKey := bkt.Get(u)
+		var rawPubKey []byte
+		if bkt := tx.Bucket([]byte(linkKeysBucket)).Bucket(u); bkt != nil {
+			// Fall back to the first key, if the default key was removed.
+			if rawPubKey = bkt.Get([]byte(userdb.DefaultLinkKeyName)); rawPubKey == nil {
+				_, rawPubKey = bkt.Cursor().First()
+			}
+		}
 		if rawPubKey == nil {
 			return fmt.Errorf("userdb: user %s does not have a link key", u)
 		}
@@ -150,6 +199,87 @@ func (d *boltUserDB) Link(u []byte) (*ecdh.PublicKey, error) {
 	return pubKey, err
 }
 
+func (d *boltUserDB) AddLinkKey(u []byte, name string, k *ecdh.PublicKey) error {
+	if !userOk(u) {
+		return fmt.Errorf("userdb: invalid username: `%v`", u)
+	}
+	if !userdb.IsValidLinkKeyName(name) {
+		return fmt.Errorf("userdb: invalid link key name: `%v`", name)
+	}
+	if k == nil {
+		return fmt.Errorf("userdb: must provide a public key")
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		if uEnt := tx.Bucket([]byte(usersBucket)).Get(u); uEnt == nil {
+			return userdb.ErrNoSuchUser
+		}
+
+		bkt, err := tx.Bucket([]byte(linkKeysBucket)).CreateBucketIfNotExists(u)
+		if err != nil {
+			return err
+		}
+		if bkt.Get([]byte(name)) != nil {
+			return userdb.ErrLinkKeyExists
+		}
+		return bkt.Put([]byte(name), k.Bytes())
+	})
+}
+
+func (d *boltUserDB) RemoveLinkKey(u []byte, name string) error {
+	if !userOk(u) {
+		return fmt.Errorf("userdb: invalid username: `%v`", u)
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		if uEnt := tx.Bucket([]byte(usersBucket)).Get(u); uEnt == nil {
+			return userdb.ErrNoSuchUser
+		}
+
+		bkt := tx.Bucket([]byte(linkKeysBucket)).Bucket(u)
+		if bkt == nil || bkt.Get([]byte(name)) == nil {
+			return userdb.ErrNoSuchLinkKey
+		}
+		cur := bkt.Cursor()
+		if first, _ := cur.First(); first != nil {
+			if next, _ := cur.Next(); next == nil {
+				return userdb.ErrLastLinkKey
+			}
+		}
+		return bkt.Delete([]byte(name))
+	})
+}
+
+func (d *boltUserDB) LinkKeys(u []byte) (map[string]*ecdh.PublicKey, error) {
+	if !userOk(u) {
+		return nil, fmt.Errorf("userdb: invalid username: `%v`", u)
+	}
+
+	keys := make(map[string]*ecdh.PublicKey)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		if uEnt := tx.Bucket([]byte(usersBucket)).Get(u); uEnt == nil {
+			return userdb.ErrNoSuchUser
+		}
+
+		bkt := tx.Bucket([]byte(linkKeysBucket)).Bucket(u)
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(func(name, rawPubKey []byte) error {
+			pubKey := new(ecdh.PublicKey)
+			if err := pubKey.FromBytes(rawPubKey); err != nil {
+				return err
+			}
+			keys[string(name)] = pubKey
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
 func (d *boltUserDB) Identity(u []byte) (*ecdh.PublicKey, error) {
 	if !userOk(u) {
 		return nil, fmt.Errorf("userdb: invalid username: `%v`", u)
@@ -187,6 +317,12 @@ func (d *boltUserDB) Remove(u []byte) error {
 		if ent := bkt.Get(u); ent == nil {
 			return userdb.ErrNoSuchUser
 		}
+		if err := tx.Bucket([]byte(userInfoBucket)).Delete(u); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(linkKeysBucket)).DeleteBucket(u); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
 		return bkt.Delete(u)
 	})
 	if err == nil {
@@ -200,6 +336,100 @@ func (d *boltUserDB) Remove(u []byte) error {
 	return err
 }
 
+func (d *boltUserDB) ForEach(fn func([]byte, *userdb.UserInfo) error) error {
+	type userEnt struct {
+		u    []byte
+		info *userdb.UserInfo
+	}
+
+	// Snapshot the users first, so that fn is not called with a
+	// transaction held open.
+	var users []userEnt
+	if err := d.db.View(func(tx *bolt.Tx) error {
+		infoBkt := tx.Bucket([]byte(userInfoBucket))
+		return tx.Bucket([]byte(usersBucket)).ForEach(func(k, v []byte) error {
+			info, err := deserializeUserInfo(infoBkt.Get(k))
+			if err != nil {
+				return err
+			}
+			users = append(users, userEnt{append([]byte{}, k...), info})
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	for _, ent := range users {
+		if err := fn(ent.u, ent.info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *boltUserDB) Count() (int, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	return len(d.userCache), nil
+}
+
+func (d *boltUserDB) Info(u []byte) (*userdb.UserInfo, error) {
+	if !userOk(u) {
+		return nil, fmt.Errorf("userdb: invalid username: `%v`", u)
+	}
+
+	var info *userdb.UserInfo
+	err := d.db.View(func(tx *bolt.Tx) error {
+		if uEnt := tx.Bucket([]byte(usersBucket)).Get(u); uEnt == nil {
+			return userdb.ErrNoSuchUser
+		}
+
+		var err error
+		info, err = deserializeUserInfo(tx.Bucket([]byte(userInfoBucket)).Get(u))
+		return err
+	})
+	return info, err
+}
+
+func (d *boltUserDB) SetDisabled(u []byte, disabled bool) error {
+	return d.updateInfo(u, func(info *userdb.UserInfo) {
+		info.Disabled = disabled
+	})
+}
+
+func (d *boltUserDB) SetLastAuthenticated(u []byte, t time.Time) error {
+	return d.updateInfo(u, func(info *userdb.UserInfo) {
+		info.LastAuthenticated = t
+	})
+}
+
+func (d *boltUserDB) SetRateLimit(u []byte, rl *userdb.RateLimit) error {
+	return d.updateInfo(u, func(info *userdb.UserInfo) {
+		info.RateLimit = rl
+	})
+}
+
+func (d *boltUserDB) updateInfo(u []byte, fn func(*userdb.UserInfo)) error {
+	if !userOk(u) {
+		return fmt.Errorf("userdb: invalid username: `%v`", u)
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		if uEnt := tx.Bucket([]byte(usersBucket)).Get(u); uEnt == nil {
+			return userdb.ErrNoSuchUser
+		}
+
+		infoBkt := tx.Bucket([]byte(userInfoBucket))
+		info, err := deserializeUserInfo(infoBkt.Get(u))
+		if err != nil {
+			return err
+		}
+		fn(info)
+		return infoBkt.Put(u, serializeUserInfo(info))
+	})
+}
+
 func (d *boltUserDB) Close() {
 	d.db.Sync()
 	d.db.Close()
@@ -234,12 +464,27 @@ func New(f string) (userdb.UserDB, error) {
 		if _, err = tx.CreateBucketIfNotExists([]byte(identitiesBucket)); err != nil {
 			return err
 		}
+		if _, err = tx.CreateBucketIfNotExists([]byte(userInfoBucket)); err != nil {
+			return err
+		}
+		lkBkt, err := tx.CreateBucketIfNotExists([]byte(linkKeysBucket))
+		if err != nil {
+			return err
+		}
 
 		if b := bkt.Get([]byte(versionKey)); b != nil {
 			// Well it looks like we loaded as opposed to created.
-			if len(b) != 1 || b[0] != 0 {
+			if len(b) != 1 || b[0] > dbVersion {
 				return fmt.Errorf("userdb: incompatible version: %d", uint(b[0]))
 			}
+			if b[0] == 0 {
+				if err = migrateV0(uBkt, lkBkt); err != nil {
+					return err
+				}
+				if err = bkt.Put([]byte(versionKey), []byte{dbVersion}); err != nil {
+					return err
+				}
+			}
 
 			// Populate the user cache.
 			uBkt.ForEach(func(k, v []byte) error {
@@ -252,7 +497,7 @@ func New(f string) (userdb.UserDB, error) {
 		}
 
 		// We created a new database, so populate the new `metadata` bucket.
-		bkt.Put([]byte(versionKey), []byte{0})
+		bkt.Put([]byte(versionKey), []byte{dbVersion})
 
 		return nil
 	}); err != nil {
@@ -264,6 +509,92 @@ func New(f string) (userdb.UserDB, error) {
 	return d, nil
 }
 
+// migrateV0 migrates each user's link key from the `users` bucket to the
+// user's default named link key.
+func migrateV0(uBkt, lkBkt *bolt.Bucket) error {
+	legacyKeys := make(map[string][]byte)
+	if err := uBkt.ForEach(func(k, v []byte) error {
+		legacyKeys[string(k)] = append([]byte{}, v...)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for u, rawPubKey := range legacyKeys {
+		bkt, err := lkBkt.CreateBucketIfNotExists([]byte(u))
+		if err != nil {
+			return err
+		}
+		if err = bkt.Put([]byte(userdb.DefaultLinkKeyName), rawPubKey); err != nil {
+			return err
+		}
+		if err = uBkt.Put([]byte(u), userMarker); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func serializeUserInfo(info *userdb.UserInfo) []byte {
+	var b [userInfoLength + userInfoRateLimitLength]byte
+	binary.BigEndian.PutUint64(b[0:8], timeToUint64(info.CreatedAt))
+	binary.BigEndian.PutUint64(b[8:16], timeToUint64(info.LastAuthenticated))
+	if info.Disabled {
+		b[16] |= flagDisabled
+	}
+	if rl := info.RateLimit; rl != nil {
+		b[16] |= flagRateLimit
+		binary.BigEndian.PutUint64(b[17:25], rl.SendRatePerMinute)
+		binary.BigEndian.PutUint64(b[25:33], rl.SendBurst)
+		return b[:]
+	}
+	return b[:userInfoLength]
+}
+
+func deserializeUserInfo(b []byte) (*userdb.UserInfo, error) {
+	info := new(userdb.UserInfo)
+	if b == nil {
+		// Users added before metadata was tracked have no entry.
+		return info, nil
+	}
+	if len(b) < userInfoLength {
+		return nil, fmt.Errorf("userdb: malformed user info entry")
+	}
+	info.CreatedAt = uint64ToTime(binary.BigEndian.Uint64(b[0:8]))
+	info.LastAuthenticated = uint64ToTime(binary.BigEndian.Uint64(b[8:16]))
+	info.Disabled = b[16]&flagDisabled != 0
+
+	hasRateLimit := b[16]&flagRateLimit != 0
+	expectedLen := userInfoLength
+	if hasRateLimit {
+		expectedLen += userInfoRateLimitLength
+	}
+	if len(b) != expectedLen {
+		return nil, fmt.Errorf("userdb: malformed user info entry")
+	}
+	if hasRateLimit {
+		info.RateLimit = &userdb.RateLimit{
+			SendRatePerMinute: binary.BigEndian.Uint64(b[17:25]),
+			SendBurst:         binary.BigEndian.Uint64(b[25:33]),
+		}
+	}
+	return info, nil
+}
+
+func timeToUint64(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.Unix())
+}
+
+func uint64ToTime(v uint64) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(v), 0)
+}
+
 func userToCacheKey(u []byte) [userdb.MaxUsernameSize]byte {
 	var k [userdb.MaxUsernameSize]byte
 	copy(k[:], u)
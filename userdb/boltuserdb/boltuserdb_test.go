@@ -18,12 +18,16 @@ package boltuserdb
 
 import (
 	"crypto/rand"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/server/userdb"
+	"github.com/katzenpost/server/userdb/userdbtest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -87,6 +91,72 @@ func doTestLoad(t *testing.T) {
 
 	err = d.Add([]byte("alice"), testUsers["alice"], false)
 	assert.Error(err, "Add('alice', k, false)")
+
+	n, err := d.Count()
+	require.NoError(err, "Count()")
+	assert.Equal(len(testUsers), n, "Count()")
+	users, err := userdb.List(d)
+	require.NoError(err, "List()")
+	assert.Len(users, len(testUsers), "List()")
+	for _, u := range users {
+		assert.Contains(testUsers, string(u), "List(): unexpected user")
+	}
+
+	info, err := d.Info([]byte("alice"))
+	require.NoError(err, "Info('alice')")
+	assert.False(info.CreatedAt.IsZero(), "Info('alice'): CreatedAt")
+	assert.True(info.LastAuthenticated.IsZero(), "Info('alice'): LastAuthenticated")
+	assert.False(info.Disabled, "Info('alice'): Disabled")
+	_, err = d.Info([]byte("malory"))
+	assert.Equal(userdb.ErrNoSuchUser, err, "Info('malory')")
+
+	now := time.Unix(time.Now().Unix(), 0)
+	require.NoError(d.SetLastAuthenticated([]byte("alice"), now), "SetLastAuthenticated('alice')")
+	require.NoError(d.SetDisabled([]byte("alice"), true), "SetDisabled('alice', true)")
+	info, err = d.Info([]byte("alice"))
+	require.NoError(err, "Info('alice')")
+	assert.True(now.Equal(info.LastAuthenticated), "Info('alice'): LastAuthenticated")
+	assert.True(info.Disabled, "Info('alice'): Disabled")
+	assert.Equal(userdb.ErrNoSuchUser, d.SetDisabled([]byte("malory"), true), "SetDisabled('malory', true)")
+
+	// Named link keys.
+	alice := []byte("alice")
+	privKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair()")
+	laptopKey := privKey.PublicKey()
+	require.NoError(d.AddLinkKey(alice, "laptop", laptopKey), "AddLinkKey('alice', 'laptop')")
+	assert.Equal(userdb.ErrLinkKeyExists, d.AddLinkKey(alice, "laptop", laptopKey), "AddLinkKey('alice', 'laptop'), duplicate")
+	assert.Equal(userdb.ErrNoSuchUser, d.AddLinkKey([]byte("malory"), "laptop", laptopKey), "AddLinkKey('malory', 'laptop')")
+	assert.True(d.IsValid(alice, laptopKey), "IsValid('alice', laptopKey)")
+	assert.True(d.IsValid(alice, testUsers["alice"]), "IsValid('alice', k)")
+	assert.False(d.IsValid([]byte("bob"), laptopKey), "IsValid('bob', laptopKey)")
+
+	keys, err := d.LinkKeys(alice)
+	require.NoError(err, "LinkKeys('alice')")
+	assert.Len(keys, 2, "LinkKeys('alice')")
+	assert.True(keys["laptop"].Equal(laptopKey), "LinkKeys('alice'): laptop")
+
+	require.NoError(d.RemoveLinkKey(alice, userdb.DefaultLinkKeyName), "RemoveLinkKey('alice', default)")
+	assert.False(d.IsValid(alice, testUsers["alice"]), "IsValid('alice', k), revoked")
+	k, err := d.Link(alice)
+	require.NoError(err, "Link('alice'), default revoked")
+	assert.True(k.Equal(laptopKey), "Link('alice'), default revoked")
+	assert.Equal(userdb.ErrNoSuchLinkKey, d.RemoveLinkKey(alice, "phone"), "RemoveLinkKey('alice', 'phone')")
+	assert.Equal(userdb.ErrLastLinkKey, d.RemoveLinkKey(alice, "laptop"), "RemoveLinkKey('alice', 'laptop')")
+}
+
+func TestBoltUserDBConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltuserdb_conformance_tests")
+	require.NoError(t, err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	n := 0
+	userdbtest.Run(t, func(t *testing.T) userdb.UserDB {
+		n++
+		d, err := New(filepath.Join(dir, fmt.Sprintf("userdb-%d.db", n)))
+		require.NoError(t, err, "New()")
+		return d
+	})
 }
 
 func init() {
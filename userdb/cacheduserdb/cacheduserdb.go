@@ -0,0 +1,317 @@
+// cacheduserdb.go - Caching Katzenpost server user database decorator.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package cacheduserdb implements a caching decorator for any Katzenpost
+// server user database.
+//
+// The results of Exists, IsValid, and Info are cached, as they are queried on
+// every client reauthentication and packet delivery.  Mutations made through the
+// decorator invalidate the affected user's entries, but changes made to the
+// underlying database by other means will only be visible once the cached
+// entries expire.
+package cacheduserdb
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/server/userdb"
+)
+
+const (
+	// DefaultMaxEntries is the default maximum number of cache entries.
+	DefaultMaxEntries = 10000
+
+	// DefaultPositiveTTL is the default lifetime of a positive result.
+	DefaultPositiveTTL = 60 * time.Second
+
+	// DefaultNegativeTTL is the default lifetime of a negative result.
+	DefaultNegativeTTL = 5 * time.Second
+
+	// OpExists is the operation name passed to OnLookup for Exists.
+	OpExists = "exists"
+
+	// OpIsValid is the operation name passed to OnLookup for IsValid.
+	OpIsValid = "isvalid"
+
+	// OpInfo is the operation name passed to OnLookup for Info.
+	OpInfo = "info"
+)
+
+// Config is the cache configuration.
+type Config struct {
+	// MaxEntries is the maximum number of cached results.  If left zero,
+	// DefaultMaxEntries will be used.
+	MaxEntries int
+
+	// PositiveTTL is the lifetime of a cached positive result.  If left
+	// zero, DefaultPositiveTTL will be used.
+	PositiveTTL time.Duration
+
+	// NegativeTTL is the lifetime of a cached negative result.  If left
+	// zero, DefaultNegativeTTL will be used.
+	NegativeTTL time.Duration
+
+	// OnLookup, if set, is called for every cacheable lookup with the
+	// operation name, and if the result was served from the cache.
+	OnLookup func(op string, hit bool)
+}
+
+type entry struct {
+	key    string
+	user   string
+	value  interface{}
+	expiry time.Time
+}
+
+type cachedUserDB struct {
+	sync.Mutex
+
+	db  userdb.UserDB
+	cfg Config
+	now func() time.Time
+
+	entries map[string]*list.Element
+	lru     *list.List
+
+	// generation is incremented on every invalidation, so that results
+	// queried from the backing database concurrently with a mutation are
+	// not cached.
+	generation uint64
+}
+
+func (d *cachedUserDB) lookup(op, key string) (value interface{}, ok bool, gen uint64) {
+	d.Lock()
+	defer func() {
+		d.Unlock()
+		if d.cfg.OnLookup != nil {
+			d.cfg.OnLookup(op, ok)
+		}
+	}()
+
+	gen = d.generation
+	elem, ok := d.entries[key]
+	if !ok {
+		return nil, false, gen
+	}
+	ent := elem.Value.(*entry)
+	if d.now().After(ent.expiry) {
+		d.lru.Remove(elem)
+		delete(d.entries, key)
+		return nil, false, gen
+	}
+	d.lru.MoveToFront(elem)
+	return ent.value, true, gen
+}
+
+func (d *cachedUserDB) insert(gen uint64, key, user string, value interface{}, positive bool) {
+	ttl := d.cfg.NegativeTTL
+	if positive {
+		ttl = d.cfg.PositiveTTL
+	}
+	ent := &entry{
+		key:    key,
+		user:   user,
+		value:  value,
+		expiry: d.now().Add(ttl),
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if gen != d.generation {
+		return
+	}
+	if elem, ok := d.entries[key]; ok {
+		elem.Value = ent
+		d.lru.MoveToFront(elem)
+		return
+	}
+	d.entries[key] = d.lru.PushFront(ent)
+	for d.lru.Len() > d.cfg.MaxEntries {
+		oldest := d.lru.Back()
+		d.lru.Remove(oldest)
+		delete(d.entries, oldest.Value.(*entry).key)
+	}
+}
+
+func (d *cachedUserDB) invalidate(u []byte) {
+	user := string(u)
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.generation++
+
+	// Note: This is a linear scan, but mutations are infrequent relative
+	// to lookups, and the cache is bounded.
+	for elem := d.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if ent := elem.Value.(*entry); ent.user == user {
+			d.lru.Remove(elem)
+			delete(d.entries, ent.key)
+		}
+		elem = next
+	}
+}
+
+func existsKey(u []byte) string {
+	return "e:" + string(u)
+}
+
+func isValidKey(u []byte, k *ecdh.PublicKey) string {
+	return "v:" + string(k.Bytes()) + string(u)
+}
+
+func infoKey(u []byte) string {
+	return "i:" + string(u)
+}
+
+func (d *cachedUserDB) Exists(u []byte) bool {
+	key := existsKey(u)
+	cv, ok, gen := d.lookup(OpExists, key)
+	if ok {
+		return cv.(bool)
+	}
+
+	v := d.db.Exists(u)
+	d.insert(gen, key, string(u), v, v)
+	return v
+}
+
+func (d *cachedUserDB) IsValid(u []byte, k *ecdh.PublicKey) bool {
+	if k == nil {
+		return d.db.IsValid(u, k)
+	}
+
+	key := isValidKey(u, k)
+	cv, ok, gen := d.lookup(OpIsValid, key)
+	if ok {
+		return cv.(bool)
+	}
+
+	v := d.db.IsValid(u, k)
+	d.insert(gen, key, string(u), v, v)
+	return v
+}
+
+func (d *cachedUserDB) Link(u []byte) (*ecdh.PublicKey, error) {
+	return d.db.Link(u)
+}
+
+func (d *cachedUserDB) Add(u []byte, k *ecdh.PublicKey, update bool) error {
+	defer d.invalidate(u)
+	return d.db.Add(u, k, update)
+}
+
+func (d *cachedUserDB) AddLinkKey(u []byte, name string, k *ecdh.PublicKey) error {
+	defer d.invalidate(u)
+	return d.db.AddLinkKey(u, name, k)
+}
+
+func (d *cachedUserDB) RemoveLinkKey(u []byte, name string) error {
+	defer d.invalidate(u)
+	return d.db.RemoveLinkKey(u, name)
+}
+
+func (d *cachedUserDB) LinkKeys(u []byte) (map[string]*ecdh.PublicKey, error) {
+	return d.db.LinkKeys(u)
+}
+
+func (d *cachedUserDB) SetIdentity(u []byte, k *ecdh.PublicKey) error {
+	defer d.invalidate(u)
+	return d.db.SetIdentity(u, k)
+}
+
+func (d *cachedUserDB) Identity(u []byte) (*ecdh.PublicKey, error) {
+	return d.db.Identity(u)
+}
+
+func (d *cachedUserDB) Remove(u []byte) error {
+	defer d.invalidate(u)
+	return d.db.Remove(u)
+}
+
+func (d *cachedUserDB) ForEach(fn func([]byte, *userdb.UserInfo) error) error {
+	return d.db.ForEach(fn)
+}
+
+func (d *cachedUserDB) Count() (int, error) {
+	return d.db.Count()
+}
+
+func (d *cachedUserDB) Info(u []byte) (*userdb.UserInfo, error) {
+	key := infoKey(u)
+	cv, ok, gen := d.lookup(OpInfo, key)
+	if ok {
+		info := *cv.(*userdb.UserInfo)
+		return &info, nil
+	}
+
+	// Errors are not cached, as they may be transient.
+	info, err := d.db.Info(u)
+	if err != nil {
+		return nil, err
+	}
+	cInfo := *info
+	d.insert(gen, key, string(u), &cInfo, true)
+	return info, nil
+}
+
+func (d *cachedUserDB) SetDisabled(u []byte, disabled bool) error {
+	defer d.invalidate(u)
+	return d.db.SetDisabled(u, disabled)
+}
+
+func (d *cachedUserDB) SetLastAuthenticated(u []byte, t time.Time) error {
+	defer d.invalidate(u)
+	return d.db.SetLastAuthenticated(u, t)
+}
+
+func (d *cachedUserDB) SetRateLimit(u []byte, rl *userdb.RateLimit) error {
+	defer d.invalidate(u)
+	return d.db.SetRateLimit(u, rl)
+}
+
+func (d *cachedUserDB) Close() {
+	d.db.Close()
+}
+
+// New wraps the provided UserDB with a cache.  The returned UserDB takes
+// ownership of db, and will close it when closed.
+func New(db userdb.UserDB, cfg *Config) userdb.UserDB {
+	d := &cachedUserDB{
+		db:      db,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	if cfg != nil {
+		d.cfg = *cfg
+	}
+	if d.cfg.MaxEntries <= 0 {
+		d.cfg.MaxEntries = DefaultMaxEntries
+	}
+	if d.cfg.PositiveTTL <= 0 {
+		d.cfg.PositiveTTL = DefaultPositiveTTL
+	}
+	if d.cfg.NegativeTTL <= 0 {
+		d.cfg.NegativeTTL = DefaultNegativeTTL
+	}
+	return d
+}
@@ -0,0 +1,206 @@
+// cacheduserdb_test.go - Caching Katzenpost server user database tests.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cacheduserdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/server/userdb"
+	"github.com/katzenpost/server/userdb/memuserdb"
+	"github.com/katzenpost/server/userdb/userdbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingUserDB struct {
+	users    map[string]*ecdh.PublicKey
+	disabled map[string]bool
+
+	nrExists  int
+	nrIsValid int
+	nrInfo    int
+}
+
+func (d *countingUserDB) Exists(u []byte) bool {
+	d.nrExists++
+	_, ok := d.users[string(u)]
+	return ok
+}
+
+func (d *countingUserDB) IsValid(u []byte, k *ecdh.PublicKey) bool {
+	d.nrIsValid++
+	uk, ok := d.users[string(u)]
+	return ok && uk.Equal(k)
+}
+
+func (d *countingUserDB) Link(u []byte) (*ecdh.PublicKey, error) {
+	if k, ok := d.users[string(u)]; ok {
+		return k, nil
+	}
+	return nil, userdb.ErrNoSuchUser
+}
+
+func (d *countingUserDB) Add(u []byte, k *ecdh.PublicKey, update bool) error {
+	d.users[string(u)] = k
+	return nil
+}
+
+func (d *countingUserDB) AddLinkKey(u []byte, name string, k *ecdh.PublicKey) error {
+	return nil
+}
+
+func (d *countingUserDB) RemoveLinkKey(u []byte, name string) error {
+	return nil
+}
+
+func (d *countingUserDB) LinkKeys(u []byte) (map[string]*ecdh.PublicKey, error) {
+	if k, ok := d.users[string(u)]; ok {
+		return map[string]*ecdh.PublicKey{userdb.DefaultLinkKeyName: k}, nil
+	}
+	return nil, userdb.ErrNoSuchUser
+}
+
+func (d *countingUserDB) SetIdentity(u []byte, k *ecdh.PublicKey) error {
+	return nil
+}
+
+func (d *countingUserDB) Identity(u []byte) (*ecdh.PublicKey, error) {
+	return nil, userdb.ErrNoIdentity
+}
+
+func (d *countingUserDB) Remove(u []byte) error {
+	delete(d.users, string(u))
+	return nil
+}
+
+func (d *countingUserDB) ForEach(fn func([]byte, *userdb.UserInfo) error) error {
+	for u := range d.users {
+		if err := fn([]byte(u), &userdb.UserInfo{Disabled: d.disabled[u]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *countingUserDB) Count() (int, error) {
+	return len(d.users), nil
+}
+
+func (d *countingUserDB) Info(u []byte) (*userdb.UserInfo, error) {
+	d.nrInfo++
+	if _, ok := d.users[string(u)]; !ok {
+		return nil, userdb.ErrNoSuchUser
+	}
+	return &userdb.UserInfo{Disabled: d.disabled[string(u)]}, nil
+}
+
+func (d *countingUserDB) SetDisabled(u []byte, disabled bool) error {
+	if _, ok := d.users[string(u)]; !ok {
+		return userdb.ErrNoSuchUser
+	}
+	d.disabled[string(u)] = disabled
+	return nil
+}
+
+func (d *countingUserDB) SetLastAuthenticated(u []byte, t time.Time) error {
+	return nil
+}
+
+func (d *countingUserDB) SetRateLimit(u []byte, rl *userdb.RateLimit) error {
+	return nil
+}
+
+func (d *countingUserDB) Close() {}
+
+func TestConformance(t *testing.T) {
+	userdbtest.Run(t, func(t *testing.T) userdb.UserDB {
+		return New(memuserdb.New(), nil)
+	})
+}
+
+func TestCachedUserDB(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	backing := &countingUserDB{
+		users:    make(map[string]*ecdh.PublicKey),
+		disabled: make(map[string]bool),
+	}
+	hits, misses := 0, 0
+	cfg := &Config{
+		MaxEntries:  2,
+		PositiveTTL: time.Minute,
+		NegativeTTL: time.Second,
+		OnLookup: func(op string, hit bool) {
+			if hit {
+				hits++
+			} else {
+				misses++
+			}
+		},
+	}
+	db := New(backing, cfg)
+	d := db.(*cachedUserDB)
+	now := time.Now()
+	d.now = func() time.Time { return now }
+
+	privKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair()")
+	k := privKey.PublicKey()
+	alice, bob, carol := []byte("alice"), []byte("bob"), []byte("carol")
+
+	// Negative results are cached, and expire after the NegativeTTL.
+	assert.False(db.Exists(alice), "Exists(): not added")
+	assert.False(db.Exists(alice), "Exists(): not added, cached")
+	assert.Equal(1, backing.nrExists, "Negative result cached")
+	now = now.Add(2 * time.Second)
+	assert.False(db.Exists(alice), "Exists(): negative expired")
+	assert.Equal(2, backing.nrExists, "Negative result expired")
+
+	// Mutations invalidate the user's entries.
+	require.NoError(db.Add(alice, k, false), "Add()")
+	assert.True(db.Exists(alice), "Exists(): added")
+	assert.True(db.IsValid(alice, k), "IsValid()")
+	assert.True(db.IsValid(alice, k), "IsValid(): cached")
+	assert.Equal(1, backing.nrIsValid, "Positive result cached")
+	info, err := db.Info(alice)
+	require.NoError(err, "Info()")
+	assert.False(info.Disabled, "Info(): Disabled")
+	require.NoError(db.SetDisabled(alice, true), "SetDisabled()")
+	info, err = db.Info(alice)
+	require.NoError(err, "Info(): after SetDisabled()")
+	assert.True(info.Disabled, "Info(): SetDisabled() invalidated")
+	info, err = db.Info(alice)
+	require.NoError(err, "Info(): cached")
+	assert.Equal(2, backing.nrInfo, "Info() cached")
+	require.NoError(db.Remove(alice), "Remove()")
+	assert.False(db.IsValid(alice, k), "IsValid(): removed")
+	assert.Equal(2, backing.nrIsValid, "Remove() invalidated")
+
+	// The cache is bounded, and evicts the least recently used entry.
+	db.Exists(bob)
+	db.Exists(carol)
+	assert.Len(d.entries, 2, "Cache bounded")
+	_, ok := d.entries[isValidKey(alice, k)]
+	assert.False(ok, "LRU entry evicted")
+
+	assert.Equal(3, hits, "Cache hits")
+	assert.Equal(9, misses, "Cache misses")
+}
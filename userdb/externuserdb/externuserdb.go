@@ -16,105 +16,471 @@
 
 // Package externuserdb implements the Katzenpost server user database with
 // http calls to a external authorization source (expected to run in localhost).
+//
+// The protocol is versioned, with each UserDB operation mapping to a JSON
+// encoded `POST` request to `<ProviderURL>/v1/<operation>`, where operation
+// is one of `exists`, `isvalid`, `link`, `add`, `setidentity`, `identity`,
+// `remove`, `list`, `count`, `info`, `setdisabled`, `setlastauth`,
+// `setratelimit`, `addlinkkey`, `removelinkkey`, and `linkkeys`.  Requests
+// and responses are encoded as the Request and Response types, with public
+// keys hex encoded.  Failures are signaled by a non-200 HTTP status code,
+// and a Response with the Error field set to one of the Err* error codes, or
+// a free form error message.
+//
+// The original unversioned protocol, with form encoded `isvalid`, `exists`
+// and `getidkey` requests, is still supported via Config.LegacyProtocol.
 package externuserdb
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
-	"net/url"
+	"strings"
+	"time"
 
-	"encoding/hex"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/server/userdb"
-	"github.com/ugorji/go/codec"
 )
 
-var (
-	errCantModify   = errors.New("Not implemented: External authentication is enabled, you can not modify users")
-	errNotSupported = errors.New("Not implemented: Support not implemented yet")
-	jsonHandle      = &codec.JsonHandle{}
+const (
+	// ProtocolVersion is the path component identifying the protocol
+	// version.
+	ProtocolVersion = "v1"
+
+	// DefaultTimeout is the default per-request timeout.
+	DefaultTimeout = 5 * time.Second
+
+	// ErrCodeNoSuchUser is the error code corresponding to
+	// userdb.ErrNoSuchUser.
+	ErrCodeNoSuchUser = "no_such_user"
+
+	// ErrCodeNoIdentity is the error code corresponding to
+	// userdb.ErrNoIdentity.
+	ErrCodeNoIdentity = "no_identity"
+
+	// ErrCodeNoSuchLinkKey is the error code corresponding to
+	// userdb.ErrNoSuchLinkKey.
+	ErrCodeNoSuchLinkKey = "no_such_link_key"
+
+	// ErrCodeLinkKeyExists is the error code corresponding to
+	// userdb.ErrLinkKeyExists.
+	ErrCodeLinkKeyExists = "link_key_exists"
+
+	// ErrCodeLastLinkKey is the error code corresponding to
+	// userdb.ErrLastLinkKey.
+	ErrCodeLastLinkKey = "last_link_key"
+
+	opExists      = "exists"
+	opIsValid     = "isvalid"
+	opLink        = "link"
+	opAdd         = "add"
+	opSetIdentity = "setidentity"
+	opIdentity    = "identity"
+	opRemove      = "remove"
+	opList        = "list"
+	opCount       = "count"
+	opInfo        = "info"
+	opSetDisabled = "setdisabled"
+	opSetLastAuth = "setlastauth"
+	opSetRateLim  = "setratelimit"
+	opAddLinkKey  = "addlinkkey"
+	opRemLinkKey  = "removelinkkey"
+	opLinkKeys    = "linkkeys"
+
+	maxResponseSize = 16 * 1024 * 1024
 )
 
+// Request is a UserDB operation request.
+type Request struct {
+	User     string `json:"user"`
+	Key      string `json:"key,omitempty"`
+	KeyName  string `json:"key_name,omitempty"`
+	Update   bool   `json:"update,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+	Time     int64  `json:"time,omitempty"`
+
+	// RateLimit is the rate limit override for `setratelimit`, with nil
+	// removing the override.
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+}
+
+// RateLimit is a user's send rate limit override.
+type RateLimit struct {
+	SendRatePerMinute uint64 `json:"send_rate_per_minute"`
+	SendBurst         uint64 `json:"send_burst"`
+}
+
+// UserInfo is a user's metadata, with times in seconds since the Unix epoch,
+// or 0 if unknown.
+type UserInfo struct {
+	User              string `json:"user,omitempty"`
+	CreatedAt         int64  `json:"created_at,omitempty"`
+	LastAuthenticated int64  `json:"last_authenticated,omitempty"`
+	Disabled          bool   `json:"disabled,omitempty"`
+
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+}
+
+// Response is a UserDB operation response.
+type Response struct {
+	Exists   bool              `json:"exists,omitempty"`
+	IsValid  bool              `json:"isvalid,omitempty"`
+	Key      string            `json:"key,omitempty"`
+	LinkKeys map[string]string `json:"link_keys,omitempty"`
+	Count    int               `json:"count,omitempty"`
+	Info     *UserInfo         `json:"info,omitempty"`
+	Users    []UserInfo        `json:"users,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// Config is the external user database configuration.
+type Config struct {
+	// ProviderURL is the base URL of the external authorization source.
+	ProviderURL string
+
+	// Timeout is the per-request timeout.  If left zero, DefaultTimeout
+	// will be used.
+	Timeout time.Duration
+
+	// BearerToken, if set, is sent as the `Authorization` header of each
+	// request.
+	BearerToken string
+
+	// TLSClientCertFile and TLSClientKeyFile, if set, are the certificate
+	// and private key used for TLS client authentication.
+	TLSClientCertFile string
+	TLSClientKeyFile  string
+
+	// TLSCACertFile, if set, is the CA certificate used to verify the
+	// server, instead of the system roots.
+	TLSCACertFile string
+
+	// LegacyProtocol, if set, selects the original unversioned protocol,
+	// which only supports querying users.
+	LegacyProtocol bool
+}
+
 type externAuth struct {
-	provider string
+	baseURL     string
+	bearerToken string
+	client      *http.Client
 }
 
-func (e *externAuth) doPost(endpoint string, data url.Values) bool {
-	uri := e.provider + "/" + endpoint
-	rsp, err := http.PostForm(uri, data)
+func (e *externAuth) do(op string, req *Request) (*Response, error) {
+	b, err := json.Marshal(req)
 	if err != nil {
-		return false
+		return nil, err
 	}
-	defer rsp.Body.Close()
 
-	response := map[string]bool{}
-	d := codec.NewDecoder(rsp.Body, jsonHandle)
-	if err = d.Decode(&response); err != nil {
-		return false
+	httpReq, err := http.NewRequest(http.MethodPost, e.baseURL+op, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if e.bearerToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+e.bearerToken)
 	}
 
-	return rsp.StatusCode == 200 && response[endpoint]
+	rsp, err := e.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	var resp Response
+	if err = json.NewDecoder(io.LimitReader(rsp.Body, maxResponseSize)).Decode(&resp); err != nil {
+		if rsp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("externuserdb: %v: HTTP status %v", op, rsp.StatusCode)
+		}
+		return nil, fmt.Errorf("externuserdb: %v: malformed response: %v", op, err)
+	}
+	if rsp.StatusCode != http.StatusOK || resp.Error != "" {
+		switch resp.Error {
+		case ErrCodeNoSuchUser:
+			return nil, userdb.ErrNoSuchUser
+		case ErrCodeNoIdentity:
+			return nil, userdb.ErrNoIdentity
+		case ErrCodeNoSuchLinkKey:
+			return nil, userdb.ErrNoSuchLinkKey
+		case ErrCodeLinkKeyExists:
+			return nil, userdb.ErrLinkKeyExists
+		case ErrCodeLastLinkKey:
+			return nil, userdb.ErrLastLinkKey
+		case "":
+			return nil, fmt.Errorf("externuserdb: %v: HTTP status %v", op, rsp.StatusCode)
+		default:
+			return nil, fmt.Errorf("externuserdb: %v: %v", op, resp.Error)
+		}
+	}
+	return &resp, nil
 }
 
 func (e *externAuth) IsValid(u []byte, k *ecdh.PublicKey) bool {
-	form := url.Values{"user": {string(u)}, "key": {k.String()}}
-	return e.doPost("isvalid", form)
+	resp, err := e.do(opIsValid, &Request{User: string(u), Key: keyToString(k)})
+	return err == nil && resp.IsValid
 }
 
 func (e *externAuth) Exists(u []byte) bool {
-	form := url.Values{"user": {string(u)}}
-	return e.doPost("exists", form)
+	resp, err := e.do(opExists, &Request{User: string(u)})
+	return err == nil && resp.Exists
 }
 
 func (e *externAuth) Add(u []byte, k *ecdh.PublicKey, update bool) error {
-	return errCantModify
+	if k == nil {
+		return errors.New("externuserdb: no link key provided")
+	}
+	_, err := e.do(opAdd, &Request{User: string(u), Key: keyToString(k), Update: update})
+	return err
 }
 
 func (e *externAuth) Link(u []byte) (*ecdh.PublicKey, error) {
-	return nil, errNotSupported
+	resp, err := e.do(opLink, &Request{User: string(u)})
+	if err != nil {
+		return nil, err
+	}
+	return keyFromString(resp.Key)
+}
+
+func (e *externAuth) AddLinkKey(u []byte, name string, k *ecdh.PublicKey) error {
+	if k == nil {
+		return errors.New("externuserdb: no link key provided")
+	}
+	_, err := e.do(opAddLinkKey, &Request{User: string(u), KeyName: name, Key: keyToString(k)})
+	return err
+}
+
+func (e *externAuth) RemoveLinkKey(u []byte, name string) error {
+	_, err := e.do(opRemLinkKey, &Request{User: string(u), KeyName: name})
+	return err
+}
+
+func (e *externAuth) LinkKeys(u []byte) (map[string]*ecdh.PublicKey, error) {
+	resp, err := e.do(opLinkKeys, &Request{User: string(u)})
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*ecdh.PublicKey)
+	for name, v := range resp.LinkKeys {
+		if keys[name], err = keyFromString(v); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
 }
 
 func (e *externAuth) SetIdentity(u []byte, k *ecdh.PublicKey) error {
-	return errNotSupported
+	_, err := e.do(opSetIdentity, &Request{User: string(u), Key: keyToString(k)})
+	return err
 }
 
 func (e *externAuth) Identity(u []byte) (*ecdh.PublicKey, error) {
-	endpoint := "getidkey"
-	uri := e.provider + "/" + endpoint
-	form := url.Values{"user": {string(u)}}
-	rsp, err := http.PostForm(uri, form)
+	resp, err := e.do(opIdentity, &Request{User: string(u)})
 	if err != nil {
 		return nil, err
 	}
-	defer rsp.Body.Close()
+	if resp.Key == "" {
+		return nil, userdb.ErrNoIdentity
+	}
+	return keyFromString(resp.Key)
+}
 
-	if rsp.StatusCode == 200 {
-		response := map[string]string{}
-		d := codec.NewDecoder(rsp.Body, jsonHandle)
-		if err = d.Decode(&response); err != nil {
-			return nil, err
-		}
+func (e *externAuth) Remove(u []byte) error {
+	_, err := e.do(opRemove, &Request{User: string(u)})
+	return err
+}
 
-		if pkhex, ok := response[endpoint]; ok {
-			if decoded, err := hex.DecodeString(pkhex); err == nil {
-				pk := new(ecdh.PublicKey)
-				if err := pk.FromBytes(decoded); err == nil {
-					return pk, nil
-				}
-			}
+func (e *externAuth) ForEach(fn func([]byte, *userdb.UserInfo) error) error {
+	resp, err := e.do(opList, &Request{})
+	if err != nil {
+		return err
+	}
+	for i := range resp.Users {
+		if err = fn([]byte(resp.Users[i].User), fromWireInfo(&resp.Users[i])); err != nil {
+			return err
 		}
 	}
-	return nil, userdb.ErrNoIdentity
+	return nil
 }
 
-func (e *externAuth) Remove(u []byte) error {
-	return errCantModify
+func (e *externAuth) Count() (int, error) {
+	resp, err := e.do(opCount, &Request{})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Count, nil
+}
+
+func (e *externAuth) Info(u []byte) (*userdb.UserInfo, error) {
+	resp, err := e.do(opInfo, &Request{User: string(u)})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Info == nil {
+		return nil, fmt.Errorf("externuserdb: %v: malformed response: no info", opInfo)
+	}
+	return fromWireInfo(resp.Info), nil
+}
+
+func (e *externAuth) SetDisabled(u []byte, disabled bool) error {
+	_, err := e.do(opSetDisabled, &Request{User: string(u), Disabled: disabled})
+	return err
+}
+
+func (e *externAuth) SetLastAuthenticated(u []byte, t time.Time) error {
+	_, err := e.do(opSetLastAuth, &Request{User: string(u), Time: timeToUnix(t)})
+	return err
+}
+
+func (e *externAuth) SetRateLimit(u []byte, rl *userdb.RateLimit) error {
+	_, err := e.do(opSetRateLim, &Request{User: string(u), RateLimit: toWireRateLimit(rl)})
+	return err
 }
 
 func (e *externAuth) Close() {
+	e.client.CloseIdleConnections()
 }
 
-// New creates an external user database with the given provider
-func New(provider string) (userdb.UserDB, error) {
-	return &externAuth{provider}, nil
+func keyToString(k *ecdh.PublicKey) string {
+	if k == nil {
+		return ""
+	}
+	return hex.EncodeToString(k.Bytes())
+}
+
+func keyFromString(s string) (*ecdh.PublicKey, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("externuserdb: malformed key: %v", err)
+	}
+	k := new(ecdh.PublicKey)
+	if err = k.FromBytes(b); err != nil {
+		return nil, fmt.Errorf("externuserdb: malformed key: %v", err)
+	}
+	return k, nil
+}
+
+func toWireInfo(u []byte, info *userdb.UserInfo) *UserInfo {
+	return &UserInfo{
+		User:              string(u),
+		CreatedAt:         timeToUnix(info.CreatedAt),
+		LastAuthenticated: timeToUnix(info.LastAuthenticated),
+		Disabled:          info.Disabled,
+		RateLimit:         toWireRateLimit(info.RateLimit),
+	}
+}
+
+func fromWireInfo(info *UserInfo) *userdb.UserInfo {
+	return &userdb.UserInfo{
+		CreatedAt:         unixToTime(info.CreatedAt),
+		LastAuthenticated: unixToTime(info.LastAuthenticated),
+		Disabled:          info.Disabled,
+		RateLimit:         fromWireRateLimit(info.RateLimit),
+	}
+}
+
+func toWireRateLimit(rl *userdb.RateLimit) *RateLimit {
+	if rl == nil {
+		return nil
+	}
+	return &RateLimit{
+		SendRatePerMinute: rl.SendRatePerMinute,
+		SendBurst:         rl.SendBurst,
+	}
+}
+
+func fromWireRateLimit(rl *RateLimit) *userdb.RateLimit {
+	if rl == nil {
+		return nil
+	}
+	return &userdb.RateLimit{
+		SendRatePerMinute: rl.SendRatePerMinute,
+		SendBurst:         rl.SendBurst,
+	}
+}
+
+func timeToUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func unixToTime(v int64) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(v, 0)
+}
+
+func newTLSConfig(cfg *Config) (*tls.Config, error) {
+	if cfg.TLSClientCertFile == "" && cfg.TLSCACertFile == "" {
+		return nil, nil
+	}
+
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.TLSClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSClientCertFile, cfg.TLSClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("externuserdb: failed to load client certificate: %v", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.TLSCACertFile != "" {
+		b, err := ioutil.ReadFile(cfg.TLSCACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("externuserdb: failed to load CA certificate: %v", err)
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errors.New("externuserdb: no certificates found in CA certificate file")
+		}
+	}
+	return tlsCfg, nil
+}
+
+// New creates an external user database with the given configuration.
+func New(cfg *Config) (userdb.UserDB, error) {
+	if cfg.ProviderURL == "" {
+		return nil, errors.New("externuserdb: no ProviderURL specified")
+	}
+
+	tlsCfg, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}
+	baseURL := strings.TrimSuffix(cfg.ProviderURL, "/") + "/"
+	if cfg.LegacyProtocol {
+		e := &legacyAuth{
+			baseURL:     baseURL,
+			bearerToken: cfg.BearerToken,
+			client:      client,
+		}
+		return e, nil
+	}
+
+	e := &externAuth{
+		baseURL:     baseURL + ProtocolVersion + "/",
+		bearerToken: cfg.BearerToken,
+		client:      client,
+	}
+	return e, nil
 }
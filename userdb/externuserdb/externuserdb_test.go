@@ -20,18 +20,30 @@
 package externuserdb
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/server/userdb"
+	"github.com/katzenpost/server/userdb/boltuserdb"
+	"github.com/katzenpost/server/userdb/memuserdb"
+	"github.com/katzenpost/server/userdb/userdbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestExists(t *testing.T) {
 	ts := httpMock("{\"exists\": true}")
 	defer ts.Close()
 
-	e, _ := New(ts.URL)
+	e, _ := New(&Config{ProviderURL: ts.URL})
 
 	u := []byte("testuser")
 	if !e.Exists(u) {
@@ -43,7 +55,7 @@ func TestNotExists(t *testing.T) {
 	ts := httpMock("{\"exists\": false}")
 	defer ts.Close()
 
-	e, _ := New(ts.URL)
+	e, _ := New(&Config{ProviderURL: ts.URL})
 
 	u := []byte("testuser")
 	if e.Exists(u) {
@@ -55,7 +67,7 @@ func TestIsValid(t *testing.T) {
 	ts := httpMock("{\"isvalid\": true}")
 	defer ts.Close()
 
-	e, _ := New(ts.URL)
+	e, _ := New(&Config{ProviderURL: ts.URL})
 
 	key := ecdh.PublicKey{}
 	key.FromString("B2E3ABEE63BCF7BAC4DCD232C4852F90FA458B4269B673C76C4DE02D0D24402C")
@@ -69,7 +81,7 @@ func TestIsNotValid(t *testing.T) {
 	ts := httpMock("{\"isvalid\": false}")
 	defer ts.Close()
 
-	e, _ := New(ts.URL)
+	e, _ := New(&Config{ProviderURL: ts.URL})
 
 	key := ecdh.PublicKey{}
 	key.FromString("B2E3ABEE63BCF7BAC4DCD232C4852F90FA458B4269B673C76C4DE02D0D24402C")
@@ -79,6 +91,174 @@ func TestIsNotValid(t *testing.T) {
 	}
 }
 
+func TestServerRoundTrip(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "externuserdb_tests")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(tmpDir)
+
+	backing, err := boltuserdb.New(filepath.Join(tmpDir, "users.db"))
+	require.NoError(err, "boltuserdb.New()")
+	defer backing.Close()
+
+	const token = "sekrit"
+	ts := httptest.NewServer(NewServer(backing, token))
+	defer ts.Close()
+
+	e, err := New(&Config{ProviderURL: ts.URL, BearerToken: token})
+	require.NoError(err, "New()")
+	defer e.Close()
+
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair()")
+	idKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair()")
+
+	u := []byte("alice")
+	assert.False(e.Exists(u), "Exists() before Add()")
+	_, err = e.Link(u)
+	assert.Equal(userdb.ErrNoSuchUser, err, "Link() before Add()")
+
+	require.NoError(e.Add(u, linkKey.PublicKey(), false), "Add()")
+	assert.True(e.Exists(u), "Exists()")
+	assert.True(e.IsValid(u, linkKey.PublicKey()), "IsValid()")
+	assert.False(e.IsValid(u, idKey.PublicKey()), "IsValid(), wrong key")
+
+	k, err := e.Link(u)
+	require.NoError(err, "Link()")
+	assert.Equal(linkKey.PublicKey().Bytes(), k.Bytes(), "Link() key")
+
+	require.NoError(e.AddLinkKey(u, "laptop", idKey.PublicKey()), "AddLinkKey()")
+	assert.Equal(userdb.ErrLinkKeyExists, e.AddLinkKey(u, "laptop", idKey.PublicKey()), "AddLinkKey(), duplicate")
+	assert.True(e.IsValid(u, idKey.PublicKey()), "IsValid(), second link key")
+	keys, err := e.LinkKeys(u)
+	require.NoError(err, "LinkKeys()")
+	assert.Len(keys, 2, "LinkKeys()")
+	require.NoError(e.RemoveLinkKey(u, "laptop"), "RemoveLinkKey()")
+	assert.Equal(userdb.ErrLastLinkKey, e.RemoveLinkKey(u, userdb.DefaultLinkKeyName), "RemoveLinkKey(), last key")
+	assert.False(e.IsValid(u, idKey.PublicKey()), "IsValid(), revoked link key")
+
+	_, err = e.Identity(u)
+	assert.Equal(userdb.ErrNoIdentity, err, "Identity() before SetIdentity()")
+	require.NoError(e.SetIdentity(u, idKey.PublicKey()), "SetIdentity()")
+	k, err = e.Identity(u)
+	require.NoError(err, "Identity()")
+	assert.Equal(idKey.PublicKey().Bytes(), k.Bytes(), "Identity() key")
+
+	n, err := e.Count()
+	require.NoError(err, "Count()")
+	assert.Equal(1, n, "Count()")
+	users, err := userdb.List(e)
+	require.NoError(err, "List()")
+	assert.Equal([][]byte{u}, users, "List()")
+	require.NoError(e.SetDisabled(u, true), "SetDisabled()")
+	info, err := e.Info(u)
+	require.NoError(err, "Info()")
+	assert.True(info.Disabled, "Info(): Disabled")
+	assert.False(info.CreatedAt.IsZero(), "Info(): CreatedAt")
+	_, err = e.Info([]byte("malory"))
+	assert.Equal(userdb.ErrNoSuchUser, err, "Info(), no such user")
+
+	require.NoError(e.Remove(u), "Remove()")
+	assert.False(e.Exists(u), "Exists() after Remove()")
+
+	// Requests without the bearer token must be rejected.
+	bad, err := New(&Config{ProviderURL: ts.URL})
+	require.NoError(err, "New(), no token")
+	defer bad.Close()
+	assert.Error(bad.Add(u, linkKey.PublicKey(), false), "Add(), no token")
+}
+
+func TestLegacyProtocol(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair()")
+	idKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair()")
+
+	// A stand-in legacy provider that knows only alice.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.ParseForm() != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		isAlice := r.PostForm.Get("user") == "alice"
+		resp := make(map[string]interface{})
+		switch r.URL.Path {
+		case "/exists":
+			resp["exists"] = isAlice
+		case "/isvalid":
+			resp["isvalid"] = isAlice && r.PostForm.Get("key") == linkKey.PublicKey().String()
+		case "/getidkey":
+			if !isAlice {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			resp["getidkey"] = keyToString(idKey.PublicKey())
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer ts.Close()
+
+	e, err := New(&Config{ProviderURL: ts.URL, LegacyProtocol: true})
+	require.NoError(err, "New()")
+	defer e.Close()
+
+	alice, bob := []byte("alice"), []byte("bob")
+	assert.True(e.Exists(alice), "Exists()")
+	assert.False(e.Exists(bob), "Exists(), no such user")
+	assert.True(e.IsValid(alice, linkKey.PublicKey()), "IsValid()")
+	assert.False(e.IsValid(alice, idKey.PublicKey()), "IsValid(), wrong key")
+	assert.False(e.IsValid(bob, linkKey.PublicKey()), "IsValid(), no such user")
+
+	k, err := e.Identity(alice)
+	require.NoError(err, "Identity()")
+	assert.Equal(idKey.PublicKey().Bytes(), k.Bytes(), "Identity() key")
+	_, err = e.Identity(bob)
+	assert.Error(err, "Identity(), no such user")
+
+	// Authentication only needs the users' (empty) metadata.
+	info, err := e.Info(alice)
+	require.NoError(err, "Info()")
+	assert.False(info.Disabled, "Info(): Disabled")
+	_, err = e.Info(bob)
+	assert.Equal(userdb.ErrNoSuchUser, err, "Info(), no such user")
+	assert.NoError(e.SetLastAuthenticated(alice, time.Now()), "SetLastAuthenticated()")
+
+	// The legacy protocol can not modify or list users.
+	assert.Error(e.Add(bob, linkKey.PublicKey(), false), "Add()")
+	assert.Error(e.Remove(alice), "Remove()")
+	_, err = e.Count()
+	assert.Error(err, "Count()")
+}
+
+// serverUserDB is a client that shuts down its stand-in server when closed.
+type serverUserDB struct {
+	userdb.UserDB
+	ts *httptest.Server
+}
+
+func (d *serverUserDB) Close() {
+	d.UserDB.Close()
+	d.ts.Close()
+}
+
+func TestConformance(t *testing.T) {
+	userdbtest.Run(t, func(t *testing.T) userdb.UserDB {
+		ts := httptest.NewServer(NewServer(memuserdb.New(), ""))
+		e, err := New(&Config{ProviderURL: ts.URL})
+		require.NoError(t, err, "New()")
+		return &serverUserDB{e, ts}
+	})
+}
+
 func httpMock(response string) *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(response))
@@ -0,0 +1,164 @@
+// legacy.go - Katzenpost server legacy external user database.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package externuserdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/server/userdb"
+)
+
+const legacyOpIdentity = "getidkey"
+
+var (
+	errCantModify   = errors.New("externuserdb: legacy protocol: users can not be modified")
+	errNotSupported = errors.New("externuserdb: legacy protocol: operation not supported")
+)
+
+// legacyAuth is the external user database speaking the original protocol,
+// where each of the supported operations is a form encoded `POST` request
+// to `<ProviderURL>/<operation>`, answered by a JSON object mapping the
+// operation to the result.
+type legacyAuth struct {
+	baseURL     string
+	bearerToken string
+	client      *http.Client
+}
+
+func (e *legacyAuth) doPost(op string, form url.Values, result interface{}) error {
+	httpReq, err := http.NewRequest(http.MethodPost, e.baseURL+op, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if e.bearerToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+e.bearerToken)
+	}
+
+	rsp, err := e.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("externuserdb: %v: HTTP status %v", op, rsp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(rsp.Body, maxResponseSize)).Decode(result)
+}
+
+func (e *legacyAuth) doBoolPost(op string, form url.Values) bool {
+	resp := make(map[string]bool)
+	if err := e.doPost(op, form, &resp); err != nil {
+		return false
+	}
+	return resp[op]
+}
+
+func (e *legacyAuth) IsValid(u []byte, k *ecdh.PublicKey) bool {
+	if k == nil {
+		return false
+	}
+	return e.doBoolPost(opIsValid, url.Values{"user": {string(u)}, "key": {k.String()}})
+}
+
+func (e *legacyAuth) Exists(u []byte) bool {
+	return e.doBoolPost(opExists, url.Values{"user": {string(u)}})
+}
+
+func (e *legacyAuth) Add(u []byte, k *ecdh.PublicKey, update bool) error {
+	return errCantModify
+}
+
+func (e *legacyAuth) Link(u []byte) (*ecdh.PublicKey, error) {
+	return nil, errNotSupported
+}
+
+func (e *legacyAuth) AddLinkKey(u []byte, name string, k *ecdh.PublicKey) error {
+	return errCantModify
+}
+
+func (e *legacyAuth) RemoveLinkKey(u []byte, name string) error {
+	return errCantModify
+}
+
+func (e *legacyAuth) LinkKeys(u []byte) (map[string]*ecdh.PublicKey, error) {
+	return nil, errNotSupported
+}
+
+func (e *legacyAuth) SetIdentity(u []byte, k *ecdh.PublicKey) error {
+	return errCantModify
+}
+
+func (e *legacyAuth) Identity(u []byte) (*ecdh.PublicKey, error) {
+	resp := make(map[string]string)
+	if err := e.doPost(legacyOpIdentity, url.Values{"user": {string(u)}}, &resp); err != nil {
+		return nil, err
+	}
+	k, err := keyFromString(resp[legacyOpIdentity])
+	if err != nil {
+		return nil, userdb.ErrNoIdentity
+	}
+	return k, nil
+}
+
+func (e *legacyAuth) Remove(u []byte) error {
+	return errCantModify
+}
+
+func (e *legacyAuth) ForEach(fn func([]byte, *userdb.UserInfo) error) error {
+	return errNotSupported
+}
+
+func (e *legacyAuth) Count() (int, error) {
+	return 0, errNotSupported
+}
+
+// Info returns empty metadata for existing users, as the legacy protocol
+// has none.
+func (e *legacyAuth) Info(u []byte) (*userdb.UserInfo, error) {
+	if !e.Exists(u) {
+		return nil, userdb.ErrNoSuchUser
+	}
+	return &userdb.UserInfo{}, nil
+}
+
+func (e *legacyAuth) SetDisabled(u []byte, disabled bool) error {
+	return errCantModify
+}
+
+// SetLastAuthenticated does nothing, as the legacy protocol has no way to
+// record the time.
+func (e *legacyAuth) SetLastAuthenticated(u []byte, t time.Time) error {
+	return nil
+}
+
+func (e *legacyAuth) SetRateLimit(u []byte, rl *userdb.RateLimit) error {
+	return errCantModify
+}
+
+func (e *legacyAuth) Close() {
+	e.client.CloseIdleConnections()
+}
@@ -0,0 +1,164 @@
+// server.go - extern REST API user database stand-in server.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package externuserdb
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/server/userdb"
+)
+
+const maxRequestSize = 4 * 1024
+
+// Server is a stand-in external authorization source that serves the
+// protocol from any userdb.UserDB.  It is intended for testing, and as a
+// reference for implementors of the protocol.
+type Server struct {
+	db          userdb.UserDB
+	bearerToken string
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeResponse(w, http.StatusMethodNotAllowed, &Response{Error: "method not allowed"})
+		return
+	}
+	if s.bearerToken != "" {
+		tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(tok), []byte(s.bearerToken)) != 1 {
+			writeResponse(w, http.StatusUnauthorized, &Response{Error: "unauthorized"})
+			return
+		}
+	}
+
+	const prefix = "/" + ProtocolVersion + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeResponse(w, http.StatusNotFound, &Response{Error: "unsupported protocol version"})
+		return
+	}
+	op := strings.TrimPrefix(r.URL.Path, prefix)
+
+	var req Request
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestSize)).Decode(&req); err != nil {
+		writeResponse(w, http.StatusBadRequest, &Response{Error: "malformed request"})
+		return
+	}
+	u := []byte(req.User)
+
+	var k *ecdh.PublicKey
+	if req.Key != "" {
+		var err error
+		if k, err = keyFromString(req.Key); err != nil {
+			writeResponse(w, http.StatusBadRequest, &Response{Error: err.Error()})
+			return
+		}
+	}
+
+	var resp Response
+	var err error
+	switch op {
+	case opExists:
+		resp.Exists = s.db.Exists(u)
+	case opIsValid:
+		resp.IsValid = k != nil && s.db.IsValid(u, k)
+	case opLink:
+		if k, err = s.db.Link(u); err == nil {
+			resp.Key = keyToString(k)
+		}
+	case opAdd:
+		err = s.db.Add(u, k, req.Update)
+	case opSetIdentity:
+		err = s.db.SetIdentity(u, k)
+	case opIdentity:
+		if k, err = s.db.Identity(u); err == nil {
+			resp.Key = keyToString(k)
+		}
+	case opRemove:
+		err = s.db.Remove(u)
+	case opAddLinkKey:
+		err = s.db.AddLinkKey(u, req.KeyName, k)
+	case opRemLinkKey:
+		err = s.db.RemoveLinkKey(u, req.KeyName)
+	case opLinkKeys:
+		var keys map[string]*ecdh.PublicKey
+		if keys, err = s.db.LinkKeys(u); err == nil {
+			resp.LinkKeys = make(map[string]string)
+			for name, k := range keys {
+				resp.LinkKeys[name] = keyToString(k)
+			}
+		}
+	case opList:
+		err = s.db.ForEach(func(u []byte, info *userdb.UserInfo) error {
+			resp.Users = append(resp.Users, *toWireInfo(u, info))
+			return nil
+		})
+	case opCount:
+		resp.Count, err = s.db.Count()
+	case opInfo:
+		var info *userdb.UserInfo
+		if info, err = s.db.Info(u); err == nil {
+			resp.Info = toWireInfo(u, info)
+		}
+	case opSetDisabled:
+		err = s.db.SetDisabled(u, req.Disabled)
+	case opSetLastAuth:
+		err = s.db.SetLastAuthenticated(u, unixToTime(req.Time))
+	case opSetRateLim:
+		err = s.db.SetRateLimit(u, fromWireRateLimit(req.RateLimit))
+	default:
+		writeResponse(w, http.StatusNotFound, &Response{Error: "unknown operation"})
+		return
+	}
+
+	switch err {
+	case nil:
+		writeResponse(w, http.StatusOK, &resp)
+	case userdb.ErrNoSuchUser:
+		writeResponse(w, http.StatusNotFound, &Response{Error: ErrCodeNoSuchUser})
+	case userdb.ErrNoIdentity:
+		writeResponse(w, http.StatusNotFound, &Response{Error: ErrCodeNoIdentity})
+	case userdb.ErrNoSuchLinkKey:
+		writeResponse(w, http.StatusNotFound, &Response{Error: ErrCodeNoSuchLinkKey})
+	case userdb.ErrLinkKeyExists:
+		writeResponse(w, http.StatusConflict, &Response{Error: ErrCodeLinkKeyExists})
+	case userdb.ErrLastLinkKey:
+		writeResponse(w, http.StatusConflict, &Response{Error: ErrCodeLastLinkKey})
+	default:
+		writeResponse(w, http.StatusInternalServerError, &Response{Error: err.Error()})
+	}
+}
+
+func writeResponse(w http.ResponseWriter, status int, resp *Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// NewServer creates a new stand-in server backed by the provided UserDB.
+// If bearerToken is non-empty, requests are required to present it.
+func NewServer(db userdb.UserDB, bearerToken string) *Server {
+	return &Server{
+		db:          db,
+		bearerToken: bearerToken,
+	}
+}
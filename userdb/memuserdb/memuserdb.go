@@ -0,0 +1,385 @@
+// memuserdb.go - In-memory Katzenpost server user database.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package memuserdb implements the Katzenpost server user database with a
+// volatile in-memory backend, suitable for tests and ephemeral nodes.
+package memuserdb
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/server/userdb"
+)
+
+type user struct {
+	linkKeys map[string][]byte
+	identity []byte
+	info     userdb.UserInfo
+}
+
+type memUserDB struct {
+	sync.RWMutex
+
+	users map[string]*user
+}
+
+func (d *memUserDB) Exists(u []byte) bool {
+	if !userOk(u) {
+		return false
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	_, ok := d.users[string(u)]
+	return ok
+}
+
+func (d *memUserDB) IsValid(u []byte, k *ecdh.PublicKey) bool {
+	if !userOk(u) || k == nil {
+		return false
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	ent, ok := d.users[string(u)]
+	if !ok {
+		return false
+	}
+
+	isValid := false
+	kBytes := k.Bytes()
+	for _, rawPubKey := range ent.linkKeys {
+		if subtle.ConstantTimeCompare(rawPubKey, kBytes) == 1 {
+			isValid = true
+		}
+	}
+	return isValid
+}
+
+func (d *memUserDB) Link(u []byte) (*ecdh.PublicKey, error) {
+	if !userOk(u) {
+		return nil, fmt.Errorf("userdb: invalid username: `%v`", u)
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	ent, ok := d.users[string(u)]
+	if !ok {
+		return nil, userdb.ErrNoSuchUser
+	}
+
+	// Fall back to the first key, if the default key was removed.
+	rawPubKey, ok := ent.linkKeys[userdb.DefaultLinkKeyName]
+	if !ok {
+		names := sortedNames(ent.linkKeys)
+		if len(names) == 0 {
+			return nil, fmt.Errorf("userdb: user %s does not have a link key", u)
+		}
+		rawPubKey = ent.linkKeys[names[0]]
+	}
+	return bytesToPublicKey(rawPubKey)
+}
+
+func (d *memUserDB) Add(u []byte, k *ecdh.PublicKey, update bool) error {
+	if !userOk(u) {
+		return fmt.Errorf("userdb: invalid username: `%v`", u)
+	}
+	if k == nil {
+		return fmt.Errorf("userdb: must provide a public key")
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	ent, ok := d.users[string(u)]
+	switch ok {
+	case true:
+		if !update {
+			return fmt.Errorf("userdb: user already exists")
+		}
+	case false:
+		if update {
+			return userdb.ErrNoSuchUser
+		}
+		ent = &user{
+			linkKeys: make(map[string][]byte),
+			info:     userdb.UserInfo{CreatedAt: time.Now()},
+		}
+		d.users[string(u)] = ent
+	}
+	ent.linkKeys[userdb.DefaultLinkKeyName] = k.Bytes()
+
+	return nil
+}
+
+func (d *memUserDB) AddLinkKey(u []byte, name string, k *ecdh.PublicKey) error {
+	if !userOk(u) {
+		return fmt.Errorf("userdb: invalid username: `%v`", u)
+	}
+	if !userdb.IsValidLinkKeyName(name) {
+		return fmt.Errorf("userdb: invalid link key name: `%v`", name)
+	}
+	if k == nil {
+		return fmt.Errorf("userdb: must provide a public key")
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	ent, ok := d.users[string(u)]
+	if !ok {
+		return userdb.ErrNoSuchUser
+	}
+	if _, ok = ent.linkKeys[name]; ok {
+		return userdb.ErrLinkKeyExists
+	}
+	ent.linkKeys[name] = k.Bytes()
+
+	return nil
+}
+
+func (d *memUserDB) RemoveLinkKey(u []byte, name string) error {
+	if !userOk(u) {
+		return fmt.Errorf("userdb: invalid username: `%v`", u)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	ent, ok := d.users[string(u)]
+	if !ok {
+		return userdb.ErrNoSuchUser
+	}
+	if _, ok = ent.linkKeys[name]; !ok {
+		return userdb.ErrNoSuchLinkKey
+	}
+	if len(ent.linkKeys) == 1 {
+		return userdb.ErrLastLinkKey
+	}
+	delete(ent.linkKeys, name)
+
+	return nil
+}
+
+func (d *memUserDB) LinkKeys(u []byte) (map[string]*ecdh.PublicKey, error) {
+	if !userOk(u) {
+		return nil, fmt.Errorf("userdb: invalid username: `%v`", u)
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	ent, ok := d.users[string(u)]
+	if !ok {
+		return nil, userdb.ErrNoSuchUser
+	}
+
+	keys := make(map[string]*ecdh.PublicKey)
+	for name, rawPubKey := range ent.linkKeys {
+		pubKey, err := bytesToPublicKey(rawPubKey)
+		if err != nil {
+			return nil, err
+		}
+		keys[name] = pubKey
+	}
+	return keys, nil
+}
+
+func (d *memUserDB) SetIdentity(u []byte, k *ecdh.PublicKey) error {
+	if !userOk(u) {
+		return fmt.Errorf("userdb: invalid username: `%v`", u)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	ent, ok := d.users[string(u)]
+	if !ok {
+		return userdb.ErrNoSuchUser
+	}
+	if k == nil {
+		ent.identity = nil
+	} else {
+		ent.identity = k.Bytes()
+	}
+
+	return nil
+}
+
+func (d *memUserDB) Identity(u []byte) (*ecdh.PublicKey, error) {
+	if !userOk(u) {
+		return nil, fmt.Errorf("userdb: invalid username: `%v`", u)
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	ent, ok := d.users[string(u)]
+	if !ok {
+		return nil, userdb.ErrNoSuchUser
+	}
+	if ent.identity == nil {
+		return nil, userdb.ErrNoIdentity
+	}
+	return bytesToPublicKey(ent.identity)
+}
+
+func (d *memUserDB) Remove(u []byte) error {
+	if !userOk(u) {
+		return fmt.Errorf("userdb: invalid username: `%v`", u)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if _, ok := d.users[string(u)]; !ok {
+		return userdb.ErrNoSuchUser
+	}
+	delete(d.users, string(u))
+
+	return nil
+}
+
+func (d *memUserDB) ForEach(fn func([]byte, *userdb.UserInfo) error) error {
+	type userEnt struct {
+		u    []byte
+		info userdb.UserInfo
+	}
+
+	// Snapshot the users first, so that fn is not called with the lock
+	// held, iterating in the same (byte-wise) order as the bolt backend.
+	d.RLock()
+	users := make([]userEnt, 0, len(d.users))
+	for u, ent := range d.users {
+		users = append(users, userEnt{[]byte(u), ent.info})
+	}
+	d.RUnlock()
+	sort.Slice(users, func(i, j int) bool {
+		return string(users[i].u) < string(users[j].u)
+	})
+
+	for i := range users {
+		if err := fn(users[i].u, &users[i].info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *memUserDB) Count() (int, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	return len(d.users), nil
+}
+
+func (d *memUserDB) Info(u []byte) (*userdb.UserInfo, error) {
+	if !userOk(u) {
+		return nil, fmt.Errorf("userdb: invalid username: `%v`", u)
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	ent, ok := d.users[string(u)]
+	if !ok {
+		return nil, userdb.ErrNoSuchUser
+	}
+	info := ent.info
+	return &info, nil
+}
+
+func (d *memUserDB) SetDisabled(u []byte, disabled bool) error {
+	return d.updateInfo(u, func(info *userdb.UserInfo) {
+		info.Disabled = disabled
+	})
+}
+
+func (d *memUserDB) SetLastAuthenticated(u []byte, t time.Time) error {
+	return d.updateInfo(u, func(info *userdb.UserInfo) {
+		info.LastAuthenticated = t
+	})
+}
+
+func (d *memUserDB) SetRateLimit(u []byte, rl *userdb.RateLimit) error {
+	if rl != nil {
+		rlCopy := *rl
+		rl = &rlCopy
+	}
+	return d.updateInfo(u, func(info *userdb.UserInfo) {
+		info.RateLimit = rl
+	})
+}
+
+func (d *memUserDB) updateInfo(u []byte, fn func(*userdb.UserInfo)) error {
+	if !userOk(u) {
+		return fmt.Errorf("userdb: invalid username: `%v`", u)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	ent, ok := d.users[string(u)]
+	if !ok {
+		return userdb.ErrNoSuchUser
+	}
+	fn(&ent.info)
+
+	return nil
+}
+
+func (d *memUserDB) Close() {
+	d.Lock()
+	defer d.Unlock()
+
+	d.users = make(map[string]*user)
+}
+
+// New creates a new empty in-memory user database.
+func New() userdb.UserDB {
+	return &memUserDB{
+		users: make(map[string]*user),
+	}
+}
+
+func sortedNames(m map[string][]byte) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func bytesToPublicKey(b []byte) (*ecdh.PublicKey, error) {
+	pubKey := new(ecdh.PublicKey)
+	if err := pubKey.FromBytes(b); err != nil {
+		return nil, err
+	}
+	return pubKey, nil
+}
+
+func userOk(u []byte) bool {
+	return len(u) > 0 && len(u) <= userdb.MaxUsernameSize
+}
@@ -0,0 +1,30 @@
+// memuserdb_test.go - In-memory Katzenpost server user database tests.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package memuserdb
+
+import (
+	"testing"
+
+	"github.com/katzenpost/server/userdb"
+	"github.com/katzenpost/server/userdb/userdbtest"
+)
+
+func TestMemUserDB(t *testing.T) {
+	userdbtest.Run(t, func(t *testing.T) userdb.UserDB {
+		return New()
+	})
+}
@@ -20,13 +20,23 @@ package userdb
 
 import (
 	"errors"
+	"time"
 
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/sphinx/constants"
 )
 
-// MaxUsernameSize is the maximum username length in bytes.
-const MaxUsernameSize = constants.RecipientIDLength
+const (
+	// MaxUsernameSize is the maximum username length in bytes.
+	MaxUsernameSize = constants.RecipientIDLength
+
+	// MaxLinkKeyNameSize is the maximum link key name length in bytes.
+	MaxLinkKeyNameSize = 64
+
+	// DefaultLinkKeyName is the name of the link key managed by Add
+	// and Link.
+	DefaultLinkKeyName = "default"
+)
 
 var (
 	// ErrNoSuchUser is the error returned when an operation fails due to
@@ -36,25 +46,83 @@ var (
 	// ErrNoIdentity is the error returned when the specified user has no
 	// identity key set.
 	ErrNoIdentity = errors.New("userdb: no identity key set")
+
+	// ErrNoSuchLinkKey is the error returned when an operation fails due
+	// to a non-existent named link key.
+	ErrNoSuchLinkKey = errors.New("userdb: no such link key")
+
+	// ErrLinkKeyExists is the error returned when adding a named link key
+	// fails due to the name already being in use.
+	ErrLinkKeyExists = errors.New("userdb: link key already exists")
+
+	// ErrLastLinkKey is the error returned when attempting to remove a
+	// user's only link key.
+	ErrLastLinkKey = errors.New("userdb: can not remove the last link key")
 )
 
+// RateLimit is a per-user override of the provider's client send rate limit.
+type RateLimit struct {
+	// SendRatePerMinute is the number of packets that the user may send per
+	// minute.  A value of 0 disables the limit.
+	SendRatePerMinute uint64
+
+	// SendBurst is the maximum number of packets that the user may send in
+	// a burst.  A value of 0 disables the limit.
+	SendBurst uint64
+}
+
+// UserInfo is the per-user metadata tracked by the user database.
+type UserInfo struct {
+	// CreatedAt is the time the user was added, or the zero time if
+	// unknown.
+	CreatedAt time.Time
+
+	// LastAuthenticated is the time the user last successfully
+	// authenticated, or the zero time if unknown.
+	LastAuthenticated time.Time
+
+	// Disabled is true iff the user has been suspended, and should not be
+	// allowed to authenticate.
+	Disabled bool
+
+	// RateLimit is the user's send rate limit override, or nil if the user
+	// is subject to the provider's default limit.
+	RateLimit *RateLimit
+}
+
 // UserDB is the interface provided by all user database implementations.
 type UserDB interface {
 	// Exists returns true iff the user identified by the username exists.
 	Exists([]byte) bool
 
 	// IsValid returns true iff the user identified by the username and
-	// public key is valid.
+	// public key is valid, where the public key may be any of the user's
+	// link keys.
 	IsValid([]byte, *ecdh.PublicKey) bool
 
-	// Link returns the user's link layer authentication key.
+	// Link returns the user's default link layer authentication key, or
+	// if it has been removed, the user's first link key in name order.
 	Link([]byte) (*ecdh.PublicKey, error)
 
 	// Add adds the user identified by the username and public key
-	// to the database.  Existing users will have their public keys
-	// updated if specified, otherwise an error will be returned.
+	// to the database, with the public key as the default link key.
+	// Existing users will have their default link key updated if
+	// specified, otherwise an error will be returned.
 	Add([]byte, *ecdh.PublicKey, bool) error
 
+	// AddLinkKey adds a named link key to the existing user identified by
+	// the username.  Adding a key with a name that is already in use will
+	// return ErrLinkKeyExists.
+	AddLinkKey([]byte, string, *ecdh.PublicKey) error
+
+	// RemoveLinkKey removes the named link key from the user identified by
+	// the username.  A user's last remaining link key can not be removed.
+	RemoveLinkKey([]byte, string) error
+
+	// LinkKeys returns all of the named link keys for the user identified
+	// by the username.
+	LinkKeys([]byte) (map[string]*ecdh.PublicKey, error)
+
 	// SetIdentity sets the optional identity key for the user identified
 	// by the user name to the provided public key.  Providing a nil key
 	// will remove the user's identity key iff it exists.
@@ -67,6 +135,56 @@ type UserDB interface {
 	// Remove removes the user identified by the username from the database.
 	Remove([]byte) error
 
+	// ForEach calls fn for each user in the database, with the user's
+	// metadata.  Iteration stops at, and ForEach returns the first error
+	// returned by fn.  fn must not modify the user database.
+	ForEach(fn func([]byte, *UserInfo) error) error
+
+	// Count returns the number of users in the database.
+	Count() (int, error)
+
+	// Info returns the metadata for the user identified by the username.
+	Info([]byte) (*UserInfo, error)
+
+	// SetDisabled sets the disabled flag for the user identified by the
+	// username.  Disabled users are retained in the database, but will
+	// fail authentication.
+	SetDisabled([]byte, bool) error
+
+	// SetLastAuthenticated sets the last authenticated time for the user
+	// identified by the username.
+	SetLastAuthenticated([]byte, time.Time) error
+
+	// SetRateLimit sets the send rate limit override for the user
+	// identified by the username.  Providing a nil limit will remove the
+	// user's override.
+	SetRateLimit([]byte, *RateLimit) error
+
 	// Close closes the UserDB instance.
 	Close()
 }
+
+// IsValidLinkKeyName returns true iff the link key name is well formed,
+// consisting of 1 to MaxLinkKeyNameSize printable non-space ASCII
+// characters.
+func IsValidLinkKeyName(name string) bool {
+	if len(name) == 0 || len(name) > MaxLinkKeyNameSize {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// List returns the usernames of all the users in the database.
+func List(db UserDB) ([][]byte, error) {
+	var users [][]byte
+	err := db.ForEach(func(u []byte, _ *UserInfo) error {
+		users = append(users, append([]byte{}, u...))
+		return nil
+	})
+	return users, err
+}
@@ -0,0 +1,246 @@
+// userdbtest.go - Katzenpost server user database conformance tests.
+// Copyright (C) 2020  Katzenpost Developers.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package userdbtest provides a conformance test suite that every
+// userdb.UserDB implementation is expected to pass.
+package userdbtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/server/userdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Run runs the conformance test suite, calling newDB to create a new empty
+// user database for each test.  The suite will close each database when
+// the test completes.
+func Run(t *testing.T, newDB func(t *testing.T) userdb.UserDB) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, userdb.UserDB)
+	}{
+		{"AddRemove", testAddRemove},
+		{"Identity", testIdentity},
+		{"LinkKeys", testLinkKeys},
+		{"Info", testInfo},
+		{"Enumerate", testEnumerate},
+	}
+
+	for _, v := range tests {
+		fn := v.fn
+		t.Run(v.name, func(t *testing.T) {
+			d := newDB(t)
+			defer d.Close()
+			fn(t, d)
+		})
+	}
+}
+
+func newPublicKey(t *testing.T) *ecdh.PublicKey {
+	privKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(t, err, "NewKeypair()")
+	return privKey.PublicKey()
+}
+
+func testAddRemove(t *testing.T, d userdb.UserDB) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	alice := []byte("alice")
+	k, k2 := newPublicKey(t), newPublicKey(t)
+
+	assert.False(d.Exists(alice), "Exists(): not added")
+	assert.False(d.IsValid(alice, k), "IsValid(): not added")
+	_, err := d.Link(alice)
+	assert.Equal(userdb.ErrNoSuchUser, err, "Link(): not added")
+	assert.Equal(userdb.ErrNoSuchUser, d.Add(alice, k, true), "Add(): update, not added")
+
+	require.NoError(d.Add(alice, k, false), "Add()")
+	assert.True(d.Exists(alice), "Exists()")
+	assert.True(d.IsValid(alice, k), "IsValid()")
+	assert.False(d.IsValid(alice, k2), "IsValid(): wrong key")
+	assert.Error(d.Add(alice, k2, false), "Add(): duplicate")
+	linkKey, err := d.Link(alice)
+	require.NoError(err, "Link()")
+	assert.True(k.Equal(linkKey), "Link(): key")
+
+	require.NoError(d.Add(alice, k2, true), "Add(): update")
+	assert.True(d.IsValid(alice, k2), "IsValid(): updated key")
+	assert.False(d.IsValid(alice, k), "IsValid(): replaced key")
+
+	require.NoError(d.Remove(alice), "Remove()")
+	assert.False(d.Exists(alice), "Exists(): removed")
+	assert.False(d.IsValid(alice, k2), "IsValid(): removed")
+	assert.Equal(userdb.ErrNoSuchUser, d.Remove(alice), "Remove(): removed")
+}
+
+func testIdentity(t *testing.T, d userdb.UserDB) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	alice := []byte("alice")
+	k, idKey := newPublicKey(t), newPublicKey(t)
+
+	assert.Equal(userdb.ErrNoSuchUser, d.SetIdentity(alice, idKey), "SetIdentity(): not added")
+	_, err := d.Identity(alice)
+	assert.Equal(userdb.ErrNoSuchUser, err, "Identity(): not added")
+
+	require.NoError(d.Add(alice, k, false), "Add()")
+	_, err = d.Identity(alice)
+	assert.Equal(userdb.ErrNoIdentity, err, "Identity(): not set")
+
+	require.NoError(d.SetIdentity(alice, idKey), "SetIdentity()")
+	key, err := d.Identity(alice)
+	require.NoError(err, "Identity()")
+	assert.True(idKey.Equal(key), "Identity(): key")
+
+	require.NoError(d.SetIdentity(alice, nil), "SetIdentity(): clear")
+	_, err = d.Identity(alice)
+	assert.Equal(userdb.ErrNoIdentity, err, "Identity(): cleared")
+}
+
+func testLinkKeys(t *testing.T, d userdb.UserDB) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	alice, bob := []byte("alice"), []byte("bob")
+	k, laptopKey := newPublicKey(t), newPublicKey(t)
+
+	assert.Equal(userdb.ErrNoSuchUser, d.AddLinkKey(alice, "laptop", laptopKey), "AddLinkKey(): not added")
+	require.NoError(d.Add(alice, k, false), "Add()")
+	require.NoError(d.Add(bob, newPublicKey(t), false), "Add(bob)")
+
+	require.NoError(d.AddLinkKey(alice, "laptop", laptopKey), "AddLinkKey()")
+	assert.Equal(userdb.ErrLinkKeyExists, d.AddLinkKey(alice, "laptop", k), "AddLinkKey(): duplicate")
+	assert.True(d.IsValid(alice, k), "IsValid(): default key")
+	assert.True(d.IsValid(alice, laptopKey), "IsValid(): laptop key")
+	assert.False(d.IsValid(bob, laptopKey), "IsValid(): other user's key")
+
+	keys, err := d.LinkKeys(alice)
+	require.NoError(err, "LinkKeys()")
+	require.Len(keys, 2, "LinkKeys()")
+	assert.True(k.Equal(keys[userdb.DefaultLinkKeyName]), "LinkKeys(): default")
+	assert.True(laptopKey.Equal(keys["laptop"]), "LinkKeys(): laptop")
+
+	assert.Equal(userdb.ErrNoSuchLinkKey, d.RemoveLinkKey(alice, "phone"), "RemoveLinkKey(): not added")
+	require.NoError(d.RemoveLinkKey(alice, userdb.DefaultLinkKeyName), "RemoveLinkKey(): default")
+	assert.False(d.IsValid(alice, k), "IsValid(): revoked key")
+	assert.True(d.IsValid(alice, laptopKey), "IsValid(): remaining key")
+	linkKey, err := d.Link(alice)
+	require.NoError(err, "Link(): default revoked")
+	assert.True(laptopKey.Equal(linkKey), "Link(): falls back to remaining key")
+	assert.Equal(userdb.ErrLastLinkKey, d.RemoveLinkKey(alice, "laptop"), "RemoveLinkKey(): last key")
+}
+
+func testInfo(t *testing.T, d userdb.UserDB) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	alice := []byte("alice")
+
+	_, err := d.Info(alice)
+	assert.Equal(userdb.ErrNoSuchUser, err, "Info(): not added")
+	assert.Equal(userdb.ErrNoSuchUser, d.SetDisabled(alice, true), "SetDisabled(): not added")
+	assert.Equal(userdb.ErrNoSuchUser, d.SetLastAuthenticated(alice, time.Now()), "SetLastAuthenticated(): not added")
+	assert.Equal(userdb.ErrNoSuchUser, d.SetRateLimit(alice, &userdb.RateLimit{}), "SetRateLimit(): not added")
+
+	require.NoError(d.Add(alice, newPublicKey(t), false), "Add()")
+	info, err := d.Info(alice)
+	require.NoError(err, "Info()")
+	assert.False(info.CreatedAt.IsZero(), "Info(): CreatedAt")
+	assert.True(info.LastAuthenticated.IsZero(), "Info(): LastAuthenticated")
+	assert.False(info.Disabled, "Info(): Disabled")
+	assert.Nil(info.RateLimit, "Info(): RateLimit")
+
+	// Backends are only required to preserve times to second precision.
+	now := time.Unix(time.Now().Unix(), 0)
+	require.NoError(d.SetLastAuthenticated(alice, now), "SetLastAuthenticated()")
+	require.NoError(d.SetDisabled(alice, true), "SetDisabled()")
+	info, err = d.Info(alice)
+	require.NoError(err, "Info()")
+	assert.Equal(now.Unix(), info.LastAuthenticated.Unix(), "Info(): LastAuthenticated")
+	assert.True(info.Disabled, "Info(): Disabled")
+
+	require.NoError(d.SetDisabled(alice, false), "SetDisabled(): enable")
+	info, err = d.Info(alice)
+	require.NoError(err, "Info()")
+	assert.False(info.Disabled, "Info(): enabled")
+
+	rl := &userdb.RateLimit{SendRatePerMinute: 120, SendBurst: 10}
+	require.NoError(d.SetRateLimit(alice, rl), "SetRateLimit()")
+	info, err = d.Info(alice)
+	require.NoError(err, "Info()")
+	assert.Equal(rl, info.RateLimit, "Info(): RateLimit")
+	assert.False(info.Disabled, "Info(): RateLimit does not disable")
+
+	// A zero limit is a valid override, that disables the limit.
+	require.NoError(d.SetRateLimit(alice, &userdb.RateLimit{}), "SetRateLimit(): unlimited")
+	info, err = d.Info(alice)
+	require.NoError(err, "Info()")
+	assert.Equal(&userdb.RateLimit{}, info.RateLimit, "Info(): RateLimit unlimited")
+
+	require.NoError(d.SetRateLimit(alice, nil), "SetRateLimit(): remove")
+	info, err = d.Info(alice)
+	require.NoError(err, "Info()")
+	assert.Nil(info.RateLimit, "Info(): RateLimit removed")
+}
+
+func testEnumerate(t *testing.T, d userdb.UserDB) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	n, err := d.Count()
+	require.NoError(err, "Count(): empty")
+	assert.Equal(0, n, "Count(): empty")
+
+	usernames := []string{"alice", "bob", "carol"}
+	for _, u := range usernames {
+		require.NoError(d.Add([]byte(u), newPublicKey(t), false), "Add(%v)", u)
+	}
+	require.NoError(d.SetDisabled([]byte("bob"), true), "SetDisabled(bob)")
+	carolLimit := &userdb.RateLimit{SendRatePerMinute: 6, SendBurst: 1}
+	require.NoError(d.SetRateLimit([]byte("carol"), carolLimit), "SetRateLimit(carol)")
+
+	n, err = d.Count()
+	require.NoError(err, "Count()")
+	assert.Equal(len(usernames), n, "Count()")
+
+	seen := make(map[string]bool)
+	err = d.ForEach(func(u []byte, info *userdb.UserInfo) error {
+		seen[string(u)] = true
+		assert.Equal(string(u) == "bob", info.Disabled, "ForEach(): Disabled(%s)", u)
+		if string(u) == "carol" {
+			assert.Equal(carolLimit, info.RateLimit, "ForEach(): RateLimit(%s)", u)
+		} else {
+			assert.Nil(info.RateLimit, "ForEach(): RateLimit(%s)", u)
+		}
+		return nil
+	})
+	require.NoError(err, "ForEach()")
+	assert.Len(seen, len(usernames), "ForEach(): users")
+
+	users, err := userdb.List(d)
+	require.NoError(err, "List()")
+	assert.Len(users, len(usernames), "List()")
+	for _, u := range usernames {
+		assert.Contains(users, []byte(u), "List(): %v", u)
+	}
+}